@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+var (
+	accessKeysFile string // JSON file with the access keys for the S3 gateway and SFTP
+	s3KeysFile     string // --s3-keys, the name of --access-keys before SFTP shared the keys
+	adminToken     string // --admin-token, needed by admin endpoints when set
+)
+
+// Default of --access-keys, and of --s3-keys before it
+const (
+	defaultAccessKeysFile = "access-keys.json"
+	legacyS3KeysFile      = "s3-keys.json"
+)
+
+// resolveAccessKeysFile picks the key file: --access-keys if it was given,
+// else the deprecated --s3-keys, else an s3-keys.json from before the rename
+// when there is no access-keys.json yet
+func resolveAccessKeysFile(accessKeysSet bool) {
+	if accessKeysSet {
+		return
+	}
+	if s3KeysFile != "" {
+		log.Printf("Warning: --s3-keys is deprecated, use --access-keys")
+		accessKeysFile = s3KeysFile
+		return
+	}
+	if _, err := os.Stat(accessKeysFile); os.IsNotExist(err) {
+		if _, err := os.Stat(legacyS3KeysFile); err == nil {
+			log.Printf("Using the access keys in %s; rename it to %s or pass --access-keys", legacyS3KeysFile, accessKeysFile)
+			accessKeysFile = legacyS3KeysFile
+		}
+	}
+}
+
+// AccessKey is a credential issued by wile. For S3 it's the access key ID and
+// secret; SFTP logs in with the key ID (or name) as user and the secret as password.
+type AccessKey struct {
+	AccessKeyID string `json:"accessKeyId"`
+	SecretKey   string `json:"secretKey,omitempty"` // Only returned when the key is created
+	Name        string `json:"name"`
+	ReadOnly    bool   `json:"readOnly"`
+	Created     int64  `json:"created"`
+}
+
+// accessKeyStore keeps the keys in memory and writes them through to a JSON file.
+// SigV4 needs the plain secret on the server side, so the file is created 0600.
+type accessKeyStore struct {
+	mu   sync.RWMutex
+	path string
+	keys map[string]AccessKey
+}
+
+var accessKeys *accessKeyStore
+
+func loadAccessKeys(path string) (*accessKeyStore, error) {
+	store := &accessKeyStore{path: path, keys: make(map[string]AccessKey)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var keys []AccessKey
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	for _, key := range keys {
+		store.keys[key.AccessKeyID] = key
+	}
+	return store, nil
+}
+
+// save writes the store. Caller must hold mu.
+func (s *accessKeyStore) save() error {
+	keys := make([]AccessKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created < keys[j].Created })
+
+	data, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func (s *accessKeyStore) get(accessKeyID string) (AccessKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	key, ok := s.keys[accessKeyID]
+	return key, ok
+}
+
+// authenticate finds the key for a user name/password login (SFTP). The user
+// may be the access key ID or the key's name.
+func (s *accessKeyStore) authenticate(user, password string) (AccessKey, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, key := range s.keys {
+		if (key.AccessKeyID == user || key.Name == user) &&
+			subtle.ConstantTimeCompare([]byte(key.SecretKey), []byte(password)) == 1 {
+			return key, true
+		}
+	}
+	return AccessKey{}, false
+}
+
+// list returns all keys without their secrets
+func (s *accessKeyStore) list() []AccessKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]AccessKey, 0, len(s.keys))
+	for _, key := range s.keys {
+		key.SecretKey = ""
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created < keys[j].Created })
+	return keys
+}
+
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func (s *accessKeyStore) create(name string, readOnly bool) (AccessKey, error) {
+	id, err := randomString(15)
+	if err != nil {
+		return AccessKey{}, err
+	}
+	secret, err := randomString(30)
+	if err != nil {
+		return AccessKey{}, err
+	}
+	key := AccessKey{
+		AccessKeyID: "WILE" + strings.ToUpper(strings.NewReplacer("-", "", "_", "").Replace(id)),
+		SecretKey:   secret,
+		Name:        name,
+		ReadOnly:    readOnly,
+		Created:     time.Now().Unix(),
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[key.AccessKeyID] = key
+	if err := s.save(); err != nil {
+		delete(s.keys, key.AccessKeyID)
+		return AccessKey{}, err
+	}
+	return key, nil
+}
+
+func (s *accessKeyStore) delete(accessKeyID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok := s.keys[accessKeyID]
+	if !ok {
+		return false, nil
+	}
+	delete(s.keys, accessKeyID)
+	if err := s.save(); err != nil {
+		s.keys[accessKeyID] = key
+		return false, err
+	}
+	return true, nil
+}
+
+// setupAccessKeys loads the key store and registers the admin endpoints.
+// Only needed when a protocol that uses the keys is enabled.
+func setupAccessKeys(app *fiber.App) {
+	if s3Port == "" && sftpPort == "" {
+		return
+	}
+	store, err := loadAccessKeys(accessKeysFile)
+	if err != nil {
+		log.Printf("Warning: S3 and SFTP disabled: %v", err)
+		return
+	}
+	accessKeys = store
+
+	// /admin/s3/keys is the old name, from before SFTP shared the keys
+	for _, prefix := range []string{"/admin/keys", "/admin/s3/keys"} {
+		admin := app.Group(prefix, requireLocalAdmin)
+		admin.Get("", handleListAccessKeys)
+		admin.Post("", handleCreateAccessKey)
+		admin.Delete("/:id", handleDeleteAccessKey)
+	}
+
+	log.Printf("Access keys: %s (%d keys)", accessKeysFile, len(store.list()))
+	if len(store.list()) == 0 {
+		log.Println(`No access keys yet. Create one from localhost with POST /admin/keys {"name": "..."}`)
+	}
+}
+
+// requireLocalAdmin only lets requests from the machine wile runs on manage
+// credentials. Behind a reverse proxy on the same machine every request comes
+// from localhost, so requests the proxy forwarded (X-Forwarded-For, Forwarded,
+// X-Real-IP) are refused. With --admin-token they also need
+// "Authorization: Bearer <token>".
+func requireLocalAdmin(c *fiber.Ctx) error {
+	proxied := c.Get(fiber.HeaderXForwardedFor) != "" || c.Get("Forwarded") != "" || c.Get("X-Real-IP") != ""
+	if !c.Context().RemoteIP().IsLoopback() || proxied {
+		return c.Status(403).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Admin endpoints are only available from localhost",
+		})
+	}
+	if adminToken != "" {
+		token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			return c.Status(401).JSON(fiber.Map{
+				"status": "error",
+				"error":  "Admin endpoints need the --admin-token as a Bearer token",
+			})
+		}
+	}
+	return c.Next()
+}
+
+// handleListAccessKeys lists the access keys (without secrets)
+func handleListAccessKeys(c *fiber.Ctx) error {
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"keys":   accessKeys.list(),
+	})
+}
+
+// handleCreateAccessKey issues a new access key. The secret is only shown in this response.
+func handleCreateAccessKey(c *fiber.Ctx) error {
+	var req struct {
+		Name     string `json:"name"`
+		ReadOnly bool   `json:"readOnly"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Name == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Request body must be JSON with a name",
+		})
+	}
+
+	key, err := accessKeys.create(req.Name, req.ReadOnly)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status": "error",
+			"error":  fmt.Sprintf("Failed to save access key: %v", err),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"key":    key,
+	})
+}
+
+// handleDeleteAccessKey revokes an access key
+func handleDeleteAccessKey(c *fiber.Ctx) error {
+	deleted, err := accessKeys.delete(c.Params("id"))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status": "error",
+			"error":  fmt.Sprintf("Failed to save access keys: %v", err),
+		})
+	}
+	if !deleted {
+		return c.Status(404).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Access key not found",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status": "ok",
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultAPIPageSize   = 1000
+	maxAPIPageSize       = 10000
+	maxAPIRecursiveItems = 100000 // Hard cap for recursive listings
+)
+
+// The API description is built into the binary, so it's there whatever the
+// working directory is
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// Field names accepted by the fields parameter (the FileItem JSON names)
+var fileItemFields = map[string]bool{
+	"name": true, "path": true, "isDir": true, "size": true, "modified": true, "sizeStale": true, "archive": true,
+	"thumbnail": true, "taken": true, "kind": true,
+}
+
+// listRecursive lists relativePath and its subdirectories depth-first, each
+// directory sorted like getDirectoryListing. depth 1 lists only relativePath,
+// depth 0 means no limit. Returns truncated=true if maxAPIRecursiveItems was hit.
+func listRecursive(m *mount, relativePath, sortBy, dir string, depth int) ([]FileItem, bool) {
+	var items []FileItem
+	truncated := false
+
+	var walk func(path string, level int)
+	walk = func(path string, level int) {
+		for _, item := range getDirectoryListing(m, path, sortBy, dir) {
+			if len(items) >= maxAPIRecursiveItems {
+				truncated = true
+				return
+			}
+			items = append(items, item)
+			if item.IsDir && (depth == 0 || level < depth) {
+				walk(item.Path, level+1)
+			}
+		}
+	}
+	walk(relativePath, 1)
+	return items, truncated
+}
+
+func encodeCursor(path string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(path))
+}
+
+func decodeCursor(cursor string) (string, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	return string(data), err == nil
+}
+
+// selectFields reduces items to the requested JSON fields
+func selectFields(items []FileItem, fields []string) ([]map[string]any, error) {
+	out := make([]map[string]any, 0, len(items))
+	for _, item := range items {
+		data, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		var full map[string]any
+		if err := json.Unmarshal(data, &full); err != nil {
+			return nil, err
+		}
+		selected := make(map[string]any, len(fields))
+		for _, f := range fields {
+			selected[f] = full[f]
+		}
+		out = append(out, selected)
+	}
+	return out, nil
+}
+
+// handleAPIList is the plain HTTP equivalent of the /files websocket listing.
+// Supports sort/dir, offset or cursor pagination, field selection and
+// recursive listings with a depth limit.
+func handleAPIList(c *fiber.Ctx) error {
+	m, err := requestMount(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	fullPath, err := m.resolve(c.Query("path"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	relativePath := cleanRelativePath(c.Query("path"))
+	info, err := statPath(fullPath)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Path not found",
+		})
+	}
+	if !info.IsDir() && !isArchiveName(fullPath) {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Path must be a directory",
+		})
+	}
+
+	sortBy := c.Query("sort", "name")
+	if sortBy != "name" && sortBy != "size" && sortBy != "modified" && sortBy != "taken" {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Invalid sort. Must be 'name', 'size', 'modified' or 'taken'",
+		})
+	}
+	dir := c.Query("dir", "asc")
+	if dir != "asc" && dir != "desc" {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Invalid dir. Must be 'asc' or 'desc'",
+		})
+	}
+
+	var fields []string
+	if f := c.Query("fields"); f != "" {
+		for _, name := range strings.Split(f, ",") {
+			name = strings.TrimSpace(name)
+			if !fileItemFields[name] {
+				return c.Status(400).JSON(fiber.Map{
+					"status": "error",
+					"error":  "Invalid fields. Allowed: name, path, isDir, size, modified, sizeStale, archive, thumbnail, taken, kind",
+				})
+			}
+			fields = append(fields, name)
+		}
+	}
+
+	limit := c.QueryInt("limit", defaultAPIPageSize)
+	if limit <= 0 || limit > maxAPIPageSize {
+		limit = maxAPIPageSize
+	}
+	offset := c.QueryInt("offset", 0)
+	if offset < 0 {
+		offset = 0
+	}
+
+	// Get the full ordered listing, then page through it
+	var items []FileItem
+	truncated := false
+	if c.QueryBool("recursive", false) {
+		depth := c.QueryInt("depth", 0)
+		if depth < 0 {
+			depth = 0
+		}
+		items, truncated = listRecursive(m, relativePath, sortBy, dir, depth)
+	} else {
+		items = getDirectoryListing(m, relativePath, sortBy, dir)
+	}
+	total := len(items)
+
+	// A cursor is the path of the last item of the previous page
+	if cursor := c.Query("cursor"); cursor != "" {
+		afterPath, ok := decodeCursor(cursor)
+		if !ok {
+			return c.Status(400).JSON(fiber.Map{
+				"status": "error",
+				"error":  "Invalid cursor",
+			})
+		}
+		offset = -1
+		for i, item := range items {
+			if item.Path == afterPath {
+				offset = i + 1
+				break
+			}
+		}
+		if offset < 0 {
+			return c.Status(410).JSON(fiber.Map{
+				"status": "error",
+				"error":  "Cursor item no longer exists; restart the listing",
+			})
+		}
+	}
+
+	start := min(offset, total)
+	end := min(start+limit, total)
+	page := items[start:end]
+
+	response := fiber.Map{
+		"status": "ok",
+		"path":   relativePath,
+		"total":  total,
+		"offset": start,
+	}
+	if end < total {
+		response["nextCursor"] = encodeCursor(page[len(page)-1].Path)
+	}
+	if truncated {
+		response["truncated"] = true
+	}
+
+	if fields != nil {
+		selected, err := selectFields(page, fields)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{
+				"status": "error",
+				"error":  "Failed to encode items",
+			})
+		}
+		response["items"] = selected
+	} else {
+		response["items"] = page
+	}
+	return c.JSON(response)
+}
+
+// handleOpenAPI serves the OpenAPI description of the HTTP endpoints
+func handleOpenAPI(c *fiber.Ctx) error {
+	c.Set("Content-Type", "application/json")
+	return c.Send(openAPIDocument)
+}
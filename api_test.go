@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type apiListResponse struct {
+	Status     string           `json:"status"`
+	Total      int              `json:"total"`
+	NextCursor string           `json:"nextCursor"`
+	Items      []map[string]any `json:"items"`
+}
+
+func getAPIList(t *testing.T, app *fiber.App, query string) (int, apiListResponse) {
+	t.Helper()
+	resp, err := app.Test(httptest.NewRequest("GET", "/api/files?"+query, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body apiListResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestListRecursive(t *testing.T) {
+	setupSearchTree(t)
+
+	items, truncated := listRecursive(primaryMount(), "", "name", "asc", 0)
+	var paths []string
+	for _, item := range items {
+		paths = append(paths, item.Path)
+	}
+	expected := []string{"photos", "photos/2024", "photos/2024/notes.md", "photos/beach.jpg", "notes.txt"}
+	if truncated || len(paths) != len(expected) {
+		t.Fatalf("Expected %v, got %v (truncated=%v)", expected, paths, truncated)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, paths)
+		}
+	}
+
+	items, _ = listRecursive(primaryMount(), "", "name", "asc", 1)
+	if len(items) != 2 {
+		t.Errorf("Expected depth 1 to list only the root, got %+v", items)
+	}
+}
+
+func TestAPIListPagination(t *testing.T) {
+	setupSearchTree(t)
+	app := fiber.New()
+	app.Get("/api/files", handleAPIList)
+
+	status, page := getAPIList(t, app, "recursive=true&limit=2&fields=path,isDir")
+	if status != 200 || page.Total != 5 || len(page.Items) != 2 || page.NextCursor == "" {
+		t.Fatalf("Unexpected first page: %d %+v", status, page)
+	}
+	if len(page.Items[0]) != 2 || page.Items[0]["path"] != "photos" {
+		t.Errorf("Expected only path and isDir fields, got %+v", page.Items[0])
+	}
+
+	status, page = getAPIList(t, app, "recursive=true&limit=2&cursor="+page.NextCursor)
+	if status != 200 || len(page.Items) != 2 || page.Items[0]["path"] != "photos/2024/notes.md" {
+		t.Fatalf("Unexpected second page: %d %+v", status, page)
+	}
+
+	if status, _ := getAPIList(t, app, "cursor="+encodeCursor("gone.txt")); status != 410 {
+		t.Errorf("Expected 410 for a stale cursor, got %d", status)
+	}
+	if status, _ := getAPIList(t, app, "path=../"); status != 400 {
+		t.Errorf("Expected 400 for a path outside the root, got %d", status)
+	}
+	if status, _ := getAPIList(t, app, "fields=owner"); status != 400 {
+		t.Errorf("Expected 400 for an unknown field, got %d", status)
+	}
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	// Served from the binary, not the working directory
+	t.Chdir(t.TempDir())
+	app := fiber.New()
+	app.Get("/openapi.json", handleOpenAPI)
+	resp, err := app.Test(httptest.NewRequest("GET", "/openapi.json", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		OpenAPI string         `json:"openapi"`
+		Paths   map[string]any `json:"paths"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil || resp.StatusCode != 200 || doc.OpenAPI == "" || doc.Paths["/openapi.json"] == nil {
+		t.Errorf("Expected the OpenAPI document, got %d %v", resp.StatusCode, err)
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"file-browser/storage"
+)
+
+// Zip and tar files can be browsed like folders: "a.zip/dir/file.txt" lists
+// and streams members straight out of the archive, nothing is extracted.
+
+// Number of archive listings kept in memory. Reading a .tar.gz means
+// decompressing all of it, so navigating inside one shouldn't do that every time.
+const archiveCacheSize = 16
+
+// archiveMember is a file or folder inside an archive
+type archiveMember struct {
+	name    string // Slash-separated path inside the archive, no leading or trailing slash
+	size    int64
+	modTime time.Time
+	isDir   bool
+}
+
+// archiveMemberInfo is the fs.FileInfo of a member, as returned by statPath
+type archiveMemberInfo struct {
+	archivePath string
+	member      archiveMember
+}
+
+func (i *archiveMemberInfo) Name() string       { return path.Base(i.member.name) }
+func (i *archiveMemberInfo) Size() int64        { return i.member.size }
+func (i *archiveMemberInfo) IsDir() bool        { return i.member.isDir }
+func (i *archiveMemberInfo) ModTime() time.Time { return i.member.modTime }
+func (i *archiveMemberInfo) Sys() any           { return nil }
+func (i *archiveMemberInfo) Mode() fs.FileMode {
+	if i.member.isDir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+type cachedArchive struct {
+	size    int64
+	modTime time.Time
+	members []archiveMember
+}
+
+var (
+	archiveCache   = make(map[string]*cachedArchive)
+	archiveCacheMu sync.Mutex
+)
+
+// isArchiveName reports whether name is a zip or tar file wile can browse
+func isArchiveName(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitArchivePath finds the archive in fullPath, e.g. /root/a.zip/dir/x.txt
+// -> /root/a.zip, dir/x.txt. inner is "" for the archive itself.
+func splitArchivePath(fullPath string) (archivePath, inner string, ok bool) {
+	for p := fullPath; ; p = filepath.Dir(p) {
+		if isArchiveName(p) {
+			if info, err := rootFS.Stat(p); err == nil && !info.IsDir() {
+				rel, _ := filepath.Rel(p, fullPath)
+				if rel == "." {
+					rel = ""
+				}
+				return p, filepath.ToSlash(rel), true
+			}
+		}
+		if filepath.Dir(p) == p {
+			return "", "", false
+		}
+	}
+}
+
+// statPath is rootFS.Stat that also finds files and folders inside archives
+func statPath(fullPath string) (fs.FileInfo, error) {
+	info, err := rootFS.Stat(fullPath)
+	if err == nil {
+		return info, nil
+	}
+	archivePath, inner, ok := splitArchivePath(fullPath)
+	if !ok || inner == "" {
+		return nil, err
+	}
+	members, archiveErr := archiveMembers(archivePath)
+	if archiveErr != nil {
+		return nil, archiveErr
+	}
+	for _, member := range members {
+		if member.name == inner {
+			return &archiveMemberInfo{archivePath: archivePath, member: member}, nil
+		}
+	}
+	return nil, err
+}
+
+// archiveMembers returns all members of an archive, including the folders
+// that are only implied by member paths. Folder sizes are the sum of their content.
+func archiveMembers(archivePath string) ([]archiveMember, error) {
+	info, err := rootFS.Stat(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	archiveCacheMu.Lock()
+	cached := archiveCache[archivePath]
+	archiveCacheMu.Unlock()
+	if cached != nil && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.members, nil
+	}
+
+	var members []archiveMember
+	if strings.HasSuffix(strings.ToLower(archivePath), ".zip") {
+		members, err = readZipMembers(archivePath, info.Size())
+	} else {
+		members, err = readTarMembers(archivePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read archive %s: %w", filepath.Base(archivePath), err)
+	}
+	members = addImpliedFolders(members)
+
+	archiveCacheMu.Lock()
+	if len(archiveCache) >= archiveCacheSize {
+		for key := range archiveCache {
+			delete(archiveCache, key) // Drop an arbitrary one
+			break
+		}
+	}
+	archiveCache[archivePath] = &cachedArchive{size: info.Size(), modTime: info.ModTime(), members: members}
+	archiveCacheMu.Unlock()
+	return members, nil
+}
+
+// cleanMemberName normalizes a member path; ok is false for names that try
+// to leave the archive ("../x") and for the archive root itself
+func cleanMemberName(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", false
+		}
+	}
+	name = strings.Trim(path.Clean("/"+name), "/")
+	return name, name != ""
+}
+
+// addImpliedFolders adds folders that only appear as part of member paths
+// and fills in the folder sizes
+func addImpliedFolders(members []archiveMember) []archiveMember {
+	folders := make(map[string]int) // name -> index in members
+	for i, member := range members {
+		if member.isDir {
+			folders[member.name] = i
+		}
+	}
+	for i := 0; i < len(members); i++ {
+		member := members[i]
+		for dir := path.Dir(member.name); dir != "."; dir = path.Dir(dir) {
+			index, ok := folders[dir]
+			if !ok {
+				index = len(members)
+				folders[dir] = index
+				members = append(members, archiveMember{name: dir, isDir: true, modTime: member.modTime})
+			}
+			if !member.isDir {
+				members[index].size += member.size
+			}
+		}
+	}
+	return members
+}
+
+// fileReaderAt reads at offsets with Seek + Read, for archive/zip on storage files
+type fileReaderAt struct {
+	mu sync.Mutex
+	f  storage.File
+}
+
+func (r *fileReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.f.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.ReadFull(r.f, p)
+}
+
+func openZip(archivePath string, size int64) (*zip.Reader, storage.File, error) {
+	f, err := rootFS.Open(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	var readerAt io.ReaderAt = &fileReaderAt{f: f}
+	if ra, ok := f.(io.ReaderAt); ok {
+		readerAt = ra
+	}
+	zr, err := zip.NewReader(readerAt, size)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return zr, f, nil
+}
+
+func readZipMembers(archivePath string, size int64) ([]archiveMember, error) {
+	zr, f, err := openZip(archivePath, size)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var members []archiveMember
+	for _, zf := range zr.File {
+		name, ok := cleanMemberName(zf.Name)
+		if !ok {
+			continue
+		}
+		members = append(members, archiveMember{
+			name:    name,
+			size:    int64(zf.UncompressedSize64),
+			modTime: zf.Modified,
+			isDir:   zf.FileInfo().IsDir(),
+		})
+	}
+	return members, nil
+}
+
+// openTar opens a tar file, decompressing .tar.gz / .tgz
+func openTar(archivePath string) (*tar.Reader, io.Closer, error) {
+	f, err := rootFS.Open(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	lower := strings.ToLower(archivePath)
+	if strings.HasSuffix(lower, ".gz") || strings.HasSuffix(lower, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(gz), f, nil
+	}
+	return tar.NewReader(f), f, nil
+}
+
+func readTarMembers(archivePath string) ([]archiveMember, error) {
+	tr, closer, err := openTar(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer closer.Close()
+
+	var members []archiveMember
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return members, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		name, ok := cleanMemberName(header.Name)
+		if !ok || (header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir) {
+			continue // Links, devices and such can't be previewed
+		}
+		members = append(members, archiveMember{
+			name:    name,
+			size:    header.Size,
+			modTime: header.ModTime,
+			isDir:   header.Typeflag == tar.TypeDir,
+		})
+	}
+}
+
+// readCloser closes the member reader and the archive file together
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloser) Close() error {
+	var firstErr error
+	for _, c := range r.closers {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// openArchiveMember opens a file inside an archive for reading
+func openArchiveMember(info *archiveMemberInfo) (io.ReadCloser, error) {
+	if info.member.isDir {
+		return nil, fmt.Errorf("%s is a folder", info.member.name)
+	}
+
+	if strings.HasSuffix(strings.ToLower(info.archivePath), ".zip") {
+		archiveInfo, err := rootFS.Stat(info.archivePath)
+		if err != nil {
+			return nil, err
+		}
+		zr, f, err := openZip(info.archivePath, archiveInfo.Size())
+		if err != nil {
+			return nil, err
+		}
+		for _, zf := range zr.File {
+			if name, ok := cleanMemberName(zf.Name); ok && name == info.member.name {
+				rc, err := zf.Open()
+				if err != nil {
+					f.Close()
+					return nil, err
+				}
+				return &readCloser{Reader: rc, closers: []io.Closer{rc, f}}, nil
+			}
+		}
+		f.Close()
+		return nil, fs.ErrNotExist
+	}
+
+	// Tar has no index, read up to the member
+	tr, closer, err := openTar(info.archivePath)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			closer.Close()
+			if err == io.EOF {
+				err = fs.ErrNotExist
+			}
+			return nil, err
+		}
+		if name, ok := cleanMemberName(header.Name); ok && name == info.member.name && header.Typeflag == tar.TypeReg {
+			return &readCloser{Reader: tr, closers: []io.Closer{closer}}, nil
+		}
+	}
+}
+
+// sendArchiveMember streams a file out of an archive. Ranges are served by
+// reading past the start, archive members can't seek.
+func sendArchiveMember(c *fiber.Ctx, info *archiveMemberInfo) error {
+	etag := fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+	return sendWithValidators(c, etag, info.Size(), info.ModTime(), func() (io.ReadCloser, error) {
+		return openArchiveMember(info)
+	})
+}
+
+// archiveListing lists a folder inside an archive (inner "" is the archive's top level).
+// ok is false if fullPath is not in an archive.
+func archiveListing(fullPath, relativePath string) ([]FileItem, bool) {
+	archivePath, inner, ok := splitArchivePath(fullPath)
+	if !ok {
+		return nil, false
+	}
+	members, err := archiveMembers(archivePath)
+	if err != nil {
+		log.Printf("Error listing archive: %v", err)
+		return []FileItem{}, true
+	}
+
+	items := []FileItem{}
+	for _, member := range members {
+		parent := path.Dir(member.name)
+		if parent == "." {
+			parent = ""
+		}
+		if parent != inner || strings.HasPrefix(path.Base(member.name), ".") {
+			continue
+		}
+		items = append(items, FileItem{
+			Name:     path.Base(member.name),
+			Path:     cleanRelativePath(relativePath + "/" + path.Base(member.name)),
+			IsDir:    member.isDir,
+			Size:     member.size,
+			Modified: member.modTime.Unix(),
+			Kind:     itemKind(member.name, member.isDir),
+		})
+	}
+	return items, true
+}
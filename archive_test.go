@@ -0,0 +1,127 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func writeTestZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Unix(1700000000, 0)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestTarGz(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), ModTime: time.Unix(1700000000, 0), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(tw, content)
+	}
+	tw.Close()
+	gz.Close()
+}
+
+func TestArchiveBrowsing(t *testing.T) {
+	setupSearchTree(t)
+	files := map[string]string{
+		"readme.txt":          "top",
+		"docs/guide.txt":      "guide text",
+		"docs/deep/notes.txt": "deep",
+		"../evil.txt":         "outside",
+	}
+	writeTestZip(t, filepath.Join(rootPath, "bundle.zip"), files)
+	writeTestTarGz(t, filepath.Join(rootPath, "photos", "bundle.tar.gz"), files)
+
+	items := getDirectoryListing(primaryMount(), "", "name", "asc")
+	var found bool
+	for _, item := range items {
+		if item.Name == "bundle.zip" {
+			found = true
+			if !item.Archive || item.IsDir {
+				t.Errorf("Expected bundle.zip to be marked as an archive: %+v", item)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("bundle.zip missing from listing: %+v", items)
+	}
+
+	app := fiber.New()
+	app.Get("/file", handleFileStream)
+	app.Get("/api/files", handleAPIList)
+	get := func(target string) (int, string) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("GET", target, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	for _, archive := range []string{"bundle.zip", "photos/bundle.tar.gz"} {
+		items := getDirectoryListing(primaryMount(), archive, "name", "asc")
+		if len(items) != 2 || items[0].Name != "docs" || !items[0].IsDir || items[1].Name != "readme.txt" {
+			t.Fatalf("%s: unexpected listing %+v", archive, items)
+		}
+		if items[0].Size != 14 || items[0].Path != archive+"/docs" {
+			t.Errorf("%s: unexpected folder entry %+v", archive, items[0])
+		}
+		if items[1].Size != 3 || items[1].Modified != 1700000000 {
+			t.Errorf("%s: unexpected file entry %+v", archive, items[1])
+		}
+
+		nested := getDirectoryListing(primaryMount(), archive+"/docs", "name", "asc")
+		if len(nested) != 2 || nested[0].Path != archive+"/docs/deep" || nested[1].Path != archive+"/docs/guide.txt" {
+			t.Errorf("%s: unexpected nested listing %+v", archive, nested)
+		}
+
+		if status, body := get("/file?path=" + archive + "/docs/guide.txt"); status != 200 || body != "guide text" {
+			t.Errorf("%s: expected member content, got %d %q", archive, status, body)
+		}
+		if status, _ := get("/file?path=" + archive + "/docs"); status != 400 {
+			t.Errorf("%s: expected 400 for a folder inside the archive, got %d", archive, status)
+		}
+		if status, _ := get("/file?path=" + archive + "/missing.txt"); status != 404 {
+			t.Errorf("%s: expected 404 for a missing member, got %d", archive, status)
+		}
+		if status, body := get("/api/files?path=" + archive + "/docs/deep"); status != 200 || !strings.Contains(body, `"notes.txt"`) {
+			t.Errorf("%s: unexpected API listing %d %s", archive, status, body)
+		}
+	}
+}
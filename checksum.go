@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tus/tusd/pkg/handler"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Status of the tus checksum extension for data that doesn't match its checksum
+const statusChecksumMismatch = 460
+
+// Checksum algorithms for Upload-Checksum and the checksum upload metadata
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// Names of the algorithms in Digest headers (RFC 3230)
+var digestNames = map[string]string{
+	"md5":    "md5",
+	"sha1":   "sha",
+	"sha256": "sha-256",
+}
+
+// Bolt bucket with verified upload digests, keyed by full path
+var digestsBucket = []byte("digests")
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// quarantineDirName is where uploads that failed verification are kept, in uploadsDir
+const quarantineDirName = "quarantine"
+
+// parseChecksum parses "<algorithm> <digest>", the digest in base64 (as tus
+// sends it) or hex
+func parseChecksum(value string) (string, []byte, error) {
+	algorithm, encoded, ok := strings.Cut(strings.TrimSpace(value), " ")
+	algorithm = strings.ToLower(algorithm)
+	newHash, known := checksumAlgorithms[algorithm]
+	if !ok || !known {
+		return "", nil, fmt.Errorf("unsupported checksum %q (supported: md5, sha1, sha256)", value)
+	}
+	encoded = strings.TrimSpace(encoded)
+	size := newHash().Size()
+	if len(encoded) == 2*size {
+		if sum, err := hex.DecodeString(encoded); err == nil {
+			return algorithm, sum, nil
+		}
+	}
+	sum, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sum) != size {
+		return "", nil, fmt.Errorf("invalid %s checksum %q", algorithm, encoded)
+	}
+	return algorithm, sum, nil
+}
+
+// tusChecksum adds the tus checksum extension, which tusd v1 doesn't have: a
+// PATCH with Upload-Checksum is refused with 460 before anything is written
+// if its data doesn't match
+func tusChecksum(c *fiber.Ctx) error {
+	if c.Method() == "PATCH" {
+		if header := c.Get("Upload-Checksum"); header != "" {
+			algorithm, want, err := parseChecksum(header)
+			if err != nil {
+				c.Set("Tus-Resumable", "1.0.0")
+				return c.Status(http.StatusBadRequest).SendString(err.Error())
+			}
+			h := checksumAlgorithms[algorithm]()
+			h.Write(c.Body())
+			if !bytes.Equal(h.Sum(nil), want) {
+				log.Printf("Checksum mismatch for a chunk of upload %s", filepath.Base(c.Path()))
+				c.Set("Tus-Resumable", "1.0.0")
+				return c.Status(statusChecksumMismatch).SendString("checksum mismatch")
+			}
+		}
+	}
+
+	if err := c.Next(); err != nil {
+		return err
+	}
+
+	if extensions := c.GetRespHeader("Tus-Extension"); extensions != "" {
+		c.Set("Tus-Extension", extensions+",checksum")
+	}
+	if c.Method() == "OPTIONS" {
+		c.Set("Tus-Checksum-Algorithm", "md5,sha1,sha256")
+	}
+	return nil
+}
+
+// fileDigest is the verified digest of an uploaded file. It only applies
+// while the file still has the size and modification time it was stored with.
+type fileDigest struct {
+	Algorithm string `json:"algorithm"`
+	Digest    string `json:"digest"` // Hex
+	Size      int64  `json:"size"`
+	ModTime   int64  `json:"modTime"` // Unix nanoseconds
+}
+
+// header is the digest as a Digest header value, e.g. "sha-256=<base64>"
+func (d *fileDigest) header() string {
+	sum, _ := hex.DecodeString(d.Digest)
+	return digestNames[d.Algorithm] + "=" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// etag is a strong ETag from the digest
+func (d *fileDigest) etag() string {
+	return fmt.Sprintf(`"%s-%s"`, d.Algorithm, d.Digest)
+}
+
+// fileChecksum hashes a local file
+func fileChecksum(path, algorithm string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := checksumAlgorithms[algorithm]()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// saveDigest stores the verified digest of the file at fullPath. Needs
+// --sizes-db; without it digests aren't kept.
+func saveDigest(fullPath, algorithm string, sum []byte) {
+	if boltDB == nil {
+		return
+	}
+	info, err := rootFS.Stat(fullPath)
+	if err != nil {
+		return
+	}
+	data, _ := json.Marshal(fileDigest{
+		Algorithm: algorithm,
+		Digest:    hex.EncodeToString(sum),
+		Size:      info.Size(),
+		ModTime:   info.ModTime().UnixNano(),
+	})
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(digestsBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(fullPath), data)
+	})
+	if err != nil {
+		log.Printf("Failed to save digest of %s: %v", fullPath, err)
+	}
+}
+
+// lookupDigest returns the stored digest of the file at fullPath, nil if
+// there is none or the file changed since
+func lookupDigest(fullPath string, info fs.FileInfo) *fileDigest {
+	if boltDB == nil {
+		return nil
+	}
+	var d *fileDigest
+	boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(digestsBucket)
+		if bucket == nil {
+			return nil
+		}
+		if data := bucket.Get([]byte(fullPath)); data != nil {
+			var stored fileDigest
+			if json.Unmarshal(data, &stored) == nil {
+				d = &stored
+			}
+		}
+		return nil
+	})
+	if d == nil || d.Size != info.Size() || d.ModTime != info.ModTime().UnixNano() {
+		return nil
+	}
+	return d
+}
+
+// verifyUpload checks a complete upload against the checksum from its
+// metadata. It returns the algorithm and digest to keep, or an error
+// (errChecksumMismatch if the data doesn't match).
+func verifyUpload(tempFile, checksum string) (string, []byte, error) {
+	algorithm, want, err := parseChecksum(checksum)
+	if err != nil {
+		return "", nil, err
+	}
+	sum, err := fileChecksum(tempFile, algorithm)
+	if err != nil {
+		return "", nil, err
+	}
+	if !bytes.Equal(sum, want) {
+		return algorithm, sum, fmt.Errorf("%w: expected %s %s, got %s", errChecksumMismatch, algorithm, hex.EncodeToString(want), hex.EncodeToString(sum))
+	}
+	return algorithm, sum, nil
+}
+
+// QuarantinedUpload describes an upload that failed verification to admins
+type QuarantinedUpload struct {
+	ID       string `json:"id"`
+	Root     string `json:"root"`
+	Path     string `json:"path"` // Where it would have gone, relative to the root
+	Size     int64  `json:"size"`
+	Error    string `json:"error"`
+	Uploader string `json:"uploader"`
+	Time     int64  `json:"time"`
+}
+
+// quarantineUpload moves an upload that failed verification out of the way,
+// next to a description of it, where an admin can look at it
+func quarantineUpload(info handler.FileInfo, m *mount, finalPath, uploader string, reason error) {
+	dir := filepath.Join(uploadsDir, quarantineDirName)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Printf("Failed to quarantine upload %s: %v", info.ID, err)
+		discardUpload(info.ID)
+		return
+	}
+	rel, _ := m.rel(finalPath)
+	entry := QuarantinedUpload{
+		ID:       info.ID,
+		Root:     m.Name,
+		Path:     rel,
+		Size:     info.Size,
+		Error:    reason.Error(),
+		Uploader: uploader,
+		Time:     time.Now().Unix(),
+	}
+	data, _ := json.MarshalIndent(entry, "", "  ")
+	if err := os.WriteFile(filepath.Join(dir, info.ID+".json"), data, 0644); err != nil {
+		log.Printf("Failed to quarantine upload %s: %v", info.ID, err)
+		discardUpload(info.ID)
+		return
+	}
+	if err := os.Rename(filepath.Join(uploadsDir, info.ID), filepath.Join(dir, info.ID)); err != nil {
+		log.Printf("Failed to quarantine upload %s: %v", info.ID, err)
+	}
+	os.Remove(filepath.Join(uploadsDir, info.ID+".info"))
+	log.Printf("Upload %s for %s quarantined: %v", info.ID, finalPath, reason)
+}
+
+// listQuarantine reads the quarantined uploads, newest first
+func listQuarantine() []QuarantinedUpload {
+	dir := filepath.Join(uploadsDir, quarantineDirName)
+	entries, _ := os.ReadDir(dir)
+	quarantined := []QuarantinedUpload{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var q QuarantinedUpload
+		if json.Unmarshal(data, &q) == nil {
+			quarantined = append(quarantined, q)
+		}
+	}
+	sort.Slice(quarantined, func(i, j int) bool { return quarantined[i].Time > quarantined[j].Time })
+	return quarantined
+}
+
+// removeQuarantined deletes a quarantined upload, false if there is none
+func removeQuarantined(id string) bool {
+	base := filepath.Join(uploadsDir, quarantineDirName, id)
+	if err := os.Remove(base + ".json"); err != nil {
+		return false
+	}
+	os.Remove(base)
+	return true
+}
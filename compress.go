@@ -0,0 +1,465 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/zstd"
+
+	"file-browser/storage"
+)
+
+// Formats the compress action can write, with the extension added to the name
+var archiveFormats = map[string]string{
+	"zip":     ".zip",
+	"tar.gz":  ".tar.gz",
+	"tar.zst": ".tar.zst",
+}
+
+// archiveLevelRange is the valid compression levels per format; 0 means
+// stored without compression for zip and gzip
+func archiveLevelRange(format string) (int, int) {
+	if format == "tar.zst" {
+		return 1, 22
+	}
+	return 0, 9
+}
+
+// archiveWriter writes the entries of a new zip or tar archive
+type archiveWriter struct {
+	zw      *zip.Writer
+	tw      *tar.Writer
+	closers []io.Closer // Compressors below tw, closed after it
+	store   bool        // Zip entries without compression
+}
+
+// newArchiveWriter writes an archive in format to w. level -1 is the format's default.
+func newArchiveWriter(w io.Writer, format string, level int) (*archiveWriter, error) {
+	aw := &archiveWriter{}
+	switch format {
+	case "zip":
+		aw.zw = zip.NewWriter(w)
+		aw.store = level == 0
+		if level > 0 {
+			aw.zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+				return flate.NewWriter(out, level)
+			})
+		}
+	case "tar":
+		aw.tw = tar.NewWriter(w)
+	case "tar.gz":
+		if level < 0 {
+			level = gzip.DefaultCompression
+		}
+		gz, err := gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return nil, err
+		}
+		aw.tw, aw.closers = tar.NewWriter(gz), []io.Closer{gz}
+	case "tar.zst":
+		options := []zstd.EOption{}
+		if level > 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		zw, err := zstd.NewWriter(w, options...)
+		if err != nil {
+			return nil, err
+		}
+		aw.tw, aw.closers = tar.NewWriter(zw), []io.Closer{zw}
+	default:
+		return nil, fmt.Errorf("unsupported archive format: %s", format)
+	}
+	return aw, nil
+}
+
+// readError is a failure to read a source file. The entry is closed off with
+// what could be read (zero padded in tar) and the archive stays usable.
+type readError struct{ err error }
+
+func (e *readError) Error() string { return e.err.Error() }
+func (e *readError) Unwrap() error { return e.err }
+
+// sourceReader remembers read errors, to tell them apart from write errors
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// add writes one entry; name is slash-separated, r is nil for folders.
+// Entries over 4 GiB and archives with more than 65535 entries are written
+// as ZIP64 by archive/zip. Returns a *readError if only r failed.
+func (aw *archiveWriter) add(name string, info fs.FileInfo, r io.Reader) error {
+	src := &sourceReader{r: r}
+	if aw.zw != nil {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		if info.IsDir() {
+			header.Name += "/"
+		} else if !aw.store {
+			header.Method = zip.Deflate
+		}
+		w, err := aw.zw.CreateHeader(header)
+		if err != nil || r == nil {
+			return err
+		}
+		if _, err = io.Copy(w, src); err != nil && src.err != nil {
+			return &readError{src.err}
+		}
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if err := aw.tw.WriteHeader(header); err != nil || r == nil {
+		return err
+	}
+	// Exactly the size in the header, files may change while being read
+	n, err := io.CopyN(aw.tw, src, header.Size)
+	if err == io.EOF {
+		src.err = fmt.Errorf("file shrank while being archived")
+	}
+	if err != nil && src.err != nil {
+		if _, padErr := io.CopyN(aw.tw, zeroReader{}, header.Size-n); padErr != nil {
+			return padErr
+		}
+		return &readError{src.err}
+	}
+	return err
+}
+
+// addLink writes a symlink entry pointing to target; the link is not followed
+func (aw *archiveWriter) addLink(name string, info fs.FileInfo, target string) error {
+	if aw.zw != nil {
+		header, err := zip.FileInfoHeader(info) // Keeps the symlink mode
+		if err != nil {
+			return err
+		}
+		header.Name = name
+		header.Method = zip.Store
+		w, err := aw.zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, target)
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, target)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	return aw.tw.WriteHeader(header)
+}
+
+func (aw *archiveWriter) Close() error {
+	var err error
+	if aw.zw != nil {
+		err = aw.zw.Close()
+	} else {
+		err = aw.tw.Close()
+	}
+	for _, c := range aw.closers {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// ctxReader stops reading once ctx is cancelled, so large files don't delay a cancel
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+	n   *int64 // Bytes read so far, shared over all files
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	n, err := r.r.Read(p)
+	*r.n += int64(n)
+	return n, err
+}
+
+// archiveSources walks the sources and calls fn for every item to archive,
+// with its name in the archive (the source's base name, then the path below it).
+// Symlinks are passed on as such, not followed. Hidden items are skipped unless
+// includeHidden; so is skipPath (the archive being written). Items that can't
+// be read go to onError and are left out.
+func archiveSources(sources []string, includeHidden bool, skipPath string, fn func(path, name string, info fs.FileInfo) error, onError func(name string, err error)) error {
+	for _, src := range sources {
+		nameOf := func(path string) string {
+			rel, _ := filepath.Rel(filepath.Dir(src), path)
+			return filepath.ToSlash(rel)
+		}
+
+		// Walk follows a symlink at the top, so look at the source itself first
+		if local, ok := storage.LocalPath(rootFS, src); ok {
+			if info, err := os.Lstat(local); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				if err := fn(src, nameOf(src), info); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		err := storage.Walk(rootFS, src, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				onError(nameOf(path), err)
+				return nil // Unreadable folders are left out, or stay empty
+			}
+			if path == skipPath || (!includeHidden && path != src && strings.HasPrefix(d.Name(), ".")) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				onError(nameOf(path), err)
+				return nil
+			}
+			if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+				return nil // Sockets, devices and such
+			}
+			return fn(path, nameOf(path), info)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeSources writes the sources into aw; see archiveSources. done counts the
+// bytes read so far and onEntry is called after every entry, for progress.
+// Unreadable items go to onError; only write errors and cancelling ctx stop it.
+func writeSources(ctx context.Context, aw *archiveWriter, sources []string, includeHidden bool, skipPath string, done *int64, onEntry func(), onError func(name string, err error)) error {
+	return archiveSources(sources, includeHidden, skipPath, func(path, name string, info fs.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		defer onEntry()
+
+		switch {
+		case info.IsDir():
+			return aw.add(name, info, nil)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := readLink(path)
+			if err != nil {
+				onError(name, err)
+				return nil
+			}
+			return aw.addLink(name, info, target)
+		}
+
+		f, err := rootFS.Open(path)
+		if err != nil {
+			onError(name, err)
+			return nil
+		}
+		defer f.Close()
+		err = aw.add(name, info, &ctxReader{ctx: ctx, r: f, n: done})
+		var readErr *readError
+		if errors.As(err, &readErr) {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			onError(name, readErr.err)
+			return nil
+		}
+		return err
+	}, onError)
+}
+
+// readLink returns the target of a symlink in rootFS (only local roots have them)
+func readLink(path string) (string, error) {
+	local, ok := storage.LocalPath(rootFS, path)
+	if !ok {
+		return "", fmt.Errorf("not a local file")
+	}
+	return os.Readlink(local)
+}
+
+// startCompress validates a compress request and starts the job: srcs (in
+// srcMount) are packed into dest/name (in destMount)
+func startCompress(c *fiber.Ctx, srcMount, destMount *mount, srcList []string, dest string) error {
+	format := c.Query("format", "zip")
+	ext, ok := archiveFormats[format]
+	if !ok {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Invalid format. Must be 'zip', 'tar.gz' or 'tar.zst'",
+		})
+	}
+	level := c.QueryInt("level", -1)
+	if low, high := archiveLevelRange(format); level != -1 && (level < low || level > high) {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  fmt.Sprintf("Invalid level. Must be between %d and %d for %s", low, high, format),
+		})
+	}
+
+	name := c.Query("name")
+	if name == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Missing required parameter: name",
+		})
+	}
+	if strings.Contains(name, "/") || strings.Contains(name, "\\") {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Archive name cannot contain path separators",
+		})
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ext) {
+		name += ext
+	}
+
+	destPath, err := destMount.resolve(dest)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	if info, err := rootFS.Stat(destPath); err != nil || !info.IsDir() {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Destination must be an existing directory",
+		})
+	}
+	target := filepath.Join(destPath, name)
+	if _, err := rootFS.Stat(target); err == nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "A file or folder with that name already exists",
+		})
+	}
+
+	var sources []string
+	for _, src := range srcList {
+		srcPath, err := srcMount.resolve(src)
+		if err == nil {
+			_, err = rootFS.Stat(srcPath)
+		}
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"status": "error",
+				"error":  fmt.Sprintf("Source does not exist: %s", src),
+			})
+		}
+		sources = append(sources, srcPath)
+	}
+
+	j := startJob("compress", destMount.Name)
+	fileOpsInProgress.Add(1)
+	go runCompress(j, srcMount, destMount, srcList, sources, cleanRelativePath(dest+"/"+name), target, format, level)
+
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"job":    j.info(),
+	})
+}
+
+// runCompress is the compress job. The archive is written under a hidden
+// temporary name and renamed when complete, so nobody sees half an archive.
+func runCompress(j *job, srcMount, destMount *mount, srcList, sources []string, result, target, format string, level int) {
+	defer fileOpsInProgress.Done()
+
+	tempPath := filepath.Join(filepath.Dir(target), "."+filepath.Base(target)+".part")
+	err := writeArchive(j, sources, tempPath, format, level)
+	if err == nil {
+		err = rootFS.Rename(tempPath, target)
+	}
+	if err != nil {
+		rootFS.Remove(tempPath)
+		log.Printf("Creating %s failed: %v", target, err)
+		j.finish("", err)
+	} else {
+		sizeTreeAdd(target)
+		log.Printf("Created archive %s", target)
+		j.finish(result, nil)
+	}
+	logTransfer(srcMount, destMount, "compress", srcList, result, j.info().Errors)
+}
+
+func writeArchive(j *job, sources []string, tempPath, format string, level int) error {
+	// Count first, for the progress
+	var total int64
+	err := archiveSources(sources, false, tempPath, func(path, name string, info fs.FileInfo) error {
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return j.ctx.Err()
+	}, func(string, error) {})
+	if err != nil {
+		return err
+	}
+	j.progress(0, total, 0)
+
+	out, err := rootFS.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	aw, err := newArchiveWriter(out, format, level)
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	var done int64
+	files := 0
+	err = writeSources(j.ctx, aw, sources, false, tempPath, &done, func() {
+		files++
+		j.progress(done, 0, files)
+	}, func(name string, err error) {
+		j.addError(fmt.Sprintf("Skipped %s: %v", name, err))
+	})
+	if closeErr := aw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/klauspost/compress/zstd"
+
+	"file-browser/storage"
+)
+
+// readTestArchive returns name -> content of the entries in an archive (folder names end in "/")
+func readTestArchive(t *testing.T, path, format string) map[string]string {
+	t.Helper()
+	content := make(map[string]string)
+	if format == "zip" {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		for _, zf := range zr.File {
+			rc, _ := zf.Open()
+			data, _ := io.ReadAll(rc)
+			rc.Close()
+			content[zf.Name] = string(data)
+		}
+		return content
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader
+	if format == "tar.gz" {
+		r, err = gzip.NewReader(f)
+	} else {
+		var zr *zstd.Decoder
+		zr, err = zstd.NewReader(f)
+		r = zr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return content
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		content[header.Name] = string(data)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	setupSearchTree(t)
+	enableTestWriteMode(t)
+	loadTestSizeTree(t)
+
+	app := fiber.New()
+	app.Get("/manage", handleManage)
+	compress := func(query string) (int, JobInfo) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("GET", "/manage?action=compress&srcs=notes.txt&srcs=photos&"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Job JobInfo `json:"job"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if resp.StatusCode != 200 {
+			return resp.StatusCode, JobInfo{}
+		}
+		return resp.StatusCode, waitForJob(t, body.Job.ID)
+	}
+
+	want := []string{"notes.txt", "photos/", "photos/2024/", "photos/2024/notes.md", "photos/beach.jpg"}
+	for _, format := range []string{"zip", "tar.gz", "tar.zst"} {
+		status, job := compress("dest=&name=pack&level=1&format=" + format)
+		if status != 200 || job.Status != "done" || job.Result != "pack."+format {
+			t.Fatalf("%s: unexpected result %d %+v", format, status, job)
+		}
+
+		content := readTestArchive(t, filepath.Join(rootPath, "pack."+format), format)
+		var names []string
+		for name := range content {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) != len(want) {
+			t.Fatalf("%s: expected %v, got %v", format, want, names)
+		}
+		for i := range want {
+			if names[i] != want[i] {
+				t.Errorf("%s: expected %v, got %v", format, want, names)
+				break
+			}
+		}
+		if content["photos/beach.jpg"] != "0123456789" || content["notes.txt"] != "hello" {
+			t.Errorf("%s: unexpected content %v", format, content)
+		}
+		if node := sizeTreeRoot.FindByPath(filepath.Join(rootPath, "pack."+format)); node == nil {
+			t.Errorf("%s: archive missing from the size tree", format)
+		}
+	}
+
+	// The archive being written is not packed into itself
+	if _, job := compress("dest=photos&name=pack.zip"); job.Status != "done" {
+		t.Errorf("Expected an archive inside a source to work, got %+v", job)
+	} else if content := readTestArchive(t, filepath.Join(rootPath, "photos", "pack.zip"), "zip"); len(content) != len(want) {
+		t.Errorf("Unexpected content of an archive inside a source: %v", content)
+	}
+	if status, _ := compress("dest=&name=pack.zip"); status != 400 {
+		t.Errorf("Expected 400 for an existing archive, got %d", status)
+	}
+	if status, _ := compress("dest=&name=x&format=rar"); status != 400 {
+		t.Errorf("Expected 400 for an unknown format, got %d", status)
+	}
+	if status, _ := compress("dest=&name=x&format=zip&level=12"); status != 400 {
+		t.Errorf("Expected 400 for an invalid level, got %d", status)
+	}
+
+	// A cancelled job leaves nothing behind
+	j := startJob("compress", "")
+	j.cancel()
+	fileOpsInProgress.Add(1)
+	runCompress(j, primaryMount(), primaryMount(), []string{"photos"}, []string{filepath.Join(rootPath, "photos")}, "cancelled.zip", filepath.Join(rootPath, "cancelled.zip"), "zip", -1)
+	if info := j.info(); info.Status != "cancelled" {
+		t.Errorf("Expected the job to be cancelled, got %+v", info)
+	}
+	for _, name := range []string{"cancelled.zip", ".cancelled.zip.part"} {
+		if _, err := os.Stat(filepath.Join(rootPath, name)); err == nil {
+			t.Errorf("%s was left behind", name)
+		}
+	}
+
+	entries := readLog(t, modificationsLogFile)
+	if len(entries) != 5 || entries[0].Action != "compress" || entries[0].Dest != "pack.zip" || len(entries[0].Sources) != 2 {
+		t.Errorf("Unexpected log: %+v", entries)
+	}
+}
+
+func TestDownloadArchive(t *testing.T) {
+	setupSearchTree(t)
+
+	app := fiber.New()
+	app.Get("/zip", handleZipDownload)
+	download := func(query, format string) (int, map[string]string) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("GET", "/zip?"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return resp.StatusCode, nil
+		}
+		path := filepath.Join(t.TempDir(), "download")
+		data, _ := io.ReadAll(resp.Body)
+		os.WriteFile(path, data, 0644)
+		if format == "tar" {
+			content := make(map[string]string)
+			tr := tar.NewReader(bytes.NewReader(data))
+			for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+				body, _ := io.ReadAll(tr)
+				content[header.Name] = string(body)
+			}
+			return resp.StatusCode, content
+		}
+		return resp.StatusCode, readTestArchive(t, path, format)
+	}
+
+	// A folder: its content, without hidden items
+	if _, content := download("path=photos", "zip"); len(content) != 3 || content["beach.jpg"] != "0123456789" || content["2024/notes.md"] != "# notes" {
+		t.Errorf("Unexpected folder download: %v", content)
+	}
+
+	// Files and folders mixed, as tar.gz with hidden items
+	_, content := download("srcs=notes.txt&srcs=photos&format=tar.gz&hidden=true", "tar.gz")
+	if content["notes.txt"] != "hello" || content["photos/.hidden/notes.md"] != "secret" || content["photos/2024/notes.md"] != "# notes" {
+		t.Errorf("Unexpected selection download: %v", content)
+	}
+	if _, content := download("srcs=notes.txt&format=tar", "tar"); len(content) != 1 || content["notes.txt"] != "hello" {
+		t.Errorf("Unexpected tar download: %v", content)
+	}
+
+	// Store-only
+	resp, _ := app.Test(httptest.NewRequest("GET", "/zip?srcs=photos/beach.jpg&store=true", nil))
+	data, _ := io.ReadAll(resp.Body)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil || len(zr.File) != 1 || zr.File[0].Method != zip.Store {
+		t.Errorf("Expected a stored entry, got %v %+v", err, zr)
+	}
+	if got := resp.Header.Get("Content-Disposition"); got != `attachment; filename="beach.jpg.zip"` {
+		t.Errorf("Unexpected Content-Disposition: %s", got)
+	}
+
+	for _, query := range []string{"", "srcs=missing.txt", "path=notes.txt", "srcs=notes.txt&format=rar"} {
+		if status, _ := download(query, "zip"); status == 200 {
+			t.Errorf("Expected an error for %q", query)
+		}
+	}
+}
+
+// failingFS fails reading one file, like a bad disk sector would
+type failingFS struct {
+	storage.FS
+	fail string
+}
+
+type failingFile struct{ storage.File }
+
+func (f failingFile) Read(p []byte) (int, error) { return 0, errors.New("input/output error") }
+
+func (f failingFS) Open(name string) (storage.File, error) {
+	file, err := f.FS.Open(name)
+	if err == nil && name == f.fail {
+		return failingFile{file}, nil
+	}
+	return file, err
+}
+
+func TestDownloadErrors(t *testing.T) {
+	setupSearchTree(t)
+
+	app := fiber.New()
+	app.Get("/zip", handleZipDownload)
+	download := func(query string) []byte {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("GET", "/zip?"+query, nil))
+		if err != nil || resp.StatusCode != 200 {
+			t.Fatalf("Download failed: %v %v", err, resp)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return data
+	}
+
+	// Symlinks are stored as links, not followed
+	if err := os.Symlink("../notes.txt", filepath.Join(rootPath, "photos", "link")); err != nil {
+		t.Fatal(err)
+	}
+	data := download("path=photos")
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, zf := range zr.File {
+		if zf.Name != "link" {
+			continue
+		}
+		rc, _ := zf.Open()
+		target, _ := io.ReadAll(rc)
+		rc.Close()
+		if zf.Mode()&os.ModeSymlink == 0 || string(target) != "../notes.txt" {
+			t.Errorf("Expected a stored symlink, got %v %q", zf.Mode(), target)
+		}
+	}
+	tr := tar.NewReader(bytes.NewReader(download("srcs=photos/link&format=tar")))
+	if header, err := tr.Next(); err != nil || header.Typeflag != tar.TypeSymlink || header.Linkname != "../notes.txt" {
+		t.Errorf("Expected a tar symlink, got %v %+v", err, header)
+	}
+	os.Remove(filepath.Join(rootPath, "photos", "link"))
+
+	// An unreadable file is skipped and listed at the end, the rest is complete
+	oldFS := rootFS
+	t.Cleanup(func() { rootFS = oldFS })
+	rootFS = failingFS{FS: rootFS, fail: filepath.Join(rootPath, "photos", "beach.jpg")}
+
+	path := filepath.Join(t.TempDir(), "errors.zip")
+	os.WriteFile(path, download("srcs=notes.txt&srcs=photos"), 0644)
+	content := readTestArchive(t, path, "zip")
+	if content["notes.txt"] != "hello" || content["photos/2024/notes.md"] != "# notes" || !strings.Contains(content[downloadErrorsName], "photos/beach.jpg: input/output error") {
+		t.Errorf("Unexpected download with an unreadable file: %v", content)
+	}
+
+	// tar entries keep their announced size, zero padded
+	content = make(map[string]string)
+	tr = tar.NewReader(bytes.NewReader(download("srcs=photos&format=tar")))
+	for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+		body, _ := io.ReadAll(tr)
+		content[header.Name] = string(body)
+	}
+	if content["photos/beach.jpg"] != strings.Repeat("\x00", 10) || content["photos/2024/notes.md"] != "# notes" || content[downloadErrorsName] == "" {
+		t.Errorf("Unexpected tar with an unreadable file: %q", content)
+	}
+}
+
+func TestZipEstimate(t *testing.T) {
+	setupSearchTree(t)
+
+	app := fiber.New()
+	app.Get("/zip/estimate", handleZipEstimate)
+	estimate := func(query string) (int, map[string]any) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("GET", "/zip/estimate?"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]any
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	if _, body := estimate("path=photos"); body["size"] != float64(-1) {
+		t.Errorf("Expected an unknown size without a size tree, got %v", body)
+	}
+
+	loadTestSizeTree(t)
+	// beach.jpg, 2024 and 2024/notes.md, without the hidden folder
+	if _, body := estimate("path=photos"); body["size"] != float64(17) || body["entries"] != float64(3) || body["name"] != "photos" {
+		t.Errorf("Unexpected folder estimate: %v", body)
+	}
+	if _, body := estimate("srcs=notes.txt&srcs=photos&hidden=true"); body["size"] != float64(28) || body["entries"] != float64(7) {
+		t.Errorf("Unexpected selection estimate: %v", body)
+	}
+	if status, _ := estimate("srcs=missing.txt"); status != 404 {
+		t.Errorf("Expected 404 for a missing source, got %d", status)
+	}
+}
+
+// More than 65535 entries need ZIP64 records to be readable
+func TestArchiveWriterZip64(t *testing.T) {
+	var buf bytes.Buffer
+	aw, err := newArchiveWriter(&buf, "zip", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const count = 70000
+	for i := 0; i < count; i++ {
+		name := fmt.Sprintf("f%d", i)
+		info := &archiveMemberInfo{member: archiveMember{name: name}}
+		if err := aw.add(name, info, strings.NewReader("")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil || len(zr.File) != count {
+		t.Fatalf("Expected %d entries, got %v", count, err)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	docCacheDir     string        // --doc-cache
+	docCacheMB      int64         // --doc-cache-mb
+	docWorkers      int           // --doc-workers
+	docTimeout      time.Duration // --doc-timeout
+	docPrewarm      string        // --doc-prewarm
+	docSlots        chan int      // Free LibreOffice workers, by number (each has its own profile)
+	docFlight       singleflight.Group
+	docCacheBytes   atomic.Int64
+	docEvicting     atomic.Bool
+	errDocTimeout   = errors.New("document conversion timed out")
+	errDocNotOffice = errors.New("not an office document")
+)
+
+// setupDocumentCache creates the cache and profile dirs and the worker slots
+func setupDocumentCache() error {
+	if abs, err := filepath.Abs(docCacheDir); err == nil {
+		docCacheDir = abs // LibreOffice wants profile URLs with absolute paths
+	}
+	if err := os.MkdirAll(filepath.Join(docCacheDir, "html"), 0755); err != nil {
+		return err
+	}
+	docSlots = make(chan int, max(docWorkers, 1))
+	for i := 0; i < cap(docSlots); i++ {
+		docSlots <- i
+	}
+	var total int64
+	filepath.WalkDir(filepath.Join(docCacheDir, "html"), func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	docCacheBytes.Store(total)
+	log.Printf("Document cache %s: %s of %d MB, %d workers, %v timeout", docCacheDir, formatBytes(total), docCacheMB, cap(docSlots), docTimeout)
+	return nil
+}
+
+// documentKey names the cached HTML of a document version
+func documentKey(fullPath string, info fs.FileInfo) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d", fullPath, info.ModTime().UnixNano(), info.Size())))
+	return hex.EncodeToString(sum[:])
+}
+
+func cachedDocumentPath(key string) string {
+	return filepath.Join(docCacheDir, "html", key[:2], key+".html")
+}
+
+// cachedDocument reads converted HTML from the cache and marks it used for eviction
+func cachedDocument(key string) (string, bool) {
+	path := cachedDocumentPath(key)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", false
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return string(content), true
+}
+
+// convertDocument returns a stored office document as HTML, from the cache if
+// it was converted before. Requests for the same document wait for one
+// conversion, which runs in one of --doc-workers LibreOffice slots and is
+// killed after --doc-timeout.
+func convertDocument(fullPath string, info fs.FileInfo) (string, error) {
+	if !officeExtensions[strings.ToLower(filepath.Ext(fullPath))] {
+		return "", errDocNotOffice
+	}
+	key := documentKey(fullPath, info)
+	if content, ok := cachedDocument(key); ok {
+		return content, nil
+	}
+	content, err, _ := docFlight.Do(key, func() (any, error) {
+		if content, ok := cachedDocument(key); ok {
+			return content, nil
+		}
+		slot := <-docSlots
+		defer func() { docSlots <- slot }()
+
+		// Needs a file on the local disk
+		localPath, cleanup, err := localFile(fullPath)
+		if err != nil {
+			return "", err
+		}
+		defer cleanup()
+		started := time.Now()
+		content, err := convertDocumentToHTML(localPath, slot)
+		if err != nil {
+			log.Printf("Converting %s failed after %v: %v", fullPath, time.Since(started).Round(time.Millisecond), err)
+			return "", err
+		}
+		if err := storeDocument(key, content); err != nil {
+			log.Printf("Caching the conversion of %s failed: %v", fullPath, err)
+		}
+		return content, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return content.(string), nil
+}
+
+// storeDocument writes converted HTML to the cache, removing the least
+// recently used documents when it grows past --doc-cache-mb
+func storeDocument(key, content string) error {
+	path := cachedDocumentPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.WriteString(content)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if docCacheBytes.Add(int64(len(content))) > docCacheMB<<20 && docEvicting.CompareAndSwap(false, true) {
+		go func() {
+			defer docEvicting.Store(false)
+			total, removed := evictLeastRecentlyUsed(filepath.Join(docCacheDir, "html"), docCacheMB<<20*9/10)
+			docCacheBytes.Store(total)
+			log.Printf("Document cache: removed %d least recently used, %s left", removed, formatBytes(total))
+		}()
+	}
+	return nil
+}
+
+// convertDocumentToHTML runs LibreOffice on a local file with the profile of
+// a worker slot (instances sharing a profile hand their work to each other).
+// The whole process group is killed when it takes longer than --doc-timeout.
+func convertDocumentToHTML(docPath string, slot int) (string, error) {
+	// Create temporary directory for output
+	tempDir, err := os.MkdirTemp("", "libreoffice_convert_")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %v", err)
+	}
+	defer os.RemoveAll(tempDir) // Clean up temp directory
+
+	// Determine the file extension to choose appropriate filter
+	ext := strings.ToLower(filepath.Ext(docPath))
+	var convertFilter string
+
+	switch ext {
+	case ".docx", ".doc", ".odt", ".rtf":
+		convertFilter = "html:XHTML Writer File:BodyOnly,EmbedImages"
+	case ".xlsx", ".xls", ".ods":
+		convertFilter = "html:HTML (StarCalc):EmbedImages:BodyOnly"
+	case ".pptx", ".ppt", ".odp":
+		convertFilter = "html:HTML (Impress):EmbedImages:BodyOnly"
+	default:
+		return "", fmt.Errorf("unsupported file format: %s", ext)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), docTimeout)
+	defer cancel()
+	profile := filepath.Join(docCacheDir, "profiles", strconv.Itoa(slot))
+	cmd := exec.CommandContext(ctx,
+		libreOfficeAppPath,
+		"--headless",
+		"-env:UserInstallation=file://"+filepath.ToSlash(profile),
+		"--convert-to", convertFilter,
+		"--outdir", tempDir,
+		docPath,
+	)
+	// LibreOffice (and the AppImage wrapper) start child processes that
+	// would keep running, and keep the output pipe open, if only the first
+	// one was killed
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+
+	// Execute the conversion
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return "", fmt.Errorf("%w after %v", errDocTimeout, docTimeout)
+	}
+	if err != nil {
+		return "", fmt.Errorf("LibreOffice conversion failed: %v, output: %s", err, string(output))
+	}
+
+	// Determine the output HTML filename
+	baseName := filepath.Base(docPath)
+	nameWithoutExt := strings.TrimSuffix(baseName, filepath.Ext(baseName))
+	htmlFilePath := filepath.Join(tempDir, nameWithoutExt+".html")
+
+	// Read the generated HTML file
+	htmlContent, err := os.ReadFile(htmlFilePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read converted HTML file: %v", err)
+	}
+
+	return string(htmlContent), nil
+}
+
+// officeDocuments lists the office documents in a directory (and its
+// subdirectories if recursive), skipping hidden ones like the listing does
+func officeDocuments(ctx context.Context, dir string, recursive bool) ([]string, int64, error) {
+	var paths []string
+	var total int64
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		entries, err := rootFS.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			fullPath := filepath.Join(dir, entry.Name())
+			if entry.IsDir() {
+				if recursive {
+					if err := walk(fullPath); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if officeExtensions[strings.ToLower(filepath.Ext(entry.Name()))] {
+				if info, err := entry.Info(); err == nil {
+					paths = append(paths, fullPath)
+					total += info.Size()
+				}
+			}
+		}
+		return nil
+	}
+	err := walk(dir)
+	sort.Strings(paths)
+	return paths, total, err
+}
+
+// runPrewarm is the prewarm job: convert the office documents of a directory
+// into the cache, one at a time so viewers still get the other workers
+func runPrewarm(j *job, m *mount, dir string, recursive bool) {
+	paths, total, err := officeDocuments(j.ctx, dir, recursive)
+	if err != nil {
+		j.finish("", err)
+		return
+	}
+	j.progress(0, total, 0)
+
+	var done int64
+	converted := 0
+	for _, fullPath := range paths {
+		if err := j.ctx.Err(); err != nil {
+			j.finish("", err)
+			return
+		}
+		info, err := rootFS.Stat(fullPath)
+		if err == nil {
+			_, err = convertDocument(fullPath, info)
+		}
+		rel, _ := m.rel(fullPath)
+		if err != nil {
+			j.addError(fmt.Sprintf("%s: %v", rel, err))
+		} else {
+			converted++
+		}
+		if info != nil {
+			done += info.Size()
+		}
+		j.progress(done, 0, converted)
+	}
+	log.Printf("Prewarmed %d of %d documents in %s", converted, len(paths), dir)
+	rel, _ := m.rel(dir)
+	j.finish(rel, nil)
+}
+
+// startPrewarm starts a prewarm job for a directory of a mount
+func startPrewarm(m *mount, dir string, recursive bool) *job {
+	j := startJob("prewarm", m.Name)
+	go runPrewarm(j, m, dir, recursive)
+	return j
+}
+
+// prewarmFromFlag starts prewarm jobs for the --doc-prewarm directories
+// (comma separated, below --path, with their subdirectories)
+func prewarmFromFlag() {
+	m := primaryMount()
+	for _, rel := range strings.Split(docPrewarm, ",") {
+		if rel = strings.TrimSpace(rel); rel == "" {
+			continue
+		}
+		dir, err := m.resolve(rel)
+		if err != nil {
+			log.Printf("Warning: Not prewarming %s: %v", rel, err)
+			continue
+		}
+		j := startPrewarm(m, dir, true)
+		log.Printf("Prewarming documents in %s (job %s)", dir, j.id)
+	}
+}
+
+// handlePrewarmDocuments converts the office documents of a directory into
+// the cache, so they open right away later. Runs as a job.
+func handlePrewarmDocuments(c *fiber.Ctx) error {
+	if libreOfficeAppPath == "" {
+		return c.Status(503).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Office document viewing is not enabled",
+		})
+	}
+	m, err := requestMount(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	dir, err := m.resolve(c.Query("path"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	if info, err := rootFS.Stat(dir); err != nil || !info.IsDir() {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Path must be a directory",
+		})
+	}
+
+	j := startPrewarm(m, dir, c.QueryBool("recursive", false))
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"job":    j.info(),
+	})
+}
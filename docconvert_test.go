@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setupTestDocuments uses a temp document cache and a fake LibreOffice that
+// writes the file name as HTML, counting its runs in the returned file.
+// Documents named slow* hang in a child process.
+func setupTestDocuments(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	script := filepath.Join(dir, "soffice")
+	os.WriteFile(script, []byte(fmt.Sprintf(`#!/bin/sh
+# --headless -env:UserInstallation=... --convert-to FILTER --outdir DIR FILE
+echo run >> %q
+name=$(basename "$7")
+case "$name" in slow*) sleep 30 ;; esac
+sleep 0.2
+echo "<p>$name</p>" > "$6/${name%%.*}.html"
+`, runs)), 0755)
+
+	oldApp, oldDir, oldMB, oldWorkers, oldTimeout := libreOfficeAppPath, docCacheDir, docCacheMB, docWorkers, docTimeout
+	t.Cleanup(func() {
+		libreOfficeAppPath, docCacheDir, docCacheMB, docWorkers, docTimeout = oldApp, oldDir, oldMB, oldWorkers, oldTimeout
+	})
+	libreOfficeAppPath, docCacheDir, docCacheMB, docWorkers, docTimeout = script, filepath.Join(dir, "cache"), 1024, 2, 10*time.Second
+	if err := setupDocumentCache(); err != nil {
+		t.Fatal(err)
+	}
+	return runs
+}
+
+func countRuns(runs string) int {
+	data, _ := os.ReadFile(runs)
+	return strings.Count(string(data), "run")
+}
+
+func TestConvertDocument(t *testing.T) {
+	setupSearchTree(t)
+	runs := setupTestDocuments(t)
+	docPath := filepath.Join(rootPath, "report.docx")
+	os.WriteFile(docPath, []byte("doc"), 0644)
+	info, _ := os.Stat(docPath)
+
+	// Concurrent requests share one conversion
+	var wg sync.WaitGroup
+	results := make([]string, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], _ = convertDocument(docPath, info)
+		}(i)
+	}
+	wg.Wait()
+	for _, result := range results {
+		if !strings.Contains(result, "<p>report.docx</p>") {
+			t.Fatalf("conversion = %q", result)
+		}
+	}
+	if n := countRuns(runs); n != 1 {
+		t.Errorf("LibreOffice ran %d times for concurrent requests, want 1", n)
+	}
+
+	// Then it comes from the cache, until the file changes
+	if _, err := convertDocument(docPath, info); err != nil || countRuns(runs) != 1 {
+		t.Errorf("cached conversion: err %v, %d runs", err, countRuns(runs))
+	}
+	later := info.ModTime().Add(time.Minute)
+	os.Chtimes(docPath, later, later)
+	info, _ = os.Stat(docPath)
+	if _, err := convertDocument(docPath, info); err != nil || countRuns(runs) != 2 {
+		t.Errorf("changed document: err %v, %d runs, want 2", err, countRuns(runs))
+	}
+
+	if _, err := convertDocument(filepath.Join(rootPath, "notes.txt"), info); !errors.Is(err, errDocNotOffice) {
+		t.Errorf("text file: err %v, want errDocNotOffice", err)
+	}
+
+	// A hanging conversion is killed with its children
+	docTimeout = 300 * time.Millisecond
+	slowPath := filepath.Join(rootPath, "slow.pptx")
+	os.WriteFile(slowPath, []byte("deck"), 0644)
+	slowInfo, _ := os.Stat(slowPath)
+	started := time.Now()
+	if _, err := convertDocument(slowPath, slowInfo); !errors.Is(err, errDocTimeout) {
+		t.Errorf("slow document: err %v, want errDocTimeout", err)
+	}
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("slow document took %v to give up", elapsed)
+	}
+	if len(docSlots) != cap(docSlots) {
+		t.Errorf("%d of %d workers free after the timeout", len(docSlots), cap(docSlots))
+	}
+}
+
+func TestDocumentViewerAndPrewarm(t *testing.T) {
+	setupSearchTree(t)
+	runs := setupTestDocuments(t)
+	os.WriteFile(filepath.Join(rootPath, "report.docx"), []byte("doc"), 0644)
+	os.WriteFile(filepath.Join(rootPath, "photos", "deck.pptx"), []byte("deck"), 0644)
+	os.WriteFile(filepath.Join(rootPath, "photos", ".hidden", "secret.odt"), []byte("odt"), 0644)
+
+	app := fiber.New()
+	app.Get("/doc_viewer", handleDocument)
+	app.Post("/admin/documents/prewarm", handlePrewarmDocuments)
+
+	resp, err := app.Test(httptest.NewRequest("POST", "/admin/documents/prewarm?recursive=true", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		t.Fatalf("prewarm: status %d: %s", resp.StatusCode, body)
+	}
+	var id string
+	jobsMu.Lock()
+	for jobID, j := range jobs {
+		if j.kind == "prewarm" && strings.Contains(string(body), jobID) {
+			id = jobID
+		}
+	}
+	jobsMu.Unlock()
+	info := waitForJob(t, id)
+	if info.Status != "done" || info.Files != 2 || info.Total != 7 {
+		t.Errorf("prewarm job = %+v, want done with 2 files of 7 bytes", info)
+	}
+
+	// The viewer then gets them from the cache
+	resp, err = app.Test(httptest.NewRequest("GET", "/doc_viewer?path=photos/deck.pptx", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Errorf("viewer: status %d", resp.StatusCode)
+	}
+	if n := countRuns(runs); n != 2 {
+		t.Errorf("LibreOffice ran %d times, want 2", n)
+	}
+
+	resp, _ = app.Test(httptest.NewRequest("POST", "/admin/documents/prewarm?path=notes.txt", nil))
+	if resp.StatusCode != 400 {
+		t.Errorf("prewarm of a file: status %d, want 400", resp.StatusCode)
+	}
+}
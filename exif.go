@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// EXIF tags we read
+const (
+	exifTagOrientation = 0x0112
+	exifTagExifIFD     = 0x8769
+	exifTagGPSIFD      = 0x8825
+)
+
+// Sizes of the TIFF field types, by type number
+var exifTypeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8}
+
+var errNoEXIF = errors.New("no EXIF data")
+
+// exifEntry is one field of an IFD, its value bytes still in the file's byte order
+type exifEntry struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// exifData holds the fields of the IFDs of a TIFF structure: IFD0 (the main
+// image), the EXIF IFD (camera settings, dates) and the GPS IFD
+type exifData struct {
+	order binary.ByteOrder
+	ifd0  map[uint16]exifEntry
+	exif  map[uint16]exifEntry
+	gps   map[uint16]exifEntry
+}
+
+// parseTIFF reads the IFDs of TIFF data: a TIFF file, or the EXIF block of a JPEG
+func parseTIFF(data []byte) (*exifData, error) {
+	if len(data) < 8 {
+		return nil, errNoEXIF
+	}
+	x := &exifData{}
+	switch string(data[:2]) {
+	case "II":
+		x.order = binary.LittleEndian
+	case "MM":
+		x.order = binary.BigEndian
+	default:
+		return nil, errNoEXIF
+	}
+	if x.order.Uint16(data[2:]) != 42 {
+		return nil, errNoEXIF
+	}
+	var err error
+	if x.ifd0, err = x.readIFD(data, x.order.Uint32(data[4:])); err != nil {
+		return nil, err
+	}
+	// The sub-IFDs are optional; a broken one leaves the rest usable
+	if offset, ok := x.uint(x.ifd0, exifTagExifIFD); ok {
+		x.exif, _ = x.readIFD(data, uint32(offset))
+	}
+	if offset, ok := x.uint(x.ifd0, exifTagGPSIFD); ok {
+		x.gps, _ = x.readIFD(data, uint32(offset))
+	}
+	return x, nil
+}
+
+func (x *exifData) readIFD(data []byte, offset uint32) (map[uint16]exifEntry, error) {
+	if int64(offset)+2 > int64(len(data)) {
+		return nil, errors.New("IFD outside of the data")
+	}
+	n := int(x.order.Uint16(data[offset:]))
+	start := int(offset) + 2
+	if start+12*n > len(data) {
+		return nil, errors.New("IFD outside of the data")
+	}
+	entries := make(map[uint16]exifEntry, n)
+	for i := 0; i < n; i++ {
+		field := data[start+12*i : start+12*i+12]
+		tag, typ, count := x.order.Uint16(field), x.order.Uint16(field[2:]), x.order.Uint32(field[4:])
+		size, ok := exifTypeSizes[typ]
+		if !ok {
+			continue
+		}
+		length := int64(size) * int64(count)
+		var value []byte
+		if length <= 4 {
+			value = field[8 : 8+length]
+		} else {
+			at := int64(x.order.Uint32(field[8:]))
+			if at+length > int64(len(data)) {
+				continue
+			}
+			value = data[at : at+length]
+		}
+		entries[tag] = exifEntry{typ: typ, count: count, value: value}
+	}
+	return entries, nil
+}
+
+// uint reads a BYTE, SHORT or LONG field
+func (x *exifData) uint(ifd map[uint16]exifEntry, tag uint16) (uint64, bool) {
+	e, ok := ifd[tag]
+	if !ok || e.count == 0 {
+		return 0, false
+	}
+	switch e.typ {
+	case 1:
+		return uint64(e.value[0]), true
+	case 3:
+		return uint64(x.order.Uint16(e.value)), true
+	case 4:
+		return uint64(x.order.Uint32(e.value)), true
+	}
+	return 0, false
+}
+
+// string reads an ASCII field, without the NUL and padding
+func (x *exifData) string(ifd map[uint16]exifEntry, tag uint16) string {
+	e, ok := ifd[tag]
+	if !ok || e.typ != 2 {
+		return ""
+	}
+	value, _, _ := bytes.Cut(e.value, []byte{0})
+	return strings.TrimSpace(string(value))
+}
+
+// rationals reads a RATIONAL or SRATIONAL field as floats
+func (x *exifData) rationals(ifd map[uint16]exifEntry, tag uint16) []float64 {
+	e, ok := ifd[tag]
+	if !ok || (e.typ != 5 && e.typ != 10) {
+		return nil
+	}
+	values := make([]float64, 0, e.count)
+	for i := 0; i+8 <= len(e.value); i += 8 {
+		num, den := x.order.Uint32(e.value[i:]), x.order.Uint32(e.value[i+4:])
+		if den == 0 {
+			values = append(values, 0)
+		} else if e.typ == 10 {
+			values = append(values, float64(int32(num))/float64(int32(den)))
+		} else {
+			values = append(values, float64(num)/float64(den))
+		}
+	}
+	return values
+}
+
+// orientation is the EXIF orientation (1-8), 1 if there is none
+func (x *exifData) orientation() int {
+	if o, ok := x.uint(x.ifd0, exifTagOrientation); ok && o >= 1 && o <= 8 {
+		return int(o)
+	}
+	return 1
+}
+
+// jpegEXIF finds the EXIF block (APP1 "Exif") of JPEG data and returns its TIFF structure
+func jpegEXIF(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, errNoEXIF
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return nil, errNoEXIF
+		}
+		marker := data[i+1]
+		if marker == 0xFF { // Padding
+			i++
+			continue
+		}
+		if marker == 0xDA || marker == 0xD9 { // Image data starts, no EXIF before it
+			return nil, errNoEXIF
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, errNoEXIF
+		}
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return segment[6:], nil
+		}
+		i += 2 + length
+	}
+	return nil, errNoEXIF
+}
+
+// readEXIF reads the EXIF data of a JPEG or TIFF file's content
+func readEXIF(data []byte) (*exifData, error) {
+	if tiff, err := jpegEXIF(data); err == nil {
+		return parseTIFF(tiff)
+	}
+	return parseTIFF(data)
+}
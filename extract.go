@@ -0,0 +1,400 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/bzip2"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ulikunitz/xz"
+
+	"file-browser/storage"
+)
+
+// Limits against archive bombs. The ratio applies to the whole archive;
+// extractRatioSlack lets small archives of very compressible data through.
+const (
+	maxExtractSize    = 50 << 30 // Uncompressed bytes per archive
+	maxExtractRatio   = 200      // Uncompressed bytes per compressed byte
+	maxExtractEntries = 200000
+	extractRatioSlack = 16 << 20
+)
+
+var errArchiveBomb = errors.New("archive expands beyond the size limits, not extracting the rest")
+
+// Conflict policies for files that already exist at the destination
+const (
+	conflictSkip      = "skip" // Keep the existing file (default)
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename" // Extract as "name (1).ext"
+)
+
+// isExtractableName reports whether the extract action can unpack name
+func isExtractableName(name string) bool {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz"} {
+		if strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// countingReader counts the compressed bytes consumed, for progress
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// extractor writes archive members below destPath
+type extractor struct {
+	job         *job
+	destPath    string
+	conflict    string
+	archiveSize int64
+	written     int64
+	entries     int
+	skipped     int
+	topLevel    map[string]bool // Names directly below destPath that were written
+}
+
+// limit is the most the archive may expand to
+func (x *extractor) limit() int64 {
+	return min(int64(maxExtractSize), x.archiveSize*maxExtractRatio+extractRatioSlack)
+}
+
+// skip records a member that was not extracted
+func (x *extractor) skip(name, reason string) {
+	x.skipped++
+	x.job.addError(fmt.Sprintf("Skipped %s: %s", name, reason))
+}
+
+// add extracts one member; body is nil for folders. Only errArchiveBomb and
+// write errors stop the extraction, bad members are skipped.
+func (x *extractor) add(rawName string, isDir bool, body io.Reader) error {
+	if err := x.job.ctx.Err(); err != nil {
+		return err
+	}
+	x.entries++
+	if x.entries > maxExtractEntries {
+		return errArchiveBomb
+	}
+
+	// Zip-slip: names like "../x" or "/etc/x" must stay below destPath
+	name, ok := cleanMemberName(rawName)
+	if !ok {
+		if strings.Trim(rawName, "/.") != "" { // Not just an entry for the top folder
+			x.skip(rawName, "path leaves the destination")
+		}
+		return nil
+	}
+	target := filepath.Join(x.destPath, filepath.FromSlash(name))
+	if !isWithin(target, x.destPath) {
+		x.skip(rawName, "path leaves the destination")
+		return nil
+	}
+	// Existing symlinks below destPath could redirect writes anywhere
+	if linked(x.destPath, target) {
+		x.skip(name, "path goes through a symlink")
+		return nil
+	}
+
+	if isDir {
+		if info, err := rootFS.Stat(target); err == nil && !info.IsDir() {
+			x.skip(name, "a file with that name exists")
+			return nil
+		}
+		if err := rootFS.MkdirAll(target); err != nil {
+			return err
+		}
+		x.wrote(target)
+		return nil
+	}
+
+	if err := rootFS.MkdirAll(filepath.Dir(target)); err != nil {
+		x.skip(name, err.Error())
+		return nil
+	}
+	if info, err := rootFS.Stat(target); err == nil {
+		switch {
+		case info.IsDir():
+			x.skip(name, "a folder with that name exists")
+			return nil
+		case x.conflict == conflictOverwrite:
+		case x.conflict == conflictRename:
+			target = freeName(target)
+		default:
+			x.skipped++
+			return nil
+		}
+	}
+
+	w, err := rootFS.Create(target)
+	if err != nil {
+		return err
+	}
+	remaining := x.limit() - x.written
+	n, err := io.Copy(w, io.LimitReader(body, remaining+1))
+	x.written += n
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > remaining {
+		err = errArchiveBomb
+	}
+	if err != nil {
+		rootFS.Remove(target) // Don't leave partial files behind
+		if err == errArchiveBomb {
+			return err
+		}
+		x.skip(name, err.Error())
+		return nil
+	}
+	x.wrote(target)
+	return nil
+}
+
+// wrote remembers the top-level item below destPath that target is in
+func (x *extractor) wrote(target string) {
+	rel, _ := filepath.Rel(x.destPath, target)
+	x.topLevel[strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]] = true
+}
+
+// linked reports whether any existing path from below root down to target is a
+// symlink. Only local roots can have symlinks.
+func linked(root, target string) bool {
+	for p := target; p != root && isWithin(p, root); p = filepath.Dir(p) {
+		local, ok := storage.LocalPath(rootFS, p)
+		if !ok {
+			return false
+		}
+		if info, err := os.Lstat(local); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// freeName adds " (n)" before the extension of path, with the first n that is free
+func freeName(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s (%d)%s", base, i, ext)
+		if _, err := rootFS.Stat(candidate); err != nil {
+			return candidate
+		}
+	}
+}
+
+// extractArchive unpacks archivePath into destPath
+func extractArchive(x *extractor, archivePath string) error {
+	info, err := rootFS.Stat(archivePath)
+	if err != nil {
+		return err
+	}
+	x.archiveSize = info.Size()
+
+	f, err := rootFS.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(strings.ToLower(archivePath), ".zip") {
+		return extractZip(x, f)
+	}
+
+	counter := &countingReader{r: f}
+	var r io.Reader = counter
+	switch lower := strings.ToLower(archivePath); {
+	case strings.HasSuffix(lower, ".gz"), strings.HasSuffix(lower, ".tgz"):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = gz
+	case strings.HasSuffix(lower, ".bz2"), strings.HasSuffix(lower, ".tbz2"):
+		r = bzip2.NewReader(r)
+	case strings.HasSuffix(lower, ".xz"), strings.HasSuffix(lower, ".txz"):
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = xr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = x.add(header.Name, true, nil)
+		case tar.TypeReg:
+			err = x.add(header.Name, false, tr)
+		default:
+			// Symlinks and hard links could point outside the destination
+			x.skip(header.Name, "links and special files are not extracted")
+		}
+		if err != nil {
+			return err
+		}
+		x.job.progress(counter.n, x.archiveSize, x.entries)
+	}
+}
+
+func extractZip(x *extractor, f storage.File) error {
+	var readerAt io.ReaderAt = &fileReaderAt{f: f}
+	if ra, ok := f.(io.ReaderAt); ok {
+		readerAt = ra
+	}
+	zr, err := zip.NewReader(readerAt, x.archiveSize)
+	if err != nil {
+		return err
+	}
+
+	var done int64
+	for _, zf := range zr.File {
+		mode := zf.Mode()
+		switch {
+		case mode.IsDir():
+			err = x.add(zf.Name, true, nil)
+		case mode.IsRegular():
+			var rc io.ReadCloser
+			if rc, err = zf.Open(); err == nil {
+				err = x.add(zf.Name, false, rc)
+				rc.Close()
+			} else {
+				x.skip(zf.Name, err.Error())
+				err = nil
+			}
+		default:
+			x.skip(zf.Name, "links and special files are not extracted")
+		}
+		if err != nil {
+			return err
+		}
+		done += int64(zf.CompressedSize64)
+		x.job.progress(done, x.archiveSize, x.entries)
+	}
+	return nil
+}
+
+// startExtract validates an extract request and starts the job. The archive
+// is in srcMount, dest (created if missing) in destMount.
+func startExtract(c *fiber.Ctx, srcMount, destMount *mount, srcList []string, dest string) error {
+	if len(srcList) != 1 {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Extract takes a single archive in srcs",
+		})
+	}
+	conflict := c.Query("conflict", conflictSkip)
+	if conflict != conflictSkip && conflict != conflictOverwrite && conflict != conflictRename {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Invalid conflict. Must be 'skip', 'overwrite' or 'rename'",
+		})
+	}
+
+	archivePath, err := srcMount.resolve(srcList[0])
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	if info, err := rootFS.Stat(archivePath); err != nil || info.IsDir() {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Source archive does not exist",
+		})
+	}
+	if !isExtractableName(archivePath) {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Unsupported archive format. Supported: zip, tar, tar.gz, tar.bz2, tar.xz",
+		})
+	}
+
+	destPath, err := destMount.resolve(dest)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	if info, err := rootFS.Stat(destPath); err == nil && !info.IsDir() {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Destination must be a directory",
+		})
+	}
+
+	j := startJob("extract", destMount.Name)
+	fileOpsInProgress.Add(1)
+	go runExtract(j, srcMount, destMount, srcList[0], archivePath, cleanRelativePath(dest), destPath, conflict)
+
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"job":    j.info(),
+	})
+}
+
+// runExtract is the extract job: unpack, update the size tree and log the result
+func runExtract(j *job, srcMount, destMount *mount, src, archivePath, dest, destPath, conflict string) {
+	defer fileOpsInProgress.Done()
+
+	createdTop, err := createParentDirs(destPath)
+	if err != nil {
+		j.finish("", err)
+		logTransfer(srcMount, destMount, "extract", []string{src}, dest, j.info().Errors)
+		return
+	}
+
+	x := &extractor{job: j, destPath: destPath, conflict: conflict, topLevel: make(map[string]bool)}
+	err = extractArchive(x, archivePath)
+
+	// Whatever made it to the disk goes into the size tree, also after errors
+	if createdTop != "" {
+		sizeTreeAdd(createdTop)
+	} else {
+		names := make([]string, 0, len(x.topLevel))
+		for name := range x.topLevel {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sizeTreeAdd(filepath.Join(destPath, name))
+		}
+	}
+
+	if err != nil {
+		log.Printf("Extracting %s failed: %v", archivePath, err)
+	} else {
+		log.Printf("Extracted %s to %s (%d entries, %d bytes, %d skipped)", archivePath, destPath, x.entries, x.written, x.skipped)
+	}
+	j.finish(dest, err)
+	logTransfer(srcMount, destMount, "extract", []string{src}, dest, j.info().Errors)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/ulikunitz/xz"
+)
+
+// waitForJob polls a job until it is no longer running
+func waitForJob(t *testing.T, id string) JobInfo {
+	t.Helper()
+	for i := 0; i < 500; i++ {
+		jobsMu.Lock()
+		j := jobs[id]
+		jobsMu.Unlock()
+		if info := j.info(); info.Status != "running" {
+			return info
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %s did not finish", id)
+	return JobInfo{}
+}
+
+func TestExtract(t *testing.T) {
+	setupSearchTree(t)
+	enableTestWriteMode(t)
+
+	// A zip with a path escaping the destination and a symlink
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range map[string]string{"docs/a.txt": "aaa", "b.txt": "bb", "../../evil.txt": "x"} {
+		w, _ := zw.Create(name)
+		io.WriteString(w, content)
+	}
+	link := &zip.FileHeader{Name: "link"}
+	link.SetMode(os.ModeSymlink | 0777)
+	w, _ := zw.CreateHeader(link)
+	io.WriteString(w, "/etc/passwd")
+	zw.Close()
+	os.WriteFile(filepath.Join(rootPath, "bundle.zip"), buf.Bytes(), 0644)
+
+	// A tar.xz with a hard link
+	buf.Reset()
+	xw, _ := xz.NewWriter(&buf)
+	tw := tar.NewWriter(xw)
+	tw.WriteHeader(&tar.Header{Name: "c.txt", Mode: 0644, Size: 4, Typeflag: tar.TypeReg})
+	io.WriteString(tw, "cccc")
+	tw.WriteHeader(&tar.Header{Name: "hard", Linkname: "/etc/passwd", Typeflag: tar.TypeLink})
+	tw.Close()
+	xw.Close()
+	os.WriteFile(filepath.Join(rootPath, "photos", "more.tar.xz"), buf.Bytes(), 0644)
+
+	loadTestSizeTree(t)
+
+	app := fiber.New()
+	app.Get("/manage", handleManage)
+	app.Get("/api/jobs/:id", handleJob)
+	extract := func(query string) (int, JobInfo) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("GET", "/manage?action=extract&"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body struct {
+			Job JobInfo `json:"job"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if resp.StatusCode != 200 {
+			return resp.StatusCode, JobInfo{}
+		}
+		return resp.StatusCode, waitForJob(t, body.Job.ID)
+	}
+
+	status, job := extract("srcs=bundle.zip&dest=out")
+	if status != 200 || job.Status != "done" || job.Result != "out" {
+		t.Fatalf("Unexpected extract result: %d %+v", status, job)
+	}
+	if data, _ := os.ReadFile(filepath.Join(rootPath, "out", "docs", "a.txt")); string(data) != "aaa" {
+		t.Errorf("Expected docs/a.txt to be extracted, got %q", data)
+	}
+	for _, bad := range []string{filepath.Join(filepath.Dir(rootPath), "evil.txt"), filepath.Join(rootPath, "evil.txt"), filepath.Join(rootPath, "out", "link")} {
+		if _, err := os.Lstat(bad); err == nil {
+			t.Errorf("%s should not have been extracted", bad)
+		}
+	}
+	if len(job.Errors) != 2 {
+		t.Errorf("Expected the escaping path and the symlink to be reported, got %v", job.Errors)
+	}
+	if node := sizeTreeRoot.FindByPath(filepath.Join(rootPath, "out")); node == nil || node.Size() != 5 {
+		t.Errorf("Extracted folder missing from the size tree: %+v", node)
+	}
+
+	// Conflicts: skip keeps the existing file, rename extracts next to it
+	os.WriteFile(filepath.Join(rootPath, "out", "b.txt"), []byte("mine"), 0644)
+	extract("srcs=bundle.zip&dest=out")
+	if data, _ := os.ReadFile(filepath.Join(rootPath, "out", "b.txt")); string(data) != "mine" {
+		t.Errorf("skip overwrote an existing file: %q", data)
+	}
+	extract("srcs=bundle.zip&dest=out&conflict=rename")
+	if data, _ := os.ReadFile(filepath.Join(rootPath, "out", "b (1).txt")); string(data) != "bb" {
+		t.Errorf("rename did not extract next to the existing file: %q", data)
+	}
+	extract("srcs=bundle.zip&dest=out&conflict=overwrite")
+	if data, _ := os.ReadFile(filepath.Join(rootPath, "out", "b.txt")); string(data) != "bb" {
+		t.Errorf("overwrite kept the existing file: %q", data)
+	}
+	if status, _ := extract("srcs=bundle.zip&dest=out&conflict=maybe"); status != 400 {
+		t.Errorf("Expected 400 for an invalid conflict policy, got %d", status)
+	}
+
+	// Into an existing folder, skipping the hard link
+	status, job = extract("srcs=photos/more.tar.xz&dest=photos")
+	if data, _ := os.ReadFile(filepath.Join(rootPath, "photos", "c.txt")); status != 200 || string(data) != "cccc" {
+		t.Errorf("Expected c.txt from the tar.xz, got %d %q", status, data)
+	}
+	if len(job.Errors) != 1 || !strings.Contains(job.Errors[0], "hard") {
+		t.Errorf("Expected the hard link to be skipped, got %v", job.Errors)
+	}
+	if node := sizeTreeRoot.FindByPath(filepath.Join(rootPath, "photos", "c.txt")); node == nil {
+		t.Error("Extracted file missing from the size tree")
+	}
+
+	// Archive bombs stop the extraction
+	buf.Reset()
+	zw = zip.NewWriter(&buf)
+	w, _ = zw.Create("zeros")
+	w.Write(make([]byte, 2*extractRatioSlack)) // Far more than 200 times its compressed size
+	zw.Close()
+	os.WriteFile(filepath.Join(rootPath, "bomb.zip"), buf.Bytes(), 0644)
+	_, job = extract("srcs=bomb.zip&dest=bomb")
+	if job.Status != "error" {
+		t.Errorf("Expected the bomb to fail, got %+v", job)
+	}
+	if _, err := os.Stat(filepath.Join(rootPath, "bomb", "zeros")); err == nil {
+		t.Error("Partial bomb output was left behind")
+	}
+
+	entries := readLog(t, modificationsLogFile)
+	if len(entries) != 6 || entries[0].Action != "extract" || entries[0].Dest != "out" || entries[5].Dest != "bomb" || len(entries[5].Errors) == 0 {
+		t.Errorf("Unexpected log: %+v", entries)
+	}
+}
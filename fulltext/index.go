@@ -0,0 +1,334 @@
+// Package fulltext implements a small inverted index of file contents persisted in bbolt
+package fulltext
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	docsBucket     = []byte("docs")     // path -> docRecord
+	idsBucket      = []byte("ids")      // doc id -> path
+	postingsBucket = []byte("postings") // term, 0, doc id -> uvarint term frequency
+
+	// term -> all postings in one value; rewriting it for every document made
+	// building the index quadratic. Indexes in that format are rebuilt.
+	oldTermsBucket = []byte("terms")
+)
+
+// maxStoredText caps how much extracted text is kept per document for snippets
+const maxStoredText = 256 * 1024
+
+// docRecord is what we persist per indexed file
+type docRecord struct {
+	ID       uint64
+	Size     int64
+	Modified int64
+	Terms    []string // Needed to remove postings when the document changes
+	Text     string   // Leading part of the extracted text, used for snippets
+}
+
+// Document is a file's extracted text, to be indexed
+type Document struct {
+	Path     string
+	Size     int64
+	Modified int64
+	Text     string
+}
+
+// Hit is a single search result
+type Hit struct {
+	Path    string `json:"path"`
+	Score   int    `json:"score"`
+	Snippet string `json:"snippet"`
+}
+
+// Index is an inverted index of document terms. Paths are opaque keys to the
+// index; callers use slash-separated paths relative to the served root.
+type Index struct {
+	db *bolt.DB
+}
+
+// Open opens or creates an index database at path
+func Open(path string) (*Index, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index db: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(oldTermsBucket) != nil {
+			for _, name := range [][]byte{docsBucket, idsBucket, oldTermsBucket} {
+				if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+					return err
+				}
+			}
+		}
+		for _, name := range [][]byte{docsBucket, idsBucket, postingsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create index buckets: %w", err)
+	}
+	return &Index{db: db}, nil
+}
+
+// Close closes the underlying database
+func (ix *Index) Close() error {
+	return ix.db.Close()
+}
+
+// UpToDate reports whether path is indexed with the given size and modified time
+func (ix *Index) UpToDate(path string, size, modified int64) bool {
+	upToDate := false
+	ix.db.View(func(tx *bolt.Tx) error {
+		rec, err := getDoc(tx, path)
+		if err == nil && rec != nil {
+			upToDate = rec.Size == size && rec.Modified == modified
+		}
+		return nil
+	})
+	return upToDate
+}
+
+// Add indexes (or re-indexes) a document
+func (ix *Index) Add(path string, size, modified int64, text string) error {
+	return ix.AddBatch([]Document{{Path: path, Size: size, Modified: modified, Text: text}})
+}
+
+// AddBatch indexes (or re-indexes) several documents in one transaction,
+// which saves a disk sync per document while building the index
+func (ix *Index) AddBatch(docs []Document) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		for _, doc := range docs {
+			if err := addDoc(tx, doc); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func addDoc(tx *bolt.Tx, doc Document) error {
+	if err := removeDoc(tx, doc.Path); err != nil {
+		return err
+	}
+
+	ids := tx.Bucket(idsBucket)
+	id, err := ids.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	postings := tx.Bucket(postingsBucket)
+	freqs := termFrequencies(doc.Text)
+	terms := make([]string, 0, len(freqs))
+	for term, tf := range freqs {
+		terms = append(terms, term)
+		if err := postings.Put(postingKey(term, id), binary.AppendUvarint(nil, uint64(tf))); err != nil {
+			return err
+		}
+	}
+	sort.Strings(terms)
+
+	text := doc.Text
+	if len(text) > maxStoredText {
+		text = text[:maxStoredText]
+	}
+	rec := docRecord{ID: id, Size: doc.Size, Modified: doc.Modified, Terms: terms, Text: text}
+	if err := putDoc(tx, doc.Path, &rec); err != nil {
+		return err
+	}
+	return ids.Put(idKey(id), []byte(doc.Path))
+}
+
+// Remove drops a single document from the index
+func (ix *Index) Remove(path string) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		return removeDoc(tx, path)
+	})
+}
+
+// RemovePrefix drops path and every document below it (for deleted or moved directories)
+func (ix *Index) RemovePrefix(path string) error {
+	paths, err := ix.Paths(path)
+	if err != nil {
+		return err
+	}
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		for _, p := range paths {
+			if err := removeDoc(tx, p); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Paths lists indexed document paths at or below prefix ("" for all)
+func (ix *Index) Paths(prefix string) ([]string, error) {
+	var paths []string
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(docsBucket).Cursor()
+		for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+			p := string(k)
+			if underPrefix(p, prefix) {
+				paths = append(paths, p)
+			}
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// Search returns documents containing all terms of query, best matches first.
+// If pathPrefix is set, only documents at or below it are returned.
+func (ix *Index) Search(query, pathPrefix string, limit int) ([]Hit, error) {
+	terms := uniqueTerms(Tokenize(query))
+	if len(terms) == 0 {
+		return []Hit{}, nil
+	}
+
+	var hits []Hit
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(postingsBucket).Cursor()
+
+		// Intersect postings, summing term frequencies as the score
+		var scores map[uint64]int
+		for _, term := range terms {
+			prefix := postingKey(term, 0)[:len(term)+1]
+			next := make(map[uint64]int)
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				id := binary.BigEndian.Uint64(k[len(prefix):])
+				tf, _ := binary.Uvarint(v)
+				if scores == nil {
+					next[id] = int(tf)
+				} else if s, ok := scores[id]; ok {
+					next[id] = s + int(tf)
+				}
+			}
+			scores = next
+			if len(scores) == 0 {
+				return nil
+			}
+		}
+
+		ids := tx.Bucket(idsBucket)
+		for id, score := range scores {
+			path := ids.Get(idKey(id))
+			if path == nil {
+				continue
+			}
+			p := string(path)
+			if pathPrefix != "" && !underPrefix(p, pathPrefix) {
+				continue
+			}
+			hits = append(hits, Hit{Path: p, Score: score})
+		}
+
+		sort.Slice(hits, func(i, j int) bool {
+			if hits[i].Score != hits[j].Score {
+				return hits[i].Score > hits[j].Score
+			}
+			return hits[i].Path < hits[j].Path
+		})
+		if limit > 0 && len(hits) > limit {
+			hits = hits[:limit]
+		}
+
+		// Only load stored text for the hits we return
+		for i := range hits {
+			rec, err := getDoc(tx, hits[i].Path)
+			if err != nil {
+				return err
+			}
+			if rec != nil {
+				hits[i].Snippet = Snippet(rec.Text, terms, 80)
+			}
+		}
+		return nil
+	})
+	if hits == nil {
+		hits = []Hit{}
+	}
+	return hits, err
+}
+
+func underPrefix(path, prefix string) bool {
+	return prefix == "" || path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+func uniqueTerms(terms []string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, t := range terms {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// postingKey is the key of a term's posting for a document. Terms never
+// contain a NUL, so the postings of a term are the keys with prefix term+NUL.
+func postingKey(term string, id uint64) []byte {
+	key := make([]byte, 0, len(term)+9)
+	key = append(key, term...)
+	key = append(key, 0)
+	return binary.BigEndian.AppendUint64(key, id)
+}
+
+func idKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+func getDoc(tx *bolt.Tx, path string) (*docRecord, error) {
+	data := tx.Bucket(docsBucket).Get([]byte(path))
+	if data == nil {
+		return nil, nil
+	}
+	var rec docRecord
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec); err != nil {
+		return nil, fmt.Errorf("failed to decode document %s: %w", path, err)
+	}
+	return &rec, nil
+}
+
+func putDoc(tx *bolt.Tx, path string, rec *docRecord) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(rec); err != nil {
+		return err
+	}
+	return tx.Bucket(docsBucket).Put([]byte(path), buf.Bytes())
+}
+
+// removeDoc deletes a document and its postings. Missing documents are not an error.
+func removeDoc(tx *bolt.Tx, path string) error {
+	rec, err := getDoc(tx, path)
+	if err != nil || rec == nil {
+		return err
+	}
+	postings := tx.Bucket(postingsBucket)
+	for _, term := range rec.Terms {
+		if err := postings.Delete(postingKey(term, rec.ID)); err != nil {
+			return err
+		}
+	}
+	if err := tx.Bucket(idsBucket).Delete(idKey(rec.ID)); err != nil {
+		return err
+	}
+	return tx.Bucket(docsBucket).Delete([]byte(path))
+}
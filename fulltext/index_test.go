@@ -0,0 +1,173 @@
+package fulltext
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestIndex(t *testing.T) *Index {
+	t.Helper()
+	ix, err := Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { ix.Close() })
+	return ix
+}
+
+func hitPaths(hits []Hit) []string {
+	paths := make([]string, len(hits))
+	for i, h := range hits {
+		paths[i] = h.Path
+	}
+	return paths
+}
+
+func TestIndexSearch(t *testing.T) {
+	ix := openTestIndex(t)
+
+	docs := map[string]string{
+		"notes/todo.md":     "Buy milk. Call the plumber about the kitchen sink.",
+		"notes/plumber.txt": "Plumber plumber plumber: invoice for the kitchen sink repair.",
+		"src/main.go":       "package main // kitchen utilities",
+	}
+	for path, text := range docs {
+		if err := ix.Add(path, int64(len(text)), 1, text); err != nil {
+			t.Fatalf("Add(%s) failed: %v", path, err)
+		}
+	}
+
+	hits, err := ix.Search("Kitchen SINK", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := hitPaths(hits)
+	if len(got) != 2 {
+		t.Fatalf("Expected 2 hits, got %v", got)
+	}
+
+	hits, err = ix.Search("plumber", "", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 2 || hits[0].Path != "notes/plumber.txt" {
+		t.Errorf("Expected notes/plumber.txt to rank first, got %v", hitPaths(hits))
+	}
+	if !strings.Contains(strings.ToLower(hits[1].Snippet), "plumber") {
+		t.Errorf("Snippet should contain the matched term, got %q", hits[1].Snippet)
+	}
+
+	hits, err = ix.Search("kitchen", "src", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 || hits[0].Path != "src/main.go" {
+		t.Errorf("Expected only src/main.go under src, got %v", hitPaths(hits))
+	}
+}
+
+func TestIndexUpdateAndRemove(t *testing.T) {
+	ix := openTestIndex(t)
+
+	if err := ix.Add("a/b.txt", 5, 100, "alpha beta"); err != nil {
+		t.Fatal(err)
+	}
+	if !ix.UpToDate("a/b.txt", 5, 100) {
+		t.Error("Expected document to be up to date")
+	}
+	if ix.UpToDate("a/b.txt", 5, 101) {
+		t.Error("Expected document with newer mtime to be stale")
+	}
+
+	// Re-indexing replaces the old terms
+	if err := ix.Add("a/b.txt", 5, 101, "gamma delta"); err != nil {
+		t.Fatal(err)
+	}
+	if hits, _ := ix.Search("alpha", "", 10); len(hits) != 0 {
+		t.Errorf("Old terms should be gone, got %v", hitPaths(hits))
+	}
+	if hits, _ := ix.Search("gamma", "", 10); len(hits) != 1 {
+		t.Errorf("Expected new terms to be indexed, got %v", hitPaths(hits))
+	}
+
+	if err := ix.Add("ab/c.txt", 5, 100, "gamma"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ix.RemovePrefix("a"); err != nil {
+		t.Fatal(err)
+	}
+	hits, _ := ix.Search("gamma", "", 10)
+	if len(hits) != 1 || hits[0].Path != "ab/c.txt" {
+		t.Errorf("RemovePrefix(a) should keep ab/c.txt, got %v", hitPaths(hits))
+	}
+}
+
+func TestIndexBatchAndOldFormat(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "index.db")
+
+	// An index in the old format (all postings of a term in one value) is rebuilt
+	db, err := bolt.Open(dbPath, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Update(func(tx *bolt.Tx) error {
+		docs, _ := tx.CreateBucket(docsBucket)
+		docs.Put([]byte("old.txt"), []byte("not a gob"))
+		terms, _ := tx.CreateBucket(oldTermsBucket)
+		return terms.Put([]byte("old"), []byte{1, 1})
+	})
+	db.Close()
+
+	ix, err := Open(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	if paths, _ := ix.Paths(""); len(paths) != 0 {
+		t.Errorf("Expected the old index to be dropped, got %v", paths)
+	}
+
+	docs := []Document{
+		{Path: "a.txt", Size: 1, Modified: 1, Text: "shared alpha"},
+		{Path: "b.txt", Size: 1, Modified: 1, Text: "shared beta"},
+		{Path: "a.txt", Size: 2, Modified: 2, Text: "shared gamma"}, // Later wins
+	}
+	if err := ix.AddBatch(docs); err != nil {
+		t.Fatal(err)
+	}
+	if hits, _ := ix.Search("shared", "", 10); len(hits) != 2 {
+		t.Errorf("Expected both documents, got %v", hitPaths(hits))
+	}
+	if hits, _ := ix.Search("alpha", "", 10); len(hits) != 0 {
+		t.Errorf("Replaced terms should be gone, got %v", hitPaths(hits))
+	}
+	if !ix.UpToDate("a.txt", 2, 2) {
+		t.Error("Expected the last version of a.txt")
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	text := strings.Repeat("filler ", 50) + "the Needle is here " + strings.Repeat("filler ", 50)
+	snippet := Snippet(text, []string{"needle"}, 20)
+	if !strings.Contains(snippet, "Needle") {
+		t.Errorf("Snippet should contain the term, got %q", snippet)
+	}
+	if !strings.HasPrefix(snippet, "…") || !strings.HasSuffix(snippet, "…") {
+		t.Errorf("Snippet should be elided on both sides, got %q", snippet)
+	}
+	// Lowercasing makes "Ⱥ" and "İ" longer, matches must still be found in text
+	for _, text := range []string{
+		strings.Repeat("Ⱥ", 10) + " word",
+		strings.Repeat("İ", 40) + " the WORD " + strings.Repeat("Ⱥ", 40),
+		"word " + strings.Repeat("Ⱥ", 10),
+	} {
+		snippet := Snippet(text, []string{"word"}, 5)
+		if !strings.Contains(strings.ToLower(snippet), "word") || !utf8.ValidString(snippet) {
+			t.Errorf("Snippet of %q: got %q", text, snippet)
+		}
+	}
+}
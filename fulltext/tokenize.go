@@ -0,0 +1,120 @@
+package fulltext
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	minTermLength = 2
+	maxTermLength = 64
+)
+
+// Tokenize splits text into lowercase terms on anything that isn't a letter or digit.
+// Terms shorter than minTermLength or longer than maxTermLength are dropped.
+func Tokenize(text string) []string {
+	var terms []string
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	for _, f := range fields {
+		n := utf8.RuneCountInString(f)
+		if n < minTermLength || n > maxTermLength {
+			continue
+		}
+		terms = append(terms, strings.ToLower(f))
+	}
+	return terms
+}
+
+// termFrequencies counts how often each term occurs in text
+func termFrequencies(text string) map[string]uint32 {
+	freqs := make(map[string]uint32)
+	for _, term := range Tokenize(text) {
+		freqs[term]++
+	}
+	return freqs
+}
+
+// Snippet returns a short excerpt of text around the first occurrence of any of the terms
+func Snippet(text string, terms []string, radius int) string {
+	lower, offsets := lowerWithOffsets(text)
+	pos, matchEnd := -1, 0
+	for _, term := range terms {
+		if i := indexWord(lower, term); i >= 0 && (pos < 0 || offsets[i] < pos) {
+			// Back to offsets in text, lowercasing can change the length
+			pos, matchEnd = offsets[i], offsets[i+len(term)]
+		}
+	}
+	if pos < 0 {
+		pos = 0
+	}
+
+	start := pos - radius
+	if start < 0 {
+		start = 0
+	}
+	end := matchEnd + radius
+	if end > len(text) {
+		end = len(text)
+	}
+	// Don't cut through a UTF-8 sequence
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	snippet := strings.Join(strings.Fields(text[start:end]), " ")
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(text) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// lowerWithOffsets lowercases text like strings.ToLower, and returns for
+// every byte of the result the offset of the rune it came from in text (plus
+// len(text) at the end). Some runes change their encoded length, "Ⱥ" takes 2
+// bytes and "ⱥ" 3.
+func lowerWithOffsets(text string) (string, []int) {
+	var b strings.Builder
+	b.Grow(len(text))
+	offsets := make([]int, 0, len(text)+1)
+	for i, r := range text {
+		n := b.Len()
+		b.WriteRune(unicode.ToLower(r))
+		for ; n < b.Len(); n++ {
+			offsets = append(offsets, i)
+		}
+	}
+	return b.String(), append(offsets, len(text))
+}
+
+// indexWord finds term in lowercased text, preferring an occurrence that starts a word
+func indexWord(lower, term string) int {
+	first := -1
+	offset := 0
+	for {
+		i := strings.Index(lower[offset:], term)
+		if i < 0 {
+			return first
+		}
+		i += offset
+		if first < 0 {
+			first = i
+		}
+		if i == 0 {
+			return i
+		}
+		r, _ := utf8.DecodeLastRuneInString(lower[:i])
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return i
+		}
+		offset = i + len(term)
+	}
+}
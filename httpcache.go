@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Cache-Control for files and images (--cache-control). The default lets
+// browsers keep files but revalidate them, which is a cheap 304 with the ETag.
+var cacheControl = "no-cache"
+
+// fileETag is the ETag of a stored file: from its verified digest if it has
+// one, otherwise from its size and modification time
+func fileETag(fullPath string, info fs.FileInfo) string {
+	if d := lookupDigest(fullPath, info); d != nil {
+		return d.etag()
+	}
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
+
+// etagMatches reports whether an If-None-Match or If-Range list contains etag.
+// Weak comparison: W/ prefixes are ignored.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since without it (RFC 9110)
+func notModified(c *fiber.Ctx, etag string, modTime time.Time) bool {
+	if c.Method() != fiber.MethodGet && c.Method() != fiber.MethodHead {
+		return false
+	}
+	if inm := c.Get(fiber.HeaderIfNoneMatch); inm != "" {
+		return etagMatches(inm, etag)
+	}
+	if ims := c.Get(fiber.HeaderIfModifiedSince); ims != "" {
+		if t, err := http.ParseTime(ims); err == nil {
+			return !modTime.Truncate(time.Second).After(t)
+		}
+	}
+	return false
+}
+
+// rangeApplies evaluates If-Range: a Range only counts if the client's copy
+// is still current. Dates only match exactly, as the ETag is the better validator.
+func rangeApplies(c *fiber.Ctx, etag string, modTime time.Time) bool {
+	ifRange := c.Get(fiber.HeaderIfRange)
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == etag
+	}
+	t, err := http.ParseTime(ifRange)
+	return err == nil && modTime.Truncate(time.Second).Equal(t)
+}
+
+// parseRange parses a single byte range ("bytes=0-99", "bytes=100-",
+// "bytes=-100") against size. ok is false for headers that are ignored
+// (malformed, other units, several ranges: the whole file is sent then);
+// satisfiable is false if the range lies beyond the end.
+func parseRange(header string, size int64) (start, length int64, ok, satisfiable bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, false
+	}
+	if first == "" {
+		// Suffix: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, false
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, true, false
+		}
+		n = min(n, size)
+		return size - n, n, true, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, false
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return 0, 0, false, false
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return 0, 0, true, false
+	}
+	return start, end - start + 1, true, true
+}
+
+// contentDisposition builds a Content-Disposition header that survives any
+// filename (RFC 6266): a plain ASCII fallback in filename, and the real name
+// percent-encoded in filename* when it differs
+func contentDisposition(disposition, filename string) string {
+	var fallback strings.Builder
+	for _, r := range filename {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' || r == '%' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	header := disposition + `; filename="` + fallback.String() + `"`
+	if fallback.String() != filename {
+		// PathEscape leaves a few characters RFC 5987 doesn't allow
+		encoded := strings.NewReplacer("'", "%27", "(", "%28", ")", "%29", "*", "%2A", ",", "%2C", ";", "%3B", "=", "%3D", "@", "%40", "&", "%26", "+", "%2B", "$", "%24", ":", "%3A").
+			Replace(url.PathEscape(filename))
+		header += "; filename*=UTF-8''" + encoded
+	}
+	return header
+}
+
+// sendWithValidators sends a file of size bytes with ETag and Last-Modified,
+// answers conditional requests with 304 and a single Range with 206. open is
+// only called when there is a body to send; if the reader can't seek, the
+// bytes before a range are skipped.
+func sendWithValidators(c *fiber.Ctx, etag string, size int64, modTime time.Time, open func() (io.ReadCloser, error)) error {
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, modTime.UTC().Format(http.TimeFormat))
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+	if cacheControl != "" {
+		c.Set(fiber.HeaderCacheControl, cacheControl)
+	}
+	if notModified(c, etag, modTime) {
+		c.Response().Header.Del(fiber.HeaderContentType)
+		c.Status(fiber.StatusNotModified)
+		return nil
+	}
+
+	start, length := int64(0), size
+	if header := c.Get(fiber.HeaderRange); header != "" && rangeApplies(c, etag, modTime) {
+		rangeStart, rangeLength, ok, satisfiable := parseRange(header, size)
+		if ok && !satisfiable {
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+			return c.Status(fiber.StatusRequestedRangeNotSatisfiable).SendString("Range not satisfiable")
+		}
+		if ok {
+			start, length = rangeStart, rangeLength
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+			c.Status(fiber.StatusPartialContent)
+		}
+	}
+
+	rc, err := open()
+	if err != nil {
+		c.Status(fiber.StatusNotFound)
+		c.Response().Header.Del(fiber.HeaderContentRange)
+		return c.SendString("File not found")
+	}
+	if start > 0 {
+		if seeker, ok := rc.(io.Seeker); ok {
+			_, err = seeker.Seek(start, io.SeekStart)
+		} else {
+			_, err = io.CopyN(io.Discard, rc, start)
+		}
+		if err != nil {
+			rc.Close()
+			c.Response().Header.Del(fiber.HeaderContentRange)
+			return c.Status(500).SendString("Failed to read file")
+		}
+	}
+	// fasthttp closes the reader once the body is sent
+	if f, ok := rc.(*os.File); ok {
+		return c.SendStream(&fileSection{LimitedReader: io.LimitedReader{R: f, N: length}, f: f}, int(length))
+	}
+	return c.SendStream(&readCloser{Reader: io.LimitReader(rc, length), closers: []io.Closer{rc}}, int(length))
+}
+
+// fileSection is the part of a local file a response sends. WriteTo hands
+// the file to the connection's ReadFrom, which copies it with sendfile, like
+// fasthttp's own file serving does.
+type fileSection struct {
+	io.LimitedReader
+	f *os.File
+}
+
+func (s *fileSection) WriteTo(w io.Writer) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(&s.LimitedReader)
+	}
+	return io.Copy(w, &s.LimitedReader)
+}
+
+func (s *fileSection) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestFileValidators(t *testing.T) {
+	setupSearchTree(t)
+	writeTestZip(t, filepath.Join(rootPath, "bundle.zip"), map[string]string{"docs/guide.txt": "guide text"})
+	app := fiber.New()
+	app.Get("/file", handleFileStream)
+	app.Get("/image", handleImageStream)
+
+	get := func(target string, headers map[string]string) (*http.Response, string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", target, nil)
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp, string(data)
+	}
+
+	resp, body := get("/image?path=photos/beach.jpg", nil)
+	etag := resp.Header.Get("ETag")
+	lastModified := resp.Header.Get("Last-Modified")
+	if resp.StatusCode != 200 || body != "0123456789" || etag == "" || lastModified == "" {
+		t.Fatalf("Expected the image with validators, got %d %q etag=%q lm=%q", resp.StatusCode, body, etag, lastModified)
+	}
+	if resp.Header.Get("Cache-Control") != "no-cache" || resp.Header.Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Unexpected caching headers: %v", resp.Header)
+	}
+
+	// Revalidation
+	if resp, body := get("/image?path=photos/beach.jpg", map[string]string{"If-None-Match": etag}); resp.StatusCode != 304 || body != "" {
+		t.Errorf("Expected 304 for a matching ETag, got %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := get("/image?path=photos/beach.jpg", map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": lastModified}); resp.StatusCode != 200 {
+		t.Errorf("Expected If-None-Match to win over If-Modified-Since, got %d", resp.StatusCode)
+	}
+	if resp, _ := get("/image?path=photos/beach.jpg", map[string]string{"If-Modified-Since": lastModified}); resp.StatusCode != 304 {
+		t.Errorf("Expected 304 for an unmodified file, got %d", resp.StatusCode)
+	}
+
+	// Ranges
+	ranges := []struct {
+		header, body, contentRange string
+		status                     int
+	}{
+		{"bytes=2-5", "2345", "bytes 2-5/10", 206},
+		{"bytes=7-", "789", "bytes 7-9/10", 206},
+		{"bytes=-3", "789", "bytes 7-9/10", 206},
+		{"bytes=8-100", "89", "bytes 8-9/10", 206},
+		{"bytes=10-", "Range not satisfiable", "bytes */10", 416},
+		{"bytes=0-1,4-5", "0123456789", "", 200}, // Several ranges: the whole file
+		{"items=0-1", "0123456789", "", 200},
+	}
+	for _, r := range ranges {
+		resp, body := get("/file?path=photos/beach.jpg", map[string]string{"Range": r.header})
+		if resp.StatusCode != r.status || body != r.body || resp.Header.Get("Content-Range") != r.contentRange {
+			t.Errorf("%s: got %d %q %q", r.header, resp.StatusCode, body, resp.Header.Get("Content-Range"))
+		}
+	}
+	if resp, body := get("/file?path=photos/beach.jpg", map[string]string{"Range": "bytes=0-1", "If-Range": etag}); resp.StatusCode != 206 || body != "01" {
+		t.Errorf("Expected the range for a current If-Range, got %d %q", resp.StatusCode, body)
+	}
+	if resp, body := get("/file?path=photos/beach.jpg", map[string]string{"Range": "bytes=0-1", "If-Range": `"stale"`}); resp.StatusCode != 200 || body != "0123456789" {
+		t.Errorf("Expected the whole file for a stale If-Range, got %d %q", resp.StatusCode, body)
+	}
+
+	// Archive members can't seek but get ranges too
+	if resp, body := get("/file?path=bundle.zip/docs/guide.txt", map[string]string{"Range": "bytes=6-"}); resp.StatusCode != 206 || body != "text" {
+		t.Errorf("Expected a range of the archive member, got %d %q", resp.StatusCode, body)
+	}
+
+	// A changed file gets a new ETag
+	os.WriteFile(filepath.Join(rootPath, "photos", "beach.jpg"), []byte("changed!"), 0644)
+	if resp, _ := get("/image?path=photos/beach.jpg", map[string]string{"If-None-Match": etag}); resp.StatusCode != 200 || resp.Header.Get("ETag") == etag {
+		t.Errorf("Expected a new ETag for a changed file, got %d %s", resp.StatusCode, resp.Header.Get("ETag"))
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct{ name, want string }{
+		{"report.pdf", `inline; filename="report.pdf"`},
+		{`say "hi".pdf`, `inline; filename="say _hi_.pdf"; filename*=UTF-8''say%20%22hi%22.pdf`},
+		{"résumé 100%.pdf", `inline; filename="r_sum_ 100_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9%20100%25.pdf`},
+		{"a;b'c.pdf", `inline; filename="a;b'c.pdf"`},
+	}
+	for _, tt := range tests {
+		if got := contentDisposition("inline", tt.name); got != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// readFromRecorder is a writer like a TCP connection, which only sends with
+// sendfile when ReadFrom gets the file itself
+type readFromRecorder struct {
+	bytes.Buffer
+	src io.Reader
+}
+
+func (w *readFromRecorder) ReadFrom(r io.Reader) (int64, error) {
+	w.src = r
+	return w.Buffer.ReadFrom(r)
+}
+
+func TestFileSectionSendfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	os.WriteFile(path, []byte("0123456789"), 0644)
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(2, io.SeekStart)
+	section := &fileSection{LimitedReader: io.LimitedReader{R: f, N: 4}, f: f}
+	defer section.Close()
+
+	var w readFromRecorder
+	if n, err := io.Copy(&w, section); err != nil || n != 4 || w.String() != "2345" {
+		t.Fatalf("Copied %d %q: %v", n, w.String(), err)
+	}
+	if lr, ok := w.src.(*io.LimitedReader); !ok || lr.R != f {
+		t.Errorf("Expected the file to reach ReadFrom, got %T", w.src)
+	}
+}
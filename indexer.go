@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"file-browser/fulltext"
+	"file-browser/storage"
+)
+
+const (
+	maxIndexedTextFile = 10 * 1024 * 1024 // Plain text files larger than this are skipped
+	maxIndexedDocument = 50 * 1024 * 1024 // Office docs and PDFs larger than this are skipped
+	pdfTextTimeout     = 2 * time.Minute
+	indexBatchDocs     = 200              // Documents written per index transaction
+	indexBatchBytes    = 32 * 1024 * 1024 // Or fewer when their text adds up to this
+)
+
+var (
+	indexDbPath  string          // Path to the full-text index database (empty = disabled)
+	contentIndex *fulltext.Index // nil when content indexing is disabled
+	indexQueue   *refreshQueue
+)
+
+// Extensions indexed as plain text without sniffing
+var textExtensions = map[string]bool{
+	".txt": true, ".md": true, ".markdown": true, ".rst": true, ".csv": true, ".tsv": true,
+	".log": true, ".json": true, ".xml": true, ".yaml": true, ".yml": true, ".toml": true,
+	".ini": true, ".cfg": true, ".conf": true, ".html": true, ".htm": true, ".css": true,
+	".go": true, ".py": true, ".js": true, ".ts": true, ".jsx": true, ".tsx": true,
+	".java": true, ".kt": true, ".c": true, ".h": true, ".cpp": true, ".hpp": true,
+	".cs": true, ".rs": true, ".rb": true, ".php": true, ".swift": true, ".scala": true,
+	".sh": true, ".bash": true, ".zsh": true, ".ps1": true, ".sql": true, ".r": true,
+	".tex": true, ".bib": true, ".srt": true, ".vtt": true, ".tmpl": true,
+}
+
+// Office formats converted through LibreOffice (see convertDocument)
+var officeExtensions = map[string]bool{
+	".docx": true, ".doc": true, ".odt": true, ".rtf": true,
+	".xlsx": true, ".xls": true, ".ods": true,
+	".pptx": true, ".ppt": true, ".odp": true,
+}
+
+var (
+	htmlScriptStyleRe = regexp.MustCompile(`(?is)<(script|style)[^>]*>.*?</(script|style)>`)
+	htmlTagRe         = regexp.MustCompile(`(?s)<[^>]*>`)
+)
+
+// htmlToText strips tags from converted office documents
+func htmlToText(s string) string {
+	s = htmlScriptStyleRe.ReplaceAllString(s, " ")
+	s = htmlTagRe.ReplaceAllString(s, " ")
+	return html.UnescapeString(s)
+}
+
+// extractText returns the text content of a file, or ok=false if the format isn't indexable
+func extractText(fullPath string, size int64) (text string, ok bool, err error) {
+	ext := strings.ToLower(filepath.Ext(fullPath))
+
+	switch {
+	case officeExtensions[ext]:
+		if libreOfficeAppPath == "" || size > maxIndexedDocument {
+			return "", false, nil
+		}
+		info, err := rootFS.Stat(fullPath)
+		if err != nil {
+			return "", false, err
+		}
+		htmlContent, err := convertDocument(fullPath, info)
+		if err != nil {
+			return "", false, err
+		}
+		return htmlToText(htmlContent), true, nil
+
+	case ext == ".pdf":
+		pdftotext, lookErr := exec.LookPath("pdftotext")
+		if lookErr != nil || size > maxIndexedDocument {
+			return "", false, nil
+		}
+		localPath, cleanup, err := localFile(fullPath)
+		if err != nil {
+			return "", false, err
+		}
+		defer cleanup()
+		ctx, cancel := context.WithTimeout(context.Background(), pdfTextTimeout)
+		defer cancel()
+		output, err := exec.CommandContext(ctx, pdftotext, "-q", "-enc", "UTF-8", localPath, "-").Output()
+		if err != nil {
+			return "", false, fmt.Errorf("pdftotext failed: %v", err)
+		}
+		return string(output), true, nil
+	}
+
+	if size > maxIndexedTextFile {
+		return "", false, nil
+	}
+
+	f, err := rootFS.Open(fullPath)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	// Unknown extensions are indexed only if the content sniffs as text
+	if !textExtensions[ext] {
+		head := make([]byte, 512)
+		n, _ := io.ReadFull(f, head)
+		if n == 0 || !strings.HasPrefix(http.DetectContentType(head[:n]), "text/") {
+			return "", false, nil
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", false, err
+		}
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return "", false, err
+	}
+	if bytes.IndexByte(data, 0) >= 0 {
+		return "", false, nil // Binary despite the extension
+	}
+	return string(data), true, nil
+}
+
+// refreshQueue is a de-duplicating queue of root-relative paths to re-index
+type refreshQueue struct {
+	mu      sync.Mutex
+	pending []string
+	queued  map[string]bool
+	signal  chan struct{}
+}
+
+func newRefreshQueue() *refreshQueue {
+	return &refreshQueue{
+		queued: make(map[string]bool),
+		signal: make(chan struct{}, 1),
+	}
+}
+
+func (q *refreshQueue) push(relPath string) {
+	q.mu.Lock()
+	if !q.queued[relPath] {
+		q.queued[relPath] = true
+		q.pending = append(q.pending, relPath)
+	}
+	q.mu.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (q *refreshQueue) pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.pending) == 0 {
+		return "", false
+	}
+	relPath := q.pending[0]
+	q.pending = q.pending[1:]
+	delete(q.queued, relPath)
+	return relPath, true
+}
+
+// setupContentIndex opens the index and starts the background indexer.
+// The whole root is re-checked on startup; after that the index follows size tree changes.
+func setupContentIndex() error {
+	if indexDbPath == "" {
+		return nil
+	}
+
+	ix, err := fulltext.Open(indexDbPath)
+	if err != nil {
+		return err
+	}
+	contentIndex = ix
+	indexQueue = newRefreshQueue()
+
+	// Keep the index current through the same hooks that update the size tree
+	onTreeChange(func(change TreeChange) {
+		if change.OldPath != "" {
+			queueIndexRefresh(change.OldPath)
+		}
+		queueIndexRefresh(change.Path)
+	})
+
+	go func() {
+		for range indexQueue.signal {
+			for {
+				relPath, ok := indexQueue.pop()
+				if !ok {
+					break
+				}
+				refreshIndex(relPath)
+			}
+		}
+	}()
+
+	log.Printf("Content index: %s (building in background)", indexDbPath)
+	indexQueue.push("")
+	return nil
+}
+
+func queueIndexRefresh(fullPath string) {
+	relPath, err := filepath.Rel(rootPath, fullPath)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		return
+	}
+	if relPath == "." {
+		relPath = ""
+	}
+	indexQueue.push(filepath.ToSlash(relPath))
+}
+
+// refreshIndex brings the index in sync with the disk for relPath and everything below it
+func refreshIndex(relPath string) {
+	fullPath := filepath.Join(rootPath, relPath)
+	start := time.Now()
+
+	info, err := rootFS.Stat(fullPath)
+	if err != nil {
+		// Gone (deleted or moved away)
+		if err := contentIndex.RemovePrefix(relPath); err != nil {
+			log.Printf("Content index: failed to remove %s: %v", relPath, err)
+		}
+		return
+	}
+
+	if !info.IsDir() {
+		if doc, ok := prepareDocument(relPath, fullPath, info); ok {
+			if err := contentIndex.Add(doc.Path, doc.Size, doc.Modified, doc.Text); err != nil {
+				log.Printf("Content index: failed to index %s: %v", relPath, err)
+			}
+		}
+		return
+	}
+
+	// Documents are written in batches, one transaction (and disk sync) each
+	seen := make(map[string]bool)
+	indexed := 0
+	var batch []fulltext.Document
+	var batchBytes int
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := contentIndex.AddBatch(batch); err != nil {
+			log.Printf("Content index: failed to index %d files under /%s: %v", len(batch), relPath, err)
+		} else {
+			indexed += len(batch)
+		}
+		batch, batchBytes = nil, 0
+	}
+	storage.Walk(rootFS, fullPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // Skip unreadable entries
+		}
+		if path != fullPath && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fileInfo, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(rootPath, path)
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+		if doc, ok := prepareDocument(rel, path, fileInfo); ok {
+			batch = append(batch, doc)
+			batchBytes += len(doc.Text)
+			if len(batch) >= indexBatchDocs || batchBytes >= indexBatchBytes {
+				flush()
+			}
+		}
+		return nil
+	})
+	flush()
+
+	// Drop documents that no longer exist below this directory
+	paths, err := contentIndex.Paths(relPath)
+	if err == nil {
+		for _, p := range paths {
+			if !seen[p] {
+				contentIndex.Remove(p)
+			}
+		}
+	}
+
+	if indexed > 0 {
+		log.Printf("Content index: indexed %d files under /%s in %v", indexed, relPath, time.Since(start).Round(time.Millisecond))
+	}
+}
+
+// prepareDocument extracts the text of a file that changed since it was
+// indexed. ok is false if it is up to date or not indexable.
+func prepareDocument(relPath, fullPath string, info os.FileInfo) (doc fulltext.Document, ok bool) {
+	size, modified := info.Size(), info.ModTime().Unix()
+	if contentIndex.UpToDate(relPath, size, modified) {
+		return doc, false
+	}
+
+	text, ok, err := extractText(fullPath, size)
+	if err != nil {
+		log.Printf("Content index: failed to extract %s: %v", relPath, err)
+	}
+	if !ok {
+		// Not indexable (any more) - make sure no stale entry is left behind
+		contentIndex.Remove(relPath)
+		return doc, false
+	}
+	return fulltext.Document{Path: relPath, Size: size, Modified: modified, Text: text}, true
+}
+
+// handleContentSearch returns files whose contents match all terms of q, with snippets
+func handleContentSearch(c *fiber.Ctx) error {
+	if contentIndex == nil {
+		return c.Status(503).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Content search is not enabled. Use --index-db to enable it",
+		})
+	}
+
+	// The index only covers the primary root
+	if m, err := requestMount(c); err != nil || m.Path != rootPath {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Content search is only available for the primary root",
+		})
+	}
+
+	query := c.Query("q")
+	if query == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Missing required parameter: q",
+		})
+	}
+	limit := c.QueryInt("limit", 50)
+	if limit <= 0 || limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+	pathPrefix := cleanRelativePath(c.Query("path"))
+
+	hits, err := contentIndex.Search(query, pathPrefix, limit)
+	if err != nil {
+		log.Printf("Content search error: %v", err)
+		return c.Status(500).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Content search failed",
+		})
+	}
+
+	type contentResult struct {
+		FileItem
+		Snippet string `json:"snippet"`
+		Score   int    `json:"score"`
+	}
+	results := make([]contentResult, 0, len(hits))
+	for _, hit := range hits {
+		info, err := rootFS.Stat(filepath.Join(rootPath, hit.Path))
+		if err != nil {
+			continue // Deleted behind our back; the next refresh will drop it
+		}
+		results = append(results, contentResult{
+			FileItem: FileItem{
+				Name:     filepath.Base(hit.Path),
+				Path:     hit.Path,
+				Size:     info.Size(),
+				Modified: info.ModTime().Unix(),
+			},
+			Snippet: hit.Snippet,
+			Score:   hit.Score,
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"status":  "ok",
+		"results": results,
+	})
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Finished jobs stay visible for this long so clients can pick up the result
+const jobRetention = 10 * time.Minute
+
+// job is a long running file operation (e.g. extracting an archive). Clients
+// get its ID back from the request that started it and poll /api/jobs/:id.
+// Deleting the job cancels ctx; the job checks it between files.
+type job struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.Mutex
+	id       string
+	kind     string
+	root     string
+	status   string // "running", "done", "error" or "cancelled"
+	done     int64  // Progress in bytes, out of total (0 if unknown)
+	total    int64
+	files    int
+	errors   []string
+	result   string // Path of the result relative to root, when there is one
+	started  time.Time
+	finished time.Time
+}
+
+// JobInfo is the JSON view of a job
+type JobInfo struct {
+	ID       string   `json:"id"`
+	Kind     string   `json:"kind"`
+	Root     string   `json:"root"`
+	Status   string   `json:"status"`
+	Done     int64    `json:"done"`
+	Total    int64    `json:"total"`
+	Files    int      `json:"files"`
+	Errors   []string `json:"errors,omitempty"`
+	Result   string   `json:"result,omitempty"`
+	Started  int64    `json:"started"`
+	Finished int64    `json:"finished,omitempty"`
+}
+
+var (
+	jobs   = make(map[string]*job)
+	jobsMu sync.Mutex
+)
+
+// startJob registers a running job; the caller runs it and calls finish
+func startJob(kind, root string) *job {
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		ctx:     ctx,
+		cancel:  cancel,
+		id:      uuid.New().String(),
+		kind:    kind,
+		root:    root,
+		status:  "running",
+		started: time.Now(),
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for id, old := range jobs {
+		old.mu.Lock()
+		expired := old.status != "running" && time.Since(old.finished) > jobRetention
+		old.mu.Unlock()
+		if expired {
+			delete(jobs, id)
+		}
+	}
+	jobs[j.id] = j
+	return j
+}
+
+// progress updates the byte counters; total 0 keeps the previous total
+func (j *job) progress(done, total int64, files int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.done, j.files = done, files
+	if total > 0 {
+		j.total = total
+	}
+}
+
+func (j *job) addError(err string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.errors = append(j.errors, err)
+}
+
+func (j *job) finish(result string, err error) {
+	j.cancel() // Releases the context
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.result = result
+	j.finished = time.Now()
+	switch {
+	case errors.Is(err, context.Canceled):
+		j.status = "cancelled"
+	case err != nil:
+		j.status = "error"
+		j.errors = append(j.errors, err.Error())
+	default:
+		j.status = "done"
+	}
+}
+
+func (j *job) info() JobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	info := JobInfo{
+		ID:      j.id,
+		Kind:    j.kind,
+		Root:    j.root,
+		Status:  j.status,
+		Done:    j.done,
+		Total:   j.total,
+		Files:   j.files,
+		Errors:  append([]string(nil), j.errors...),
+		Result:  j.result,
+		Started: j.started.Unix(),
+	}
+	if !j.finished.IsZero() {
+		info.Finished = j.finished.Unix()
+	}
+	return info
+}
+
+// handleJobs lists running and recently finished jobs, newest first
+func handleJobs(c *fiber.Ctx) error {
+	jobsMu.Lock()
+	list := make([]JobInfo, 0, len(jobs))
+	for _, j := range jobs {
+		list = append(list, j.info())
+	}
+	jobsMu.Unlock()
+	sort.Slice(list, func(i, k int) bool { return list[i].Started > list[k].Started })
+
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"jobs":   list,
+	})
+}
+
+// handleJob returns the progress of a single job
+func handleJob(c *fiber.Ctx) error {
+	jobsMu.Lock()
+	j := jobs[c.Params("id")]
+	jobsMu.Unlock()
+	if j == nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Job not found",
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"job":    j.info(),
+	})
+}
+
+// handleCancelJob stops a running job. The job cleans up after itself and
+// ends up "cancelled"; finished jobs are left alone.
+func handleCancelJob(c *fiber.Ctx) error {
+	jobsMu.Lock()
+	j := jobs[c.Params("id")]
+	jobsMu.Unlock()
+	if j == nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Job not found",
+		})
+	}
+	j.cancel()
+	return c.JSON(fiber.Map{
+		"status": "ok",
+	})
+}
@@ -1,17 +1,16 @@
 package main
 
 import (
-	"archive/zip"
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
-	"io"
-	"io/ioutil"
 	"log"
 	"net/url"
 	"os"
-	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"sort"
@@ -27,26 +26,43 @@ import (
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/websocket/v2"
 	"github.com/google/uuid"
-	"github.com/otiai10/copy"
 	"github.com/tus/tusd/pkg/filestore"
 	"github.com/tus/tusd/pkg/handler"
 
 	"file-browser/scan"
+	"file-browser/storage"
 )
 
-func move(src, dst string) error {
-	// Try atomic rename first (fast moving on same filesystem)
-	if err := os.Rename(src, dst); err == nil {
-		return nil
+// createParentDirs creates dir and any missing parents, like os.MkdirAll. It returns
+// the topmost directory it created ("" if dir already existed), which is the
+// node to add to the size tree once the new content is in place.
+func createParentDirs(dir string) (string, error) {
+	top := ""
+	for p := dir; ; p = filepath.Dir(p) {
+		if _, err := rootFS.Stat(p); err == nil {
+			break
+		}
+		top = p
+		if filepath.Dir(p) == p {
+			break
+		}
 	}
-
-	// Fallback: Copy file OR directory to destination
-	if err := copy.Copy(src, dst); err != nil {
-		return err
+	if top == "" {
+		return "", nil
 	}
+	return top, rootFS.MkdirAll(dir)
+}
 
-	// Remove source file OR directory after successful copy
-	return os.RemoveAll(src)
+// resolveRootPath joins a client supplied relative path onto rootPath and
+// rejects paths that would escape the root (e.g. "../..")
+func resolveRootPath(relativePath string) (string, error) {
+	return primaryMount().resolve(relativePath)
+}
+
+// cleanRelativePath normalizes a client supplied relative path to the
+// slash-separated form used in FileItem.Path ("" for the root)
+func cleanRelativePath(relativePath string) string {
+	return strings.Trim(filepath.ToSlash(filepath.Clean("/"+relativePath)), "/")
 }
 
 type DocumentData struct {
@@ -56,26 +72,59 @@ type DocumentData struct {
 }
 
 type IndexData struct {
-	WriteMode bool // Changed to WriteMode
-	RootPath  string
+	WriteMode    bool // Changed to WriteMode
+	RootPath     string
+	Roots        []RootInfo
+	UploadPolicy UploadPolicy // For client side checks, the server checks again
+	// Extensions the listing opens in the lightbox and the document viewer
+	ImageExtensions    []string
+	DocumentExtensions []string
 }
 
 // ModificationLogEntry represents a single file operation logged to JSONL
 type ModificationLogEntry struct {
 	Timestamp string   `json:"timestamp"`
-	Action    string   `json:"action"`           // delete, copy, paste
-	Sources   []string `json:"sources"`          // source file paths
-	Dest      string   `json:"dest,omitempty"`   // destination (empty for delete)
-	Errors    []string `json:"errors,omitempty"` // errors if any
+	Action    string   `json:"action"`             // delete, copy, paste, extract, compress, new_folder, upload, rename
+	Sources   []string `json:"sources"`            // source file paths
+	Dest      string   `json:"dest,omitempty"`     // destination (empty for delete)
+	DestRoot  string   `json:"destRoot,omitempty"` // root of dest, only set for copies/moves between roots
+	User      string   `json:"user,omitempty"`     // who made the change, when known (client address for uploads)
+	Errors    []string `json:"errors,omitempty"`   // errors if any
 }
 
 var modificationsLogFile string
 
-// logModification appends a file operation to modifications.jsonl
-// NEVER overwrites the file, only appends
+// logModification appends a file operation of the primary root to modifications.jsonl
 func logModification(action string, sources []string, dest string, errors []string) {
-	logFilePath := modificationsLogFile
+	primaryMount().logModification(action, sources, dest, errors)
+}
+
+func newModificationLogEntry(action string, sources []string, dest string, errors []string) ModificationLogEntry {
+	return ModificationLogEntry{
+		Timestamp: time.Now().Format(time.RFC3339),
+		Action:    action,
+		Sources:   sources,
+		Dest:      dest,
+		Errors:    errors,
+	}
+}
+
+// logTransfer logs an operation from srcMount to destMount; operations
+// between roots go to both logs
+func logTransfer(srcMount, destMount *mount, action string, sources []string, dest string, errors []string) {
+	entry := newModificationLogEntry(action, sources, dest, errors)
+	if destMount.Name != srcMount.Name {
+		entry.DestRoot = destMount.Name
+	}
+	writeModificationLog(srcMount.LogFile, entry)
+	if destMount.LogFile != srcMount.LogFile {
+		writeModificationLog(destMount.LogFile, entry)
+	}
+}
 
+// writeModificationLog appends entry to a modifications log
+// NEVER overwrites the file, only appends
+func writeModificationLog(logFilePath string, entry ModificationLogEntry) {
 	// Open file with append mode - creates if doesn't exist, never overwrites
 	f, err := os.OpenFile(logFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
@@ -84,14 +133,6 @@ func logModification(action string, sources []string, dest string, errors []stri
 	}
 	defer f.Close()
 
-	entry := ModificationLogEntry{
-		Timestamp: time.Now().Format(time.RFC3339),
-		Action:    action,
-		Sources:   sources,
-		Dest:      dest,
-		Errors:    errors,
-	}
-
 	data, err := json.Marshal(entry)
 	if err != nil {
 		log.Printf("Failed to marshal log entry: %v", err)
@@ -109,19 +150,37 @@ func handleManage(c *fiber.Ctx) error {
 	fileOpsInProgress.Add(1)
 	defer fileOpsInProgress.Done()
 
-	// Add this check at the beginning
-	if !writeMode {
-		return c.Status(403).JSON(fiber.Map{
+	// Sources are in root, dest in destRoot (default: the same root)
+	srcMount, err := requestMount(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
 			"status": "error",
-			"error":  "File operations are disabled. Use --write flag to enable write mode",
+			"error":  err.Error(),
 		})
 	}
+	destMount := srcMount
+	if name := c.Query("destRoot"); name != "" {
+		if destMount, err = mountByName(name); err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"status": "error",
+				"error":  err.Error(),
+			})
+		}
+	}
 
 	// Get parameters
 	sources := c.Query("srcs")
 	action := c.Query("action")
 	dest := c.Query("dest", "")
 
+	// Delete and move change the source root, everything but delete the destination root
+	if (action != "delete" && !destMount.WriteMode) || ((action == "delete" || action == "paste") && !srcMount.WriteMode) {
+		return c.Status(403).JSON(fiber.Map{
+			"status": "error",
+			"error":  "File operations are disabled. Use --write flag to enable write mode",
+		})
+	}
+
 	// Special handling for new_folder action
 	if action == "new_folder" {
 		folderName := c.Query("name")
@@ -141,11 +200,17 @@ func handleManage(c *fiber.Ctx) error {
 		}
 
 		// Build full path for new folder
-		destPath := filepath.Join(rootPath, dest)
+		destPath, err := destMount.resolve(dest)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"status": "error",
+				"error":  err.Error(),
+			})
+		}
 		newFolderPath := filepath.Join(destPath, folderName)
 
 		// Check if folder already exists
-		if _, err := os.Stat(newFolderPath); err == nil {
+		if _, err := rootFS.Stat(newFolderPath); err == nil {
 			return c.Status(400).JSON(fiber.Map{
 				"status": "error",
 				"error":  "A file or folder with that name already exists",
@@ -153,7 +218,7 @@ func handleManage(c *fiber.Ctx) error {
 		}
 
 		// Create the folder
-		if err := os.Mkdir(newFolderPath, 0755); err != nil {
+		if err := rootFS.Mkdir(newFolderPath); err != nil {
 			log.Printf("Error creating folder %s: %v", newFolderPath, err)
 			return c.Status(500).JSON(fiber.Map{
 				"status": "error",
@@ -162,35 +227,11 @@ func handleManage(c *fiber.Ctx) error {
 		}
 
 		// Update size tree if enabled
-		if withSizes && sizeTreeRoot != nil {
-			sizeTreeMutex.Lock()
-			// Find parent node and add new folder node
-			if parent := sizeTreeRoot.FindByPath(destPath); parent != nil {
-				newNode := &scan.FileData{
-					ID:         uuid.New().String(),
-					Name:       folderName,
-					Parent:     parent,
-					IsDir:      true,
-					IsLink:     false,
-					CachedSize: 0, // Empty folder
-					Children:   []*scan.FileData{},
-				}
-				parent.Children = append(parent.Children, newNode)
-
-				// Update bolt database incrementally (still holding sizeTreeMutex)
-				if boltDB != nil {
-					err := updateNodeInBolt(boltDB, newNode)
-					if err != nil {
-						log.Printf("Warning: Failed to update bolt db for new folder: %v", err)
-					}
-				}
-			}
-			sizeTreeMutex.Unlock()
-		}
+		sizeTreeAdd(newFolderPath)
 
 		log.Printf("Created folder: %s", newFolderPath)
 		// Log the operation
-		logModification("new_folder", nil, filepath.Join(dest, folderName), nil)
+		destMount.logModification("new_folder", nil, filepath.Join(dest, folderName), nil)
 
 		return c.JSON(fiber.Map{
 			"status": "ok",
@@ -216,20 +257,32 @@ func handleManage(c *fiber.Ctx) error {
 	}
 
 	// Validate action
-	if action != "copy" && action != "paste" && action != "delete" {
+	if action != "copy" && action != "paste" && action != "delete" && action != "extract" && action != "compress" {
 		return c.Status(400).JSON(fiber.Map{
 			"status": "error",
-			"error":  "Invalid action. Must be 'copy' or 'paste'",
+			"error":  "Invalid action. Must be one of copy, paste, delete, extract, compress or new_folder",
 		})
 	}
 
+	// Extracting and compressing run as jobs, the client polls /api/jobs/:id for progress
+	if action == "extract" {
+		return startExtract(c, srcMount, destMount, srcList, dest)
+	}
+	if action == "compress" {
+		return startCompress(c, srcMount, destMount, srcList, dest)
+	}
+
 	// Build destination path
+	destPath, err := destMount.resolve(dest)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
 	if action != "delete" {
-		// Build destination path
-		destPath := filepath.Join(rootPath, dest)
-
 		// Check if destination exists and is a directory
-		destInfo, err := os.Stat(destPath)
+		destInfo, err := rootFS.Stat(destPath)
 		if err != nil {
 			return c.Status(400).JSON(fiber.Map{
 				"status": "error",
@@ -249,10 +302,14 @@ func handleManage(c *fiber.Ctx) error {
 
 	// Process each source file
 	for _, src := range srcList {
-		srcPath := filepath.Join(rootPath, src)
+		srcPath, err := srcMount.resolve(src)
+		if err != nil {
+			errors = append(errors, err.Error())
+			continue
+		}
 
 		// Check if source exists
-		srcInfo, err := os.Stat(srcPath)
+		srcInfo, err := rootFS.Stat(srcPath)
 		if err != nil {
 			errors = append(errors, fmt.Sprintf("Failed to %s %s: source does not exist", action, src))
 			continue
@@ -262,49 +319,16 @@ func handleManage(c *fiber.Ctx) error {
 			// Handle delete operation
 			log.Printf("Would DELETE: %s", srcPath)
 
-			// Get node and size BEFORE deleting from filesystem
-			var nodeToDelete *scan.FileData
-			var sizeToSubtract int64
-			if withSizes && sizeTreeRoot != nil {
-				sizeTreeMutex.RLock()
-				nodeToDelete = sizeTreeRoot.FindByPath(srcPath)
-				if nodeToDelete != nil {
-					sizeToSubtract = nodeToDelete.Size()
-				}
-				sizeTreeMutex.RUnlock()
-			}
-
-			// Delete from filesystem (no lock held during I/O)
-			err = os.RemoveAll(srcPath) // RemoveAll works for both files and directories
+			// Delete from filesystem
+			err = rootFS.RemoveAll(srcPath) // RemoveAll works for both files and directories
 			if err != nil {
 				errors = append(errors, fmt.Sprintf("Failed to delete %s: %v", src, err))
-			} else if nodeToDelete != nil {
+			} else {
 				// Update size tree after successful delete
-				sizeTreeMutex.Lock()
-				nodeToDelete.UpdateParentSizes(-sizeToSubtract) // Subtract from parent chain
-				if nodeToDelete.Parent != nil {
-					nodeToDelete.Parent.RemoveChild(nodeToDelete)
-
-					// Update bolt database: delete node and update all parents (still holding sizeTreeMutex)
-					if boltDB != nil {
-						err := deleteNodeIDInBolt(boltDB, nodeToDelete.ID)
-						if err != nil {
-							log.Printf("Warning: Failed to delete from bolt db: %v", err)
-						}
-						// Update all parents in bolt
-						for p := nodeToDelete.Parent; p != nil; p = p.Parent {
-							err := updateNodeInBolt(boltDB, p)
-							if err != nil {
-								log.Printf("Warning: Failed to update parent in bolt db: %v", err)
-							}
-						}
-					}
-				}
-				sizeTreeMutex.Unlock()
+				sizeTreeRemove(srcPath, srcInfo.IsDir())
 			}
 		} else {
 			// Handle copy/paste operations (existing code)
-			destPath := filepath.Join(rootPath, dest)
 			baseName := filepath.Base(srcPath)
 			targetPath := filepath.Join(destPath, baseName)
 
@@ -313,182 +337,30 @@ func handleManage(c *fiber.Ctx) error {
 				// Handle directory
 				if action == "copy" {
 					log.Printf("Would COPY DIR: %s -> %s", srcPath, targetPath)
-					err = copy.Copy(srcPath, targetPath)
+					err = storage.Copy(rootFS, srcPath, targetPath)
 				} else { // paste (move)
 					log.Printf("Would MOVE DIR: %s -> %s", srcPath, targetPath)
-					err = move(srcPath, targetPath)
+					err = storage.Move(rootFS, srcPath, targetPath)
 				}
 			} else {
 				// Handle file
 				if action == "copy" {
 					log.Printf("Would COPY FILE: %s -> %s", srcPath, targetPath)
-					err = copy.Copy(srcPath, targetPath)
+					err = storage.Copy(rootFS, srcPath, targetPath)
 				} else { // paste (move)
 					log.Printf("Would MOVE FILE: %s -> %s", srcPath, targetPath)
-					err = move(srcPath, targetPath)
+					err = storage.Move(rootFS, srcPath, targetPath)
 				}
 			}
 
 			if err != nil {
 				errors = append(errors, fmt.Sprintf("Failed to %s %s to %s: %v", action, src, dest, err))
-			} else if withSizes && sizeTreeRoot != nil {
-				// Update size tree after successful operation
-				// IMPORTANT: Must hold lock during size calculation to prevent races
-				sizeTreeMutex.Lock()
-				if action == "copy" {
-					// Handle copy updates: add new node to tree and DB
-					newInfo, statErr := os.Stat(targetPath)
-					if statErr == nil {
-						parentPath := filepath.Dir(targetPath)
-						parent := sizeTreeRoot.FindByPath(parentPath)
-
-						if parent != nil {
-							var newNode *scan.FileData
-							if newInfo.IsDir() {
-								// Scan the new directory to build subtree
-								children, err := scan.ScanDirConcurrent(targetPath, 0, nil)
-								if err != nil {
-									log.Printf("Warning: Failed to scan new copy: %v", err)
-									// Create empty placeholder if scan fails
-									children = []*scan.FileData{}
-								}
-
-								newNode = &scan.FileData{
-									ID:         uuid.New().String(),
-									Name:       newInfo.Name(),
-									Parent:     parent,
-									IsDir:      true,
-									Children:   children,
-									CachedSize: -1, // Force recalc
-								}
-								// Fix parent pointers for children
-								for _, child := range children {
-									child.RebuildParentPointers(newNode)
-								}
-							} else {
-								// File
-								newNode = &scan.FileData{
-									ID:         uuid.New().String(),
-									Name:       newInfo.Name(),
-									Parent:     parent,
-									IsDir:      false,
-									CachedSize: newInfo.Size(),
-								}
-							}
-
-							// Compute size (recursively for dirs)
-							sizeToAdd := newNode.Size()
-
-							// Add to parent
-							parent.Children = append(parent.Children, newNode)
-							parent.UpdateParentSizes(sizeToAdd)
-
-							// Update BoltDB
-							if boltDB != nil {
-								// Update all parents first
-								for p := parent; p != nil; p = p.Parent {
-									// Best effort
-									updateNodeInBolt(boltDB, p)
-								}
-
-								// Save new subtree
-								err := boltDB.Update(func(tx *bolt.Tx) error {
-									bucket := tx.Bucket([]byte("sizes"))
-									var saveRec func(*scan.FileData) error
-									saveRec = func(n *scan.FileData) error {
-										if err := saveNodeToBolt(bucket, n); err != nil {
-											return err
-										}
-										for _, c := range n.Children {
-											if err := saveRec(c); err != nil {
-												return err
-											}
-										}
-										return nil
-									}
-									return saveRec(newNode)
-								})
-								if err != nil {
-									log.Printf("Warning: Failed to save new copy to bolt db: %v", err)
-								}
-							}
-						}
-					}
-				} else { // paste (move)
-					// For move, subtract from old parent and add to new parent
-					if oldNode := sizeTreeRoot.FindByPath(srcPath); oldNode != nil {
-						size := oldNode.Size()
-						oldParent := oldNode.Parent
-
-						// Remove from old location
-						oldNode.UpdateParentSizes(-size)
-						if oldNode.Parent != nil {
-							oldNode.Parent.RemoveChild(oldNode)
-						}
-
-						// Add to new location
-						newParentPath := filepath.Dir(targetPath)
-						if newParent := sizeTreeRoot.FindByPath(newParentPath); newParent != nil {
-							// Update Structure (O(1) in graph)
-							oldNode.Parent = newParent
-							// Update Name (in case it was a move-rename, though purely move keeps name)
-							// But wait, 'paste' targetPath includes the name.
-							// If srcPath=/a/b, targetPath=/x/y/b. Name is same.
-							// The 'move' function does the FS move.
-
-							newParent.Children = append(newParent.Children, oldNode)
-							oldNode.UpdateParentSizes(size)
-							// Dir update not needed anymore as path is dynamic!
-
-							// Update bolt database:
-							// 1. Remove from old parent (implied by graph structure change? No, we store relations.)
-							// Actually, Bolt stores Node -> ParentID.
-							// So we just need to save the MOVED NODE (it has new ParentID).
-							// And we need to save the OLD PARENT (now has fewer children) - wait, children list is in parent?
-							// scan/storage.go: StoredFileData has `ChildIDs []string`.
-							// So we MUST save: OldParent, NewParent, and Node.
-
-							if boltDB != nil {
-								// Update Old Parent (to remove child ID)
-								if oldParent != nil {
-									err := updateNodeInBolt(boltDB, oldParent)
-									if err != nil {
-										log.Printf("Warning: Failed to update old parent in bolt: %v", err)
-									}
-								}
-								// Update New Parent (to add child ID)
-								err := updateNodeInBolt(boltDB, newParent)
-								if err != nil {
-									log.Printf("Warning: Failed to update new parent in bolt: %v", err)
-								}
-								// Update Node (to update ParentID)
-								err = updateNodeInBolt(boltDB, oldNode)
-								if err != nil {
-									log.Printf("Warning: Failed to update moved node in bolt: %v", err)
-								}
-
-								// Update cumulative sizes up the tree?
-								// Sizes are stored in nodes. We updated in-memory sizes.
-								// So we should save the ancestry to persist size changes?
-								// Technically yes, if we want size persistence.
-								// Update old parent chain
-								for p := oldParent; p != nil; p = p.Parent {
-									// Best effort, skip if already saved above (oldParent)
-									if p != oldParent {
-										updateNodeInBolt(boltDB, p)
-									}
-								}
-								// Update new parent chain
-								for p := newParent; p != nil; p = p.Parent {
-									if p != newParent {
-										updateNodeInBolt(boltDB, p)
-									}
-								}
-							}
-						}
-					}
-				}
-				sizeTreeMutex.Unlock()
+			} else if action == "copy" {
+				// Update size tree after successful operation: add new node to tree and DB
+				sizeTreeAdd(targetPath)
+			} else { // paste (move)
+				// For move, subtract from old parent and add to new parent
+				sizeTreeMove(srcPath, targetPath, srcInfo.IsDir())
 			}
 		}
 	}
@@ -501,7 +373,7 @@ func handleManage(c *fiber.Ctx) error {
 	}
 
 	// Log the operation to modifications.jsonl
-	logModification(action, srcList, dest, errors)
+	logTransfer(srcMount, destMount, action, srcList, dest, errors)
 
 	// Return response
 	if len(errors) > 0 {
@@ -518,25 +390,36 @@ func handleManage(c *fiber.Ctx) error {
 
 type FileItem struct {
 	Name      string `json:"name"`
-	Path      string `json:"path"`      // Relative path for navigation/actions
-	IsDir     bool   `json:"isDir"`     // Whether this is a directory
-	Size      int64  `json:"size"`      // -1 when --with-sizes not used
-	Modified  int64  `json:"modified"`  // Modification time
-	SizeStale bool   `json:"sizeStale"` // True if size data may be invalid
+	Path      string `json:"path"`                // Relative path for navigation/actions
+	IsDir     bool   `json:"isDir"`               // Whether this is a directory
+	Size      int64  `json:"size"`                // -1 when --with-sizes not used
+	Modified  int64  `json:"modified"`            // Modification time
+	SizeStale bool   `json:"sizeStale"`           // True if size data may be invalid
+	Archive   bool   `json:"archive,omitempty"`   // Zip or tar file that can be browsed like a folder
+	Kind      string `json:"kind,omitempty"`      // folder, image, document, video, audio, text or file (see fileKind)
+	Thumbnail string `json:"thumbnail,omitempty"` // URL of a scaled down version, for images
+	Taken     int64  `json:"taken,omitempty"`     // When a photo or video was taken, only when sorting by it
 }
 
 type WSMessage struct {
 	RequestID int        `json:"requestId"`
 	Items     []FileItem `json:"items"`
+	Error     string     `json:"error,omitempty"`
 }
 
 type WSRequest struct {
-	Path      string `json:"path"`
-	RequestID int    `json:"requestId"`
-	SortBy    string `json:"sortBy"`
-	Dir       string `json:"dir"`
+	Type      string         `json:"type"` // "" or "list" for listings, "search" for filename search, "subscribe"/"unsubscribe" for change events
+	Root      string         `json:"root"` // Named root, "" for the primary one
+	Path      string         `json:"path"`
+	RequestID int            `json:"requestId"`
+	SortBy    string         `json:"sortBy"`
+	Dir       string         `json:"dir"`
+	Search    *SearchOptions `json:"search,omitempty"` // Only for type "search"
 }
 
+// Number of items sent per websocket message
+const wsChunkSize = 10
+
 func handleDocument(c *fiber.Ctx) error {
 	// Check if office docs are enabled
 	if libreOfficeAppPath == "" {
@@ -556,10 +439,14 @@ func handleDocument(c *fiber.Ctx) error {
 	}
 
 	// Concatenate with root path to get full file path
-	fullDocPath := filepath.Join(rootPath, decodedDocPath)
+	fullDocPath, err := resolveRequestPath(c, decodedDocPath)
+	if err != nil {
+		return c.Status(400).SendString(err.Error())
+	}
 
 	// Check if file exists
-	if _, err := os.Stat(fullDocPath); os.IsNotExist(err) {
+	info, err := rootFS.Stat(fullDocPath)
+	if err != nil {
 		return c.Status(404).SendString("File not found: " + decodedDocPath)
 	}
 
@@ -569,8 +456,14 @@ func handleDocument(c *fiber.Ctx) error {
 		return c.Status(500).SendString("Template error: " + err.Error())
 	}
 
-	// Convert document to HTML using LibreOffice
-	htmlContent, err := convertDocumentToHTML(fullDocPath)
+	// Convert document to HTML using LibreOffice, or take it from the cache
+	htmlContent, err := convertDocument(fullDocPath, info)
+	if errors.Is(err, errDocTimeout) {
+		return c.Status(504).SendString("Document conversion failed: " + err.Error())
+	}
+	if errors.Is(err, errDocNotOffice) {
+		return c.Status(415).SendString("Document conversion failed: " + err.Error())
+	}
 	if err != nil {
 		return c.Status(500).SendString("Document conversion failed: " + err.Error())
 	}
@@ -587,59 +480,6 @@ func handleDocument(c *fiber.Ctx) error {
 	return tmpl.Execute(c.Response().BodyWriter(), data)
 }
 
-func convertDocumentToHTML(docPath string) (string, error) {
-	// Create temporary directory for output
-	tempDir, err := ioutil.TempDir("", "libreoffice_convert_")
-	if err != nil {
-		return "", fmt.Errorf("failed to create temp directory: %v", err)
-	}
-	defer os.RemoveAll(tempDir) // Clean up temp directory
-
-	// Determine the file extension to choose appropriate filter
-	ext := strings.ToLower(filepath.Ext(docPath))
-	var convertFilter string
-
-	switch ext {
-	case ".docx", ".doc", ".odt", ".rtf":
-		convertFilter = "html:XHTML Writer File:BodyOnly,EmbedImages"
-	case ".xlsx", ".xls", ".ods":
-		convertFilter = "html:HTML (StarCalc):EmbedImages:BodyOnly"
-	case ".pptx", ".ppt", ".odp":
-		convertFilter = "html:HTML (Impress):EmbedImages:BodyOnly"
-	default:
-		return "", fmt.Errorf("unsupported file format: %s", ext)
-	}
-
-	// Prepare LibreOffice command
-	cmd := exec.Command(
-		libreOfficeAppPath,
-		"--headless",
-		"--convert-to", convertFilter,
-		"--outdir", tempDir,
-		docPath,
-	)
-
-	// Execute the conversion
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return "", fmt.Errorf("LibreOffice conversion failed: %v, output: %s", err, string(output))
-	}
-
-	// Determine the output HTML filename
-	baseName := filepath.Base(docPath)
-	nameWithoutExt := strings.TrimSuffix(baseName, filepath.Ext(baseName))
-	htmlFileName := nameWithoutExt + ".html"
-	htmlFilePath := filepath.Join(tempDir, htmlFileName)
-
-	// Read the generated HTML file
-	htmlContent, err := ioutil.ReadFile(htmlFilePath)
-	if err != nil {
-		return "", fmt.Errorf("failed to read converted HTML file: %v", err)
-	}
-
-	return string(htmlContent), nil
-}
-
 var (
 	rootPath           string
 	libreOfficeAppPath string
@@ -658,13 +498,16 @@ var (
 )
 
 func setupTusUpload(app *fiber.App) {
-	if !writeMode {
+	writable := false
+	for _, m := range allMounts() {
+		writable = writable || m.WriteMode
+	}
+	if !writable {
 		log.Println("Upload disabled: not in write mode")
 		return
 	}
 
 	// Check uploads directory
-	uploadsDir := "./uploads"
 	info, err := os.Stat(uploadsDir)
 	if err == nil {
 		// Directory exists
@@ -675,7 +518,7 @@ func setupTusUpload(app *fiber.App) {
 		log.Printf("Uploads directory already exists: %s", uploadsDir)
 	} else if os.IsNotExist(err) {
 		// Directory doesn't exist, create it
-		if err := os.Mkdir(uploadsDir, 0755); err != nil {
+		if err := os.MkdirAll(uploadsDir, 0755); err != nil {
 			log.Printf("Failed to create uploads directory: %s", err)
 			return
 		}
@@ -695,9 +538,13 @@ func setupTusUpload(app *fiber.App) {
 
 	// Create config
 	config := handler.Config{
-		StoreComposer:         composer,
-		NotifyCompleteUploads: true,
-		BasePath:              "/upload/tus/",
+		StoreComposer: composer,
+		BasePath:      "/upload/tus/",
+		MaxSize:       uploadPolicy.MaxFileSize,
+		// Bad destinations fail before any data is sent, and the
+		// result of moving the file into place goes back to the client
+		PreUploadCreateCallback:   checkUploadCreate,
+		PreFinishResponseCallback: finishUpload,
 	}
 
 	// Create handler
@@ -708,39 +555,31 @@ func setupTusUpload(app *fiber.App) {
 	}
 	log.Println("TUS upload handler initialized successfully")
 
-	// Handle completed uploads
-	go func() {
-		for event := range tusHandler.CompleteUploads {
-			fileOpsInProgress.Add(1)
-			func() {
-				defer fileOpsInProgress.Done()
-
-				info := event.Upload
-				targetPath := info.MetaData["relativePath"]
-				filename := info.MetaData["filename"]
-
-				log.Printf("Upload completed - ID: %s, Filename: %s, TargetPath: %s", event.Upload.ID, filename, targetPath)
-
-				tempFile := filepath.Join(uploadsDir, event.Upload.ID)
-				finalPath := filepath.Join(rootPath, targetPath, filename)
-				log.Printf("Moving from %s to %s", tempFile, finalPath)
-
-				os.MkdirAll(filepath.Dir(finalPath), 0755)
-				move(tempFile, finalPath)
-				log.Printf("Successfully moved uploaded file to %s", finalPath)
-			}()
-		}
-	}()
-
 	// Mount using the bridge pattern - no manual conversion needed!
 	prefix := "/upload/tus/"
-	group := app.Group(prefix, adaptor.HTTPMiddleware(tusHandler.Middleware))
+	group := app.Group(prefix, tusExpiration, tusChecksum, adaptor.HTTPMiddleware(tusHandler.Middleware))
 
 	group.Post("", adaptor.HTTPHandlerFunc(tusHandler.PostFile))
 	group.Head(":id", adaptor.HTTPHandlerFunc(tusHandler.HeadFile))
 	group.Patch(":id", adaptor.HTTPHandlerFunc(tusHandler.PatchFile))
 	group.Get(":id", adaptor.HTTPHandlerFunc(tusHandler.GetFile))
 	group.Delete(":id", adaptor.HTTPHandlerFunc(tusHandler.DelFile))
+
+	// Folder uploads: one batch groups the uploads of all files
+	app.Post("/upload/batches", handleCreateUploadBatch)
+	app.Post("/upload/batches/:id/finish", handleFinishUploadBatch)
+
+	admin := app.Group("/admin/uploads", requireLocalAdmin)
+	admin.Get("", handleListUploads)
+	admin.Delete("/:id", handleAbortUpload)
+
+	// Unfinished uploads expire when no data arrives for a while
+	go func() {
+		for {
+			sweepUploads()
+			time.Sleep(uploadSweepInterval)
+		}
+	}()
 }
 
 // loadSizeTree loads the size tree from a JSON file
@@ -832,27 +671,19 @@ func deleteNodeFromBolt(bucket *bolt.Bucket, id string) error {
 // updateNodeInBolt updates a single node in the database
 func updateNodeInBolt(db *bolt.DB, node *scan.FileData) error {
 	return db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("sizes"))
+		bucket := tx.Bucket(sizesBucketOf(node))
 		return saveNodeToBolt(bucket, node)
 	})
 }
 
-// deleteNodeIDInBolt deletes a node by ID from the database
-func deleteNodeIDInBolt(db *bolt.DB, id string) error {
-	return db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("sizes"))
-		return deleteNodeFromBolt(bucket, id)
-	})
-}
-
-// loadSizeTreeFromBolt loads the entire size tree from bolt database
-func loadSizeTreeFromBolt(db *bolt.DB, rootPath string) (*scan.FileData, error) {
+// loadSizeTreeFromBolt loads the entire size tree of a root from its bucket
+func loadSizeTreeFromBolt(db *bolt.DB, bucketName, rootPath string) (*scan.FileData, error) {
 	storedNodes := make(map[string]*scan.StoredFileData)
 
 	err := db.View(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("sizes"))
+		bucket := tx.Bucket([]byte(bucketName))
 		if bucket == nil {
-			return fmt.Errorf("sizes bucket not found")
+			return fmt.Errorf("%s bucket not found", bucketName)
 		}
 
 		return bucket.ForEach(func(k, v []byte) error {
@@ -872,8 +703,8 @@ func loadSizeTreeFromBolt(db *bolt.DB, rootPath string) (*scan.FileData, error)
 	return scan.LoadTreeFromStored(storedNodes, rootPath)
 }
 
-// saveSizeTreeToBolt saves the entire size tree to bolt database
-func saveSizeTreeToBolt(db *bolt.DB, root *scan.FileData) error {
+// saveSizeTreeToBolt saves the entire size tree to a bucket of the bolt database
+func saveSizeTreeToBolt(db *bolt.DB, bucketName string, root *scan.FileData) error {
 	// 1. Flatten the tree first
 	log.Println("=== OPTIMIZED SAVE: Flattening size tree... ===")
 	nodes := make([]*scan.FileData, 0, 100000) // Pre-allocate decent size
@@ -899,7 +730,10 @@ func saveSizeTreeToBolt(db *bolt.DB, root *scan.FileData) error {
 
 	// 3. Save all in one transaction (User preference: no batching)
 	return db.Update(func(tx *bolt.Tx) error {
-		bucket := tx.Bucket([]byte("sizes"))
+		bucket, err := tx.CreateBucketIfNotExists([]byte(bucketName))
+		if err != nil {
+			return err
+		}
 
 		// Fill Percent can be optimized for sequential writes if needed,
 		// but default behavior with sorted keys is already append-like.
@@ -916,33 +750,43 @@ func saveSizeTreeToBolt(db *bolt.DB, root *scan.FileData) error {
 
 // buildSizeTree scans the directory tree and builds the size tree
 func buildSizeTree(rootPath string) error {
+	root, err := scanSizeTree(rootPath)
+	if err != nil {
+		return err
+	}
+	sizeTreeRoot = root
+	return nil
+}
+
+// scanSizeTree scans a root and returns its size tree
+func scanSizeTree(rootPath string) (*scan.FileData, error) {
 	// Create and start progress spinner
 	spinner := scan.NewProgressSpinner()
 
 	// Scan the directory tree
-	children, err := scan.ScanDirConcurrent(rootPath, 0, spinner)
+	children, err := scan.ScanFSConcurrent(rootFS, rootPath, 0, spinner)
 
 	// Stop spinner regardless of error
 	spinner.Stop()
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Create root node with children
-	sizeTreeRoot = &scan.FileData{
+	root := &scan.FileData{
 		ID:       uuid.New().String(),
 		Name:     filepath.Base(rootPath),
 		RootPath: rootPath,
 		IsDir:    true,
 	}
-	sizeTreeRoot.Children = children
+	root.Children = children
 
 	// Compute all sizes eagerly by calling Size() on root
 	// This recursively computes and caches sizes for all nodes
-	sizeTreeRoot.Size()
+	root.Size()
 
-	return nil
+	return root, nil
 }
 
 func main() {
@@ -950,20 +794,63 @@ func main() {
 	var showVersion bool
 	var port string
 	flag.BoolVar(&showVersion, "version", false, "Show version information and exit")
-	flag.StringVar(&rootPath, "path", ".", "Root path to serve files from")
+	flag.StringVar(&rootPath, "path", ".", "Root path to serve files from (local directory or s3://bucket/prefix)")
+	flag.StringVar(&storageEndpoint, "storage-endpoint", "", "S3 endpoint for s3:// paths, e.g. http://localhost:9000 for MinIO (default: AWS)")
+	flag.StringVar(&storageRegion, "storage-region", "", "S3 region for s3:// paths (default: $AWS_REGION or us-east-1)")
 	flag.StringVar(&libreOfficeAppPath, "libreoffice", "", "Path to LibreOffice AppImage executable (optional - enables office document viewing)")
 	flag.BoolVar(&writeMode, "write", false, "Enable write mode (allows file operations)")
 	flag.BoolVar(&withSizes, "with-sizes", false, "Compute and display cumulative directory sizes")
 	flag.StringVar(&sizesFile, "sizes", "", "JSON file for size tree (loads if exists, saves on exit)")
 	flag.StringVar(&sizesDb, "sizes-db", "", "bbolt database for size tree (loads if exists, saves incrementally)")
 	flag.StringVar(&modificationsLogFile, "modifications-log", "", "Path to modifications log file (REQUIRED)")
+	flag.StringVar(&indexDbPath, "index-db", "", "bbolt database for the full-text content index (optional - enables content search)")
 	flag.StringVar(&port, "port", "8080", "Port to listen on (default 8080)")
+	flag.StringVar(&webdavPort, "webdav-port", "", "Port for the WebDAV server (optional - serves the root over WebDAV)")
+	flag.StringVar(&s3Port, "s3-port", "", "Port for the S3-compatible gateway (optional - top-level folders become buckets)")
+	flag.StringVar(&sftpPort, "sftp-port", "", "Port for the SFTP server (optional)")
+	flag.StringVar(&sftpHostKeyFile, "sftp-host-key", "sftp_host_key", "SFTP host key file (generated if missing)")
+	flag.StringVar(&accessKeysFile, "access-keys", defaultAccessKeysFile, "JSON file with the access keys for S3 and SFTP")
+	flag.StringVar(&s3KeysFile, "s3-keys", "", "Deprecated name of --access-keys")
+	flag.StringVar(&adminToken, "admin-token", "", "Token admin endpoints require as \"Authorization: Bearer <token>\" (optional; they are localhost only either way)")
+	flag.StringVar(&mountsFile, "mounts", "", "JSON file with more named roots to serve next to --path (optional)")
+	flag.StringVar(&rootName, "root-name", "", "Name of the --path root in the root switcher (default: its base name)")
+	flag.StringVar(&uploadsDir, "uploads-dir", "", "Directory for unfinished uploads (default: uploads next to --modifications-log)")
+	flag.DurationVar(&uploadExpiry, "upload-expiry", 24*time.Hour, "Remove unfinished uploads (tus and S3 multipart) after this long without new data")
+	flag.StringVar(&cacheControl, "cache-control", cacheControl, "Cache-Control header for files and images (empty to leave it out)")
+	flag.StringVar(&thumbnailDir, "thumbnail-cache", "", "Directory for cached thumbnails (default: thumbnails next to --modifications-log)")
+	flag.Int64Var(&thumbnailCacheMB, "thumbnail-cache-mb", 1024, "Size of the thumbnail cache in MB; least recently used thumbnails are removed beyond it")
+	flag.IntVar(&thumbnailWorkers, "thumbnail-workers", 2, "How many thumbnails are made at the same time (each can take a few hundred MB for large photos)")
+	flag.StringVar(&docCacheDir, "doc-cache", "", "Directory for converted office documents (default: doc-cache next to --modifications-log)")
+	flag.Int64Var(&docCacheMB, "doc-cache-mb", 1024, "Size of the document cache in MB; least recently used documents are removed beyond it")
+	flag.IntVar(&docWorkers, "doc-workers", 2, "How many LibreOffice conversions run at the same time")
+	flag.DurationVar(&docTimeout, "doc-timeout", 2*time.Minute, "Kill LibreOffice conversions that take longer than this")
+	flag.StringVar(&docPrewarm, "doc-prewarm", "", "Comma separated folders below --path whose office documents are converted at startup (optional)")
+	flag.StringVar(&mimeTypesFile, "mime-types", "", "JSON file mapping extensions to MIME types, e.g. {\".raw\": \"image/x-raw\"} (optional - overrides the system tables)")
+	flag.StringVar(&uploadPolicyFile, "upload-policy", "", "JSON file with upload limits: max file size, quotas, allowed/denied types (optional)")
 	flag.Parse()
+	accessKeysSet := false
+	flag.Visit(func(f *flag.Flag) { accessKeysSet = accessKeysSet || f.Name == "access-keys" })
+	resolveAccessKeysFile(accessKeysSet)
 
 	if modificationsLogFile == "" {
 		log.Fatal("Error: --modifications-log is required. Please specify a path for the modification log file.")
 	}
 
+	// Unfinished tus uploads and S3 multipart parts, not relative to the working directory
+	if uploadsDir == "" {
+		uploadsDir = filepath.Join(filepath.Dir(modificationsLogFile), "uploads")
+	}
+	if abs, err := filepath.Abs(uploadsDir); err == nil {
+		uploadsDir = abs
+	}
+	s3MultipartDir = filepath.Join(uploadsDir, s3MultipartDirName)
+	if thumbnailDir == "" {
+		thumbnailDir = filepath.Join(filepath.Dir(modificationsLogFile), "thumbnails")
+	}
+	if docCacheDir == "" {
+		docCacheDir = filepath.Join(filepath.Dir(modificationsLogFile), "doc-cache")
+	}
+
 	// Validate mutually exclusive flags
 	if withSizes && sizesFile != "" {
 		log.Fatal("Error: --with-sizes and --sizes are mutually exclusive")
@@ -998,12 +885,12 @@ func main() {
 		log.Printf("LibreOffice path: (not set - office document viewing disabled)")
 	}
 
-	// Convert to absolute path
-	absPath, err := filepath.Abs(rootPath)
+	// Local directory (converted to an absolute path) or s3:// URL
+	fsys, absPath, err := openRootStorage(rootPath)
 	if err != nil {
-		log.Fatal("Invalid root path:", err)
+		log.Fatal("Invalid root path: ", err)
 	}
-	rootPath = absPath
+	rootFS, rootPath = fsys, absPath
 
 	log.Printf("Serving files from: %s", rootPath)
 
@@ -1019,7 +906,7 @@ func main() {
 
 		// Try to load existing tree from database
 		log.Println("Loading size tree from bbolt database...")
-		loadedRoot, err := loadSizeTreeFromBolt(boltDB, rootPath)
+		loadedRoot, err := loadSizeTreeFromBolt(boltDB, "sizes", rootPath)
 		if err != nil || loadedRoot == nil {
 			// Database might be empty on first run
 			if err != nil {
@@ -1035,7 +922,7 @@ func main() {
 			} else {
 				// Save initial tree to database
 				log.Println("Saving initial size tree to database...")
-				err = saveSizeTreeToBolt(boltDB, sizeTreeRoot)
+				err = saveSizeTreeToBolt(boltDB, "sizes", sizeTreeRoot)
 				if err != nil {
 					log.Printf("Warning: Failed to save to database: %v", err)
 				}
@@ -1082,6 +969,41 @@ func main() {
 		}
 	}
 
+	// More named roots from --mounts
+	if err := setupMounts(); err != nil {
+		log.Fatalf("Failed to set up roots: %v", err)
+	}
+
+	if uploadPolicyFile != "" {
+		if uploadPolicy, err = loadUploadPolicy(uploadPolicyFile); err != nil {
+			log.Fatalf("Failed to load upload policy: %v", err)
+		}
+		log.Printf("Upload policy loaded from %s", uploadPolicyFile)
+	}
+	if mimeTypesFile != "" {
+		if mimeOverrides, err = loadMimeOverrides(mimeTypesFile); err != nil {
+			log.Fatalf("Failed to load MIME types: %v", err)
+		}
+		log.Printf("%d MIME type overrides loaded from %s", len(mimeOverrides), mimeTypesFile)
+	}
+	if err := setupThumbnails(); err != nil {
+		log.Fatalf("Failed to set up the thumbnail cache: %v", err)
+	}
+	if libreOfficeAppPath != "" {
+		if err := setupDocumentCache(); err != nil {
+			log.Fatalf("Failed to set up the document cache: %v", err)
+		}
+		prewarmFromFlag()
+	}
+
+	// Push directory changes to subscribed websocket clients
+	startLiveChanges()
+
+	// Open the content index (builds/refreshes in the background)
+	if err := setupContentIndex(); err != nil {
+		log.Printf("Warning: Content search disabled: %v", err)
+	}
+
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
@@ -1098,6 +1020,7 @@ func main() {
 
 	// Your existing server setup code here...
 	app.Get("/doc_viewer", handleDocument)
+	app.Post("/admin/documents/prewarm", requireLocalAdmin, handlePrewarmDocuments)
 
 	// Serve the main HTML file at root
 	app.Get("/", func(c *fiber.Ctx) error {
@@ -1107,8 +1030,15 @@ func main() {
 		}
 
 		data := IndexData{
-			WriteMode: writeMode, // Pass writeMode
-			RootPath:  rootPath,
+			WriteMode:    writeMode, // Pass writeMode
+			RootPath:     rootPath,
+			UploadPolicy: uploadPolicy,
+
+			ImageExtensions:    extensionsOfKind("image"),
+			DocumentExtensions: extensionsOfKind("document"),
+		}
+		for _, m := range allMounts() {
+			data.Roots = append(data.Roots, m.info())
 		}
 
 		c.Set("Content-Type", "text/html")
@@ -1117,12 +1047,14 @@ func main() {
 
 	// Image streaming route - now uses query parameter
 	app.Get("/image", handleImageStream)
+	app.Get("/thumbnail", handleThumbnail)
 
 	// File streaming route - now uses query parameter
 	app.Get("/file", handleFileStream)
 
 	// Zip download route - streams folder as zip
 	app.Get("/zip", handleZipDownload)
+	app.Get("/zip/estimate", handleZipEstimate)
 
 	// Rename route - renames file or folder
 	app.Post("/rename", handleRename)
@@ -1130,6 +1062,24 @@ func main() {
 	//
 	app.Get("/manage", handleManage)
 
+	// Filename search across the whole tree (NDJSON stream)
+	app.Get("/search", handleSearch)
+
+	// Full-text content search (requires --index-db)
+	app.Get("/search/content", handleContentSearch)
+
+	// Most recently modified files (from the size tree)
+	app.Get("/recent", handleRecent)
+
+	// Plain HTTP JSON listing API and its OpenAPI description
+	app.Get("/api/files", handleAPIList)
+	app.Get("/api/roots", handleRoots)
+	app.Get("/api/metadata", handleMetadata)
+	app.Get("/api/jobs", handleJobs)
+	app.Get("/api/jobs/:id", handleJob)
+	app.Delete("/api/jobs/:id", handleCancelJob)
+	app.Get("/openapi.json", handleOpenAPI)
+
 	// WebSocket upgrade middleware
 	app.Use("/files", func(c *fiber.Ctx) error {
 		if websocket.IsWebSocketUpgrade(c) {
@@ -1140,6 +1090,9 @@ func main() {
 	})
 
 	setupTusUpload(app)
+	setupAccessKeys(app)
+	setupS3()
+	setupSFTP()
 	// WebSocket handler
 	app.Get("/files", websocket.New(handleWebSocket))
 
@@ -1147,6 +1100,9 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 
+	// WebDAV runs on its own port
+	startWebDAV()
+
 	// Start server in goroutine
 	go func() {
 		log.Printf("Server starting on :%s\n", port)
@@ -1174,11 +1130,18 @@ func main() {
 		}
 	}
 
+	// Close content index if open
+	if contentIndex != nil {
+		if err := contentIndex.Close(); err != nil {
+			log.Printf("Error closing content index: %v", err)
+		}
+	}
+
 	// Save size tree to JSON if using --sizes flag
 	if sizeTreeRoot != nil && withSizes && boltDB == nil && sizesFile != "" {
 		saveFile := sizesFile
-		// If it's a relative path, make it relative to rootPath
-		if !filepath.IsAbs(saveFile) {
+		// If it's a relative path, make it relative to rootPath (when that's on this disk)
+		if _, local := storage.LocalPath(rootFS, rootPath); !filepath.IsAbs(saveFile) && local {
 			saveFile = filepath.Join(rootPath, saveFile)
 		}
 
@@ -1212,10 +1175,13 @@ func handleImageStream(c *fiber.Ctx) error {
 	log.Printf("Image request for path: %s", decodedPath)
 
 	// Construct full path using decoded path
-	fullPath := filepath.Join(rootPath, decodedPath)
+	fullPath, err := resolveRequestPath(c, decodedPath)
+	if err != nil {
+		return c.Status(400).SendString(err.Error())
+	}
 
-	// Check if file exists
-	info, err := os.Stat(fullPath)
+	// Check if file exists (possibly inside an archive)
+	info, err := statPath(fullPath)
 	if err != nil {
 		log.Printf("Image file does not exist: %s", fullPath)
 		return c.Status(404).SendString("Image not found")
@@ -1226,18 +1192,15 @@ func handleImageStream(c *fiber.Ctx) error {
 		return c.Status(400).SendString("Path is a directory, not a file")
 	}
 
-	// Check if it's an image file
-	ext := strings.ToLower(filepath.Ext(fullPath))
-	if !isImageFile(ext) {
+	// Check if it's an image the browser can show (by content if the name doesn't tell)
+	contentType := contentTypeOf(fullPath, info)
+	if fileKind(contentType) != "image" {
 		return c.Status(400).SendString("File is not a supported image format")
 	}
-
-	// Set appropriate content type
-	contentType := getImageContentType(ext)
-	c.Set("Content-Type", contentType)
+	setContentType(c, contentType)
 
 	// Stream the file
-	return c.SendFile(fullPath)
+	return sendStoredFile(c, fullPath, info)
 }
 
 func handleFileStream(c *fiber.Ctx) error {
@@ -1257,10 +1220,13 @@ func handleFileStream(c *fiber.Ctx) error {
 	log.Printf("File request for path: %s", decodedPath)
 
 	// Construct full path using decoded path
-	fullPath := filepath.Join(rootPath, decodedPath)
+	fullPath, err := resolveRequestPath(c, decodedPath)
+	if err != nil {
+		return c.Status(400).SendString(err.Error())
+	}
 
-	// Check if file exists
-	info, err := os.Stat(fullPath)
+	// Check if file exists (possibly inside an archive)
+	info, err := statPath(fullPath)
 	if err != nil {
 		log.Printf("File does not exist: %s", fullPath)
 		return c.Status(404).SendString("File not found")
@@ -1272,131 +1238,230 @@ func handleFileStream(c *fiber.Ctx) error {
 	}
 
 	// Set appropriate content type
-	ext := strings.ToLower(filepath.Ext(fullPath))
-	contentType := getFileContentType(ext)
-	c.Set("Content-Type", contentType)
+	contentType := contentTypeOf(fullPath, info)
+	setContentType(c, contentType)
 
 	// Set Content-Disposition header for documents to suggest download
-	if isDocumentFile(ext) {
-		filename := filepath.Base(fullPath)
-		c.Set("Content-Disposition", "inline; filename=\""+filename+"\"")
+	if fileKind(contentType) == "document" {
+		c.Set("Content-Disposition", contentDisposition("inline", filepath.Base(fullPath)))
 	}
 
 	// Stream the file
-	return c.SendFile(fullPath)
+	return sendStoredFile(c, fullPath, info)
 }
 
-func handleZipDownload(c *fiber.Ctx) error {
-	// Get the path from query parameter
-	relativePath := c.Query("path")
-	if relativePath == "" {
-		return c.Status(400).SendString("Path parameter required")
-	}
-
-	// Explicitly URL decode the path
-	decodedPath, err := url.QueryUnescape(relativePath)
-	if err != nil {
-		log.Printf("Error decoding path: %v", err)
-		return c.Status(400).SendString("Invalid path encoding")
-	}
-
-	log.Printf("Zip download request for path: %s", decodedPath)
+// Download formats of /zip and their content types
+var downloadFormats = map[string]string{
+	"zip":    "application/zip",
+	"tar":    "application/x-tar",
+	"tar.gz": "application/gzip",
+}
 
-	// Construct full path using decoded path
-	fullPath := filepath.Join(rootPath, decodedPath)
+// Name of the entry listing the items that could not be read, added to the end
+// of a download instead of aborting it halfway
+const downloadErrorsName = "DOWNLOAD-ERRORS.txt"
 
-	// Check if path exists
-	info, err := os.Stat(fullPath)
+// downloadSources resolves the items of a /zip request: path is a single
+// folder whose content is archived (the original form), srcs any mix of files
+// and folders, each archived under its own name. Errors are *fiber.Error.
+func downloadSources(c *fiber.Ctx, includeHidden bool) (sources []string, baseName string, err error) {
+	m, err := requestMount(c)
 	if err != nil {
-		log.Printf("Path does not exist: %s", fullPath)
-		return c.Status(404).SendString("Path not found")
+		return nil, "", fiber.NewError(400, err.Error())
 	}
 
-	// Check if it's a directory
-	if !info.IsDir() {
-		return c.Status(400).SendString("Path must be a directory")
-	}
-
-	// Set headers for zip download
-	zipName := filepath.Base(fullPath) + ".zip"
-	c.Set("Content-Type", "application/zip")
-	c.Set("Content-Disposition", "attachment; filename=\""+zipName+"\"")
+	if relativePath := c.Query("path"); relativePath != "" {
+		// Explicitly URL decode the path
+		decodedPath, err := url.QueryUnescape(relativePath)
+		if err != nil {
+			log.Printf("Error decoding path: %v", err)
+			return nil, "", fiber.NewError(400, "Invalid path encoding")
+		}
 
-	// Create zip writer that writes directly to response
-	zipWriter := zip.NewWriter(c.Response().BodyWriter())
-	defer zipWriter.Close()
+		// Construct full path using decoded path
+		fullPath, err := m.resolve(decodedPath)
+		if err != nil {
+			return nil, "", fiber.NewError(400, err.Error())
+		}
 
-	// Walk the directory and add files to zip
-	err = filepath.Walk(fullPath, func(path string, info os.FileInfo, err error) error {
+		// Check if path exists
+		info, err := rootFS.Stat(fullPath)
 		if err != nil {
-			return err
+			log.Printf("Path does not exist: %s", fullPath)
+			return nil, "", fiber.NewError(404, "Path not found")
 		}
 
-		// Skip hidden files
-		if strings.HasPrefix(filepath.Base(path), ".") {
-			if info.IsDir() {
-				return filepath.SkipDir
-			}
-			return nil
+		// Check if it's a directory
+		if !info.IsDir() {
+			return nil, "", fiber.NewError(400, "Path must be a directory")
 		}
 
-		// Get relative path for zip entry
-		relPath, err := filepath.Rel(fullPath, path)
+		// The folder's content goes into the archive, not the folder itself
+		entries, err := rootFS.ReadDir(fullPath)
 		if err != nil {
-			return err
+			return nil, "", fiber.NewError(500, "Failed to read directory")
 		}
-
-		// Skip the root directory itself
-		if relPath == "." {
-			return nil
+		for _, entry := range entries {
+			if includeHidden || !strings.HasPrefix(entry.Name(), ".") {
+				sources = append(sources, filepath.Join(fullPath, entry.Name()))
+			}
 		}
+		return sources, filepath.Base(fullPath), nil
+	}
 
-		// Create zip header
-		header, err := zip.FileInfoHeader(info)
+	// Parse sources (they come as multiple values with same key)
+	values, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+	srcList := values["srcs"]
+	if len(srcList) == 0 {
+		return nil, "", fiber.NewError(400, "Path or srcs parameter required")
+	}
+	for _, src := range srcList {
+		fullPath, err := m.resolve(src)
 		if err != nil {
-			return err
+			return nil, "", fiber.NewError(400, err.Error())
 		}
+		if _, err := rootFS.Stat(fullPath); err != nil {
+			return nil, "", fiber.NewError(404, "Path not found: "+src)
+		}
+		sources = append(sources, fullPath)
+	}
+	baseName = "download"
+	if len(sources) == 1 {
+		baseName = filepath.Base(sources[0])
+	}
+	return sources, baseName, nil
+}
 
-		// Use forward slashes in zip paths
-		header.Name = filepath.ToSlash(relPath)
+// handleZipDownload streams folders and files as one archive, see downloadSources.
+// Entries are written as the folders are walked, so the response is committed
+// before everything was read: unreadable items are skipped and listed in a
+// DOWNLOAD-ERRORS.txt entry at the end. Symlinks are stored, not followed.
+func handleZipDownload(c *fiber.Ctx) error {
+	format := c.Query("format", "zip")
+	contentType, ok := downloadFormats[format]
+	if !ok {
+		return c.Status(400).SendString("Invalid format. Must be 'zip', 'tar' or 'tar.gz'")
+	}
+	// Store-only skips compression, for media that is compressed already
+	level := -1
+	if c.QueryBool("store", false) {
+		level = 0
+	}
+	includeHidden := c.QueryBool("hidden", false)
 
-		// Set compression method
-		if info.IsDir() {
-			header.Name += "/"
-		} else {
-			header.Method = zip.Deflate
-		}
+	sources, baseName, err := downloadSources(c, includeHidden)
+	if err != nil {
+		e := err.(*fiber.Error)
+		return c.Status(e.Code).SendString(e.Message)
+	}
+	log.Printf("Download request for %d items", len(sources))
 
-		// Write header
-		writer, err := zipWriter.CreateHeader(header)
+	// Set headers for the download
+	archiveName := baseName + "." + format
+	c.Set("Content-Type", contentType)
+	c.Set("Content-Disposition", contentDisposition("attachment", archiveName))
+
+	// Stream the archive into the response as it is written
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		aw, err := newArchiveWriter(w, format, level)
 		if err != nil {
-			return err
+			log.Printf("Error creating %s: %v", archiveName, err)
+			return
+		}
+		var done int64
+		var failed []string
+		err = writeSources(context.Background(), aw, sources, includeHidden, "", &done, func() {}, func(name string, err error) {
+			log.Printf("Skipping %s in %s: %v", name, archiveName, err)
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+		})
+		if err == nil && len(failed) > 0 {
+			report := strings.Join(failed, "\n") + "\n"
+			info := &archiveMemberInfo{member: archiveMember{name: downloadErrorsName, size: int64(len(report)), modTime: time.Now()}}
+			err = aw.add(downloadErrorsName, info, strings.NewReader(report))
+		}
+		if closeErr := aw.Close(); err == nil {
+			err = closeErr
 		}
+		if err != nil {
+			// Headers are out already, the client sees a truncated archive.
+			// Only writing can fail here, most likely the client went away.
+			log.Printf("Error creating %s: %v", archiveName, err)
+			return
+		}
+		log.Printf("Successfully created %s (%d bytes read, %d items skipped)", archiveName, done, len(failed))
+	})
+	return nil
+}
 
-		// If it's a file, copy contents
-		if !info.IsDir() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
+// Rough zip overhead per entry, headers and central directory with a short name
+const archiveEntryOverhead = 128
 
-			_, err = io.Copy(writer, file)
-			if err != nil {
-				return err
-			}
+// handleZipEstimate tells how big a /zip download of the same items would be,
+// from the size tree, so the UI can warn before starting a huge one. Sizes are
+// uncompressed; size is -1 without --with-sizes.
+func handleZipEstimate(c *fiber.Ctx) error {
+	includeHidden := c.QueryBool("hidden", false)
+	sources, baseName, err := downloadSources(c, includeHidden)
+	if err != nil {
+		e := err.(*fiber.Error)
+		return c.Status(e.Code).JSON(fiber.Map{
+			"status": "error",
+			"error":  e.Message,
+		})
+	}
+
+	var size, entries int64
+	known := true
+	sizeTreeMutex.RLock()
+	for _, src := range sources {
+		tree := sizeTreeFor(src)
+		if tree == nil {
+			known = false
+			break
+		}
+		node := tree.FindByPath(src)
+		if node == nil {
+			known = false // Added behind our back
+			break
 		}
+		n, bytes := treeTotals(node, includeHidden)
+		size += bytes
+		entries += n
+	}
+	sizeTreeMutex.RUnlock()
 
-		return nil
+	if !known {
+		return c.JSON(fiber.Map{
+			"status":  "ok",
+			"name":    baseName,
+			"size":    -1,
+			"entries": -1,
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status":   "ok",
+		"name":     baseName,
+		"size":     size,
+		"entries":  entries,
+		"estimate": size + entries*archiveEntryOverhead,
 	})
+}
 
-	if err != nil {
-		log.Printf("Error creating zip: %v", err)
-		return c.Status(500).SendString("Failed to create zip archive")
+// treeTotals counts node and everything below it, as archiveSources would
+// visit them, and their size. The caller holds sizeTreeMutex.
+func treeTotals(node *scan.FileData, includeHidden bool) (entries, size int64) {
+	if !node.IsDir {
+		return 1, node.Size()
+	}
+	entries = 1
+	for _, child := range node.Children {
+		if includeHidden || !strings.HasPrefix(child.Name, ".") {
+			n, bytes := treeTotals(child, includeHidden)
+			entries += n
+			size += bytes
+		}
 	}
-
-	log.Printf("Successfully created zip for: %s", decodedPath)
-	return nil
+	return entries, size
 }
 
 func handleRename(c *fiber.Ctx) error {
@@ -1406,6 +1471,7 @@ func handleRename(c *fiber.Ctx) error {
 
 	// Parse JSON body
 	var req struct {
+		Root    string `json:"root"`
 		Path    string `json:"path"`
 		NewName string `json:"newName"`
 	}
@@ -1433,13 +1499,34 @@ func handleRename(c *fiber.Ctx) error {
 		})
 	}
 
+	m, err := mountByName(req.Root)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	if !m.WriteMode {
+		return c.Status(403).JSON(fiber.Map{
+			"status": "error",
+			"error":  "File operations are disabled. Use --write flag to enable write mode",
+		})
+	}
+
 	// Build old and new paths
-	oldPath := filepath.Join(rootPath, req.Path)
+	oldPath, err := m.resolve(req.Path)
+	if err != nil || oldPath == m.Path {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Invalid path",
+		})
+	}
 	dirPath := filepath.Dir(oldPath)
 	newPath := filepath.Join(dirPath, req.NewName)
 
 	// Check if old path exists
-	if _, err := os.Stat(oldPath); err != nil {
+	oldInfo, err := rootFS.Stat(oldPath)
+	if err != nil {
 		return c.Status(404).JSON(fiber.Map{
 			"status": "error",
 			"error":  "File or folder not found",
@@ -1447,7 +1534,7 @@ func handleRename(c *fiber.Ctx) error {
 	}
 
 	// Check if new path already exists
-	if _, err := os.Stat(newPath); err == nil {
+	if _, err := rootFS.Stat(newPath); err == nil {
 		return c.Status(400).JSON(fiber.Map{
 			"status": "error",
 			"error":  "A file or folder with that name already exists",
@@ -1455,7 +1542,7 @@ func handleRename(c *fiber.Ctx) error {
 	}
 
 	// Perform rename
-	if err := os.Rename(oldPath, newPath); err != nil {
+	if err := rootFS.Rename(oldPath, newPath); err != nil {
 		log.Printf("Error renaming %s to %s: %v", oldPath, newPath, err)
 		return c.Status(500).JSON(fiber.Map{
 			"status": "error",
@@ -1464,28 +1551,7 @@ func handleRename(c *fiber.Ctx) error {
 	}
 
 	// Update size tree after successful rename
-	if withSizes && sizeTreeRoot != nil {
-		sizeTreeMutex.Lock()
-		if node := sizeTreeRoot.FindByPath(oldPath); node != nil {
-			// Update Name field
-			node.Name = req.NewName
-			// Path is dynamic, so node.Path() will now return newPath automatically.
-
-			// Update bolt database:
-			// ID is constant. Just save the node with new name.
-			// ALSO need to save the PARENT because it contains the list of child IDs (which hasn't changed),
-			// BUT if we store Name in Parent's child list (we don't, we store IDs), then parent update might not be needed?
-			// scan/storage.go `StoredFileData` has `ChildIDs`. It doesn't duplicate names there.
-			// So technically only the Node needs update in DB.
-
-			if boltDB != nil {
-				if err := updateNodeInBolt(boltDB, node); err != nil {
-					log.Printf("Warning: Failed to update renamed node in bolt db: %v", err)
-				}
-			}
-		}
-		sizeTreeMutex.Unlock()
-	}
+	sizeTreeMove(oldPath, newPath, oldInfo.IsDir())
 
 	log.Printf("Renamed: %s -> %s", req.Path, req.NewName)
 
@@ -1499,97 +1565,50 @@ func handleRename(c *fiber.Ctx) error {
 	})
 }
 
-func isImageFile(ext string) bool {
-	imageExts := map[string]bool{
-		".jpg":  true,
-		".jpeg": true,
-		".png":  true,
-	}
-	return imageExts[ext]
-}
-
-func isDocumentFile(ext string) bool {
-	docExts := map[string]bool{
-		".docx": true,
-		".doc":  true,
-		".xls":  true,
-		".xlsx": true,
-		".ppt":  true,
-		".pptx": true,
-		".pdf":  true,
-	}
-	return docExts[ext]
-}
-
-func getImageContentType(ext string) string {
-	switch ext {
-	case ".jpg", ".jpeg":
-		return "image/jpeg"
-	case ".png":
-		return "image/png"
-	default:
-		return "application/octet-stream"
-	}
-}
-
-func getFileContentType(ext string) string {
-	switch ext {
-	case ".docx":
-		return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
-	case ".doc":
-		return "application/msword"
-	case ".xlsx":
-		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
-	case ".xls":
-		return "application/vnd.ms-excel"
-	case ".pptx":
-		return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
-	case ".ppt":
-		return "application/vnd.ms-powerpoint"
-	case ".pdf":
-		return "application/pdf"
-	case ".txt":
-		return "text/plain"
-	case ".js":
-		return "application/javascript"
-	case ".css":
-		return "text/css"
-	case ".html":
-		return "text/html"
-	case ".json":
-		return "application/json"
-	default:
-		return "application/octet-stream"
-	}
-}
-
-func getFileType(entry os.DirEntry) string {
-	if entry.IsDir() {
-		return "folder"
-	}
-
-	ext := strings.ToLower(filepath.Ext(entry.Name()))
-	if isImageFile(ext) {
-		return "image"
-	} else if isDocumentFile(ext) {
-		return "document"
-	}
-	return "file"
-}
-
-func handleWebSocket(c *websocket.Conn) {
-	defer c.Close()
+func handleWebSocket(conn *websocket.Conn) {
+	c := newWSClient(conn)
+	defer c.close()
+	defer liveChanges.unsubscribeAll(c)
 
 	log.Println("WebSocket connected")
 
 	// Listen for path requests from client
 	for {
 		var req WSRequest
-		if err := c.ReadJSON(&req); err != nil {
+		if err := conn.ReadJSON(&req); err != nil {
 			log.Printf("WebSocket read error: %v", err)
 			return
 		}
 
+		switch req.Type {
+		case "search":
+			if err := handleWebSocketSearch(c, req); err != nil {
+				log.Printf("Error sending search results: %v", err)
+				return
+			}
+			continue
+		}
+
+		m, err := mountByName(req.Root)
+		var fullPath string
+		if err == nil {
+			fullPath, err = m.resolve(req.Path)
+		}
+		if err != nil {
+			c.WriteJSON(WSMessage{RequestID: req.RequestID, Items: []FileItem{}, Error: err.Error()})
+			continue
+		}
+
+		switch req.Type {
+		case "subscribe":
+			// Push add/remove/update events for this directory until unsubscribed
+			liveChanges.subscribe(c, fullPath)
+			continue
+		case "unsubscribe":
+			liveChanges.unsubscribe(c, fullPath)
+			continue
+		}
+
 		relativePath := req.Path
 		requestID := req.RequestID
 		sortBy := req.SortBy
@@ -1597,67 +1616,90 @@ func handleWebSocket(c *websocket.Conn) {
 		log.Printf("WebSocket received path request: %s (ID: %d, Sort: %s %s)", relativePath, requestID, sortBy, dir)
 
 		// Get file listing for requested path
-		items := getDirectoryListing(relativePath, sortBy, dir)
-
-		// Send items in chunks of 10, wrapped with requestId
-		chunkSize := 10
-		for i := 0; i < len(items); i += chunkSize {
-			end := min(i+chunkSize, len(items))
-			chunk := items[i:end]
+		items := getDirectoryListing(m, relativePath, sortBy, dir)
 
-			msg := WSMessage{
-				RequestID: requestID,
-				Items:     chunk,
-			}
-
-			if err := c.WriteJSON(msg); err != nil {
-				log.Printf("Error sending chunk: %v", err)
-				return
-			}
+		if err := sendWSItems(c, requestID, items); err != nil {
+			log.Printf("Error sending chunk: %v", err)
+			return
 		}
 
-		// Send empty array wrapped with requestId to indicate completion
-		completionMsg := WSMessage{
+		log.Printf("Finished sending files for path: %s (ID: %d)", relativePath, requestID)
+	}
+}
+
+// sendWSItems sends items in chunks of wsChunkSize, wrapped with requestId,
+// followed by an empty array to indicate completion
+func sendWSItems(c *wsClient, requestID int, items []FileItem) error {
+	for i := 0; i < len(items); i += wsChunkSize {
+		end := min(i+wsChunkSize, len(items))
+		msg := WSMessage{
 			RequestID: requestID,
-			Items:     []FileItem{},
+			Items:     items[i:end],
 		}
-		if err := c.WriteJSON(completionMsg); err != nil {
-			log.Printf("Error sending completion signal: %v", err)
-			return
+		if err := c.WriteJSON(msg); err != nil {
+			return err
 		}
+	}
 
-		log.Printf("Finished sending files for path: %s (ID: %d)", relativePath, requestID)
+	completionMsg := WSMessage{
+		RequestID: requestID,
+		Items:     []FileItem{},
 	}
+	return c.WriteJSON(completionMsg)
+}
+
+// treeSize looks up the size of fullPath in the size tree. Size is -1 when
+// --with-sizes is not used; stale is true if the item exists on the filesystem
+// but not in the tree (new file/folder added behind our back).
+func treeSize(fullPath string) (size int64, stale bool) {
+	tree := sizeTreeFor(fullPath)
+	if tree == nil {
+		return -1, false
+	}
+	sizeTreeMutex.RLock()
+	defer sizeTreeMutex.RUnlock()
+	if fileData := tree.FindByPath(fullPath); fileData != nil {
+		return fileData.Size(), false
+	}
+	return -1, true
 }
 
 // Extract directory listing logic into separate function
-func getDirectoryListing(relativePath, sortBy, dir string) []FileItem {
+func getDirectoryListing(m *mount, relativePath, sortBy, dir string) []FileItem {
 
-	// Simply concatenate rootPath with relativePath
-	fullPath := filepath.Join(rootPath, relativePath)
+	// Simply concatenate the root with relativePath
+	fullPath, err := m.resolve(relativePath)
+	if err != nil {
+		log.Printf("Invalid listing path: %v", err)
+		return []FileItem{}
+	}
 
 	// Check if path exists
-	info, err := os.Stat(fullPath)
+	info, err := statPath(fullPath)
 	if err != nil {
 		log.Printf("Path does not exist: %s (error: %v)", fullPath, err)
 		return []FileItem{}
 	}
 
-	if !info.IsDir() {
+	if _, inArchive := info.(*archiveMemberInfo); inArchive || !info.IsDir() {
+		// Zip and tar files (and folders inside them) are listed like directories
+		if items, ok := archiveListing(fullPath, relativePath); ok {
+			sortListing(items, sortBy, dir)
+			return items
+		}
 		log.Printf("Path is not a directory: %s", fullPath)
 		return []FileItem{}
 	}
 
 	// List directory contents
-	entries, err := os.ReadDir(fullPath)
+	entries, err := rootFS.ReadDir(fullPath)
 	if err != nil {
 		log.Printf("Error reading directory %s: %v", fullPath, err)
 		return []FileItem{}
 	}
 
-	// Convert to FileItems - separate folders from files
-	var folders []FileItem
-	var files []FileItem
+	// Convert to FileItems
+	items := []FileItem{}
 
 	for _, entry := range entries {
 		// Skip hidden files/folders
@@ -1676,24 +1718,7 @@ func getDirectoryListing(relativePath, sortBy, dir string) []FileItem {
 		itemRelativePath = filepath.ToSlash(itemRelativePath)
 
 		// Determine size
-		var size int64 = -1        // Default when --with-sizes not used
-		var sizeStale bool = false // Track if size data is missing from tree
-		if withSizes && sizeTreeRoot != nil {
-			// Build full path for this item
-			itemFullPath := filepath.Join(fullPath, entry.Name())
-			sizeTreeMutex.RLock()
-			if fileData := sizeTreeRoot.FindByPath(itemFullPath); fileData != nil {
-				size = fileData.Size()
-				// Use modified time from tree if available (should match fs)
-				// But we get it fresh from os.DirEntry via Info below usually?
-				// Actually ReadDir gives DirEntry. Info() gives ModTime.
-				// We do that below anyway.
-			} else {
-				// Item exists on filesystem but not in tree (new file/folder added)
-				sizeStale = true
-			}
-			sizeTreeMutex.RUnlock()
-		}
+		size, sizeStale := treeSize(filepath.Join(fullPath, entry.Name()))
 
 		// Get ModTime
 		var modTime int64
@@ -1708,42 +1733,43 @@ func getDirectoryListing(relativePath, sortBy, dir string) []FileItem {
 			Size:      size,
 			Modified:  modTime,
 			SizeStale: sizeStale,
+			Archive:   !entry.IsDir() && isArchiveName(entry.Name()),
+			Kind:      itemKind(entry.Name(), entry.IsDir()),
 		}
-
-		// Separate folders from files using entry.IsDir()
-		if entry.IsDir() {
-			folders = append(folders, item)
-		} else {
-			files = append(files, item)
+		if !entry.IsDir() && canThumbnail(entry.Name()) {
+			item.Thumbnail = thumbnailURL(m, itemRelativePath)
 		}
+		items = append(items, item)
 	}
 
-	// Sort function
-	sortItems := func(items []FileItem) {
-		sort.Slice(items, func(i, j int) bool {
-			var result bool
-			switch sortBy {
-			case "size":
-				result = items[i].Size < items[j].Size
-			case "modified":
-				result = items[i].Modified < items[j].Modified
-			default: // default to name sorting
-				result = strings.ToLower(items[i].Name) < strings.ToLower(items[j].Name)
-			}
-			// Reverse if descending
-			if dir == "desc" {
-				result = !result
-			}
-			return result
-		})
+	if sortBy == "taken" {
+		fillDateTaken(fullPath, items)
 	}
+	sortListing(items, sortBy, dir)
+	return items
+}
 
-	// Sort folders and files separately
-	sortItems(folders)
-	sortItems(files)
-
-	// Combine: folders first, then files
-	allItems := append(folders, files...)
-
-	return allItems
+// sortListing sorts items by sortBy and dir in place, folders first
+func sortListing(items []FileItem, sortBy, dir string) {
+	sort.SliceStable(items, func(i, j int) bool {
+		if items[i].IsDir != items[j].IsDir {
+			return items[i].IsDir
+		}
+		var result bool
+		switch sortBy {
+		case "size":
+			result = items[i].Size < items[j].Size
+		case "modified":
+			result = items[i].Modified < items[j].Modified
+		case "taken": // Files without a date taken go by their modification time
+			result = takenOrModified(items[i]) < takenOrModified(items[j])
+		default: // default to name sorting
+			result = strings.ToLower(items[i].Name) < strings.ToLower(items[j].Name)
+		}
+		// Reverse if descending
+		if dir == "desc" {
+			result = !result
+		}
+		return result
+	})
 }
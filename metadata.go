@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// More EXIF tags, for the metadata endpoint
+const (
+	exifTagMake             = 0x010F
+	exifTagModel            = 0x0110
+	exifTagDateTime         = 0x0132
+	exifTagExposureTime     = 0x829A
+	exifTagFNumber          = 0x829D
+	exifTagISO              = 0x8827
+	exifTagDateTimeOriginal = 0x9003
+	exifTagOffsetOriginal   = 0x9011
+	exifTagFocalLength      = 0x920A
+	exifTagPixelWidth       = 0xA002
+	exifTagPixelHeight      = 0xA003
+	exifTagLensModel        = 0xA434
+
+	gpsTagLatitudeRef  = 1
+	gpsTagLatitude     = 2
+	gpsTagLongitudeRef = 3
+	gpsTagLongitude    = 4
+	gpsTagAltitudeRef  = 5
+	gpsTagAltitude     = 6
+)
+
+const (
+	maxTIFFMetadata  = 64 << 20 // TIFF tags can be anywhere in the file, so it is read whole
+	maxID3Frame      = 1 << 20  // Bigger frames (cover art) are skipped
+	maxMP4Moov       = 64 << 20
+	maxMetadataCache = 20000
+)
+
+// FileMetadata is what /api/metadata finds in a file; fields that don't
+// apply or weren't found are left out
+type FileMetadata struct {
+	Type        string       `json:"type"`
+	Width       int          `json:"width,omitempty"` // As displayed (EXIF orientation applied)
+	Height      int          `json:"height,omitempty"`
+	Orientation int          `json:"orientation,omitempty"`
+	Taken       int64        `json:"taken,omitempty"` // Unix seconds: EXIF date taken, MP4/MOV creation time
+	CameraMake  string       `json:"cameraMake,omitempty"`
+	CameraModel string       `json:"cameraModel,omitempty"`
+	Lens        string       `json:"lens,omitempty"`
+	Exposure    string       `json:"exposure,omitempty"` // Seconds, e.g. "1/250"
+	FNumber     float64      `json:"fNumber,omitempty"`
+	ISO         int          `json:"iso,omitempty"`
+	FocalLength float64      `json:"focalLength,omitempty"` // mm
+	GPS         *GPSPosition `json:"gps,omitempty"`
+	Duration    float64      `json:"duration,omitempty"` // Seconds
+	Title       string       `json:"title,omitempty"`
+	Artist      string       `json:"artist,omitempty"`
+	Album       string       `json:"album,omitempty"`
+	Year        string       `json:"year,omitempty"`
+	Track       string       `json:"track,omitempty"`
+	Genre       string       `json:"genre,omitempty"`
+}
+
+type GPSPosition struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"` // Meters above sea level
+}
+
+// Metadata of recently asked files, by full path. Only valid for the size and
+// modification time it was read at. Cleared when full, it is cheap to refill.
+type cachedMetadata struct {
+	size    int64
+	modTime time.Time
+	meta    *FileMetadata
+}
+
+var (
+	metadataCache   = make(map[string]cachedMetadata)
+	metadataCacheMu sync.Mutex
+)
+
+// fileMetadata reads the metadata of a file, from the cache if it didn't change
+func fileMetadata(fullPath string, info fs.FileInfo) (*FileMetadata, error) {
+	metadataCacheMu.Lock()
+	cached, ok := metadataCache[fullPath]
+	metadataCacheMu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.meta, nil
+	}
+
+	meta, err := readMetadata(fullPath, info)
+	if err != nil {
+		return nil, err
+	}
+	metadataCacheMu.Lock()
+	if len(metadataCache) >= maxMetadataCache {
+		metadataCache = make(map[string]cachedMetadata)
+	}
+	metadataCache[fullPath] = cachedMetadata{info.Size(), info.ModTime(), meta}
+	metadataCacheMu.Unlock()
+	return meta, nil
+}
+
+// readMetadata reads what the file's type has: EXIF and dimensions for
+// images, ID3 tags for MP3, container info for MP4 and MOV
+func readMetadata(fullPath string, info fs.FileInfo) (*FileMetadata, error) {
+	meta := &FileMetadata{Type: contentTypeOf(fullPath, info)}
+	r, err := openStored(fullPath, info)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	switch mediaType(meta.Type) {
+	case "image/jpeg":
+		tiff, width, height, err := scanJPEG(r)
+		if err != nil {
+			return nil, err
+		}
+		meta.Width, meta.Height = width, height
+		if x, err := parseTIFF(tiff); err == nil {
+			meta.addEXIF(x)
+		}
+	case "image/tiff":
+		if info.Size() > maxTIFFMetadata {
+			return meta, nil
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if config, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+			meta.Width, meta.Height = config.Width, config.Height
+		}
+		if x, err := parseTIFF(data); err == nil {
+			meta.addEXIF(x)
+		}
+	case "image/png", "image/gif", "image/webp", "image/bmp":
+		config, _, err := image.DecodeConfig(r)
+		if err != nil {
+			return nil, err
+		}
+		meta.Width, meta.Height = config.Width, config.Height
+	case "audio/mpeg":
+		if err := meta.addID3(r, info.Size()); err != nil {
+			return nil, err
+		}
+	case "video/mp4", "video/quicktime", "audio/mp4", "video/x-m4v":
+		if err := meta.addMP4(r); err != nil {
+			return nil, err
+		}
+	}
+	return meta, nil
+}
+
+// scanJPEG reads the segments of a JPEG up to the image data and returns the
+// EXIF block (nil if there is none) and the dimensions from the frame header.
+// Other segments (thumbnails, ICC profiles) are skipped without keeping them.
+func scanJPEG(r io.Reader) (tiff []byte, width, height int, err error) {
+	br := bufio.NewReader(r)
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi != [2]byte{0xFF, 0xD8} {
+		return nil, 0, 0, errors.New("not a JPEG file")
+	}
+	for {
+		marker, err := br.ReadByte()
+		if err != nil {
+			return tiff, width, height, nil
+		}
+		if marker != 0xFF {
+			continue
+		}
+		for marker == 0xFF { // Fill bytes
+			if marker, err = br.ReadByte(); err != nil {
+				return tiff, width, height, nil
+			}
+		}
+		if marker == 0xD8 || (marker >= 0xD0 && marker <= 0xD7) || marker == 0x01 {
+			continue // No length
+		}
+		if marker == 0xDA || marker == 0xD9 { // Image data starts
+			return tiff, width, height, nil
+		}
+		var length uint16
+		if err := binary.Read(br, binary.BigEndian, &length); err != nil || length < 2 {
+			return tiff, width, height, nil
+		}
+		n := int(length) - 2
+
+		isSOF := marker >= 0xC0 && marker <= 0xCF && marker != 0xC4 && marker != 0xC8 && marker != 0xCC
+		if (marker == 0xE1 && tiff == nil) || isSOF {
+			segment := make([]byte, n)
+			if _, err := io.ReadFull(br, segment); err != nil {
+				return tiff, width, height, nil
+			}
+			if isSOF && n >= 5 {
+				height, width = int(binary.BigEndian.Uint16(segment[1:])), int(binary.BigEndian.Uint16(segment[3:]))
+			} else if bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+				tiff = segment[6:]
+			}
+			continue
+		}
+		if _, err := br.Discard(n); err != nil {
+			return tiff, width, height, nil
+		}
+	}
+}
+
+// addEXIF copies the interesting EXIF fields
+func (meta *FileMetadata) addEXIF(x *exifData) {
+	meta.CameraMake = x.string(x.ifd0, exifTagMake)
+	meta.CameraModel = x.string(x.ifd0, exifTagModel)
+	meta.Lens = x.string(x.exif, exifTagLensModel)
+	if o := x.orientation(); o != 1 {
+		meta.Orientation = o
+	}
+	if meta.Width == 0 {
+		w, _ := x.uint(x.exif, exifTagPixelWidth)
+		h, _ := x.uint(x.exif, exifTagPixelHeight)
+		meta.Width, meta.Height = int(w), int(h)
+	}
+	if meta.Orientation >= 5 { // Turned by 90°
+		meta.Width, meta.Height = meta.Height, meta.Width
+	}
+
+	taken := x.string(x.exif, exifTagDateTimeOriginal)
+	if taken == "" {
+		taken = x.string(x.ifd0, exifTagDateTime)
+	}
+	if t, ok := parseEXIFTime(taken, x.string(x.exif, exifTagOffsetOriginal)); ok {
+		meta.Taken = t.Unix()
+	}
+
+	if v := x.rationals(x.exif, exifTagExposureTime); len(v) > 0 && v[0] > 0 {
+		if v[0] < 1 {
+			meta.Exposure = fmt.Sprintf("1/%d", int(math.Round(1/v[0])))
+		} else {
+			meta.Exposure = fmt.Sprintf("%g", v[0])
+		}
+	}
+	if v := x.rationals(x.exif, exifTagFNumber); len(v) > 0 {
+		meta.FNumber = math.Round(v[0]*10) / 10
+	}
+	if v := x.rationals(x.exif, exifTagFocalLength); len(v) > 0 {
+		meta.FocalLength = math.Round(v[0]*10) / 10
+	}
+	if iso, ok := x.uint(x.exif, exifTagISO); ok {
+		meta.ISO = int(iso)
+	}
+
+	lat, lon := x.rationals(x.gps, gpsTagLatitude), x.rationals(x.gps, gpsTagLongitude)
+	if len(lat) == 3 && len(lon) == 3 {
+		gps := &GPSPosition{
+			Latitude:  lat[0] + lat[1]/60 + lat[2]/3600,
+			Longitude: lon[0] + lon[1]/60 + lon[2]/3600,
+		}
+		if x.string(x.gps, gpsTagLatitudeRef) == "S" {
+			gps.Latitude = -gps.Latitude
+		}
+		if x.string(x.gps, gpsTagLongitudeRef) == "W" {
+			gps.Longitude = -gps.Longitude
+		}
+		if alt := x.rationals(x.gps, gpsTagAltitude); len(alt) == 1 {
+			if ref, _ := x.uint(x.gps, gpsTagAltitudeRef); ref == 1 {
+				alt[0] = -alt[0] // Below sea level
+			}
+			gps.Altitude = &alt[0]
+		}
+		meta.GPS = gps
+	}
+}
+
+// parseEXIFTime parses an EXIF date ("2006:01:02 15:04:05"), in the given
+// offset ("+02:00") or local time if there is none
+func parseEXIFTime(value, offset string) (time.Time, bool) {
+	if value == "" || strings.HasPrefix(value, "0000") {
+		return time.Time{}, false
+	}
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", value+offset); err == nil {
+			return t, true
+		}
+	}
+	t, err := time.ParseInLocation("2006:01:02 15:04:05", value, time.Local)
+	return t, err == nil
+}
+
+// addID3 reads ID3v2 text frames from the start of an MP3, or the ID3v1 tag
+// at its end if there are none and r can seek
+func (meta *FileMetadata) addID3(r io.Reader, size int64) error {
+	br := bufio.NewReader(r)
+	header := make([]byte, 10)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil // Too short for tags
+	}
+	if string(header[:3]) != "ID3" {
+		if seeker, ok := r.(io.Seeker); ok && size >= 128 {
+			return meta.addID3v1(r, seeker, size)
+		}
+		return nil
+	}
+	version, flags := header[3], header[5]
+	remaining := int64(syncsafe(header[6:10]))
+	if flags&0x40 != 0 && version >= 3 { // Extended header
+		ext := make([]byte, 4)
+		if _, err := io.ReadFull(br, ext); err != nil {
+			return nil
+		}
+		extSize := int64(binary.BigEndian.Uint32(ext)) // Without these 4 bytes in v2.3
+		if version == 4 {
+			extSize = int64(syncsafe(ext)) - 4
+		}
+		br.Discard(int(extSize))
+		remaining -= 4 + extSize
+	}
+
+	frames := map[string]*string{
+		"TIT2": &meta.Title, "TT2": &meta.Title,
+		"TPE1": &meta.Artist, "TP1": &meta.Artist,
+		"TALB": &meta.Album, "TAL": &meta.Album,
+		"TYER": &meta.Year, "TYE": &meta.Year, "TDRC": &meta.Year,
+		"TRCK": &meta.Track, "TRK": &meta.Track,
+		"TCON": &meta.Genre, "TCO": &meta.Genre,
+	}
+	idLen, headerLen := 4, 10
+	if version == 2 {
+		idLen, headerLen = 3, 6
+	}
+	frameHeader := make([]byte, headerLen)
+	for remaining > int64(headerLen) {
+		if _, err := io.ReadFull(br, frameHeader); err != nil || frameHeader[0] == 0 {
+			break // Padding
+		}
+		id := string(frameHeader[:idLen])
+		var frameSize int64
+		switch version {
+		case 2:
+			frameSize = int64(frameHeader[3])<<16 | int64(frameHeader[4])<<8 | int64(frameHeader[5])
+		case 4:
+			frameSize = int64(syncsafe(frameHeader[4:8]))
+		default:
+			frameSize = int64(binary.BigEndian.Uint32(frameHeader[4:8]))
+		}
+		remaining -= int64(headerLen) + frameSize
+		field, wanted := frames[id]
+		if !wanted || frameSize > maxID3Frame || frameSize < 1 {
+			if _, err := br.Discard(int(frameSize)); err != nil {
+				break
+			}
+			continue
+		}
+		data := make([]byte, frameSize)
+		if _, err := io.ReadFull(br, data); err != nil {
+			break
+		}
+		*field = decodeID3Text(data[0], data[1:])
+	}
+	if len(meta.Year) > 4 { // TDRC is a timestamp
+		meta.Year = meta.Year[:4]
+	}
+	return nil
+}
+
+// addID3v1 reads the 128 byte tag at the end of an MP3
+func (meta *FileMetadata) addID3v1(r io.Reader, seeker io.Seeker, size int64) error {
+	if _, err := seeker.Seek(size-128, io.SeekStart); err != nil {
+		return nil
+	}
+	tag := make([]byte, 128)
+	if _, err := io.ReadFull(r, tag); err != nil || string(tag[:3]) != "TAG" {
+		return nil
+	}
+	field := func(b []byte) string {
+		return strings.TrimSpace(decodeID3Text(0, b))
+	}
+	meta.Title, meta.Artist, meta.Album, meta.Year = field(tag[3:33]), field(tag[33:63]), field(tag[63:93]), field(tag[93:97])
+	if tag[125] == 0 && tag[126] != 0 { // ID3v1.1 track number
+		meta.Track = fmt.Sprint(tag[126])
+	}
+	return nil
+}
+
+// syncsafe decodes an ID3v2 size: 4 bytes of 7 bits
+func syncsafe(b []byte) uint32 {
+	return uint32(b[0]&0x7F)<<21 | uint32(b[1]&0x7F)<<14 | uint32(b[2]&0x7F)<<7 | uint32(b[3]&0x7F)
+}
+
+// decodeID3Text decodes an ID3 text in one of its encodings: ISO-8859-1,
+// UTF-16 with BOM, UTF-16BE or UTF-8. Only the first of several values is kept.
+func decodeID3Text(encoding byte, data []byte) string {
+	var s string
+	switch encoding {
+	case 1, 2:
+		bigEndian := encoding == 2
+		if len(data) >= 2 && (data[0] == 0xFE && data[1] == 0xFF || data[0] == 0xFF && data[1] == 0xFE) {
+			bigEndian = data[0] == 0xFE
+			data = data[2:]
+		}
+		units := make([]uint16, 0, len(data)/2)
+		for i := 0; i+1 < len(data); i += 2 {
+			if bigEndian {
+				units = append(units, binary.BigEndian.Uint16(data[i:]))
+			} else {
+				units = append(units, binary.LittleEndian.Uint16(data[i:]))
+			}
+		}
+		s = string(utf16.Decode(units))
+	case 3:
+		s = string(data)
+	default:
+		runes := make([]rune, len(data))
+		for i, b := range data {
+			runes[i] = rune(b)
+		}
+		s = string(runes)
+	}
+	s, _, _ = strings.Cut(s, "\x00")
+	return strings.TrimSpace(s)
+}
+
+// Seconds between the MP4 epoch (1904) and the Unix epoch
+const mp4EpochOffset = 2082844800
+
+// addMP4 reads duration, creation time and video size from the moov box of an
+// MP4 or MOV file. moov is often at the end; the boxes before it are skipped
+// (by seeking when r can).
+func (meta *FileMetadata) addMP4(r io.Reader) error {
+	for {
+		boxType, size, err := readBoxHeader(r)
+		if err != nil {
+			return nil // No moov
+		}
+		if boxType == "moov" {
+			if size < 0 || size > maxMP4Moov {
+				return errors.New("moov box too large")
+			}
+			moov := make([]byte, size)
+			if _, err := io.ReadFull(r, moov); err != nil {
+				return err
+			}
+			meta.addMoov(moov)
+			return nil
+		}
+		if size < 0 {
+			return nil // Runs to the end of the file
+		}
+		if seeker, ok := r.(io.Seeker); ok {
+			_, err = seeker.Seek(size, io.SeekCurrent)
+		} else {
+			_, err = io.CopyN(io.Discard, r, size)
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// readBoxHeader reads an MP4 box header; size is that of the content, -1 if
+// it runs to the end of the file
+func readBoxHeader(r io.Reader) (string, int64, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, err
+	}
+	size := int64(binary.BigEndian.Uint32(header))
+	boxType := string(header[4:8])
+	switch size {
+	case 0:
+		return boxType, -1, nil
+	case 1:
+		large := make([]byte, 8)
+		if _, err := io.ReadFull(r, large); err != nil {
+			return "", 0, err
+		}
+		size = int64(binary.BigEndian.Uint64(large)) - 16
+	default:
+		size -= 8
+	}
+	if size < 0 {
+		return "", 0, errors.New("invalid box size")
+	}
+	return boxType, size, nil
+}
+
+// mp4Boxes iterates the child boxes of a box's content
+func mp4Boxes(data []byte, fn func(boxType string, content []byte)) {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		boxType := string(data[4:8])
+		header := 8
+		if size == 1 && len(data) >= 16 {
+			size, header = int(binary.BigEndian.Uint64(data[8:])), 16
+		} else if size == 0 {
+			size = len(data)
+		}
+		if size < header || size > len(data) {
+			return
+		}
+		fn(boxType, data[header:size])
+		data = data[size:]
+	}
+}
+
+func (meta *FileMetadata) addMoov(moov []byte) {
+	mp4Boxes(moov, func(boxType string, content []byte) {
+		switch boxType {
+		case "mvhd":
+			var created, timescale, duration uint64
+			if len(content) >= 32 && content[0] == 1 {
+				created = binary.BigEndian.Uint64(content[4:])
+				timescale = uint64(binary.BigEndian.Uint32(content[20:]))
+				duration = binary.BigEndian.Uint64(content[24:])
+			} else if len(content) >= 20 {
+				created = uint64(binary.BigEndian.Uint32(content[4:]))
+				timescale = uint64(binary.BigEndian.Uint32(content[12:]))
+				duration = uint64(binary.BigEndian.Uint32(content[16:]))
+			}
+			if timescale > 0 {
+				meta.Duration = math.Round(float64(duration)/float64(timescale)*1000) / 1000
+			}
+			if created > mp4EpochOffset {
+				meta.Taken = int64(created - mp4EpochOffset)
+			}
+		case "trak":
+			mp4Boxes(content, func(boxType string, content []byte) {
+				if boxType != "tkhd" {
+					return
+				}
+				at := 76 // Width and height (16.16 fixed point) after the matrix
+				if len(content) > 0 && content[0] == 1 {
+					at = 88
+				}
+				if len(content) >= at+8 && meta.Width == 0 {
+					meta.Width = int(binary.BigEndian.Uint32(content[at:]) >> 16)
+					meta.Height = int(binary.BigEndian.Uint32(content[at+4:]) >> 16)
+				}
+			})
+		}
+	})
+}
+
+// dateTaken is when a photo or video was taken, 0 if unknown
+func dateTaken(fullPath string, info fs.FileInfo) int64 {
+	switch mediaType(typeByExtension(fullPath)) {
+	case "image/jpeg", "image/tiff", "video/mp4", "video/quicktime", "video/x-m4v":
+	default:
+		return 0
+	}
+	meta, err := fileMetadata(fullPath, info)
+	if err != nil {
+		return 0
+	}
+	return meta.Taken
+}
+
+// fillDateTaken sets Taken on the photos and videos of a listing of dir.
+// Reading them can take a while the first time, so a few run at once.
+func fillDateTaken(dir string, items []FileItem) {
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, 8)
+	for i := range items {
+		if items[i].IsDir {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(item *FileItem) {
+			defer func() { <-slots; wg.Done() }()
+			fullPath := filepath.Join(dir, item.Name)
+			if info, err := statPath(fullPath); err == nil {
+				item.Taken = dateTaken(fullPath, info)
+			}
+		}(&items[i])
+	}
+	wg.Wait()
+}
+
+func takenOrModified(item FileItem) int64 {
+	if item.Taken != 0 {
+		return item.Taken
+	}
+	return item.Modified
+}
+
+// handleMetadata returns the metadata of a file: EXIF for JPEG and TIFF,
+// dimensions for other images, ID3 tags for MP3, MP4/MOV container info
+func handleMetadata(c *fiber.Ctx) error {
+	relativePath := c.Query("path")
+	if relativePath == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Path parameter required",
+		})
+	}
+	fullPath, err := resolveRequestPath(c, relativePath)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	info, err := statPath(fullPath)
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status": "error",
+			"error":  "File not found",
+		})
+	}
+	if info.IsDir() {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Path is a directory, not a file",
+		})
+	}
+
+	meta, err := fileMetadata(fullPath, info)
+	if err != nil {
+		return c.Status(422).JSON(fiber.Map{
+			"status": "error",
+			"error":  fmt.Sprintf("Failed to read metadata: %v", err),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status":   "ok",
+		"path":     relativePath,
+		"size":     info.Size(),
+		"modified": info.ModTime().Unix(),
+		"metadata": meta,
+	})
+}
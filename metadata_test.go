@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"math"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type testTag struct {
+	tag, typ uint16
+	count    uint32
+	value    []byte
+}
+
+func asciiTag(tag uint16, s string) testTag {
+	return testTag{tag, 2, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func rationalTag(tag uint16, values ...uint32) testTag {
+	var b []byte
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return testTag{tag, 5, uint32(len(values) / 2), b}
+}
+
+// buildTIFF lays out a big-endian TIFF structure with IFD0 and the EXIF and
+// GPS IFDs, values longer than 4 bytes after them
+func buildTIFF(ifd0, exif, gps []testTag) []byte {
+	ifdSize := func(n int) int { return 2 + 12*n + 4 }
+	exifAt := 8 + ifdSize(len(ifd0)+2)
+	gpsAt := exifAt + ifdSize(len(exif))
+	dataAt := gpsAt + ifdSize(len(gps))
+
+	pointer := func(tag uint16, at int) testTag {
+		return testTag{tag, 4, 1, binary.BigEndian.AppendUint32(nil, uint32(at))}
+	}
+	ifd0 = append(ifd0, pointer(exifTagExifIFD, exifAt), pointer(exifTagGPSIFD, gpsAt))
+
+	out := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	var data []byte
+	for _, ifd := range [][]testTag{ifd0, exif, gps} {
+		out = binary.BigEndian.AppendUint16(out, uint16(len(ifd)))
+		for _, e := range ifd {
+			out = binary.BigEndian.AppendUint16(out, e.tag)
+			out = binary.BigEndian.AppendUint16(out, e.typ)
+			out = binary.BigEndian.AppendUint32(out, e.count)
+			if len(e.value) <= 4 {
+				out = append(out, append(e.value, make([]byte, 4-len(e.value))...)...)
+			} else {
+				out = binary.BigEndian.AppendUint32(out, uint32(dataAt+len(data)))
+				data = append(data, e.value...)
+			}
+		}
+		out = append(out, 0, 0, 0, 0) // No next IFD
+	}
+	return append(out, data...)
+}
+
+// withEXIF inserts a TIFF structure as the EXIF block of JPEG data
+func withEXIF(data, tiff []byte) []byte {
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+// id3Frame is an ID3v2.3 text frame in ISO-8859-1
+func id3Frame(id, text string) []byte {
+	frame := []byte(id)
+	frame = binary.BigEndian.AppendUint32(frame, uint32(len(text)+1))
+	return append(append(frame, 0, 0, 0), text...)
+}
+
+// mp4Box builds a box of a type around content
+func mp4Box(boxType string, content ...[]byte) []byte {
+	body := bytes.Join(content, nil)
+	box := binary.BigEndian.AppendUint32(nil, uint32(len(body)+8))
+	return append(append(box, boxType...), body...)
+}
+
+func TestMetadata(t *testing.T) {
+	setupSearchTree(t)
+
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 40, 30)), nil)
+	tiff := buildTIFF(
+		[]testTag{
+			asciiTag(exifTagMake, "Canon"),
+			asciiTag(exifTagModel, "EOS R6"),
+			{exifTagOrientation, 3, 1, []byte{0, 6}},
+		},
+		[]testTag{
+			asciiTag(exifTagDateTimeOriginal, "2023:07:14 18:30:00"),
+			asciiTag(exifTagOffsetOriginal, "+02:00"),
+			rationalTag(exifTagExposureTime, 1, 250),
+			rationalTag(exifTagFNumber, 28, 10),
+			{exifTagISO, 3, 1, []byte{0x01, 0x90}},
+		},
+		[]testTag{
+			asciiTag(gpsTagLatitudeRef, "N"),
+			rationalTag(gpsTagLatitude, 48, 1, 51, 1, 30, 1),
+			asciiTag(gpsTagLongitudeRef, "W"),
+			rationalTag(gpsTagLongitude, 2, 1, 21, 1, 0, 1),
+		},
+	)
+	os.WriteFile(filepath.Join(rootPath, "photo.jpg"), withEXIF(buf.Bytes(), tiff), 0644)
+	os.WriteFile(filepath.Join(rootPath, "old.jpg"), buf.Bytes(), 0644)
+
+	tags := bytes.Join([][]byte{id3Frame("TIT2", "Song"), id3Frame("TPE1", "Band"), id3Frame("TRCK", "3/12")}, nil)
+	tags = append(tags, make([]byte, 16)...) // Padding
+	id3 := []byte("ID3\x03\x00\x00")
+	id3 = append(id3, byte(len(tags)>>21&0x7F), byte(len(tags)>>14&0x7F), byte(len(tags)>>7&0x7F), byte(len(tags)&0x7F))
+	os.WriteFile(filepath.Join(rootPath, "song.mp3"), append(append(id3, tags...), 0xFF, 0xFB, 0x90, 0x00), 0644)
+
+	// mvhd v0: created 2020-01-01, 90000 units at 1000/s
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[4:], 1577836800+mp4EpochOffset)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)
+	binary.BigEndian.PutUint32(mvhd[16:], 90000)
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:], 1920<<16)
+	binary.BigEndian.PutUint32(tkhd[80:], 1080<<16)
+	mp4 := append(mp4Box("ftyp", []byte("isom\x00\x00\x02\x00")), mp4Box("mdat", make([]byte, 1000))...)
+	mp4 = append(mp4, mp4Box("moov", mp4Box("mvhd", mvhd), mp4Box("trak", mp4Box("tkhd", tkhd)))...)
+	os.WriteFile(filepath.Join(rootPath, "clip.mp4"), mp4, 0644)
+
+	app := fiber.New()
+	app.Get("/api/metadata", handleMetadata)
+	get := func(path string) (int, FileMetadata) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("GET", "/api/metadata?path="+path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Metadata FileMetadata `json:"metadata"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Metadata
+	}
+
+	status, meta := get("photo.jpg")
+	if status != 200 {
+		t.Fatalf("photo: status %d", status)
+	}
+	// Orientation 6 is turned by 90°, so it displays 30x40
+	if meta.Width != 30 || meta.Height != 40 || meta.Orientation != 6 {
+		t.Errorf("photo: %dx%d orientation %d, want 30x40 and 6", meta.Width, meta.Height, meta.Orientation)
+	}
+	if meta.CameraMake != "Canon" || meta.CameraModel != "EOS R6" || meta.Exposure != "1/250" || meta.FNumber != 2.8 || meta.ISO != 400 {
+		t.Errorf("photo: camera fields %+v", meta)
+	}
+	if meta.Taken != 1689352200 { // 16:30 UTC
+		t.Errorf("photo: taken %d, want 1689352200", meta.Taken)
+	}
+	if meta.GPS == nil || math.Abs(meta.GPS.Latitude-48.858333) > 1e-4 || math.Abs(meta.GPS.Longitude+2.35) > 1e-4 {
+		t.Errorf("photo: GPS %+v", meta.GPS)
+	}
+
+	if _, meta := get("song.mp3"); meta.Title != "Song" || meta.Artist != "Band" || meta.Track != "3/12" {
+		t.Errorf("song: %+v", meta)
+	}
+	if _, meta := get("clip.mp4"); meta.Duration != 90 || meta.Width != 1920 || meta.Height != 1080 || meta.Taken != 1577836800 {
+		t.Errorf("clip: %+v", meta)
+	}
+	if status, _ := get("photos"); status != 400 {
+		t.Errorf("directory: status %d, want 400", status)
+	}
+	if status, _ := get("missing.jpg"); status != 404 {
+		t.Errorf("missing: status %d, want 404", status)
+	}
+
+	// Sorted by date taken, files without one go by modification time
+	old := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	os.Chtimes(filepath.Join(rootPath, "old.jpg"), old, old)
+	items := getDirectoryListing(primaryMount(), "", "taken", "asc")
+	var order []string
+	for _, item := range items {
+		if !item.IsDir {
+			order = append(order, item.Name)
+		}
+	}
+	if len(order) < 3 || order[0] != "old.jpg" || order[1] != "clip.mp4" || order[2] != "photo.jpg" {
+		t.Errorf("sorted by taken: %v", order)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Types the system tables often lack (minimal containers have no
+// /etc/mime.types, Go's own table is short)
+var fallbackTypes = map[string]string{
+	".avif": "image/avif",
+	".bmp":  "image/bmp",
+	".gif":  "image/gif",
+	".heic": "image/heic",
+	".ico":  "image/x-icon",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".svg":  "image/svg+xml",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".webp": "image/webp",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".mov":  "video/quicktime",
+	".mkv":  "video/x-matroska",
+	".webm": "video/webm",
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".flac": "audio/flac",
+	".ogg":  "audio/ogg",
+	".wav":  "audio/wav",
+	".pdf":  "application/pdf",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".odp":  "application/vnd.oasis.opendocument.presentation",
+	".rtf":  "application/rtf",
+	".txt":  "text/plain; charset=utf-8",
+	".md":   "text/markdown; charset=utf-8",
+	".log":  "text/plain; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+	".json": "application/json",
+	".js":   "text/javascript; charset=utf-8",
+	".css":  "text/css; charset=utf-8",
+	".html": "text/html; charset=utf-8",
+	".htm":  "text/html; charset=utf-8",
+	".xml":  "text/xml; charset=utf-8",
+}
+
+// Image types browsers show, and so the lightbox. TIFF only works in Safari
+// but is still better opened there than downloaded.
+var viewableImageTypes = map[string]bool{
+	"image/avif":               true,
+	"image/bmp":                true,
+	"image/gif":                true,
+	"image/jpeg":               true,
+	"image/png":                true,
+	"image/svg+xml":            true,
+	"image/tiff":               true,
+	"image/webp":               true,
+	"image/x-icon":             true,
+	"image/vnd.microsoft.icon": true,
+}
+
+// Document types the document viewer opens (PDF directly, the rest through LibreOffice)
+var documentTypes = map[string]bool{
+	"application/pdf":               true,
+	"application/msword":            true,
+	"application/vnd.ms-excel":      true,
+	"application/vnd.ms-powerpoint": true,
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   true,
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         true,
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": true,
+	"application/vnd.oasis.opendocument.text":                                   true,
+	"application/vnd.oasis.opendocument.spreadsheet":                            true,
+	"application/vnd.oasis.opendocument.presentation":                           true,
+	"application/rtf": true,
+}
+
+var (
+	mimeTypesFile string            // --mime-types
+	mimeOverrides map[string]string // Extension (".raw") to type, before everything else
+)
+
+// loadMimeOverrides reads the --mime-types file: {".ext": "type/subtype"}
+func loadMimeOverrides(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("invalid MIME types file %s: %w", path, err)
+	}
+	overrides := make(map[string]string, len(raw))
+	for ext, contentType := range raw {
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return nil, fmt.Errorf("invalid type for %s: %q", ext, contentType)
+		}
+		overrides[normalizeExtension(ext)] = contentType
+	}
+	return overrides, nil
+}
+
+// typeByExtension looks a file name up in the overrides, the system tables
+// and the fallback table. "" if its extension is unknown or it has none.
+func typeByExtension(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	if ext == "" {
+		return ""
+	}
+	if contentType, ok := mimeOverrides[ext]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return fallbackTypes[ext]
+}
+
+// Sniffed types that would run scripts on our origin if served inline. Files
+// without an extension that look like these are sent as plain text.
+var activeSniffedTypes = map[string]bool{
+	"text/html":             true,
+	"text/xml":              true,
+	"application/xml":       true,
+	"application/xhtml+xml": true,
+	"image/svg+xml":         true,
+}
+
+// contentTypeOf is the type a stored file is served with: by extension, or
+// sniffed from its first bytes when the extension doesn't tell
+func contentTypeOf(fullPath string, info fs.FileInfo) string {
+	if contentType := typeByExtension(fullPath); contentType != "" {
+		return contentType
+	}
+	r, err := openStored(fullPath, info)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer r.Close()
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(r, head)
+	contentType := http.DetectContentType(head[:n])
+	if activeSniffedTypes[mediaType(contentType)] {
+		return "text/plain; charset=utf-8"
+	}
+	return contentType
+}
+
+// mediaType strips parameters: "text/plain; charset=utf-8" is "text/plain"
+func mediaType(contentType string) string {
+	t, _, _ := strings.Cut(contentType, ";")
+	return strings.ToLower(strings.TrimSpace(t))
+}
+
+// fileKind groups a content type for icons and preview routing: image,
+// document, video, audio, text or file
+func fileKind(contentType string) string {
+	t := mediaType(contentType)
+	switch {
+	case viewableImageTypes[t]:
+		return "image"
+	case documentTypes[t]:
+		return "document"
+	case strings.HasPrefix(t, "video/"):
+		return "video"
+	case strings.HasPrefix(t, "audio/"):
+		return "audio"
+	case strings.HasPrefix(t, "text/"):
+		return "text"
+	}
+	return "file"
+}
+
+// extensionsOfKind lists the extensions the browser routes as kind (for the
+// listing, which goes by name), from all the tables
+func extensionsOfKind(kind string) []string {
+	seen := make(map[string]bool)
+	var types []string
+	for contentType := range viewableImageTypes {
+		types = append(types, contentType)
+	}
+	for contentType := range documentTypes {
+		types = append(types, contentType)
+	}
+	for _, contentType := range types {
+		exts, _ := mime.ExtensionsByType(contentType)
+		for _, ext := range exts {
+			seen[strings.ToLower(ext)] = true
+		}
+	}
+	for ext := range fallbackTypes {
+		seen[ext] = true
+	}
+	for ext := range mimeOverrides {
+		seen[ext] = true
+	}
+
+	var exts []string
+	for ext := range seen {
+		// Checked again, so overrides win over the tables
+		if fileKind(typeByExtension(ext)) == kind {
+			exts = append(exts, ext)
+		}
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// itemKind is the kind of a listing entry, for its icon and what opening it does
+func itemKind(name string, isDir bool) string {
+	if isDir {
+		return "folder"
+	}
+	return fileKind(typeByExtension(name))
+}
+
+// setContentType sets the type of a file response. Browsers must not guess
+// otherwise, and SVG (which can carry scripts) is shown without running them.
+func setContentType(c *fiber.Ctx, contentType string) {
+	c.Set(fiber.HeaderContentType, contentType)
+	c.Set(fiber.HeaderXContentTypeOptions, "nosniff")
+	if mediaType(contentType) == "image/svg+xml" {
+		c.Set(fiber.HeaderContentSecurityPolicy, "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+	}
+}
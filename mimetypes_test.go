@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestContentTypes(t *testing.T) {
+	setupSearchTree(t)
+	old := mimeOverrides
+	t.Cleanup(func() { mimeOverrides = old })
+	overridesFile := filepath.Join(t.TempDir(), "mime.json")
+	os.WriteFile(overridesFile, []byte(`{"raw": "image/x-raw", ".PNG": "application/x-not-png"}`), 0644)
+	var err error
+	if mimeOverrides, err = loadMimeOverrides(overridesFile); err != nil {
+		t.Fatal(err)
+	}
+
+	kinds := map[string]string{
+		"a.gif": "image", "a.WEBP": "image", "a.avif": "image", "a.svg": "image",
+		"a.bmp": "image", "a.tiff": "image", "a.jpeg": "image",
+		"a.pdf": "document", "a.odt": "document", "a.xlsx": "document",
+		"a.mp4": "video", "a.mp3": "audio", "a.md": "text",
+		"a.raw": "file", "a.png": "file", // Overridden
+		"a.unknownext": "file", "noext": "file",
+	}
+	for name, want := range kinds {
+		if got := fileKind(typeByExtension(name)); got != want {
+			t.Errorf("%s: got kind %s (%q), want %s", name, got, typeByExtension(name), want)
+		}
+	}
+	// Listings carry the kind, with the overrides applied
+	os.WriteFile(filepath.Join(rootPath, "scan.raw"), []byte("raw"), 0644)
+	listed := map[string]string{}
+	for _, item := range getDirectoryListing(primaryMount(), "", "name", "asc") {
+		listed[item.Name] = item.Kind
+	}
+	if listed["photos"] != "folder" || listed["notes.txt"] != "text" || listed["scan.raw"] != "file" {
+		t.Errorf("Unexpected kinds in the listing: %v", listed)
+	}
+	if items := getDirectoryListing(primaryMount(), "photos", "name", "asc"); len(items) < 2 || items[1].Kind != "image" {
+		t.Errorf("Expected beach.jpg to be listed as an image: %+v", items)
+	}
+	images := extensionsOfKind("image")
+	if !slices.Contains(images, ".webp") || !slices.Contains(images, ".svg") || slices.Contains(images, ".png") || slices.Contains(images, ".pdf") {
+		t.Errorf("Unexpected image extensions %v", images)
+	}
+
+	// Names that don't tell are sniffed
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+	os.WriteFile(filepath.Join(rootPath, "picture"), png, 0644)
+	os.WriteFile(filepath.Join(rootPath, "drawing.svg"), []byte(`<svg xmlns="http://www.w3.org/2000/svg"/>`), 0644)
+	app := fiber.New()
+	app.Get("/image", handleImageStream)
+	app.Get("/file", handleFileStream)
+
+	resp, _ := app.Test(httptest.NewRequest("GET", "/image?path=picture", nil))
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "image/png" {
+		t.Errorf("Expected the sniffed PNG, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	resp, _ = app.Test(httptest.NewRequest("GET", "/image?path=drawing.svg", nil))
+	if resp.StatusCode != 200 || resp.Header.Get("Content-Type") != "image/svg+xml" || resp.Header.Get("Content-Security-Policy") == "" {
+		t.Errorf("Expected the SVG with a CSP, got %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	// HTML without an extension is not served as HTML
+	os.WriteFile(filepath.Join(rootPath, "page"), []byte("<html><script>alert(1)</script></html>"), 0644)
+	os.WriteFile(filepath.Join(rootPath, "feed"), []byte(`<?xml version="1.0"?><rss/>`), 0644)
+	for _, name := range []string{"page", "feed"} {
+		resp, _ = app.Test(httptest.NewRequest("GET", "/file?path="+name, nil))
+		if mediaType(resp.Header.Get("Content-Type")) != "text/plain" {
+			t.Errorf("Expected %s as plain text, got %s", name, resp.Header.Get("Content-Type"))
+		}
+	}
+	if resp, _ := app.Test(httptest.NewRequest("GET", "/image?path=notes.txt", nil)); resp.StatusCode != 400 {
+		t.Errorf("Expected 400 for text as an image, got %d", resp.StatusCode)
+	}
+	resp, _ = app.Test(httptest.NewRequest("GET", "/file?path=photos/2024/notes.md", nil))
+	if mediaType(resp.Header.Get("Content-Type")) != "text/markdown" || resp.Header.Get("X-Content-Type-Options") != "nosniff" {
+		t.Errorf("Unexpected headers for markdown: %v", resp.Header)
+	}
+
+	if _, err := loadMimeOverrides(writeTempFile(t, `{".x": "not a type"}`)); err == nil {
+		t.Error("Expected an invalid type to be refused")
+	}
+}
+
+func writeTempFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
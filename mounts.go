@@ -0,0 +1,289 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"file-browser/scan"
+	"file-browser/storage"
+)
+
+// mount is a named root. The primary mount is --path with the top-level flags
+// (--write, --modifications-log, the "sizes" bucket) and keeps its state in
+// the globals; --mounts adds more roots, each with its own write mode, size
+// tree, bbolt bucket and modifications log. All of them share rootFS, which
+// dispatches on the full path, so full paths identify the mount.
+type mount struct {
+	Name      string
+	Path      string // Root as a full path in rootFS
+	WriteMode bool
+	LogFile   string
+	Bucket    string         // bbolt bucket for the size tree
+	SizeTree  *scan.FileData // nil without sizes
+}
+
+// MountConfig is one entry of the --mounts JSON file
+type MountConfig struct {
+	Name             string `json:"name"`
+	Path             string `json:"path"` // Local directory or s3://bucket/prefix
+	Write            bool   `json:"write"`
+	ModificationsLog string `json:"modificationsLog"` // Default: --modifications-log with the name added
+}
+
+// RootInfo describes a mount to clients
+type RootInfo struct {
+	Name      string `json:"name"`
+	WriteMode bool   `json:"writeMode"`
+	Primary   bool   `json:"primary"`
+}
+
+var (
+	mountsFile  string   // JSON file with extra mounts
+	rootName    string   // Name of the primary mount (default: base name of --path)
+	extraMounts []*mount // Mounts from --mounts
+)
+
+// primaryMount returns the --path mount. It is rebuilt from the globals on
+// every call, so the tests (and anything else) can keep setting those directly.
+func primaryMount() *mount {
+	m := &mount{
+		Name:      rootName,
+		Path:      rootPath,
+		WriteMode: writeMode,
+		LogFile:   modificationsLogFile,
+		Bucket:    "sizes",
+	}
+	if withSizes {
+		m.SizeTree = sizeTreeRoot
+	}
+	return m
+}
+
+// allMounts returns the primary mount followed by the extra mounts
+func allMounts() []*mount {
+	return append([]*mount{primaryMount()}, extraMounts...)
+}
+
+// mountByName returns the mount for a client's root parameter ("" is the primary mount)
+func mountByName(name string) (*mount, error) {
+	if name == "" || name == rootName {
+		return primaryMount(), nil
+	}
+	for _, m := range extraMounts {
+		if m.Name == name {
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown root: %s", name)
+}
+
+// requestMount returns the mount named by the root query parameter
+func requestMount(c *fiber.Ctx) (*mount, error) {
+	return mountByName(c.Query("root"))
+}
+
+// resolveRequestPath resolves relativePath in the root named by the root query parameter
+func resolveRequestPath(c *fiber.Ctx, relativePath string) (string, error) {
+	m, err := requestMount(c)
+	if err != nil {
+		return "", err
+	}
+	return m.resolve(relativePath)
+}
+
+// mountOf returns the mount that fullPath belongs to
+func mountOf(fullPath string) *mount {
+	for _, m := range extraMounts {
+		if isWithin(fullPath, m.Path) {
+			return m
+		}
+	}
+	return primaryMount()
+}
+
+// isWithin reports whether fullPath is root or below it. A root that ends in
+// a separator ("/" with --path /) is a prefix as it is.
+func isWithin(fullPath, root string) bool {
+	if fullPath == root {
+		return true
+	}
+	if !strings.HasSuffix(root, string(filepath.Separator)) {
+		root += string(filepath.Separator)
+	}
+	return strings.HasPrefix(fullPath, root)
+}
+
+// resolve joins a client supplied relative path onto the mount root and
+// rejects paths that would escape it (e.g. "../..")
+func (m *mount) resolve(relativePath string) (string, error) {
+	fullPath := filepath.Join(m.Path, relativePath)
+	if !isWithin(fullPath, m.Path) {
+		return "", fmt.Errorf("path is outside of the served root: %s", relativePath)
+	}
+	return fullPath, nil
+}
+
+// rel converts a full path below the mount root to the slash-separated relative form
+func (m *mount) rel(fullPath string) (string, bool) {
+	rel, err := filepath.Rel(m.Path, fullPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	if rel == "." {
+		return "", true
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// logModification appends a file operation to the mount's modifications log
+func (m *mount) logModification(action string, sources []string, dest string, errors []string) {
+	writeModificationLog(m.LogFile, newModificationLogEntry(action, sources, dest, errors))
+}
+
+func (m *mount) info() RootInfo {
+	return RootInfo{Name: m.Name, WriteMode: m.WriteMode, Primary: m.Path == rootPath}
+}
+
+// sizeTreeFor returns the size tree that fullPath belongs to, nil without sizes
+func sizeTreeFor(fullPath string) *scan.FileData {
+	return mountOf(fullPath).SizeTree
+}
+
+// sizesBucketOf returns the bbolt bucket of the tree that node is in
+func sizesBucketOf(node *scan.FileData) []byte {
+	root := node
+	for root.Parent != nil {
+		root = root.Parent
+	}
+	for _, m := range extraMounts {
+		if m.SizeTree == root {
+			return []byte(m.Bucket)
+		}
+	}
+	return []byte("sizes")
+}
+
+// loadMountConfigs reads and validates the --mounts file
+func loadMountConfigs(path string) ([]MountConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []MountConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("invalid mounts file %s: %w", path, err)
+	}
+
+	names := map[string]bool{rootName: true}
+	for _, config := range configs {
+		if config.Name == "" || config.Path == "" {
+			return nil, fmt.Errorf("every mount needs a name and a path")
+		}
+		if strings.ContainsAny(config.Name, "/\\") {
+			return nil, fmt.Errorf("mount name cannot contain path separators: %s", config.Name)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("duplicate root name: %s", config.Name)
+		}
+		names[config.Name] = true
+	}
+	return configs, nil
+}
+
+// defaultMountLog derives a log file for a mount from --modifications-log,
+// e.g. modifications.jsonl -> modifications.media.jsonl
+func defaultMountLog(name string) string {
+	ext := filepath.Ext(modificationsLogFile)
+	return strings.TrimSuffix(modificationsLogFile, ext) + "." + name + ext
+}
+
+// setupMounts opens the roots from --mounts, builds their size trees and
+// switches rootFS to a storage.Mux that serves all of them
+func setupMounts() error {
+	if rootName == "" {
+		rootName = filepath.Base(rootPath)
+	}
+	if mountsFile == "" {
+		return nil
+	}
+	configs, err := loadMountConfigs(mountsFile)
+	if err != nil {
+		return err
+	}
+
+	mux := storage.NewMux(rootFS)
+	roots := []string{rootPath}
+	for _, config := range configs {
+		fsys, path, err := openRootStorage(config.Path)
+		if err != nil {
+			return fmt.Errorf("root %s: %w", config.Name, err)
+		}
+		// Overlapping roots would make full paths ambiguous
+		for _, other := range roots {
+			if isWithin(path, other) || isWithin(other, path) {
+				return fmt.Errorf("root %s (%s) overlaps %s", config.Name, path, other)
+			}
+		}
+		roots = append(roots, path)
+		mux.Mount(path, fsys)
+
+		m := &mount{
+			Name:      config.Name,
+			Path:      path,
+			WriteMode: config.Write,
+			LogFile:   config.ModificationsLog,
+			Bucket:    "sizes:" + config.Name,
+		}
+		if m.LogFile == "" {
+			m.LogFile = defaultMountLog(config.Name)
+		}
+		extraMounts = append(extraMounts, m)
+		log.Printf("Serving root %s from: %s (write: %v, log: %s)", m.Name, m.Path, m.WriteMode, m.LogFile)
+	}
+	rootFS = mux
+
+	// Sizes follow the primary root: with --sizes-db every mount has its own
+	// bucket, otherwise (--with-sizes, --sizes) mounts are scanned at startup
+	if !withSizes {
+		return nil
+	}
+	for _, m := range extraMounts {
+		if boltDB != nil {
+			if tree, err := loadSizeTreeFromBolt(boltDB, m.Bucket, m.Path); err == nil && tree != nil {
+				m.SizeTree = tree
+				continue
+			}
+		}
+		log.Printf("Computing directory sizes for root %s...", m.Name)
+		tree, err := scanSizeTree(m.Path)
+		if err != nil {
+			log.Printf("Warning: Failed to compute sizes for root %s: %v", m.Name, err)
+			continue
+		}
+		m.SizeTree = tree
+		if boltDB != nil {
+			if err := saveSizeTreeToBolt(boltDB, m.Bucket, tree); err != nil {
+				log.Printf("Warning: Failed to save sizes of root %s to database: %v", m.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// handleRoots lists the roots for the root switcher
+func handleRoots(c *fiber.Ctx) error {
+	roots := []RootInfo{}
+	for _, m := range allMounts() {
+		roots = append(roots, m.info())
+	}
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"roots":  roots,
+	})
+}
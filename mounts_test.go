@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"file-browser/scan"
+	"file-browser/storage"
+)
+
+// addTestMount serves an in-memory root named name next to the primary one
+func addTestMount(t *testing.T, name string, write bool) (*mount, *storage.Memory) {
+	t.Helper()
+	fsys := storage.NewMemory("/" + name)
+	w, _ := fsys.Create("/" + name + "/readme.txt")
+	io.WriteString(w, "abc")
+	w.Close()
+
+	oldFS, oldMounts := rootFS, extraMounts
+	t.Cleanup(func() { rootFS, extraMounts = oldFS, oldMounts })
+	mux := storage.NewMux(rootFS)
+	mux.Mount(fsys.Root(), fsys)
+	rootFS = mux
+
+	children, err := scan.ScanFSConcurrent(fsys, fsys.Root(), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := &scan.FileData{ID: name, Name: name, RootPath: fsys.Root(), IsDir: true, Children: children, CachedSize: -1}
+	tree.RebuildParentPointers(nil)
+	tree.Size()
+
+	m := &mount{
+		Name:      name,
+		Path:      fsys.Root(),
+		WriteMode: write,
+		LogFile:   filepath.Join(t.TempDir(), name+".jsonl"),
+		Bucket:    "sizes:" + name,
+		SizeTree:  tree,
+	}
+	extraMounts = append(extraMounts, m)
+	return m, fsys
+}
+
+func readLog(t *testing.T, path string) []ModificationLogEntry {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []ModificationLogEntry
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry ModificationLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestMounts(t *testing.T) {
+	setupSearchTree(t)
+	loadTestSizeTree(t)
+	enableTestWriteMode(t)
+	oldName := rootName
+	t.Cleanup(func() { rootName = oldName })
+	rootName = "primary"
+	media, mediaFS := addTestMount(t, "media", true)
+	archive, _ := addTestMount(t, "archive", false)
+
+	app := fiber.New()
+	app.Get("/manage", handleManage)
+	app.Post("/rename", handleRename)
+	app.Get("/file", handleFileStream)
+	app.Get("/api/roots", handleRoots)
+	do := func(method, target, body string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	if _, body := do("GET", "/api/roots", ""); !strings.Contains(body, `"name":"media","writeMode":true`) || !strings.Contains(body, `"name":"archive","writeMode":false`) {
+		t.Errorf("Unexpected roots: %s", body)
+	}
+	if items := getDirectoryListing(media, "", "name", "asc"); len(items) != 1 || items[0].Path != "readme.txt" || items[0].Size != 3 {
+		t.Errorf("Unexpected media listing: %+v", items)
+	}
+	if status, body := do("GET", "/file?root=media&path=readme.txt", ""); status != 200 || body != "abc" {
+		t.Errorf("Expected file from the media root, got %d %q", status, body)
+	}
+	if status, _ := do("GET", "/file?root=nope&path=readme.txt", ""); status != 400 {
+		t.Errorf("Expected 400 for an unknown root, got %d", status)
+	}
+	if status, body := do("GET", "/manage?action=move&srcs=notes.txt&dest=photos", ""); status != 400 || !strings.Contains(body, "copy, paste, delete, extract, compress") {
+		t.Errorf("Expected the accepted actions for an unknown one, got %d %s", status, body)
+	}
+
+	// Copy from the primary root into media: sizes and logs of both roots
+	primaryTotal := sizeTreeRoot.Size()
+	if status, body := do("GET", "/manage?action=copy&srcs=notes.txt&dest=&destRoot=media", ""); status != 200 || !strings.Contains(body, "ok") {
+		t.Fatalf("copy between roots failed: %d %s", status, body)
+	}
+	if _, err := mediaFS.Stat("/media/notes.txt"); err != nil {
+		t.Errorf("Copied file missing: %v", err)
+	}
+	if media.SizeTree.Size() != 8 || sizeTreeRoot.Size() != primaryTotal {
+		t.Errorf("Unexpected sizes after copy: media %d, primary %d", media.SizeTree.Size(), sizeTreeRoot.Size())
+	}
+	for _, logFile := range []string{modificationsLogFile, media.LogFile} {
+		entries := readLog(t, logFile)
+		if len(entries) != 1 || entries[0].Action != "copy" || entries[0].DestRoot != "media" {
+			t.Errorf("Unexpected log in %s: %+v", logFile, entries)
+		}
+	}
+
+	// Move from media back into the primary root
+	if status, body := do("GET", "/manage?action=paste&root=media&srcs=readme.txt&dest=photos&destRoot=primary", ""); status != 200 || !strings.Contains(body, "ok") {
+		t.Fatalf("move between roots failed: %d %s", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(rootPath, "photos", "readme.txt")); err != nil {
+		t.Errorf("Moved file missing: %v", err)
+	}
+	if media.SizeTree.Size() != 5 || sizeTreeRoot.Size() != primaryTotal+3 {
+		t.Errorf("Unexpected sizes after move: media %d, primary %d", media.SizeTree.Size(), sizeTreeRoot.Size())
+	}
+
+	// The read-only root can be copied from but not changed
+	if status, _ := do("GET", "/manage?action=copy&root=archive&srcs=readme.txt&dest=&destRoot=media", ""); status != 200 {
+		t.Errorf("Expected copy out of the read-only root to work, got %d", status)
+	}
+	if status, _ := do("GET", "/manage?action=paste&root=archive&srcs=readme.txt&dest=&destRoot=media", ""); status != 403 {
+		t.Errorf("Expected 403 moving out of the read-only root, got %d", status)
+	}
+	if status, _ := do("GET", "/manage?action=new_folder&root=archive&dest=&name=x", ""); status != 403 {
+		t.Errorf("Expected 403 for new_folder in the read-only root, got %d", status)
+	}
+	if status, _ := do("POST", "/rename", `{"root":"archive","path":"readme.txt","newName":"x.txt"}`); status != 403 {
+		t.Errorf("Expected 403 renaming in the read-only root, got %d", status)
+	}
+	if entries := readLog(t, archive.LogFile); len(entries) != 1 || entries[0].Action != "copy" {
+		t.Errorf("Expected only the copy in the read-only root's log, got %+v", entries)
+	}
+
+	// Paths can't escape into another root
+	if status, _ := do("GET", "/manage?action=delete&root=media&srcs=../archive/readme.txt", ""); status != 200 {
+		t.Fatalf("Unexpected status for an escaping delete: %d", status)
+	}
+	if _, err := rootFS.Stat("/archive/readme.txt"); err != nil {
+		t.Errorf("Delete escaped into another root: %v", err)
+	}
+}
+
+func TestIsWithin(t *testing.T) {
+	for _, c := range []struct {
+		fullPath, root string
+		want           bool
+	}{
+		{"/srv/files", "/srv/files", true},
+		{"/srv/files/a/b", "/srv/files", true},
+		{"/srv/files2", "/srv/files", false},
+		{"/srv", "/srv/files", false},
+		// --path /
+		{"/", "/", true},
+		{"/etc/passwd", "/", true},
+	} {
+		if got := isWithin(c.fullPath, c.root); got != c.want {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", c.fullPath, c.root, got, c.want)
+		}
+	}
+	m := &mount{Path: "/"}
+	if fullPath, err := m.resolve("etc/hosts"); err != nil || fullPath != "/etc/hosts" {
+		t.Errorf("resolve below /: %q, %v", fullPath, err)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"file-browser/scan"
+)
+
+const (
+	defaultRecentLimit = 100
+	maxRecentLimit     = 5000
+)
+
+// recentHeap is a min-heap on Modified, used to keep the N newest files
+type recentHeap []FileItem
+
+func (h recentHeap) Len() int           { return len(h) }
+func (h recentHeap) Less(i, j int) bool { return h[i].Modified < h[j].Modified }
+func (h recentHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *recentHeap) Push(x any)        { *h = append(*h, x.(FileItem)) }
+func (h *recentHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// parseWithin parses a time window like "90m", "24h" or "7d"
+func parseWithin(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid within: %s", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid within: %s", s)
+	}
+	return d, nil
+}
+
+// recentFiles returns the most recently modified files below startPath, newest first.
+// It only looks at the Modified values in the size tree, no disk access.
+func recentFiles(tree *scan.FileData, startPath, startRel string, since int64, limit int) []FileItem {
+	h := &recentHeap{}
+
+	sizeTreeMutex.RLock()
+	if start := tree.FindByPath(startPath); start != nil {
+		var visit func(node *scan.FileData, rel string)
+		visit = func(node *scan.FileData, rel string) {
+			for _, child := range node.Children {
+				if strings.HasPrefix(child.Name, ".") {
+					continue
+				}
+				childRel := child.Name
+				if rel != "" {
+					childRel = rel + "/" + child.Name
+				}
+				if child.IsDir {
+					if !child.IsLink {
+						visit(child, childRel)
+					}
+					continue
+				}
+				if child.Modified < since {
+					continue
+				}
+				if h.Len() == limit && (*h)[0].Modified >= child.Modified {
+					continue
+				}
+				heap.Push(h, FileItem{
+					Name:     child.Name,
+					Path:     childRel,
+					Size:     child.Size(),
+					Modified: child.Modified,
+				})
+				if h.Len() > limit {
+					heap.Pop(h)
+				}
+			}
+		}
+		visit(start, startRel)
+	}
+	sizeTreeMutex.RUnlock()
+
+	items := []FileItem(*h)
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Modified != items[j].Modified {
+			return items[i].Modified > items[j].Modified
+		}
+		return items[i].Path < items[j].Path
+	})
+	return items
+}
+
+// handleRecent returns the most recently modified files across the tree or a subtree,
+// limited by count (limit) and/or time window (since as unix seconds, or within like "24h" or "7d")
+func handleRecent(c *fiber.Ctx) error {
+	m, err := requestMount(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	if m.SizeTree == nil {
+		return c.Status(503).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Recent files need the size tree. Use --with-sizes, --sizes or --sizes-db",
+		})
+	}
+
+	relativePath := c.Query("path")
+	startPath, err := m.resolve(relativePath)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	startRel := cleanRelativePath(relativePath)
+
+	limit := c.QueryInt("limit", defaultRecentLimit)
+	if limit <= 0 || limit > maxRecentLimit {
+		limit = maxRecentLimit
+	}
+
+	var since int64
+	if v := c.Query("since"); v != "" {
+		since, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"status": "error",
+				"error":  "Invalid since: " + v,
+			})
+		}
+	}
+	if v := c.Query("within"); v != "" {
+		within, err := parseWithin(v)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{
+				"status": "error",
+				"error":  err.Error(),
+			})
+		}
+		since = max(since, time.Now().Add(-within).Unix())
+	}
+
+	items := recentFiles(m.SizeTree, startPath, startRel, since, limit)
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"items":  items,
+	})
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"file-browser/scan"
+)
+
+func TestParseWithin(t *testing.T) {
+	tests := map[string]time.Duration{
+		"90m": 90 * time.Minute,
+		"24h": 24 * time.Hour,
+		"7d":  7 * 24 * time.Hour,
+	}
+	for input, expected := range tests {
+		got, err := parseWithin(input)
+		if err != nil || got != expected {
+			t.Errorf("parseWithin(%q) = %v, %v; expected %v", input, got, err, expected)
+		}
+	}
+	for _, input := range []string{"", "d", "-1d", "soon"} {
+		if _, err := parseWithin(input); err == nil {
+			t.Errorf("parseWithin(%q) should fail", input)
+		}
+	}
+}
+
+func TestRecentFiles(t *testing.T) {
+	oldTree := sizeTreeRoot
+	t.Cleanup(func() { sizeTreeRoot = oldTree })
+
+	root := &scan.FileData{ID: "root", Name: "root", RootPath: "/srv", IsDir: true}
+	docs := &scan.FileData{ID: "docs", Name: "docs", IsDir: true}
+	root.Children = []*scan.FileData{
+		{ID: "a", Name: "a.txt", CachedSize: 1, Modified: 100},
+		{ID: "h", Name: ".hidden", CachedSize: 1, Modified: 999},
+		docs,
+	}
+	docs.Children = []*scan.FileData{
+		{ID: "b", Name: "b.txt", CachedSize: 1, Modified: 300},
+		{ID: "c", Name: "c.txt", CachedSize: 1, Modified: 200},
+	}
+	root.RebuildParentPointers(nil)
+	sizeTreeRoot = root
+
+	items := recentFiles(root, "/srv", "", 0, 2)
+	if len(items) != 2 || items[0].Path != "docs/b.txt" || items[1].Path != "docs/c.txt" {
+		t.Errorf("Expected the 2 newest files, got %+v", items)
+	}
+
+	items = recentFiles(root, "/srv", "", 150, 10)
+	if len(items) != 2 {
+		t.Errorf("Expected 2 files modified since 150, got %+v", items)
+	}
+
+	items = recentFiles(root, "/srv/docs", "docs", 0, 10)
+	if len(items) != 2 || items[0].Path != "docs/b.txt" {
+		t.Errorf("Expected files below docs only, got %+v", items)
+	}
+}
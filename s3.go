@@ -0,0 +1,1094 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3XMLNamespace     = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3DefaultMaxKeys   = 1000
+	s3MaxParts         = 10000
+	s3TimeFormat       = "2006-01-02T15:04:05.000Z"
+	s3TempPrefix       = ".wile-s3-" // Hidden temp files, renamed into place when complete
+	s3MultipartDirName = "s3-multipart"
+)
+
+var (
+	s3Port         string // Port for the S3 gateway (empty = disabled)
+	s3MultipartDir = filepath.Join("uploads", s3MultipartDirName)
+)
+
+// HTTP status for each S3 error code we return
+var s3ErrorStatus = map[string]int{
+	"AccessDenied":                 403,
+	"InvalidAccessKeyId":           403,
+	"SignatureDoesNotMatch":        403,
+	"RequestTimeTooSkewed":         403,
+	"AuthorizationHeaderMalformed": 400,
+	"XAmzContentSHA256Mismatch":    400,
+	"BadDigest":                    400,
+	"InvalidArgument":              400,
+	"InvalidBucketName":            400,
+	"InvalidRequest":               400,
+	"InvalidPart":                  400,
+	"InvalidPartOrder":             400,
+	"MalformedXML":                 400,
+	"NoSuchBucket":                 404,
+	"NoSuchKey":                    404,
+	"NoSuchUpload":                 404,
+	"BucketAlreadyOwnedByYou":      409,
+	"BucketNotEmpty":               409,
+	"MethodNotAllowed":             405,
+	"NotImplemented":               501,
+	"InternalError":                500,
+}
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+// s3Request is one authenticated request against the gateway
+type s3Request struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	key    AccessKey
+	auth   *sigV4Auth
+	bucket string
+	object string // Object key, "" for bucket and service requests
+}
+
+func (req *s3Request) error(code, message string) {
+	status, ok := s3ErrorStatus[code]
+	if !ok {
+		status = 500
+	}
+	req.w.Header().Set("Content-Type", "application/xml")
+	req.w.WriteHeader(status)
+	if req.r.Method == "HEAD" {
+		return
+	}
+	io.WriteString(req.w, xml.Header)
+	xml.NewEncoder(req.w).Encode(s3ErrorResponse{Code: code, Message: message, Resource: req.r.URL.Path})
+}
+
+func (req *s3Request) xml(v any) {
+	req.w.Header().Set("Content-Type", "application/xml")
+	io.WriteString(req.w, xml.Header)
+	if err := xml.NewEncoder(req.w).Encode(v); err != nil {
+		log.Printf("S3: failed to encode response: %v", err)
+	}
+}
+
+// body returns the request body, decoded and verified against the signature
+func (req *s3Request) body() io.Reader {
+	return s3Body(req.r, req.auth, req.key.SecretKey)
+}
+
+// bucketPath returns the directory for the bucket (a top-level directory of the root)
+func s3BucketPath(bucket string) (string, bool) {
+	if bucket == "" || bucket == "." || bucket == ".." || strings.ContainsAny(bucket, `/\`) {
+		return "", false
+	}
+	return filepath.Join(rootPath, bucket), true
+}
+
+// s3ObjectPath maps an object key to a path below the bucket directory. Keys
+// with empty, "." or ".." segments can't be represented as files and are rejected.
+// A trailing slash (folder marker) is allowed.
+func s3ObjectPath(bucket, key string) (string, bool) {
+	bucketPath, ok := s3BucketPath(bucket)
+	if !ok || key == "" {
+		return "", false
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.Contains(segment, `\`) {
+			return "", false
+		}
+	}
+	return filepath.Join(bucketPath, filepath.FromSlash(key)), true
+}
+
+// s3RelPath is the root-relative path used in the modifications log
+func s3RelPath(bucket, key string) string {
+	return strings.TrimSuffix(bucket+"/"+key, "/")
+}
+
+// s3ETag is a cheap ETag for files we don't have a digest for. The dash makes
+// clients treat it like a multipart ETag instead of comparing it with an MD5.
+func s3ETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format(s3TimeFormat)
+}
+
+// newS3Handler serves the root as an S3-compatible API (path-style requests only)
+func newS3Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := &s3Request{w: w, r: r}
+		req.bucket, req.object, _ = strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+		auth, err := parseSigV4(r)
+		if err != nil {
+			req.error(err.Error(), "Could not parse the request signature")
+			return
+		}
+		if auth == nil {
+			req.error("AccessDenied", "Anonymous access is not allowed")
+			return
+		}
+		key, ok := accessKeys.get(auth.accessKeyID)
+		if !ok {
+			req.error("InvalidAccessKeyId", "The access key does not exist")
+			return
+		}
+		if err := auth.verify(r, key.SecretKey, time.Now()); err != nil {
+			req.error(err.Error(), "The request signature does not match")
+			return
+		}
+		req.key, req.auth = key, auth
+
+		if r.Method != "GET" && r.Method != "HEAD" {
+			if !writeMode {
+				req.error("AccessDenied", "File operations are disabled. Use --write flag to enable write mode")
+				return
+			}
+			if key.ReadOnly {
+				req.error("AccessDenied", "This access key is read-only")
+				return
+			}
+			fileOpsInProgress.Add(1)
+			defer fileOpsInProgress.Done()
+		}
+
+		switch {
+		case req.bucket == "":
+			if r.Method != "GET" {
+				req.error("MethodNotAllowed", "")
+				return
+			}
+			req.listBuckets()
+		case req.object == "":
+			req.serveBucket()
+		default:
+			req.serveObject()
+		}
+	})
+}
+
+func (req *s3Request) serveBucket() {
+	bucketPath, ok := s3BucketPath(req.bucket)
+	if !ok {
+		req.error("InvalidBucketName", "")
+		return
+	}
+	query := req.r.URL.Query()
+
+	if req.r.Method == "PUT" {
+		req.createBucket(bucketPath)
+		return
+	}
+	if info, err := os.Stat(bucketPath); err != nil || !info.IsDir() {
+		req.error("NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+
+	switch req.r.Method {
+	case "HEAD":
+		req.w.WriteHeader(200)
+	case "GET":
+		switch {
+		case query.Has("location"):
+			req.xml(struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+				Xmlns   string   `xml:"xmlns,attr"`
+			}{Xmlns: s3XMLNamespace})
+		case query.Has("uploads"), query.Has("versioning"), query.Has("policy"), query.Has("acl"):
+			req.error("NotImplemented", "")
+		default:
+			req.listObjects(bucketPath, query)
+		}
+	case "POST":
+		if !query.Has("delete") {
+			req.error("NotImplemented", "")
+			return
+		}
+		req.deleteObjects()
+	case "DELETE":
+		req.deleteBucket(bucketPath)
+	default:
+		req.error("MethodNotAllowed", "")
+	}
+}
+
+func (req *s3Request) serveObject() {
+	fullPath, ok := s3ObjectPath(req.bucket, req.object)
+	if !ok {
+		req.error("InvalidArgument", "Object keys must be valid relative paths")
+		return
+	}
+	bucketPath, _ := s3BucketPath(req.bucket)
+	if info, err := os.Stat(bucketPath); err != nil || !info.IsDir() {
+		req.error("NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	query := req.r.URL.Query()
+	uploadID := query.Get("uploadId")
+
+	switch req.r.Method {
+	case "GET", "HEAD":
+		if uploadID != "" {
+			req.listParts(uploadID)
+			return
+		}
+		req.getObject(fullPath)
+	case "PUT":
+		switch {
+		case uploadID != "":
+			req.uploadPart(uploadID, query.Get("partNumber"))
+		case req.r.Header.Get("X-Amz-Copy-Source") != "":
+			req.copyObject(fullPath)
+		default:
+			req.putObject(fullPath)
+		}
+	case "POST":
+		switch {
+		case query.Has("uploads"):
+			req.createMultipartUpload()
+		case uploadID != "":
+			req.completeMultipartUpload(uploadID, fullPath)
+		default:
+			req.error("NotImplemented", "")
+		}
+	case "DELETE":
+		if uploadID != "" {
+			req.abortMultipartUpload(uploadID)
+			return
+		}
+		err := s3DeleteObject(fullPath, strings.HasSuffix(req.object, "/"))
+		var errors []string
+		if err != nil {
+			errors = []string{err.Error()}
+		}
+		logModification("delete", []string{s3RelPath(req.bucket, req.object)}, "", errors)
+		if err != nil {
+			req.error("InternalError", err.Error())
+			return
+		}
+		req.w.WriteHeader(204)
+	default:
+		req.error("MethodNotAllowed", "")
+	}
+}
+
+// Buckets
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+func (req *s3Request) listBuckets() {
+	entries, err := os.ReadDir(rootPath)
+	if err != nil {
+		req.error("InternalError", err.Error())
+		return
+	}
+	var buckets []s3Bucket
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		buckets = append(buckets, s3Bucket{Name: entry.Name(), CreationDate: s3Time(info.ModTime())})
+	}
+	req.xml(struct {
+		XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+		Xmlns   string     `xml:"xmlns,attr"`
+		Owner   struct{}   `xml:"Owner"`
+		Buckets []s3Bucket `xml:"Buckets>Bucket"`
+	}{Xmlns: s3XMLNamespace, Buckets: buckets})
+}
+
+func (req *s3Request) createBucket(bucketPath string) {
+	if err := os.Mkdir(bucketPath, 0755); err != nil {
+		if os.IsExist(err) {
+			req.error("BucketAlreadyOwnedByYou", "")
+			return
+		}
+		req.error("InternalError", err.Error())
+		return
+	}
+	sizeTreeAdd(bucketPath)
+	logModification("new_folder", nil, req.bucket, nil)
+	req.w.Header().Set("Location", "/"+req.bucket)
+	req.w.WriteHeader(200)
+}
+
+func (req *s3Request) deleteBucket(bucketPath string) {
+	if err := os.Remove(bucketPath); err != nil {
+		req.error("BucketNotEmpty", "Only empty buckets can be deleted")
+		return
+	}
+	sizeTreeRemove(bucketPath, true)
+	logModification("delete", []string{req.bucket}, "", nil)
+	req.w.WriteHeader(204)
+}
+
+// Listing
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListEntry struct {
+	key      string
+	info     os.FileInfo
+	isPrefix bool
+}
+
+// s3ListEntries returns the entries of the bucket matching prefix, sorted by key.
+// With delimiter "/" only one directory level is read and subdirectories become
+// common prefixes; without a delimiter the tree is walked and empty directories
+// show up as "dir/" folder markers.
+func s3ListEntries(bucketPath, prefix, delimiter string) ([]s3ListEntry, error) {
+	dirPart := prefix[:strings.LastIndex(prefix, "/")+1]
+	startDir := filepath.Join(bucketPath, filepath.FromSlash(dirPart))
+	var entries []s3ListEntry
+
+	if delimiter == "/" {
+		dirEntries, err := os.ReadDir(startDir)
+		if err != nil {
+			return nil, nil // Prefix names nothing that exists
+		}
+		for _, entry := range dirEntries {
+			key := dirPart + entry.Name()
+			if entry.IsDir() {
+				key += "/"
+			}
+			if !strings.HasPrefix(key, prefix) || strings.HasPrefix(entry.Name(), s3TempPrefix) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			entries = append(entries, s3ListEntry{key: key, info: info, isPrefix: entry.IsDir()})
+		}
+	} else {
+		err := filepath.WalkDir(startDir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // Skip unreadable entries (or a missing start dir)
+			}
+			rel, _ := filepath.Rel(bucketPath, p)
+			key := filepath.ToSlash(rel)
+			if d.IsDir() {
+				key += "/"
+				// Skip subtrees that can't contain a match
+				if p != startDir && !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+					return filepath.SkipDir
+				}
+				if p == startDir || !strings.HasPrefix(key, prefix) {
+					return nil
+				}
+				if children, err := os.ReadDir(p); err != nil || len(children) > 0 {
+					return nil
+				}
+			} else if !strings.HasPrefix(key, prefix) || strings.HasPrefix(d.Name(), s3TempPrefix) {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			entries = append(entries, s3ListEntry{key: key, info: info})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+// listObjects handles ListObjectsV2 (list-type=2) and the original ListObjects
+func (req *s3Request) listObjects(bucketPath string, query url.Values) {
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	if delimiter != "" && delimiter != "/" {
+		req.error("NotImplemented", "Only '/' is supported as delimiter")
+		return
+	}
+	maxKeys := s3DefaultMaxKeys
+	if v := query.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			req.error("InvalidArgument", "Invalid max-keys")
+			return
+		}
+		maxKeys = min(n, s3DefaultMaxKeys)
+	}
+	v2 := query.Get("list-type") == "2"
+
+	// Keys are returned strictly after this one
+	after := query.Get("marker")
+	if v2 {
+		after = query.Get("start-after")
+		if token := query.Get("continuation-token"); token != "" {
+			decoded, err := base64.StdEncoding.DecodeString(token)
+			if err != nil {
+				req.error("InvalidArgument", "Invalid continuation token")
+				return
+			}
+			after = max(after, string(decoded))
+		}
+	}
+
+	entries, err := s3ListEntries(bucketPath, prefix, delimiter)
+	if err != nil {
+		req.error("InternalError", err.Error())
+		return
+	}
+
+	encode := func(s string) string { return s }
+	if query.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+	}
+
+	var contents []s3Object
+	var prefixes []s3CommonPrefix
+	truncated := false
+	lastKey := ""
+	for _, entry := range entries {
+		if entry.key <= after {
+			continue
+		}
+		if len(contents)+len(prefixes) >= maxKeys {
+			truncated = true
+			break
+		}
+		lastKey = entry.key
+		if entry.isPrefix {
+			prefixes = append(prefixes, s3CommonPrefix{Prefix: encode(entry.key)})
+			continue
+		}
+		var size int64
+		if !entry.info.IsDir() {
+			size = entry.info.Size()
+		}
+		contents = append(contents, s3Object{
+			Key:          encode(entry.key),
+			LastModified: s3Time(entry.info.ModTime()),
+			ETag:         s3ETag(entry.info),
+			Size:         size,
+			StorageClass: "STANDARD",
+		})
+	}
+
+	type listResult struct {
+		XMLName               xml.Name         `xml:"ListBucketResult"`
+		Xmlns                 string           `xml:"xmlns,attr"`
+		Name                  string           `xml:"Name"`
+		Prefix                string           `xml:"Prefix"`
+		Delimiter             string           `xml:"Delimiter,omitempty"`
+		MaxKeys               int              `xml:"MaxKeys"`
+		EncodingType          string           `xml:"EncodingType,omitempty"`
+		IsTruncated           bool             `xml:"IsTruncated"`
+		Marker                *string          `xml:"Marker"`
+		NextMarker            string           `xml:"NextMarker,omitempty"`
+		KeyCount              *int             `xml:"KeyCount"`
+		StartAfter            string           `xml:"StartAfter,omitempty"`
+		ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+		NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+		Contents              []s3Object       `xml:"Contents"`
+		CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+	}
+	result := listResult{
+		Xmlns:          s3XMLNamespace,
+		Name:           req.bucket,
+		Prefix:         encode(prefix),
+		Delimiter:      encode(delimiter),
+		MaxKeys:        maxKeys,
+		EncodingType:   query.Get("encoding-type"),
+		IsTruncated:    truncated,
+		Contents:       contents,
+		CommonPrefixes: prefixes,
+	}
+	if v2 {
+		keyCount := len(contents) + len(prefixes)
+		result.KeyCount = &keyCount
+		result.StartAfter = encode(query.Get("start-after"))
+		result.ContinuationToken = query.Get("continuation-token")
+		if truncated {
+			result.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(lastKey))
+		}
+	} else {
+		marker := encode(query.Get("marker"))
+		result.Marker = &marker
+		if truncated {
+			result.NextMarker = encode(lastKey)
+		}
+	}
+	req.xml(result)
+}
+
+// Objects
+
+func (req *s3Request) getObject(fullPath string) {
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() != strings.HasSuffix(req.object, "/") {
+		req.error("NoSuchKey", "The specified key does not exist")
+		return
+	}
+
+	req.w.Header().Set("ETag", s3ETag(info))
+	req.w.Header().Set("Accept-Ranges", "bytes")
+	if info.IsDir() {
+		// Folder marker
+		req.w.Header().Set("Content-Type", "application/x-directory")
+		req.w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+		req.w.Header().Set("Content-Length", "0")
+		req.w.WriteHeader(200)
+		return
+	}
+
+	f, err := os.Open(fullPath)
+	if err != nil {
+		req.error("AccessDenied", err.Error())
+		return
+	}
+	defer f.Close()
+	if contentType := typeByExtension(fullPath); contentType != "" {
+		req.w.Header().Set("Content-Type", contentType)
+	} else {
+		req.w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	// Handles Range, If-Match, If-None-Match, If-Modified-Since, ...
+	http.ServeContent(req.w, req.r, "", info.ModTime(), f)
+}
+
+// writeS3File streams body into a temp file next to fullPath and renames it into
+// place, so readers never see partial files. If contentMD5 (base64, from the
+// Content-MD5 header) is set, the content must match it. Returns the MD5 of the content.
+func writeS3File(fullPath string, body io.Reader, contentMD5 string) ([]byte, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(fullPath), s3TempPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name()) // No-op after a successful rename
+
+	digest := md5.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, digest), body); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	sum := digest.Sum(nil)
+	if contentMD5 != "" && contentMD5 != base64.StdEncoding.EncodeToString(sum) {
+		return nil, errS3BadDigest
+	}
+	if info, err := os.Stat(fullPath); err == nil && info.IsDir() {
+		return nil, fmt.Errorf("a folder with that name already exists")
+	}
+	if err := os.Rename(tmp.Name(), fullPath); err != nil {
+		return nil, err
+	}
+	return sum, nil
+}
+
+// s3Added updates the size tree after fullPath was created. If parent
+// directories had to be created, the topmost of them is added instead.
+func s3Added(fullPath, createdTop string) {
+	if createdTop != "" {
+		sizeTreeAdd(createdTop)
+	} else {
+		sizeTreeAdd(fullPath)
+	}
+}
+
+func (req *s3Request) putObject(fullPath string) {
+	relPath := s3RelPath(req.bucket, req.object)
+
+	// Folder marker: create the directory
+	if strings.HasSuffix(req.object, "/") {
+		createdTop, err := createParentDirs(fullPath)
+		if err != nil {
+			req.error("InternalError", err.Error())
+			return
+		}
+		if createdTop != "" {
+			sizeTreeAdd(createdTop)
+			logModification("new_folder", nil, relPath, nil)
+		}
+		req.w.Header().Set("ETag", `"d41d8cd98f00b204e9800998ecf8427e"`)
+		req.w.WriteHeader(200)
+		return
+	}
+
+	createdTop, err := createParentDirs(filepath.Dir(fullPath))
+	if err != nil {
+		req.error("InternalError", err.Error())
+		return
+	}
+	sum, err := writeS3File(fullPath, req.body(), req.r.Header.Get("Content-MD5"))
+	if err != nil {
+		if createdTop != "" {
+			s3Added(fullPath, createdTop)
+		}
+		req.writeError(err)
+		return
+	}
+
+	s3Added(fullPath, createdTop)
+	logModification("upload", nil, relPath, nil)
+	req.w.Header().Set("ETag", `"`+hex.EncodeToString(sum)+`"`)
+	req.w.WriteHeader(200)
+}
+
+// writeError maps errors from writing a request body to S3 errors
+func (req *s3Request) writeError(err error) {
+	switch {
+	case errors.Is(err, errS3ContentSHA256):
+		req.error("XAmzContentSHA256Mismatch", "The content does not match x-amz-content-sha256")
+	case errors.Is(err, errS3SignatureMismatch):
+		req.error("SignatureDoesNotMatch", "A chunk signature does not match")
+	case errors.Is(err, errS3BadDigest):
+		req.error("BadDigest", "The Content-MD5 you specified did not match what we received")
+	default:
+		req.error("InternalError", err.Error())
+	}
+}
+
+func (req *s3Request) copyObject(fullPath string) {
+	source := s3QueryUnescape(req.r.Header.Get("X-Amz-Copy-Source"))
+	source, _, _ = strings.Cut(source, "?versionId=")
+	srcBucket, srcKey, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+	srcPath, ok := s3ObjectPath(srcBucket, srcKey)
+	if !ok || strings.HasSuffix(req.object, "/") {
+		req.error("InvalidArgument", "Invalid copy source")
+		return
+	}
+	srcInfo, err := os.Stat(srcPath)
+	if err != nil || srcInfo.IsDir() {
+		req.error("NoSuchKey", "The copy source does not exist")
+		return
+	}
+
+	srcRel, dstRel := s3RelPath(srcBucket, srcKey), s3RelPath(req.bucket, req.object)
+	var sum []byte
+	createdTop, err := createParentDirs(filepath.Dir(fullPath))
+	if err == nil {
+		var f *os.File
+		if f, err = os.Open(srcPath); err == nil {
+			sum, err = writeS3File(fullPath, f, "")
+			f.Close()
+		}
+	}
+	if err != nil {
+		logModification("copy", []string{srcRel}, dstRel, []string{err.Error()})
+		req.error("InternalError", err.Error())
+		return
+	}
+
+	s3Added(fullPath, createdTop)
+	logModification("copy", []string{srcRel}, dstRel, nil)
+
+	info, _ := os.Stat(fullPath)
+	req.xml(struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		LastModified string   `xml:"LastModified"`
+		ETag         string   `xml:"ETag"`
+	}{Xmlns: s3XMLNamespace, LastModified: s3Time(info.ModTime()), ETag: `"` + hex.EncodeToString(sum) + `"`})
+}
+
+// s3DeleteObject deletes a file, or an empty directory for folder markers.
+// Deleting something that doesn't exist is not an error in S3.
+func s3DeleteObject(fullPath string, folderMarker bool) error {
+	info, err := os.Stat(fullPath)
+	if err != nil || info.IsDir() != folderMarker {
+		return nil
+	}
+	if err := os.Remove(fullPath); err != nil {
+		if folderMarker {
+			return nil // Not empty: the "folder" still exists because of its contents
+		}
+		return err
+	}
+	sizeTreeRemove(fullPath, folderMarker)
+	return nil
+}
+
+func (req *s3Request) deleteObjects() {
+	data, err := readS3XMLBody(req.body())
+	if err != nil {
+		req.writeError(err)
+		return
+	}
+	var request struct {
+		Quiet   bool `xml:"Quiet"`
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := xml.Unmarshal(data, &request); err != nil || len(request.Objects) > 1000 {
+		req.error("MalformedXML", "")
+		return
+	}
+
+	type deleted struct {
+		Key string `xml:"Key"`
+	}
+	type deleteError struct {
+		Key     string `xml:"Key"`
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	var result struct {
+		XMLName xml.Name      `xml:"DeleteResult"`
+		Xmlns   string        `xml:"xmlns,attr"`
+		Deleted []deleted     `xml:"Deleted"`
+		Errors  []deleteError `xml:"Error"`
+	}
+	result.Xmlns = s3XMLNamespace
+
+	var sources, errors []string
+	for _, object := range request.Objects {
+		sources = append(sources, s3RelPath(req.bucket, object.Key))
+		fullPath, ok := s3ObjectPath(req.bucket, object.Key)
+		if !ok {
+			result.Errors = append(result.Errors, deleteError{Key: object.Key, Code: "InvalidArgument", Message: "Invalid key"})
+			errors = append(errors, fmt.Sprintf("Failed to delete %s: invalid key", object.Key))
+			continue
+		}
+		if err := s3DeleteObject(fullPath, strings.HasSuffix(object.Key, "/")); err != nil {
+			result.Errors = append(result.Errors, deleteError{Key: object.Key, Code: "InternalError", Message: err.Error()})
+			errors = append(errors, fmt.Sprintf("Failed to delete %s: %v", object.Key, err))
+			continue
+		}
+		if !request.Quiet {
+			result.Deleted = append(result.Deleted, deleted{Key: object.Key})
+		}
+	}
+	logModification("delete", sources, "", errors)
+	req.xml(result)
+}
+
+// Multipart uploads. Parts are staged in s3MultipartDir/<uploadId>/ and
+// concatenated next to the target when the upload is completed.
+
+type s3MultipartMeta struct {
+	Bucket      string `json:"bucket"`
+	Key         string `json:"key"`
+	AccessKeyID string `json:"accessKeyId"`
+	Created     int64  `json:"created"`
+}
+
+func s3UploadDir(uploadID string) (string, bool) {
+	if uploadID == "" || strings.ContainsAny(uploadID, `/\.`) {
+		return "", false
+	}
+	return filepath.Join(s3MultipartDir, uploadID), true
+}
+
+// loadUpload returns the staging dir of uploadID if it belongs to this bucket and key
+func (req *s3Request) loadUpload(uploadID string) (string, bool) {
+	dir, ok := s3UploadDir(uploadID)
+	if !ok {
+		return "", false
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "meta.json"))
+	if err != nil {
+		return "", false
+	}
+	var meta s3MultipartMeta
+	if json.Unmarshal(data, &meta) != nil || meta.Bucket != req.bucket || meta.Key != req.object {
+		return "", false
+	}
+	return dir, true
+}
+
+func s3PartPath(dir string, partNumber int) string {
+	return filepath.Join(dir, fmt.Sprintf("part-%05d", partNumber))
+}
+
+func (req *s3Request) createMultipartUpload() {
+	if strings.HasSuffix(req.object, "/") {
+		req.error("InvalidArgument", "Folder markers can't be uploaded in parts")
+		return
+	}
+	uploadID, err := randomString(24)
+	if err != nil {
+		req.error("InternalError", err.Error())
+		return
+	}
+	uploadID = strings.NewReplacer("-", "A", "_", "B").Replace(uploadID)
+	dir := filepath.Join(s3MultipartDir, uploadID)
+	meta, _ := json.Marshal(s3MultipartMeta{Bucket: req.bucket, Key: req.object, AccessKeyID: req.key.AccessKeyID, Created: time.Now().Unix()})
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		req.error("InternalError", err.Error())
+		return
+	}
+	if err := os.WriteFile(filepath.Join(dir, "meta.json"), meta, 0644); err != nil {
+		req.error("InternalError", err.Error())
+		return
+	}
+
+	req.xml(struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Xmlns: s3XMLNamespace, Bucket: req.bucket, Key: req.object, UploadID: uploadID})
+}
+
+func (req *s3Request) uploadPart(uploadID, partNumberStr string) {
+	dir, ok := req.loadUpload(uploadID)
+	if !ok {
+		req.error("NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	partNumber, err := strconv.Atoi(partNumberStr)
+	if err != nil || partNumber < 1 || partNumber > s3MaxParts {
+		req.error("InvalidArgument", "Part number must be between 1 and 10000")
+		return
+	}
+	if req.r.Header.Get("X-Amz-Copy-Source") != "" {
+		req.error("NotImplemented", "UploadPartCopy is not supported")
+		return
+	}
+
+	partPath := s3PartPath(dir, partNumber)
+	sum, err := writeS3File(partPath, req.body(), req.r.Header.Get("Content-MD5"))
+	if err != nil {
+		req.writeError(err)
+		return
+	}
+	etag := hex.EncodeToString(sum)
+	if err := os.WriteFile(partPath+".md5", []byte(etag), 0644); err != nil {
+		req.error("InternalError", err.Error())
+		return
+	}
+	req.w.Header().Set("ETag", `"`+etag+`"`)
+	req.w.WriteHeader(200)
+}
+
+func (req *s3Request) listParts(uploadID string) {
+	dir, ok := req.loadUpload(uploadID)
+	if !ok {
+		req.error("NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+
+	type part struct {
+		PartNumber   int    `xml:"PartNumber"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+	}
+	var parts []part
+	for n := 1; n <= s3MaxParts; n++ {
+		info, err := os.Stat(s3PartPath(dir, n))
+		if err != nil {
+			continue
+		}
+		etag, err := os.ReadFile(s3PartPath(dir, n) + ".md5")
+		if err != nil {
+			continue
+		}
+		parts = append(parts, part{PartNumber: n, LastModified: s3Time(info.ModTime()), ETag: `"` + string(etag) + `"`, Size: info.Size()})
+	}
+
+	req.xml(struct {
+		XMLName  xml.Name `xml:"ListPartsResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+		Parts    []part   `xml:"Part"`
+	}{Xmlns: s3XMLNamespace, Bucket: req.bucket, Key: req.object, UploadID: uploadID, Parts: parts})
+}
+
+func (req *s3Request) completeMultipartUpload(uploadID, fullPath string) {
+	dir, ok := req.loadUpload(uploadID)
+	if !ok {
+		req.error("NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	data, err := readS3XMLBody(req.body())
+	if err != nil {
+		req.writeError(err)
+		return
+	}
+	var request struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := xml.Unmarshal(data, &request); err != nil || len(request.Parts) == 0 {
+		req.error("MalformedXML", "")
+		return
+	}
+
+	// Check the parts before touching the target
+	var readers []io.Reader
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	partDigests := md5.New()
+	for i, part := range request.Parts {
+		if i > 0 && part.PartNumber <= request.Parts[i-1].PartNumber {
+			req.error("InvalidPartOrder", "Parts must be in ascending order")
+			return
+		}
+		partPath := s3PartPath(dir, part.PartNumber)
+		etag, err := os.ReadFile(partPath + ".md5")
+		if err != nil || string(etag) != strings.Trim(part.ETag, `"`) {
+			req.error("InvalidPart", fmt.Sprintf("Part %d is missing or its ETag does not match", part.PartNumber))
+			return
+		}
+		raw, _ := hex.DecodeString(string(etag))
+		partDigests.Write(raw)
+		f, err := os.Open(partPath)
+		if err != nil {
+			req.error("InvalidPart", err.Error())
+			return
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+	}
+
+	relPath := s3RelPath(req.bucket, req.object)
+	createdTop, err := createParentDirs(filepath.Dir(fullPath))
+	if err == nil {
+		_, err = writeS3File(fullPath, io.MultiReader(readers...), "")
+	}
+	if err != nil {
+		if createdTop != "" {
+			s3Added(fullPath, createdTop)
+		}
+		logModification("upload", nil, relPath, []string{err.Error()})
+		req.error("InternalError", err.Error())
+		return
+	}
+	os.RemoveAll(dir)
+
+	s3Added(fullPath, createdTop)
+	logModification("upload", nil, relPath, nil)
+
+	etag := fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(partDigests.Sum(nil)), len(request.Parts))
+	req.xml(struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}{Xmlns: s3XMLNamespace, Location: "/" + path.Join(req.bucket, req.object), Bucket: req.bucket, Key: req.object, ETag: etag})
+}
+
+func (req *s3Request) abortMultipartUpload(uploadID string) {
+	dir, ok := req.loadUpload(uploadID)
+	if !ok {
+		req.error("NoSuchUpload", "The specified upload does not exist")
+		return
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		req.error("InternalError", err.Error())
+		return
+	}
+	req.w.WriteHeader(204)
+}
+
+// cleanupS3Multipart removes multipart uploads that were never completed or
+// aborted: no part arrived for maxAge. The upload sweeper runs it with
+// --upload-expiry.
+func cleanupS3Multipart(maxAge time.Duration) {
+	entries, err := os.ReadDir(s3MultipartDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(s3MultipartDir, entry.Name())
+		if time.Since(s3LastActivity(dir)) < maxAge {
+			continue
+		}
+		log.Printf("S3: removing abandoned multipart upload %s", entry.Name())
+		os.RemoveAll(dir)
+	}
+}
+
+// s3LastActivity is when the staging dir of a multipart upload last changed;
+// parts sent again replace their file, which doesn't touch the dir
+func s3LastActivity(dir string) time.Time {
+	var last time.Time
+	if info, err := os.Stat(dir); err == nil {
+		last = info.ModTime()
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+// setupS3 starts the S3 gateway on its own listener (like WebDAV, so bodies are streamed)
+func setupS3() {
+	if s3Port == "" || accessKeys == nil || !localOnly("S3 gateway") {
+		return
+	}
+
+	log.Printf("S3 gateway starting on :%s", s3Port)
+	go func() {
+		if err := http.ListenAndServe(":"+s3Port, newS3Handler()); err != nil {
+			log.Printf("S3 gateway error: %v", err)
+		}
+	}()
+}
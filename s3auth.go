@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm      = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat     = "20060102T150405Z"
+	sigV4MaxClockSkew   = 15 * time.Minute
+	unsignedPayload     = "UNSIGNED-PAYLOAD"
+	streamingPayload    = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	emptyPayloadSHA256  = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxPresignedExpires = 7 * 24 * 60 * 60
+)
+
+// S3 error codes returned for authentication failures
+var (
+	errS3AccessDenied      = errors.New("AccessDenied")
+	errS3SignatureMismatch = errors.New("SignatureDoesNotMatch")
+	errS3RequestExpired    = errors.New("RequestTimeTooSkewed")
+	errS3AuthMalformed     = errors.New("AuthorizationHeaderMalformed")
+	errS3ContentSHA256     = errors.New("XAmzContentSHA256Mismatch")
+	errS3BadDigest         = errors.New("BadDigest")
+)
+
+// sigV4Auth holds the parsed signature of a request
+type sigV4Auth struct {
+	accessKeyID   string
+	date          string // yyyymmdd from the credential scope
+	region        string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	payloadHash   string
+	presigned     bool
+	expires       time.Duration
+}
+
+func (a *sigV4Auth) scope() string {
+	return a.date + "/" + a.region + "/s3/aws4_request"
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func sigV4SigningKey(secret, date, region string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	return hmacSHA256(key, "aws4_request")
+}
+
+// awsURIEncode encodes s the way SigV4 expects: everything but unreserved characters
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// parseSigV4 extracts the signature from the Authorization header or, for
+// presigned URLs, from the query string. Returns nil for anonymous requests.
+func parseSigV4(r *http.Request) (*sigV4Auth, error) {
+	auth := &sigV4Auth{}
+	var credential, amzDate string
+
+	if header := r.Header.Get("Authorization"); header != "" {
+		rest, ok := strings.CutPrefix(header, sigV4Algorithm+" ")
+		if !ok {
+			return nil, errS3AuthMalformed
+		}
+		for _, part := range strings.Split(rest, ",") {
+			k, v, _ := strings.Cut(strings.TrimSpace(part), "=")
+			switch k {
+			case "Credential":
+				credential = v
+			case "SignedHeaders":
+				auth.signedHeaders = strings.Split(v, ";")
+			case "Signature":
+				auth.signature = v
+			}
+		}
+		amzDate = r.Header.Get("X-Amz-Date")
+		if amzDate == "" {
+			amzDate = r.Header.Get("Date")
+		}
+		auth.payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if auth.payloadHash == "" {
+			return nil, errS3AuthMalformed
+		}
+	} else if q := r.URL.Query(); q.Get("X-Amz-Algorithm") != "" {
+		if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+			return nil, errS3AuthMalformed
+		}
+		auth.presigned = true
+		credential = q.Get("X-Amz-Credential")
+		auth.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+		auth.signature = q.Get("X-Amz-Signature")
+		amzDate = q.Get("X-Amz-Date")
+		auth.payloadHash = unsignedPayload
+		expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || expires < 0 || expires > maxPresignedExpires {
+			return nil, errS3AuthMalformed
+		}
+		auth.expires = time.Duration(expires) * time.Second
+	} else {
+		return nil, nil
+	}
+
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" || auth.signature == "" || len(auth.signedHeaders) == 0 {
+		return nil, errS3AuthMalformed
+	}
+	auth.accessKeyID, auth.date, auth.region = parts[0], parts[1], parts[2]
+
+	t, err := time.Parse(sigV4TimeFormat, amzDate)
+	if err != nil {
+		t, err = http.ParseTime(amzDate)
+		if err != nil {
+			return nil, errS3AuthMalformed
+		}
+	}
+	auth.amzDate = t
+	return auth, nil
+}
+
+// canonicalRequest builds the SigV4 canonical request
+func (a *sigV4Auth) canonicalRequest(r *http.Request) string {
+	// Query string, sorted by key then value, without the signature itself
+	query := r.URL.Query()
+	var params []string
+	for k, values := range query {
+		if a.presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range values {
+			params = append(params, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+
+	var headers strings.Builder
+	for _, name := range a.signedHeaders {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else {
+			value = strings.Join(r.Header.Values(name), ",")
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		strings.Join(params, "&"),
+		headers.String(),
+		strings.Join(a.signedHeaders, ";"),
+		a.payloadHash,
+	}, "\n")
+}
+
+// verify checks the signature against secret at time now
+func (a *sigV4Auth) verify(r *http.Request, secret string, now time.Time) error {
+	if a.presigned {
+		if now.Before(a.amzDate.Add(-sigV4MaxClockSkew)) || now.After(a.amzDate.Add(a.expires)) {
+			return errS3AccessDenied
+		}
+	} else if d := now.Sub(a.amzDate); d > sigV4MaxClockSkew || d < -sigV4MaxClockSkew {
+		return errS3RequestExpired
+	}
+	if a.amzDate.UTC().Format("20060102") != a.date {
+		return errS3AuthMalformed
+	}
+
+	if !hmac.Equal([]byte(a.sign(r, secret)), []byte(a.signature)) {
+		return errS3SignatureMismatch
+	}
+	return nil
+}
+
+// sign computes the signature of r with secret
+func (a *sigV4Auth) sign(r *http.Request, secret string) string {
+	stringToSign := strings.Join([]string{
+		sigV4Algorithm,
+		a.amzDate.UTC().Format(sigV4TimeFormat),
+		a.scope(),
+		sha256Hex([]byte(a.canonicalRequest(r))),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(sigV4SigningKey(secret, a.date, a.region), stringToSign))
+}
+
+// payloadReader wraps a request body so the content hash promised in
+// x-amz-content-sha256 is checked when the body has been read completely
+type payloadReader struct {
+	r        io.Reader
+	hash     hash.Hash
+	expected string
+}
+
+func (p *payloadReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.hash.Write(b[:n])
+	if err == io.EOF && hex.EncodeToString(p.hash.Sum(nil)) != p.expected {
+		return n, errS3ContentSHA256
+	}
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked body and, for signed streaming uploads,
+// verifies the signature of every chunk. Trailers are ignored.
+type chunkedReader struct {
+	r          *bufio.Reader
+	signingKey []byte // nil for unsigned streaming
+	scope      string
+	amzDate    string
+	prevSig    string
+	chunk      []byte
+	done       bool
+}
+
+func (c *chunkedReader) Read(b []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return io.ErrUnexpectedEOF
+	}
+	sizeStr, ext, _ := strings.Cut(strings.TrimRight(line, "\r\n"), ";")
+	size, err := strconv.ParseInt(sizeStr, 16, 64)
+	if err != nil || size < 0 || size > 64*1024*1024 {
+		return fmt.Errorf("invalid aws-chunked chunk size %q", sizeStr)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return io.ErrUnexpectedEOF
+	}
+
+	if c.signingKey != nil {
+		sig, _ := strings.CutPrefix(ext, "chunk-signature=")
+		stringToSign := strings.Join([]string{
+			sigV4Algorithm + "-PAYLOAD", c.amzDate, c.scope, c.prevSig, emptyPayloadSHA256, sha256Hex(data),
+		}, "\n")
+		expected := hex.EncodeToString(hmacSHA256(c.signingKey, stringToSign))
+		if !hmac.Equal([]byte(expected), []byte(sig)) {
+			return errS3SignatureMismatch
+		}
+		c.prevSig = sig
+	}
+
+	if size == 0 {
+		// Final chunk; whatever follows are trailers
+		c.done = true
+		return nil
+	}
+	if crlf, err := c.r.ReadString('\n'); err != nil || strings.TrimRight(crlf, "\r\n") != "" {
+		return fmt.Errorf("malformed aws-chunked body")
+	}
+	c.chunk = data
+	return nil
+}
+
+// s3Body returns the request body decoded and checked according to the signature
+func s3Body(r *http.Request, auth *sigV4Auth, secret string) io.Reader {
+	switch {
+	case auth.payloadHash == streamingPayload:
+		return &chunkedReader{
+			r:          bufio.NewReader(r.Body),
+			signingKey: sigV4SigningKey(secret, auth.date, auth.region),
+			scope:      auth.scope(),
+			amzDate:    auth.amzDate.UTC().Format(sigV4TimeFormat),
+			prevSig:    auth.signature,
+		}
+	case strings.HasPrefix(auth.payloadHash, "STREAMING-"):
+		// STREAMING-UNSIGNED-PAYLOAD-TRAILER and friends
+		return &chunkedReader{r: bufio.NewReader(r.Body)}
+	case auth.payloadHash == unsignedPayload:
+		return r.Body
+	default:
+		return &payloadReader{r: r.Body, hash: sha256.New(), expected: auth.payloadHash}
+	}
+}
+
+// readS3XMLBody reads a small XML request body (multipart completion, batch delete)
+func readS3XMLBody(body io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, 4*1024*1024+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 4*1024*1024 {
+		return nil, fmt.Errorf("request body too large")
+	}
+	return bytes.TrimSpace(data), nil
+}
+
+// s3QueryUnescape decodes the URL-encoded x-amz-copy-source header
+func s3QueryUnescape(s string) string {
+	if u, err := url.PathUnescape(s); err == nil {
+		return u
+	}
+	return s
+}
@@ -2,12 +2,18 @@ package scan
 
 import (
 	"io/fs"
-	"os"
 	"runtime"
 	"sync"
+
+	"file-browser/storage"
 )
 
 func ScanDirConcurrent(dir string, concurrency int, spinner *ProgressSpinner) ([]*FileData, error) {
+	return ScanFSConcurrent(storage.Local{}, dir, concurrency, spinner)
+}
+
+// ScanFSConcurrent is ScanDirConcurrent for any storage backend
+func ScanFSConcurrent(fsys storage.FS, dir string, concurrency int, spinner *ProgressSpinner) ([]*FileData, error) {
 	root := newRootFileData(dir)
 
 	if concurrency == 0 {
@@ -22,7 +28,7 @@ func ScanDirConcurrent(dir string, concurrency int, spinner *ProgressSpinner) ([
 	for i := 0; i < concurrency; i++ {
 		go func() {
 			for file := range ch {
-				scanDir(file, ch, closeWait, spinner)
+				scanDir(fsys, file, ch, closeWait, spinner)
 				closeWait.Done()
 				if spinner != nil {
 					spinner.IncrementProcessed()
@@ -32,7 +38,7 @@ func ScanDirConcurrent(dir string, concurrency int, spinner *ProgressSpinner) ([
 		}()
 	}
 
-	err := scanDir(root, ch, closeWait, spinner)
+	err := scanDir(fsys, root, ch, closeWait, spinner)
 	if err != nil {
 		return nil, err
 	}
@@ -56,12 +62,12 @@ func DefaultConcurrency() int {
 	return numCPU
 }
 
-func scanDir(parent *FileData, ch chan *FileData, closeWait *sync.WaitGroup, spinner *ProgressSpinner) error {
+func scanDir(fsys storage.FS, parent *FileData, ch chan *FileData, closeWait *sync.WaitGroup, spinner *ProgressSpinner) error {
 	if !parent.IsDir || parent.IsLink {
 		return nil
 	}
 
-	entries, err := os.ReadDir(parent.Path())
+	entries, err := fsys.ReadDir(parent.Path())
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"file-browser/scan"
+)
+
+const (
+	defaultSearchLimit = 500
+	maxSearchLimit     = 5000
+	searchKeepalive    = 5 * time.Second // Empty chunks while nothing matches, to notice clients that left
+)
+
+// SearchOptions describes a filename search across the whole root (or a subtree of it)
+type SearchOptions struct {
+	Query          string `json:"query"`
+	Mode           string `json:"mode"`           // substring (default), glob, regex
+	Root           string `json:"root"`           // named root, "" for the primary one
+	Path           string `json:"path"`           // subtree to search, relative to root
+	Type           string `json:"type"`           // "" (any), "file" or "dir"
+	MinSize        int64  `json:"minSize"`        // bytes, 0 = no lower bound
+	MaxSize        int64  `json:"maxSize"`        // bytes, 0 = no upper bound
+	ModifiedAfter  int64  `json:"modifiedAfter"`  // unix seconds, 0 = no lower bound
+	ModifiedBefore int64  `json:"modifiedBefore"` // unix seconds, 0 = no upper bound
+	Limit          int    `json:"limit"`
+}
+
+// SearchChunk is one line of the /search NDJSON stream
+type SearchChunk struct {
+	Items     []FileItem `json:"items"`
+	Done      bool       `json:"done,omitempty"`
+	Truncated bool       `json:"truncated,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// newNameMatcher compiles the query into a predicate on a single file name.
+// Substring and glob matching are case-insensitive, regex is used as given.
+func newNameMatcher(query, mode string) (func(name string) bool, error) {
+	switch mode {
+	case "", "substring":
+		q := strings.ToLower(query)
+		return func(name string) bool {
+			return strings.Contains(strings.ToLower(name), q)
+		}, nil
+	case "glob":
+		pattern := strings.ToLower(query)
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob pattern: %v", err)
+		}
+		return func(name string) bool {
+			ok, _ := filepath.Match(pattern, strings.ToLower(name))
+			return ok
+		}, nil
+	case "regex":
+		re, err := regexp.Compile(query)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex: %v", err)
+		}
+		return re.MatchString, nil
+	default:
+		return nil, fmt.Errorf("invalid mode %q. Must be 'substring', 'glob' or 'regex'", mode)
+	}
+}
+
+// matchesFilters checks the type, size and modified-time filters for a candidate item
+func (o *SearchOptions) matchesFilters(isDir bool, size, modified int64) bool {
+	switch o.Type {
+	case "file":
+		if isDir {
+			return false
+		}
+	case "dir":
+		if !isDir {
+			return false
+		}
+	}
+	if o.MinSize > 0 && (size < 0 || size < o.MinSize) {
+		return false
+	}
+	if o.MaxSize > 0 && (size < 0 || size > o.MaxSize) {
+		return false
+	}
+	if o.ModifiedAfter > 0 && modified < o.ModifiedAfter {
+		return false
+	}
+	if o.ModifiedBefore > 0 && modified > o.ModifiedBefore {
+		return false
+	}
+	return true
+}
+
+// searchFiles runs a filename search and calls emit for every match.
+// Returns truncated=true if the limit was hit before the search finished.
+// Uses the in-memory size tree when it is loaded, otherwise walks the disk.
+func searchFiles(ctx context.Context, opts SearchOptions, emit func(FileItem) bool) (bool, error) {
+	if opts.Type != "" && opts.Type != "file" && opts.Type != "dir" {
+		return false, fmt.Errorf("invalid type %q. Must be 'file' or 'dir'", opts.Type)
+	}
+	match, err := newNameMatcher(opts.Query, opts.Mode)
+	if err != nil {
+		return false, err
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = defaultSearchLimit
+	}
+	if opts.Limit > maxSearchLimit {
+		opts.Limit = maxSearchLimit
+	}
+
+	m, err := mountByName(opts.Root)
+	if err != nil {
+		return false, err
+	}
+	startPath, err := m.resolve(opts.Path)
+	if err != nil {
+		return false, err
+	}
+	info, err := rootFS.Stat(startPath)
+	if err != nil || !info.IsDir() {
+		return false, fmt.Errorf("search path is not a directory: %s", opts.Path)
+	}
+	startRel := cleanRelativePath(opts.Path)
+
+	if m.SizeTree != nil {
+		return searchSizeTree(m.SizeTree, startPath, startRel, &opts, match, emit), nil
+	}
+	return searchDisk(ctx, startPath, startRel, &opts, match, emit), nil
+}
+
+// searchSizeTree searches the in-memory size tree. Matches are collected under
+// the read lock and emitted afterwards so slow clients don't block writers.
+func searchSizeTree(tree *scan.FileData, startPath, startRel string, opts *SearchOptions, match func(string) bool, emit func(FileItem) bool) bool {
+	var results []FileItem
+	truncated := false
+
+	sizeTreeMutex.RLock()
+	start := tree.FindByPath(startPath)
+	if start != nil {
+		var visit func(node *scan.FileData, rel string) bool
+		visit = func(node *scan.FileData, rel string) bool {
+			for _, child := range node.Children {
+				if strings.HasPrefix(child.Name, ".") {
+					continue
+				}
+				childRel := child.Name
+				if rel != "" {
+					childRel = rel + "/" + child.Name
+				}
+				if match(child.Name) && opts.matchesFilters(child.IsDir, child.Size(), child.Modified) {
+					if len(results) >= opts.Limit {
+						truncated = true
+						return false
+					}
+					results = append(results, FileItem{
+						Name:     child.Name,
+						Path:     childRel,
+						IsDir:    child.IsDir,
+						Size:     child.Size(),
+						Modified: child.Modified,
+					})
+				}
+				if child.IsDir && !child.IsLink {
+					if !visit(child, childRel) {
+						return false
+					}
+				}
+			}
+			return true
+		}
+		visit(start, startRel)
+	}
+	sizeTreeMutex.RUnlock()
+
+	for _, item := range results {
+		if !emit(item) {
+			return true
+		}
+	}
+	return truncated
+}
+
+// dirQueue is an unbounded work queue of directories for searchDisk.
+// pending counts directories that are queued or still being read.
+type dirQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	items   [][2]string // {full path, relative path}
+	pending int
+	stopped bool
+}
+
+func newDirQueue() *dirQueue {
+	q := &dirQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *dirQueue) push(full, rel string) {
+	q.mu.Lock()
+	if !q.stopped {
+		q.items = append(q.items, [2]string{full, rel})
+		q.pending++
+		q.cond.Signal()
+	}
+	q.mu.Unlock()
+}
+
+// pop blocks until a directory is available. Returns false once the walk is finished or stopped.
+func (q *dirQueue) pop() ([2]string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && q.pending > 0 && !q.stopped {
+		q.cond.Wait()
+	}
+	if q.stopped || len(q.items) == 0 {
+		return [2]string{}, false
+	}
+	item := q.items[len(q.items)-1]
+	q.items = q.items[:len(q.items)-1]
+	return item, true
+}
+
+func (q *dirQueue) done() {
+	q.mu.Lock()
+	q.pending--
+	if q.pending == 0 {
+		q.cond.Broadcast()
+	}
+	q.mu.Unlock()
+}
+
+func (q *dirQueue) stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.items = nil
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// searchDisk walks the tree with a bounded number of concurrent directory readers
+func searchDisk(ctx context.Context, startPath, startRel string, opts *SearchOptions, match func(string) bool, emit func(FileItem) bool) bool {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := newDirQueue()
+	queue.push(startPath, startRel)
+
+	var emitMu sync.Mutex
+	count := 0
+	truncated := false
+
+	// Stop the walk as soon as the client goes away
+	go func() {
+		<-ctx.Done()
+		queue.stop()
+	}()
+
+	workers := scan.DefaultConcurrency()
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for {
+				dir, ok := queue.pop()
+				if !ok {
+					return
+				}
+				entries, err := rootFS.ReadDir(dir[0])
+				if err != nil {
+					log.Printf("Search: error reading directory %s: %v", dir[0], err)
+				}
+				for _, entry := range entries {
+					name := entry.Name()
+					if strings.HasPrefix(name, ".") {
+						continue
+					}
+					rel := name
+					if dir[1] != "" {
+						rel = dir[1] + "/" + name
+					}
+					isDir := entry.IsDir()
+					if isDir {
+						queue.push(filepath.Join(dir[0], name), rel)
+					}
+					if !match(name) {
+						continue
+					}
+
+					var size int64 = -1
+					var modified int64
+					if info, err := entry.Info(); err == nil {
+						modified = info.ModTime().Unix()
+						if !isDir {
+							size = info.Size()
+						}
+					}
+					if !opts.matchesFilters(isDir, size, modified) {
+						continue
+					}
+
+					emitMu.Lock()
+					if count >= opts.Limit {
+						truncated = true
+						queue.stop()
+					} else if !emit(FileItem{Name: name, Path: rel, IsDir: isDir, Size: size, Modified: modified}) {
+						queue.stop()
+					} else {
+						count++
+					}
+					emitMu.Unlock()
+				}
+				queue.done()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return truncated
+}
+
+// parseSearchOptions reads search options from query parameters
+func parseSearchOptions(c *fiber.Ctx) (SearchOptions, error) {
+	opts := SearchOptions{
+		Query: c.Query("q"),
+		Mode:  c.Query("mode"),
+		Root:  c.Query("root"),
+		Path:  c.Query("path"),
+		Type:  c.Query("type"),
+		Limit: c.QueryInt("limit", defaultSearchLimit),
+	}
+	int64Params := map[string]*int64{
+		"minSize":        &opts.MinSize,
+		"maxSize":        &opts.MaxSize,
+		"modifiedAfter":  &opts.ModifiedAfter,
+		"modifiedBefore": &opts.ModifiedBefore,
+	}
+	for name, dst := range int64Params {
+		if v := c.Query(name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return opts, fmt.Errorf("invalid %s: %s", name, v)
+			}
+			*dst = n
+		}
+	}
+	return opts, nil
+}
+
+// handleSearch streams filename search results as NDJSON, one chunk of items per line
+func handleSearch(c *fiber.Ctx) error {
+	opts, err := parseSearchOptions(c)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	if opts.Query == "" {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Missing required parameter: q",
+		})
+	}
+	// Validate up front so bad patterns get a proper 400 instead of an error line
+	if _, err := newNameMatcher(opts.Query, opts.Mode); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+
+	log.Printf("Search request: %q (mode: %s, path: %s)", opts.Query, opts.Mode, opts.Path)
+
+	c.Set("Content-Type", "application/x-ndjson")
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		// A client that went away only shows as a failed write. Searches
+		// without matches write nothing for a long time, so an empty chunk is
+		// sent every searchKeepalive, and the search stops at the first
+		// write that fails.
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		var writeMu sync.Mutex
+		finished := false // No keepalives after the last chunk
+		enc := json.NewEncoder(w)
+		write := func(chunk SearchChunk) bool {
+			writeMu.Lock()
+			defer writeMu.Unlock()
+			if finished {
+				return false
+			}
+			finished = chunk.Done
+			if enc.Encode(chunk) != nil || w.Flush() != nil {
+				cancel()
+				return false
+			}
+			return true
+		}
+		go func() {
+			ticker := time.NewTicker(searchKeepalive)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					write(SearchChunk{Items: []FileItem{}})
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		chunk := make([]FileItem, 0, wsChunkSize)
+		flush := func() bool {
+			if len(chunk) == 0 {
+				return true
+			}
+			ok := write(SearchChunk{Items: chunk})
+			chunk = chunk[:0]
+			return ok
+		}
+
+		truncated, err := searchFiles(ctx, opts, func(item FileItem) bool {
+			chunk = append(chunk, item)
+			if len(chunk) >= wsChunkSize {
+				return flush()
+			}
+			return true
+		})
+		if ctx.Err() != nil {
+			log.Printf("Search for %q stopped, the client went away", opts.Query)
+			return
+		}
+		flush()
+
+		final := SearchChunk{Items: []FileItem{}, Done: true, Truncated: truncated}
+		if err != nil {
+			final.Error = err.Error()
+		}
+		write(final)
+	})
+	return nil
+}
+
+// handleWebSocketSearch runs a search for a websocket client, streaming results
+// the same way directory listings are streamed
+func handleWebSocketSearch(c *wsClient, req WSRequest) error {
+	if req.Search == nil {
+		return sendWSItems(c, req.RequestID, nil)
+	}
+	opts := *req.Search
+	if opts.Root == "" {
+		opts.Root = req.Root
+	}
+	log.Printf("WebSocket search request: %q (ID: %d, mode: %s)", opts.Query, req.RequestID, opts.Mode)
+
+	chunk := make([]FileItem, 0, wsChunkSize)
+	var writeErr error
+	_, err := searchFiles(c.ctx, opts, func(item FileItem) bool {
+		chunk = append(chunk, item)
+		if len(chunk) >= wsChunkSize {
+			writeErr = c.WriteJSON(WSMessage{RequestID: req.RequestID, Items: chunk})
+			chunk = chunk[:0]
+		}
+		return writeErr == nil
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	if err != nil {
+		log.Printf("WebSocket search error: %v", err)
+		if werr := c.WriteJSON(WSMessage{RequestID: req.RequestID, Items: []FileItem{}, Error: err.Error()}); werr != nil {
+			return werr
+		}
+		return nil
+	}
+	return sendWSItems(c, req.RequestID, chunk)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"file-browser/scan"
+)
+
+func TestNameMatcher(t *testing.T) {
+	tests := []struct {
+		query, mode, name string
+		expected          bool
+	}{
+		{"report", "", "Q3-Report.pdf", true},
+		{"report", "substring", "summary.pdf", false},
+		{"*.PDF", "glob", "q3-report.pdf", true},
+		{"*.pdf", "glob", "q3-report.pdfx", false},
+		{`^IMG_\d+\.jpg$`, "regex", "IMG_0042.jpg", true},
+		{`^IMG_\d+\.jpg$`, "regex", "img_0042.jpg", false},
+	}
+
+	for _, test := range tests {
+		match, err := newNameMatcher(test.query, test.mode)
+		if err != nil {
+			t.Fatalf("newNameMatcher(%q, %q) failed: %v", test.query, test.mode, err)
+		}
+		if got := match(test.name); got != test.expected {
+			t.Errorf("match(%q, %q) on %q = %v, expected %v", test.query, test.mode, test.name, got, test.expected)
+		}
+	}
+
+	if _, err := newNameMatcher("[", "glob"); err == nil {
+		t.Error("Expected error for invalid glob pattern")
+	}
+	if _, err := newNameMatcher("(", "regex"); err == nil {
+		t.Error("Expected error for invalid regex")
+	}
+	if _, err := newNameMatcher("x", "fuzzy"); err == nil {
+		t.Error("Expected error for unknown mode")
+	}
+}
+
+func setupSearchTree(t *testing.T) {
+	t.Helper()
+	tmpDir := t.TempDir()
+	files := map[string]string{
+		"notes.txt":               "hello",
+		"photos/beach.jpg":        "0123456789",
+		"photos/2024/notes.md":    "# notes",
+		"photos/.hidden/notes.md": "secret",
+	}
+	for name, content := range files {
+		full := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldRoot, oldWithSizes, oldTree := rootPath, withSizes, sizeTreeRoot
+	t.Cleanup(func() {
+		rootPath, withSizes, sizeTreeRoot = oldRoot, oldWithSizes, oldTree
+	})
+	rootPath = tmpDir
+	withSizes = false
+	sizeTreeRoot = nil
+}
+
+// loadTestSizeTree scans rootPath into an in-memory size tree (no bolt db)
+func loadTestSizeTree(t *testing.T) {
+	t.Helper()
+	children, err := scan.ScanDirConcurrent(rootPath, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizeTreeRoot = &scan.FileData{ID: "root", Name: filepath.Base(rootPath), RootPath: rootPath, IsDir: true, Children: children}
+	sizeTreeRoot.RebuildParentPointers(nil)
+	sizeTreeRoot.Size()
+	withSizes = true
+}
+
+func collectSearch(t *testing.T, opts SearchOptions) []string {
+	t.Helper()
+	var paths []string
+	_, err := searchFiles(context.Background(), opts, func(item FileItem) bool {
+		paths = append(paths, item.Path)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("searchFiles failed: %v", err)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestSearchFiles(t *testing.T) {
+	setupSearchTree(t)
+
+	check := func(label string, opts SearchOptions, expected []string) {
+		t.Helper()
+		got := collectSearch(t, opts)
+		if len(got) != len(expected) {
+			t.Fatalf("%s: expected %v, got %v", label, expected, got)
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Errorf("%s: expected %v, got %v", label, expected, got)
+			}
+		}
+	}
+
+	runAll := func(label string) {
+		check(label+" substring", SearchOptions{Query: "notes"}, []string{"notes.txt", "photos/2024/notes.md"})
+		check(label+" glob", SearchOptions{Query: "*.md", Mode: "glob"}, []string{"photos/2024/notes.md"})
+		check(label+" subtree", SearchOptions{Query: "notes", Path: "photos"}, []string{"photos/2024/notes.md"})
+		check(label+" dirs", SearchOptions{Query: "o", Type: "dir"}, []string{"photos"})
+		check(label+" min size", SearchOptions{Query: ".", Type: "file", MinSize: 6}, []string{"photos/2024/notes.md", "photos/beach.jpg"})
+	}
+
+	// Disk walk
+	runAll("disk")
+
+	// In-memory size tree
+	loadTestSizeTree(t)
+	runAll("tree")
+}
+
+func TestSearchFilesLimit(t *testing.T) {
+	setupSearchTree(t)
+
+	truncated, err := searchFiles(context.Background(), SearchOptions{Query: "o", Limit: 1}, func(FileItem) bool { return true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("Expected search to be truncated at limit")
+	}
+
+	if _, err := searchFiles(context.Background(), SearchOptions{Query: "x", Path: "../.."}, func(FileItem) bool { return true }); err == nil {
+		t.Error("Expected error for path outside of root")
+	}
+}
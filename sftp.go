@@ -0,0 +1,418 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	sftpPort        string // Port for the SFTP server (empty = disabled)
+	sftpHostKeyFile string // Private host key, generated on first start
+)
+
+// sftpHandlers serves rootPath for one logged in access key. Writes need both
+// write mode and a key that isn't read-only, same as the S3 gateway.
+type sftpHandlers struct {
+	key AccessKey
+}
+
+func sftpRelPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func sftpFullPath(name string) string {
+	return filepath.Join(rootPath, filepath.FromSlash(sftpRelPath(name)))
+}
+
+func (h *sftpHandlers) canWrite() bool {
+	return writeMode && !h.key.ReadOnly
+}
+
+func (h *sftpHandlers) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return os.Open(sftpFullPath(r.Filepath))
+}
+
+func (h *sftpHandlers) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return h.openForWrite(r, os.O_WRONLY)
+}
+
+func (h *sftpHandlers) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return h.openForWrite(r, os.O_RDWR)
+}
+
+func (h *sftpHandlers) openForWrite(r *sftp.Request, flag int) (*sftpFile, error) {
+	if !h.canWrite() {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	// O_APPEND is left out on purpose: clients send offsets and os.File
+	// refuses WriteAt on append-only files
+	pflags := r.Pflags()
+	if pflags.Creat {
+		flag |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flag |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flag |= os.O_EXCL
+	}
+
+	// Clients also open files for writing to change their attributes, or
+	// open and close them without writing. Only creating, truncating or
+	// writing counts as an upload.
+	fullPath := sftpFullPath(r.Filepath)
+	_, statErr := os.Stat(fullPath)
+	changed := flag&os.O_TRUNC != 0 || (flag&os.O_CREATE != 0 && os.IsNotExist(statErr))
+
+	f, err := os.OpenFile(fullPath, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// Released in Close, so shutdown waits for the upload to finish
+	fileOpsInProgress.Add(1)
+	return &sftpFile{File: f, fullPath: fullPath, relPath: sftpRelPath(r.Filepath), changed: changed}, nil
+}
+
+// sftpFile updates the size tree and log once a written file is closed, if
+// it was actually created or written to
+type sftpFile struct {
+	*os.File
+	fullPath string
+	relPath  string
+	changed  bool
+	closed   bool
+}
+
+func (f *sftpFile) WriteAt(p []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(p, off)
+	if n > 0 {
+		f.changed = true
+	}
+	return n, err
+}
+
+func (f *sftpFile) Truncate(size int64) error {
+	f.changed = true
+	return f.File.Truncate(size)
+}
+
+func (f *sftpFile) Close() error {
+	err := f.File.Close()
+	if f.closed {
+		return err
+	}
+	f.closed = true
+	defer fileOpsInProgress.Done()
+	if !f.changed {
+		return err
+	}
+
+	sizeTreeAdd(f.fullPath)
+	var errors []string
+	if err != nil {
+		errors = []string{err.Error()}
+	}
+	logModification("upload", nil, f.relPath, errors)
+	return err
+}
+
+func (h *sftpHandlers) Filecmd(r *sftp.Request) error {
+	if r.Method == "Link" || r.Method == "Symlink" {
+		// Links could point outside the root
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	if !h.canWrite() {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	fileOpsInProgress.Add(1)
+	defer fileOpsInProgress.Done()
+
+	fullPath, relPath := sftpFullPath(r.Filepath), sftpRelPath(r.Filepath)
+	switch r.Method {
+	case "Setstat":
+		return h.setstat(r, fullPath, relPath)
+
+	case "Rename":
+		// Plain SFTP rename never overwrites
+		if _, err := os.Lstat(sftpFullPath(r.Target)); err == nil {
+			return os.ErrExist
+		}
+		return h.rename(r)
+
+	case "Mkdir":
+		if err := os.Mkdir(fullPath, 0755); err != nil {
+			return err
+		}
+		sizeTreeAdd(fullPath)
+		logModification("new_folder", nil, relPath, nil)
+		return nil
+
+	case "Rmdir", "Remove":
+		info, err := os.Lstat(fullPath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() != (r.Method == "Rmdir") {
+			return sftp.ErrSSHFxFailure
+		}
+		// os.Remove only removes empty directories, like rmdir(2)
+		if err := os.Remove(fullPath); err != nil {
+			logModification("delete", []string{relPath}, "", []string{err.Error()})
+			return err
+		}
+		sizeTreeRemove(fullPath, info.IsDir())
+		logModification("delete", []string{relPath}, "", nil)
+		return nil
+	}
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+// PosixRename is the posix-rename@openssh.com extension, which replaces the target
+func (h *sftpHandlers) PosixRename(r *sftp.Request) error {
+	if !h.canWrite() {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	fileOpsInProgress.Add(1)
+	defer fileOpsInProgress.Done()
+	return h.rename(r)
+}
+
+func (h *sftpHandlers) rename(r *sftp.Request) error {
+	oldPath, newPath := sftpFullPath(r.Filepath), sftpFullPath(r.Target)
+	oldRel, newRel := sftpRelPath(r.Filepath), sftpRelPath(r.Target)
+	info, err := os.Lstat(oldPath)
+	if err != nil {
+		return err
+	}
+	target, targetErr := os.Lstat(newPath)
+
+	if err := os.Rename(oldPath, newPath); err != nil {
+		logModification("rename", []string{oldRel}, newRel, []string{err.Error()})
+		return err
+	}
+	if targetErr == nil {
+		// The replaced item would otherwise stay in the tree next to the moved one
+		sizeTreeRemove(newPath, target.IsDir())
+	}
+	sizeTreeMove(oldPath, newPath, info.IsDir())
+	logModification("rename", []string{oldRel}, newRel, nil)
+	return nil
+}
+
+// setstat applies truncate/chmod/chtimes. Only a size change touches the
+// content, so only that is logged (as an upload, like an overwrite would be).
+func (h *sftpHandlers) setstat(r *sftp.Request, fullPath, relPath string) error {
+	flags, attrs := r.AttrFlags(), r.Attributes()
+	if flags.Size {
+		if err := os.Truncate(fullPath, int64(attrs.Size)); err != nil {
+			return err
+		}
+		sizeTreeAdd(fullPath)
+		logModification("upload", nil, relPath, nil)
+	}
+	if flags.Permissions {
+		if err := os.Chmod(fullPath, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := os.Chtimes(fullPath, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *sftpHandlers) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	fullPath := sftpFullPath(r.Filepath)
+	switch r.Method {
+	case "List":
+		entries, err := os.ReadDir(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		return sftpListerAt(infos), nil
+	case "Stat":
+		info, err := os.Stat(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListerAt{info}, nil
+	}
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (h *sftpHandlers) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	info, err := os.Lstat(sftpFullPath(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return sftpListerAt{info}, nil
+}
+
+func (h *sftpHandlers) Readlink(name string) (string, error) {
+	return os.Readlink(sftpFullPath(name))
+}
+
+type sftpListerAt []os.FileInfo
+
+func (l sftpListerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// loadSFTPHostKey reads the host key, generating an ed25519 key on first start
+// so clients see the same fingerprint across restarts
+func loadSFTPHostKey(path string) (ssh.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		return ssh.ParsePrivateKey(data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ssh.MarshalPrivateKey(key, "wile sftp host key")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return nil, err
+	}
+	log.Printf("Generated SFTP host key %s", path)
+	return ssh.NewSignerFromKey(key)
+}
+
+// newSFTPServerConfig logs users in with an access key: the key ID or name as
+// user and the secret as password
+func newSFTPServerConfig(hostKey ssh.Signer) *ssh.ServerConfig {
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			key, ok := accessKeys.authenticate(conn.User(), string(password))
+			if !ok {
+				log.Printf("SFTP login failed for %q from %s", conn.User(), conn.RemoteAddr())
+				return nil, fmt.Errorf("invalid credentials")
+			}
+			return &ssh.Permissions{Extensions: map[string]string{"access-key": key.AccessKeyID}}, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+	return config
+}
+
+func serveSFTP(listener net.Listener, config *ssh.ServerConfig) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("SFTP server error: %v", err)
+			return
+		}
+		go handleSFTPConn(conn, config)
+	}
+}
+
+func handleSFTPConn(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go handleSFTPSession(sshConn, channel, requests)
+	}
+}
+
+// handleSFTPSession serves the sftp subsystem; shells and exec are refused
+func handleSFTPSession(sshConn *ssh.ServerConn, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		var subsystem struct{ Name string }
+		if req.Type != "subsystem" || ssh.Unmarshal(req.Payload, &subsystem) != nil || subsystem.Name != "sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+
+		// Looked up per session so a revoked key can't open new ones
+		key, ok := accessKeys.get(sshConn.Permissions.Extensions["access-key"])
+		if !ok {
+			req.Reply(false, nil)
+			return
+		}
+		req.Reply(true, nil)
+		go ssh.DiscardRequests(requests)
+
+		handlers := &sftpHandlers{key: key}
+		server := sftp.NewRequestServer(channel, sftp.Handlers{
+			FileGet: handlers, FilePut: handlers, FileCmd: handlers, FileList: handlers,
+		})
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Printf("SFTP session for %s ended: %v", key.Name, err)
+		}
+		server.Close()
+		return
+	}
+}
+
+// setupSFTP starts the SFTP server on its own listener
+func setupSFTP() {
+	if sftpPort == "" || accessKeys == nil || !localOnly("SFTP") {
+		return
+	}
+	hostKey, err := loadSFTPHostKey(sftpHostKeyFile)
+	if err != nil {
+		log.Printf("Warning: SFTP disabled: failed to load host key: %v", err)
+		return
+	}
+	listener, err := net.Listen("tcp", ":"+sftpPort)
+	if err != nil {
+		log.Printf("Warning: SFTP disabled: %v", err)
+		return
+	}
+
+	mode := "read-only"
+	if writeMode {
+		mode = "read-write"
+	}
+	log.Printf("SFTP server starting on :%s (%s, host key %s)", sftpPort, mode, ssh.FingerprintSHA256(hostKey.PublicKey()))
+	go serveSFTP(listener, newSFTPServerConfig(hostKey))
+}
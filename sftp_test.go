@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// startTestSFTP starts an SFTP server on a random port with a single access key
+func startTestSFTP(t *testing.T, readOnly bool) (string, AccessKey) {
+	t.Helper()
+	store, err := loadAccessKeys(filepath.Join(t.TempDir(), "keys.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := store.create("tester", readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKeys := accessKeys
+	t.Cleanup(func() { accessKeys = oldKeys })
+	accessKeys = store
+
+	hostKey, err := loadSFTPHostKey(filepath.Join(t.TempDir(), "host_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go serveSFTP(listener, newSFTPServerConfig(hostKey))
+	return listener.Addr().String(), key
+}
+
+func dialTestSFTP(t *testing.T, addr, user, password string) (*sftp.Client, error) {
+	t.Helper()
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.Password(password)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.Cleanup(func() { client.Close(); conn.Close() })
+	return client, nil
+}
+
+func TestSFTPReadOnly(t *testing.T) {
+	setupSearchTree(t)
+	enableTestWriteMode(t)
+	addr, key := startTestSFTP(t, true)
+
+	if _, err := dialTestSFTP(t, addr, "tester", "wrong"); err == nil {
+		t.Error("Expected login with a wrong password to fail")
+	}
+	client, err := dialTestSFTP(t, addr, key.AccessKeyID, key.SecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := client.Open("/photos/beach.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if len(data) == 0 {
+		t.Error("Expected to read beach.jpg")
+	}
+
+	if _, err := client.Create("/x.txt"); err == nil {
+		t.Error("Expected read-only key to be denied writes")
+	}
+	if err := client.Mkdir("/docs"); err == nil {
+		t.Error("Expected read-only key to be denied mkdir")
+	}
+
+	// Paths can't climb out of the root
+	entries, err := client.ReadDir("/../..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !strings.Contains(strings.Join(names, ","), "notes.txt") {
+		t.Errorf("Expected /../.. to list the root, got %v", names)
+	}
+}
+
+func TestSFTPWrites(t *testing.T) {
+	setupSearchTree(t)
+	loadTestSizeTree(t)
+	enableTestWriteMode(t)
+	addr, key := startTestSFTP(t, false)
+	client, err := dialTestSFTP(t, addr, "tester", key.SecretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootSize := sizeTreeRoot.Size()
+
+	if err := client.Mkdir("/docs"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := client.Create("/docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("12345"))
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if node := sizeTreeRoot.FindByPath(filepath.Join(rootPath, "docs", "a.txt")); node == nil || node.Size() != 5 {
+		t.Fatalf("Uploaded file missing from size tree: %+v", node)
+	}
+	// Opening an existing file for writing and closing it changes nothing
+	if f, err := client.OpenFile("/docs/a.txt", os.O_WRONLY); err != nil {
+		t.Fatal(err)
+	} else if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plain rename refuses to overwrite, posix-rename replaces the target
+	if err := client.Rename("/docs/a.txt", "/notes.txt"); err == nil {
+		t.Error("Expected rename onto an existing file to fail")
+	}
+	notesSize := sizeTreeRoot.FindByPath(filepath.Join(rootPath, "notes.txt")).Size()
+	if err := client.PosixRename("/docs/a.txt", "/notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(rootPath, "notes.txt")); string(data) != "12345" {
+		t.Errorf("Expected notes.txt to be replaced, got %q", data)
+	}
+	if sizeTreeRoot.Size() != rootSize-notesSize+5 {
+		t.Errorf("Expected root size %d after replacing notes.txt, got %d", rootSize-notesSize+5, sizeTreeRoot.Size())
+	}
+
+	if err := client.Remove("/notes.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.RemoveDirectory("/docs"); err != nil {
+		t.Fatal(err)
+	}
+	if sizeTreeRoot.Size() != rootSize-notesSize {
+		t.Errorf("Expected root size %d, got %d", rootSize-notesSize, sizeTreeRoot.Size())
+	}
+
+	var actions []string
+	for _, entry := range readModificationLog(t) {
+		actions = append(actions, entry.Action)
+	}
+	if strings.Join(actions, ",") != "new_folder,upload,rename,delete,delete" {
+		t.Errorf("Unexpected modifications log: %v", actions)
+	}
+}
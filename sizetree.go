@@ -0,0 +1,272 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/google/uuid"
+
+	"file-browser/scan"
+)
+
+// TreeChange describes a change that wile made to the served tree
+type TreeChange struct {
+	Op      string // "add", "remove" or "move"
+	Path    string // Absolute path of the affected item (the new path for moves)
+	OldPath string // Previous absolute path, only set for moves and renames
+	IsDir   bool
+}
+
+var (
+	treeChangeHooks   []func(TreeChange)
+	treeChangeHooksMu sync.RWMutex
+)
+
+// onTreeChange registers a hook that is called after every size tree update.
+// Hooks are called synchronously from the handler, so they must not block.
+func onTreeChange(hook func(TreeChange)) {
+	treeChangeHooksMu.Lock()
+	treeChangeHooks = append(treeChangeHooks, hook)
+	treeChangeHooksMu.Unlock()
+}
+
+func notifyTreeChange(change TreeChange) {
+	treeChangeHooksMu.RLock()
+	hooks := treeChangeHooks
+	treeChangeHooksMu.RUnlock()
+	for _, hook := range hooks {
+		hook(change)
+	}
+}
+
+// saveSubtreeToBolt saves node and all of its descendants in one transaction
+func saveSubtreeToBolt(db *bolt.DB, node *scan.FileData) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sizesBucketOf(node))
+		var saveRec func(*scan.FileData) error
+		saveRec = func(n *scan.FileData) error {
+			if err := saveNodeToBolt(bucket, n); err != nil {
+				return err
+			}
+			for _, c := range n.Children {
+				if err := saveRec(c); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return saveRec(node)
+	})
+}
+
+// deleteSubtreeFromBolt deletes node and all of its descendants in one transaction
+func deleteSubtreeFromBolt(db *bolt.DB, node *scan.FileData) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sizesBucketOf(node))
+		var deleteRec func(*scan.FileData) error
+		deleteRec = func(n *scan.FileData) error {
+			if err := deleteNodeFromBolt(bucket, n.ID); err != nil {
+				return err
+			}
+			for _, c := range n.Children {
+				if err := deleteRec(c); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return deleteRec(node)
+	})
+}
+
+// updateAncestorsInBolt persists the sizes of node's parent chain (best effort)
+func updateAncestorsInBolt(db *bolt.DB, node *scan.FileData) {
+	for p := node.Parent; p != nil; p = p.Parent {
+		if err := updateNodeInBolt(db, p); err != nil {
+			log.Printf("Warning: Failed to update parent in bolt db: %v", err)
+		}
+	}
+}
+
+// detachNode removes node from the tree and the bolt db, subtracting its size from its parents.
+// Caller must hold sizeTreeMutex.
+func detachNode(node *scan.FileData) {
+	node.UpdateParentSizes(-node.Size()) // Subtract from parent chain
+	if node.Parent == nil {
+		return
+	}
+	node.Parent.RemoveChild(node)
+	if boltDB != nil {
+		if err := deleteSubtreeFromBolt(boltDB, node); err != nil {
+			log.Printf("Warning: Failed to delete from bolt db: %v", err)
+		}
+		// Update all parents in bolt (still holding sizeTreeMutex)
+		updateAncestorsInBolt(boltDB, node)
+	}
+}
+
+// sizeTreeAdd adds a file or directory that was just created at targetPath
+// (copy, new folder, upload, ...) to the size tree and bolt db. Directories are
+// scanned to build their subtree. An existing node at targetPath (overwrite) is replaced.
+func sizeTreeAdd(targetPath string) {
+	newInfo, statErr := rootFS.Stat(targetPath)
+	if statErr != nil {
+		log.Printf("Warning: Failed to stat %s for size tree: %v", targetPath, statErr)
+		return
+	}
+
+	if tree := sizeTreeFor(targetPath); tree != nil {
+		// IMPORTANT: Must hold lock during size calculation to prevent races
+		sizeTreeMutex.Lock()
+		parent := tree.FindByPath(filepath.Dir(targetPath))
+		if parent != nil {
+			// Replace an existing node (e.g. a file copied over an existing one)
+			for _, child := range parent.Children {
+				if child.Name == newInfo.Name() {
+					detachNode(child)
+					break
+				}
+			}
+
+			var newNode *scan.FileData
+			if newInfo.IsDir() {
+				// Scan the new directory to build subtree
+				children, err := scan.ScanFSConcurrent(rootFS, targetPath, 0, nil)
+				if err != nil {
+					log.Printf("Warning: Failed to scan new directory: %v", err)
+					// Create empty placeholder if scan fails
+					children = []*scan.FileData{}
+				}
+
+				newNode = &scan.FileData{
+					ID:         uuid.New().String(),
+					Name:       newInfo.Name(),
+					Parent:     parent,
+					IsDir:      true,
+					Children:   children,
+					CachedSize: -1, // Force recalc
+					Modified:   newInfo.ModTime().Unix(),
+				}
+				// Fix parent pointers for children
+				for _, child := range children {
+					child.RebuildParentPointers(newNode)
+				}
+			} else {
+				// File
+				newNode = &scan.FileData{
+					ID:         uuid.New().String(),
+					Name:       newInfo.Name(),
+					Parent:     parent,
+					IsDir:      false,
+					CachedSize: newInfo.Size(),
+					Modified:   newInfo.ModTime().Unix(),
+				}
+			}
+
+			// Compute size (recursively for dirs)
+			sizeToAdd := newNode.Size()
+
+			// Add to parent
+			parent.Children = append(parent.Children, newNode)
+			newNode.UpdateParentSizes(sizeToAdd)
+
+			// Update BoltDB
+			if boltDB != nil {
+				// Update all parents first (best effort)
+				updateAncestorsInBolt(boltDB, newNode)
+
+				// Save new subtree
+				if err := saveSubtreeToBolt(boltDB, newNode); err != nil {
+					log.Printf("Warning: Failed to save new node to bolt db: %v", err)
+				}
+			}
+		}
+		sizeTreeMutex.Unlock()
+	}
+
+	notifyTreeChange(TreeChange{Op: "add", Path: targetPath, IsDir: newInfo.IsDir()})
+}
+
+// sizeTreeRemove removes a deleted file or directory from the size tree and bolt db
+func sizeTreeRemove(srcPath string, isDir bool) {
+	if tree := sizeTreeFor(srcPath); tree != nil {
+		sizeTreeMutex.Lock()
+		if node := tree.FindByPath(srcPath); node != nil {
+			detachNode(node)
+		}
+		sizeTreeMutex.Unlock()
+	}
+
+	notifyTreeChange(TreeChange{Op: "remove", Path: srcPath, IsDir: isDir})
+}
+
+// sizeTreeMove moves a node from srcPath to targetPath (move or rename).
+// The node keeps its ID, so only the node and the affected parents are saved.
+func sizeTreeMove(srcPath, targetPath string, isDir bool) {
+	// Between roots the node changes trees and bbolt buckets; rescan the target instead
+	if mountOf(srcPath).Name != mountOf(targetPath).Name {
+		sizeTreeRemove(srcPath, isDir)
+		sizeTreeAdd(targetPath)
+		return
+	}
+
+	if tree := sizeTreeFor(srcPath); tree != nil {
+		sizeTreeMutex.Lock()
+		if oldNode := tree.FindByPath(srcPath); oldNode != nil {
+			oldParent := oldNode.Parent
+			newParentPath := filepath.Dir(targetPath)
+			newName := filepath.Base(targetPath)
+
+			if oldParent != nil && oldParent.Path() == newParentPath {
+				// Plain rename: ID is constant, Path is dynamic, so just save the node with its new name.
+				// The parent only stores child IDs, so it doesn't need an update.
+				oldNode.Name = newName
+				if boltDB != nil {
+					if err := updateNodeInBolt(boltDB, oldNode); err != nil {
+						log.Printf("Warning: Failed to update renamed node in bolt db: %v", err)
+					}
+				}
+			} else if newParent := tree.FindByPath(newParentPath); newParent != nil {
+				size := oldNode.Size()
+
+				// Remove from old location
+				oldNode.UpdateParentSizes(-size)
+				if oldParent != nil {
+					oldParent.RemoveChild(oldNode)
+				}
+
+				// Add to new location
+				oldNode.Parent = newParent
+				oldNode.Name = newName
+				newParent.Children = append(newParent.Children, oldNode)
+				oldNode.UpdateParentSizes(size)
+
+				// Bolt stores Node -> ParentID and Parent -> ChildIDs, so we must save
+				// the old parent chain, the new parent chain and the node itself
+				if boltDB != nil {
+					if oldParent != nil {
+						if err := updateNodeInBolt(boltDB, oldParent); err != nil {
+							log.Printf("Warning: Failed to update old parent in bolt: %v", err)
+						}
+						for p := oldParent.Parent; p != nil; p = p.Parent {
+							updateNodeInBolt(boltDB, p)
+						}
+					}
+					updateAncestorsInBolt(boltDB, oldNode)
+					if err := updateNodeInBolt(boltDB, oldNode); err != nil {
+						log.Printf("Warning: Failed to update moved node in bolt: %v", err)
+					}
+				}
+			} else {
+				// Destination is not in the tree; drop the node so sizes stay consistent
+				detachNode(oldNode)
+			}
+		}
+		sizeTreeMutex.Unlock()
+	}
+
+	notifyTreeChange(TreeChange{Op: "move", Path: targetPath, OldPath: srcPath, IsDir: isDir})
+}
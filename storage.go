@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"file-browser/storage"
+)
+
+// rootFS is the storage behind rootPath. All file access for the UI and the
+// size tree goes through it, so --path can also be an s3:// URL.
+var rootFS storage.FS = storage.Local{}
+
+var (
+	storageEndpoint string // S3 endpoint for s3:// roots
+	storageRegion   string
+)
+
+// openRootStorage returns the storage for the --path flag and the rootPath to
+// use with it. s3://bucket/prefix serves a bucket; credentials come from
+// AWS_ACCESS_KEY_ID / AWS_SECRET_ACCESS_KEY like for the aws cli.
+func openRootStorage(path string) (storage.FS, string, error) {
+	if !strings.HasPrefix(path, "s3://") {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, "", err
+		}
+		return storage.Local{}, absPath, nil
+	}
+
+	u, err := url.Parse(path)
+	if err != nil || u.Host == "" {
+		return nil, "", fmt.Errorf("invalid S3 URL %q, expected s3://bucket/prefix", path)
+	}
+	region := storageRegion
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := storageEndpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	accessKeyID, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKeyID == "" || secretKey == "" {
+		return nil, "", fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for %s", path)
+	}
+
+	fsys := storage.NewS3(storage.S3Config{
+		Endpoint:    endpoint,
+		Region:      region,
+		Bucket:      u.Host,
+		Prefix:      u.Path,
+		AccessKeyID: accessKeyID,
+		SecretKey:   secretKey,
+	})
+	if _, err := fsys.ReadDir(fsys.Root()); err != nil {
+		return nil, "", fmt.Errorf("cannot list %s: %w", path, err)
+	}
+	return fsys, fsys.Root(), nil
+}
+
+// localOnly reports whether a feature that needs the (primary) root on the
+// local disk can be enabled, and logs why not otherwise
+func localOnly(feature string) bool {
+	if _, ok := storage.LocalPath(rootFS, rootPath); ok {
+		return true
+	}
+	log.Printf("%s disabled: needs a local --path", feature)
+	return false
+}
+
+// sendStoredFile sends a file from rootFS or an archive, with validators for
+// caching and range requests (video seeking)
+func sendStoredFile(c *fiber.Ctx, fullPath string, info fs.FileInfo) error {
+	if member, ok := info.(*archiveMemberInfo); ok {
+		return sendArchiveMember(c, member)
+	}
+	// Files that arrived with a verified checksum
+	if d := lookupDigest(fullPath, info); d != nil {
+		c.Set("Digest", d.header())
+	}
+	return sendWithValidators(c, fileETag(fullPath, info), info.Size(), info.ModTime(), func() (io.ReadCloser, error) {
+		return rootFS.Open(fullPath)
+	})
+}
+
+// openStored opens a file from rootFS or an archive for reading
+func openStored(fullPath string, info fs.FileInfo) (io.ReadCloser, error) {
+	if member, ok := info.(*archiveMemberInfo); ok {
+		return openArchiveMember(member)
+	}
+	return rootFS.Open(fullPath)
+}
+
+// localFile returns a local copy of a file for external tools (LibreOffice,
+// pdftotext). Local roots need no copy; cleanup must be called in any case.
+func localFile(fullPath string) (string, func(), error) {
+	if localPath, ok := storage.LocalPath(rootFS, fullPath); ok {
+		return localPath, func() {}, nil
+	}
+
+	tempDir, err := os.MkdirTemp("", "wile-local-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.RemoveAll(tempDir) }
+
+	// Same base name, tools derive their output names from it
+	localPath := filepath.Join(tempDir, filepath.Base(fullPath))
+	in, err := rootFS.Open(fullPath)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	defer in.Close()
+	out, err := os.Create(localPath)
+	if err == nil {
+		_, err = io.Copy(out, in)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return localPath, cleanup, nil
+}
@@ -0,0 +1,264 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is an in-memory FS for tests. Names are paths below the root given
+// to NewMemory, e.g. "/mem/photos/beach.jpg".
+type Memory struct {
+	mu    sync.RWMutex
+	root  string
+	nodes map[string]*memNode
+}
+
+type memNode struct {
+	dir     bool
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemory(root string) *Memory {
+	root = filepath.Clean(root)
+	return &Memory{
+		root:  root,
+		nodes: map[string]*memNode{root: {dir: true, modTime: time.Now()}},
+	}
+}
+
+// Root is the path the memory tree is mounted at
+func (m *Memory) Root() string {
+	return m.root
+}
+
+// clean returns the key for name, or "" if it's outside the root
+func (m *Memory) clean(name string) string {
+	name = filepath.Clean(name)
+	if name != m.root && !strings.HasPrefix(name, m.root+string(filepath.Separator)) {
+		return ""
+	}
+	return name
+}
+
+// lookup returns the node for name. Caller must hold mu.
+func (m *Memory) lookup(op, name string) (string, *memNode, error) {
+	key := m.clean(name)
+	node := m.nodes[key]
+	if node == nil {
+		return key, nil, pathError(op, name, fs.ErrNotExist)
+	}
+	return key, node, nil
+}
+
+// checkParent makes sure the parent of key is an existing directory. Caller must hold mu.
+func (m *Memory) checkParent(op, name, key string) error {
+	if key == "" || key == m.root {
+		return pathError(op, name, fs.ErrInvalid)
+	}
+	if parent := m.nodes[filepath.Dir(key)]; parent == nil || !parent.dir {
+		return pathError(op, name, fs.ErrNotExist)
+	}
+	return nil
+}
+
+func (m *Memory) info(key string, node *memNode) *fileInfo {
+	return &fileInfo{name: filepath.Base(key), size: int64(len(node.data)), dir: node.dir, modTime: node.modTime}
+}
+
+func (m *Memory) Stat(name string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key, node, err := m.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return m.info(key, node), nil
+}
+
+func (m *Memory) ReadDir(name string) ([]fs.DirEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key, node, err := m.lookup("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	if !node.dir {
+		return nil, pathError("readdir", name, fs.ErrInvalid)
+	}
+
+	var entries []fs.DirEntry
+	for k, child := range m.nodes {
+		if k != key && filepath.Dir(k) == key {
+			entries = append(entries, fs.FileInfoToDirEntry(m.info(k, child)))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+type memFile struct {
+	*bytes.Reader
+	info *fileInfo
+}
+
+func (f *memFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *memFile) Close() error               { return nil }
+
+func (m *Memory) Open(name string) (File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	key, node, err := m.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	// Written files get a new data slice, so readers keep a consistent snapshot
+	return &memFile{Reader: bytes.NewReader(node.data), info: m.info(key, node)}, nil
+}
+
+type memWriter struct {
+	bytes.Buffer
+	m    *Memory
+	name string
+}
+
+func (w *memWriter) Close() error {
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	key := w.m.clean(w.name)
+	if err := w.m.checkParent("create", w.name, key); err != nil {
+		return err
+	}
+	w.m.nodes[key] = &memNode{data: bytes.Clone(w.Bytes()), modTime: time.Now()}
+	return nil
+}
+
+func (m *Memory) Create(name string) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := m.clean(name)
+	if err := m.checkParent("create", name, key); err != nil {
+		return nil, err
+	}
+	if node := m.nodes[key]; node != nil && node.dir {
+		return nil, pathError("create", name, fs.ErrExist)
+	}
+	// Like os.Create, the file exists (empty) right away
+	m.nodes[key] = &memNode{modTime: time.Now()}
+	return &memWriter{m: m, name: name}, nil
+}
+
+func (m *Memory) Mkdir(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := m.clean(name)
+	if err := m.checkParent("mkdir", name, key); err != nil {
+		return err
+	}
+	if m.nodes[key] != nil {
+		return pathError("mkdir", name, fs.ErrExist)
+	}
+	m.nodes[key] = &memNode{dir: true, modTime: time.Now()}
+	return nil
+}
+
+func (m *Memory) MkdirAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := m.clean(name)
+	if key == "" {
+		return pathError("mkdir", name, fs.ErrInvalid)
+	}
+	for p := key; ; p = filepath.Dir(p) {
+		if node := m.nodes[p]; node != nil {
+			if !node.dir {
+				return pathError("mkdir", p, fs.ErrExist)
+			}
+			break
+		}
+		m.nodes[p] = &memNode{dir: true, modTime: time.Now()}
+	}
+	return nil
+}
+
+// children returns the keys of everything below key. Caller must hold mu.
+func (m *Memory) children(key string) []string {
+	var keys []string
+	prefix := key + string(filepath.Separator)
+	for k := range m.nodes {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func (m *Memory) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key, node, err := m.lookup("remove", name)
+	if err != nil {
+		return err
+	}
+	if key == m.root {
+		return pathError("remove", name, fs.ErrInvalid)
+	}
+	if node.dir && len(m.children(key)) > 0 {
+		return pathError("remove", name, errNotEmpty)
+	}
+	delete(m.nodes, key)
+	return nil
+}
+
+func (m *Memory) RemoveAll(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := m.clean(name)
+	if key == "" || key == m.root {
+		return pathError("removeall", name, fs.ErrInvalid)
+	}
+	for _, k := range m.children(key) {
+		delete(m.nodes, k)
+	}
+	delete(m.nodes, key)
+	return nil
+}
+
+func (m *Memory) Rename(oldName, newName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldKey, node, err := m.lookup("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newKey := m.clean(newName)
+	if err := m.checkParent("rename", newName, newKey); err != nil {
+		return err
+	}
+	if oldKey == m.root || strings.HasPrefix(newKey, oldKey+string(filepath.Separator)) {
+		return pathError("rename", newName, fs.ErrInvalid)
+	}
+	// Same rules as rename(2): a file replaces a file, a directory only an empty directory
+	if target := m.nodes[newKey]; target != nil && newKey != oldKey {
+		if target.dir != node.dir {
+			return pathError("rename", newName, fs.ErrExist)
+		}
+		if target.dir && len(m.children(newKey)) > 0 {
+			return pathError("rename", newName, errNotEmpty)
+		}
+	}
+
+	for _, k := range m.children(oldKey) {
+		m.nodes[newKey+strings.TrimPrefix(k, oldKey)] = m.nodes[k]
+		delete(m.nodes, k)
+	}
+	delete(m.nodes, oldKey)
+	m.nodes[newKey] = node
+	return nil
+}
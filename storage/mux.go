@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// errCrossMount is returned by Mux.Rename across filesystems; Move falls back to copy + delete
+var errCrossMount = errors.New("rename across mounts")
+
+// Mux serves several filesystems as one, each mounted at its own root. Names
+// outside every mount go to the fallback filesystem. wile uses it for named roots,
+// so handlers and the size tree can keep passing full paths around.
+type Mux struct {
+	fallback FS
+	mounts   []muxMount // Longest root first
+}
+
+type muxMount struct {
+	root string
+	fsys FS
+}
+
+// NewMux returns a Mux that sends everything to fallback until roots are mounted
+func NewMux(fallback FS) *Mux {
+	return &Mux{fallback: fallback}
+}
+
+// Mount serves fsys for root and everything below it
+func (m *Mux) Mount(root string, fsys FS) {
+	m.mounts = append(m.mounts, muxMount{root: filepath.Clean(root), fsys: fsys})
+	sort.SliceStable(m.mounts, func(i, j int) bool {
+		return len(m.mounts[i].root) > len(m.mounts[j].root)
+	})
+}
+
+// FS returns the filesystem that serves name
+func (m *Mux) FS(name string) FS {
+	for _, mount := range m.mounts {
+		if name == mount.root || strings.HasPrefix(name, mount.root+string(filepath.Separator)) {
+			return mount.fsys
+		}
+	}
+	return m.fallback
+}
+
+func (m *Mux) Stat(name string) (fs.FileInfo, error)      { return m.FS(name).Stat(name) }
+func (m *Mux) ReadDir(name string) ([]fs.DirEntry, error) { return m.FS(name).ReadDir(name) }
+func (m *Mux) Open(name string) (File, error)             { return m.FS(name).Open(name) }
+func (m *Mux) Create(name string) (io.WriteCloser, error) { return m.FS(name).Create(name) }
+func (m *Mux) Mkdir(name string) error                    { return m.FS(name).Mkdir(name) }
+func (m *Mux) MkdirAll(name string) error                 { return m.FS(name).MkdirAll(name) }
+func (m *Mux) Remove(name string) error                   { return m.FS(name).Remove(name) }
+func (m *Mux) RemoveAll(name string) error                { return m.FS(name).RemoveAll(name) }
+
+func (m *Mux) Rename(oldName, newName string) error {
+	fsys := m.FS(oldName)
+	if fsys != m.FS(newName) {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: errCrossMount}
+	}
+	return fsys.Rename(oldName, newName)
+}
+
+// Copy uses the mounted filesystem's own copy when both names are on it
+func (m *Mux) Copy(src, dst string) error {
+	fsys := m.FS(src)
+	if fsys == m.FS(dst) {
+		return Copy(fsys, src, dst)
+	}
+	return copyTree(m, src, dst)
+}
+
+func (m *Mux) LocalPath(name string) (string, bool) {
+	return LocalPath(m.FS(name), name)
+}
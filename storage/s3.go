@@ -0,0 +1,634 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config describes the bucket (and key prefix) an S3 FS serves
+type S3Config struct {
+	Endpoint    string // e.g. https://s3.eu-west-1.amazonaws.com or http://localhost:9000 for MinIO
+	Region      string
+	Bucket      string
+	Prefix      string // Key prefix that maps to the root, "" for the whole bucket
+	AccessKeyID string
+	SecretKey   string
+	Client      *http.Client // Defaults to http.DefaultClient
+}
+
+// S3 serves a bucket through the S3 API (path-style requests, SigV4).
+// Directories are key prefixes; empty ones are kept as "dir/" marker objects,
+// the convention the S3 console and most tools use.
+type S3 struct {
+	cfg  S3Config
+	root string
+}
+
+func NewS3(cfg S3Config) *S3 {
+	cfg.Endpoint = strings.TrimRight(cfg.Endpoint, "/")
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+	root := filepath.Join(string(filepath.Separator)+cfg.Bucket, filepath.FromSlash(cfg.Prefix))
+	return &S3{cfg: cfg, root: root}
+}
+
+// Root is the path names start with: /bucket/prefix
+func (s *S3) Root() string {
+	return s.root
+}
+
+// key maps a name to its object key ("" for the root). ok is false for names
+// outside the root.
+func (s *S3) key(name string) (key string, ok bool) {
+	name = filepath.Clean(name)
+	if name == s.root {
+		return "", true
+	}
+	rel, found := strings.CutPrefix(name, s.root+string(filepath.Separator))
+	if !found {
+		return "", false
+	}
+	return path.Join(s.cfg.Prefix, filepath.ToSlash(rel)), true
+}
+
+// dirPrefix returns the prefix the children of a directory key start with
+func (s *S3) dirPrefix(key string) string {
+	if key == "" && s.cfg.Prefix == "" {
+		return ""
+	}
+	if key == "" {
+		key = s.cfg.Prefix
+	}
+	return key + "/"
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// uriEncode encodes everything but the unreserved characters, as SigV4 expects
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func encodeQuery(query url.Values) string {
+	var params []string
+	for k, values := range query {
+		for _, v := range values {
+			params = append(params, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// sign adds a SigV4 Authorization header. The payload isn't hashed
+// (UNSIGNED-PAYLOAD), so bodies can be streamed from disk.
+func (s *S3) sign(r *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + s.cfg.Region + "/s3/aws4_request"
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	signed := []string{"host"}
+	for name := range r.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			signed = append(signed, name)
+		}
+	}
+	sort.Strings(signed)
+	var headers strings.Builder
+	for _, name := range signed {
+		value := r.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(r.Header.Get(name))
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+
+	canonical := strings.Join([]string{
+		r.Method, r.URL.EscapedPath(), r.URL.RawQuery, headers.String(), strings.Join(signed, ";"), "UNSIGNED-PAYLOAD",
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.cfg.SecretKey), amzDate[:8])
+	key = hmacSHA256(key, s.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	r.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.cfg.AccessKeyID, scope, strings.Join(signed, ";"), hex.EncodeToString(hmacSHA256(key, stringToSign))))
+}
+
+// do sends a signed request for key. body may be nil; size is its length.
+func (s *S3) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + s.cfg.Bucket + "/" + key
+	u.RawPath = "/" + uriEncode(s.cfg.Bucket, true) + "/" + uriEncode(key, false)
+	u.RawQuery = encodeQuery(query)
+
+	r, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	if body != nil {
+		r.ContentLength = size
+	}
+	s.sign(r, time.Now())
+	return s.cfg.Client.Do(r)
+}
+
+// s3Error turns an error response into an error; 404s match fs.ErrNotExist
+func s3Error(op, name string, resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return pathError(op, name, fs.ErrNotExist)
+	}
+	var e struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if xml.Unmarshal(data, &e) != nil || e.Code == "" {
+		e.Code = resp.Status
+	}
+	return pathError(op, name, fmt.Errorf("s3: %s %s", e.Code, e.Message))
+}
+
+func (s *S3) checkKey(op, name string) (string, error) {
+	key, ok := s.key(name)
+	if !ok {
+		return "", pathError(op, name, fs.ErrInvalid)
+	}
+	return key, nil
+}
+
+// head returns the size and modification time of an object
+func (s *S3) head(op, name, key string) (*fileInfo, error) {
+	resp, err := s.do("HEAD", key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3Error(op, name, resp)
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &fileInfo{name: filepath.Base(name), size: resp.ContentLength, modTime: modTime}, nil
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	Size         int64  `xml:"Size"`
+	LastModified string `xml:"LastModified"`
+}
+
+// list returns the objects and common prefixes below prefix, following
+// continuation tokens. limit stops early (0 = everything).
+func (s *S3) list(prefix, delimiter string, limit int) ([]s3Object, []string, error) {
+	var objects []s3Object
+	var prefixes []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if limit > 0 {
+			query.Set("max-keys", strconv.Itoa(limit))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.do("GET", "", query, nil, nil, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, s3Error("list", prefix, resp)
+		}
+		var result struct {
+			Contents       []s3Object `xml:"Contents"`
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		objects = append(objects, result.Contents...)
+		for _, p := range result.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" || (limit > 0 && len(objects)+len(prefixes) >= limit) {
+			return objects, prefixes, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *S3) Stat(name string) (fs.FileInfo, error) {
+	key, err := s.checkKey("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return &fileInfo{name: filepath.Base(name), dir: true}, nil
+	}
+
+	info, err := s.head("stat", name, key)
+	if err == nil || !isNotExist(err) {
+		return info, err
+	}
+	// A directory: its marker object, or just keys below it
+	if info, err := s.head("stat", name, key+"/"); err == nil {
+		info.dir, info.size = true, 0
+		return info, nil
+	}
+	objects, prefixes, err := s.list(key+"/", "/", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 && len(prefixes) == 0 {
+		return nil, pathError("stat", name, fs.ErrNotExist)
+	}
+	return &fileInfo{name: filepath.Base(name), dir: true}, nil
+}
+
+func isNotExist(err error) bool {
+	pe, ok := err.(*fs.PathError)
+	return ok && pe.Err == fs.ErrNotExist
+}
+
+func (s *S3) ReadDir(name string) ([]fs.DirEntry, error) {
+	key, err := s.checkKey("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	prefix := s.dirPrefix(key)
+	objects, prefixes, err := s.list(prefix, "/", 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(objects) == 0 && len(prefixes) == 0 && key != "" {
+		// Empty (marker only) or missing
+		if _, err := s.Stat(name); err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(objects)+len(prefixes))
+	for _, object := range objects {
+		childName := strings.TrimPrefix(object.Key, prefix)
+		if childName == "" || strings.Contains(childName, "/") {
+			continue // The directory's own marker
+		}
+		modTime, _ := time.Parse(time.RFC3339, object.LastModified)
+		entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{name: childName, size: object.Size, modTime: modTime}))
+	}
+	for _, p := range prefixes {
+		childName := strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/")
+		if childName != "" {
+			entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{name: childName, dir: true}))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// s3File reads an object with ranged GETs, so seeking (e.g. for HTTP range
+// requests) doesn't download what's skipped
+type s3File struct {
+	s      *S3
+	key    string
+	info   *fileInfo
+	offset int64
+	body   io.ReadCloser
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) { return f.info, nil }
+
+func (f *s3File) Read(b []byte) (int, error) {
+	if f.body == nil {
+		if f.offset >= f.info.size {
+			return 0, io.EOF
+		}
+		header := http.Header{"Range": {fmt.Sprintf("bytes=%d-", f.offset)}}
+		resp, err := f.s.do("GET", f.key, nil, header, nil, 0)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+			return 0, s3Error("read", f.info.name, resp)
+		}
+		f.body = resp.Body
+	}
+	n, err := f.body.Read(b)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("seek before start of file")
+	}
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *s3File) Close() error {
+	if f.body != nil {
+		return f.body.Close()
+	}
+	return nil
+}
+
+func (s *S3) Open(name string) (File, error) {
+	key, err := s.checkKey("open", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, pathError("open", name, fs.ErrInvalid)
+	}
+	return &s3File{s: s, key: key, info: info.(*fileInfo)}, nil
+}
+
+// s3Writer buffers to a temp file, because PutObject needs the length up front
+type s3Writer struct {
+	*os.File
+	s    *S3
+	name string
+	key  string
+}
+
+func (w *s3Writer) Close() error {
+	defer os.Remove(w.File.Name())
+	defer w.File.Close()
+	size, err := w.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := w.File.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return w.s.put(w.name, w.key, w.File, size, nil)
+}
+
+func (s *S3) put(name, key string, body io.Reader, size int64, header http.Header) error {
+	if body == nil {
+		body = strings.NewReader("")
+	}
+	resp, err := s.do("PUT", key, nil, header, body, size)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3Error("put", name, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Create(name string) (io.WriteCloser, error) {
+	key, err := s.checkKey("create", name)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return nil, pathError("create", name, fs.ErrInvalid)
+	}
+	f, err := os.CreateTemp("", "wile-s3-")
+	if err != nil {
+		return nil, err
+	}
+	return &s3Writer{File: f, s: s, name: name, key: key}, nil
+}
+
+func (s *S3) Mkdir(name string) error {
+	if _, err := s.Stat(name); err == nil {
+		return pathError("mkdir", name, fs.ErrExist)
+	}
+	return s.MkdirAll(name)
+}
+
+// MkdirAll only writes the marker for name; parents exist implicitly
+func (s *S3) MkdirAll(name string) error {
+	key, err := s.checkKey("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return nil
+	}
+	if info, err := s.Stat(name); err == nil {
+		if !info.IsDir() {
+			return pathError("mkdir", name, fs.ErrExist)
+		}
+		return nil
+	}
+	return s.put(name, key+"/", nil, 0, nil)
+}
+
+func (s *S3) delete(name, key string) error {
+	resp, err := s.do("DELETE", key, nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s3Error("remove", name, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Remove(name string) error {
+	key, err := s.checkKey("remove", name)
+	if err != nil {
+		return err
+	}
+	info, err := s.Stat(name)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return pathError("remove", name, fs.ErrInvalid)
+	}
+	if !info.IsDir() {
+		return s.delete(name, key)
+	}
+	objects, prefixes, err := s.list(key+"/", "/", 2)
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if object.Key != key+"/" {
+			return pathError("remove", name, errNotEmpty)
+		}
+	}
+	if len(prefixes) > 0 {
+		return pathError("remove", name, errNotEmpty)
+	}
+	return s.delete(name, key+"/")
+}
+
+func (s *S3) RemoveAll(name string) error {
+	key, err := s.checkKey("removeall", name)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return pathError("removeall", name, fs.ErrInvalid)
+	}
+	objects, _, err := s.list(key+"/", "", 0)
+	if err != nil {
+		return err
+	}
+
+	// Markers for every level too (some servers keep empty directories around
+	// until their marker is deleted). Reverse order deletes children first.
+	keys := map[string]bool{key: true, key + "/": true}
+	for _, object := range objects {
+		keys[object.Key] = true
+		for p := path.Dir(object.Key); len(p) > len(key); p = path.Dir(p) {
+			keys[p+"/"] = true
+		}
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(sorted)))
+	for _, k := range sorted {
+		if err := s.delete(name, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyObject is a server side copy
+func (s *S3) copyObject(name, srcKey, dstKey string) error {
+	source := "/" + s.cfg.Bucket + "/" + uriEncode(srcKey, false)
+	return s.put(name, dstKey, nil, 0, http.Header{"X-Amz-Copy-Source": {source}})
+}
+
+// Copy copies a file or a directory tree with server side copies.
+// Objects over 5 GB would need a multipart copy, which isn't implemented.
+func (s *S3) Copy(src, dst string) error {
+	srcKey, err := s.checkKey("copy", src)
+	if err != nil {
+		return err
+	}
+	dstKey, err := s.checkKey("copy", dst)
+	if err != nil {
+		return err
+	}
+	info, err := s.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return s.copyObject(dst, srcKey, dstKey)
+	}
+	if srcKey == "" || dstKey == "" || strings.HasPrefix(dstKey+"/", srcKey+"/") {
+		return pathError("copy", dst, fs.ErrInvalid)
+	}
+
+	objects, _, err := s.list(srcKey+"/", "", 0)
+	if err != nil {
+		return err
+	}
+	if err := s.put(dst, dstKey+"/", nil, 0, nil); err != nil {
+		return err
+	}
+	for _, object := range objects {
+		target := dstKey + "/" + strings.TrimPrefix(object.Key, srcKey+"/")
+		if strings.HasSuffix(object.Key, "/") {
+			err = s.put(dst, target, nil, 0, nil)
+		} else {
+			err = s.copyObject(dst, object.Key, target)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename copies and deletes; S3 has no rename
+func (s *S3) Rename(oldName, newName string) error {
+	oldKey, err := s.checkKey("rename", oldName)
+	if err != nil {
+		return err
+	}
+	newKey, err := s.checkKey("rename", newName)
+	if err != nil {
+		return err
+	}
+	if oldKey == "" {
+		return pathError("rename", oldName, fs.ErrInvalid)
+	}
+	if oldKey == newKey {
+		return nil
+	}
+	if err := s.Copy(oldName, newName); err != nil {
+		return err
+	}
+	return s.RemoveAll(oldName)
+}
@@ -0,0 +1,237 @@
+// Package storage abstracts the tree wile serves, so the root doesn't have to
+// be a local directory. Implementations: local disk, memory (tests) and S3.
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/otiai10/copy"
+)
+
+// FS is the filesystem behind rootPath. Names are the full paths the rest of
+// wile builds with filepath.Join(rootPath, ...); non-local implementations map
+// them below their own root. Errors for missing items match fs.ErrNotExist.
+type FS interface {
+	Stat(name string) (fs.FileInfo, error)
+	// ReadDir returns the entries sorted by name, like os.ReadDir
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Open(name string) (File, error)
+	// Create creates or truncates a file. The content is complete once Close returns.
+	Create(name string) (io.WriteCloser, error)
+	Mkdir(name string) error
+	MkdirAll(name string) error
+	// Remove removes a file or an empty directory
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+}
+
+// File is an open file for reading
+type File interface {
+	io.Reader
+	io.Seeker
+	io.Closer
+	Stat() (fs.FileInfo, error)
+}
+
+// copier is implemented by filesystems that copy faster than read + write
+// (server side copies for S3, otiai10/copy for local disk)
+type copier interface {
+	Copy(src, dst string) error
+}
+
+// Local is the local disk. Names are OS paths.
+type Local struct{}
+
+func (Local) Stat(name string) (fs.FileInfo, error)      { return os.Stat(name) }
+func (Local) ReadDir(name string) ([]fs.DirEntry, error) { return os.ReadDir(name) }
+func (Local) Open(name string) (File, error)             { return os.Open(name) }
+func (Local) Create(name string) (io.WriteCloser, error) { return os.Create(name) }
+func (Local) Mkdir(name string) error                    { return os.Mkdir(name, 0755) }
+func (Local) MkdirAll(name string) error                 { return os.MkdirAll(name, 0755) }
+func (Local) Remove(name string) error                   { return os.Remove(name) }
+func (Local) RemoveAll(name string) error                { return os.RemoveAll(name) }
+func (Local) Rename(oldName, newName string) error       { return os.Rename(oldName, newName) }
+func (Local) Copy(src, dst string) error                 { return copy.Copy(src, dst) }
+func (Local) LocalPath(name string) (string, bool)       { return name, true }
+
+// localPather is implemented by filesystems that keep (some of) their files on the local disk
+type localPather interface {
+	LocalPath(name string) (string, bool)
+}
+
+// LocalPath returns the path of name on the local disk, if it is stored there.
+// Used for things that need a real file (sendfile, LibreOffice, fsnotify).
+func LocalPath(fsys FS, name string) (string, bool) {
+	if l, ok := fsys.(localPather); ok {
+		return l.LocalPath(name)
+	}
+	return "", false
+}
+
+// IsLocal reports whether fsys is the local disk
+func IsLocal(fsys FS) bool {
+	_, ok := fsys.(Local)
+	return ok
+}
+
+// Walk walks the tree rooted at root like filepath.WalkDir
+func Walk(fsys FS, root string, fn fs.WalkDirFunc) error {
+	info, err := fsys.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDir(fsys, root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkDir(fsys FS, path string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(path, d, nil); err != nil || !d.IsDir() {
+		if err == filepath.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := fsys.ReadDir(path)
+	if err != nil {
+		// Second call, to report the ReadDir error
+		if err = fn(path, d, err); err != nil {
+			if err == filepath.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		if err := walkDir(fsys, filepath.Join(path, entry.Name()), entry, fn); err != nil {
+			if err == filepath.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy copies a file or a directory tree
+func Copy(fsys FS, src, dst string) error {
+	if c, ok := fsys.(copier); ok {
+		return c.Copy(src, dst)
+	}
+	return copyTree(fsys, src, dst)
+}
+
+// copyTree copies with plain reads and writes
+func copyTree(fsys FS, src, dst string) error {
+	info, err := fsys.Stat(src)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return copyFile(fsys, src, dst)
+	}
+
+	if err := fsys.MkdirAll(dst); err != nil {
+		return err
+	}
+	entries, err := fsys.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := copyTree(fsys, filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(fsys FS, src, dst string) error {
+	in, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fsys.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Move renames src to dst, falling back to copy + delete (e.g. across devices)
+func Move(fsys FS, src, dst string) error {
+	if err := fsys.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := Copy(fsys, src, dst); err != nil {
+		return err
+	}
+	return fsys.RemoveAll(src)
+}
+
+// Import moves a file from the local disk (e.g. a finished upload) to name
+func Import(fsys FS, localPath, name string) error {
+	if dst, ok := LocalPath(fsys, name); ok {
+		return Move(Local{}, localPath, dst)
+	}
+
+	in, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fsys.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Remove(localPath)
+}
+
+// fileInfo is the fs.FileInfo of the memory and S3 implementations
+type fileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i *fileInfo) Name() string       { return i.name }
+func (i *fileInfo) Size() int64        { return i.size }
+func (i *fileInfo) IsDir() bool        { return i.dir }
+func (i *fileInfo) ModTime() time.Time { return i.modTime }
+func (i *fileInfo) Sys() any           { return nil }
+func (i *fileInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+var errNotEmpty = errors.New("directory not empty")
+
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
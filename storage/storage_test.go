@@ -0,0 +1,82 @@
+package storage_test
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"file-browser/storage"
+	"file-browser/storage/storagetest"
+)
+
+func TestLocal(t *testing.T) {
+	storagetest.TestFS(t, storage.Local{}, t.TempDir())
+}
+
+func TestMemory(t *testing.T) {
+	fsys := storage.NewMemory("/mem")
+	storagetest.TestFS(t, fsys, fsys.Root())
+}
+
+// TestS3 runs against a real S3 or MinIO bucket, e.g.
+//
+//	minio server /tmp/minio &
+//	WILE_TEST_S3_ENDPOINT=http://localhost:9000 WILE_TEST_S3_BUCKET=test \
+//	AWS_ACCESS_KEY_ID=minioadmin AWS_SECRET_ACCESS_KEY=minioadmin go test ./storage
+//
+// The gateway tests in the main package run the same checks against wile's own S3 gateway.
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("WILE_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("WILE_TEST_S3_ENDPOINT not set")
+	}
+	fsys := storage.NewS3(storage.S3Config{
+		Endpoint:    endpoint,
+		Region:      os.Getenv("AWS_REGION"),
+		Bucket:      os.Getenv("WILE_TEST_S3_BUCKET"),
+		Prefix:      fmt.Sprintf("wile-test-%d", time.Now().UnixNano()),
+		AccessKeyID: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:   os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	})
+	t.Cleanup(func() {
+		entries, _ := fsys.ReadDir(fsys.Root())
+		for _, entry := range entries {
+			fsys.RemoveAll(fsys.Root() + "/" + entry.Name())
+		}
+	})
+	storagetest.TestFS(t, fsys, fsys.Root())
+}
+
+func TestMux(t *testing.T) {
+	// The conformance suite below a memory mount, with the local disk as fallback
+	mem := storage.NewMemory("/mem")
+	mux := storage.NewMux(storage.Local{})
+	mux.Mount(mem.Root(), mem)
+	storagetest.TestFS(t, mux, mem.Root())
+	storagetest.TestFS(t, mux, t.TempDir())
+
+	// Copies and moves between mounts
+	local := t.TempDir()
+	w, _ := mux.Create(local + "/a.txt")
+	w.Write([]byte("hello"))
+	w.Close()
+	if err := storage.Copy(mux, local+"/a.txt", "/mem/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Move(mux, "/mem/a.txt", local+"/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := mem.Stat("/mem/a.txt"); err == nil {
+		t.Error("Moved file still in the memory mount")
+	}
+	if data, err := os.ReadFile(local + "/b.txt"); err != nil || string(data) != "hello" {
+		t.Errorf("Unexpected moved file: %q %v", data, err)
+	}
+	if _, ok := storage.LocalPath(mux, "/mem/x"); ok {
+		t.Error("Memory mount reported as local")
+	}
+	if p, ok := storage.LocalPath(mux, local+"/b.txt"); !ok || p != local+"/b.txt" {
+		t.Errorf("Expected local path for the fallback, got %q %v", p, ok)
+	}
+}
@@ -0,0 +1,179 @@
+// Package storagetest checks that a storage.FS behaves the way wile expects
+package storagetest
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"file-browser/storage"
+)
+
+func writeFile(t *testing.T, fsys storage.FS, name, content string) {
+	t.Helper()
+	w, err := fsys.Create(name)
+	if err != nil {
+		t.Fatalf("Create %s: %v", name, err)
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		t.Fatalf("Write %s: %v", name, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close %s: %v", name, err)
+	}
+}
+
+func readFile(t *testing.T, fsys storage.FS, name string) string {
+	t.Helper()
+	f, err := fsys.Open(name)
+	if err != nil {
+		t.Fatalf("Open %s: %v", name, err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatalf("Read %s: %v", name, err)
+	}
+	return string(data)
+}
+
+func names(t *testing.T, fsys storage.FS, dir string) string {
+	t.Helper()
+	entries, err := fsys.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir %s: %v", dir, err)
+	}
+	var list []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		list = append(list, name)
+	}
+	return strings.Join(list, ",")
+}
+
+// TestFS runs the conformance checks against an empty directory root in fsys
+func TestFS(t *testing.T, fsys storage.FS, root string) {
+	join := func(parts ...string) string {
+		return filepath.Join(append([]string{root}, parts...)...)
+	}
+
+	// Create and read back
+	if err := fsys.MkdirAll(join("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fsys, join("a", "b", "hello.txt"), "hello world")
+	writeFile(t, fsys, join("a", "top.txt"), "top")
+	if err := fsys.Mkdir(join("empty")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Mkdir(join("empty")); err == nil {
+		t.Error("Expected Mkdir of an existing directory to fail")
+	}
+
+	info, err := fsys.Stat(join("a", "b", "hello.txt"))
+	if err != nil || info.IsDir() || info.Size() != 11 || info.Name() != "hello.txt" {
+		t.Fatalf("Unexpected Stat result: %v %v", info, err)
+	}
+	if info, err := fsys.Stat(join("a", "b")); err != nil || !info.IsDir() {
+		t.Errorf("Expected a/b to be a directory: %v %v", info, err)
+	}
+	if _, err := fsys.Stat(join("missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist for a missing file, got %v", err)
+	}
+
+	if got := names(t, fsys, root); got != "a/,empty/" {
+		t.Errorf("Unexpected root listing: %s", got)
+	}
+	if got := names(t, fsys, join("a")); got != "b/,top.txt" {
+		t.Errorf("Unexpected listing of a: %s", got)
+	}
+	if got := names(t, fsys, join("empty")); got != "" {
+		t.Errorf("Expected empty directory, got %s", got)
+	}
+
+	// Seek + read, as used for range requests
+	f, err := fsys.Open(join("a", "b", "hello.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(6, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 3)
+	if _, err := io.ReadFull(f, buf); err != nil || string(buf) != "wor" {
+		t.Errorf("Expected wor after seeking, got %q %v", buf, err)
+	}
+	if size, err := f.Seek(0, io.SeekEnd); err != nil || size != 11 {
+		t.Errorf("Expected SeekEnd to return 11, got %d %v", size, err)
+	}
+	f.Close()
+
+	// Overwrite
+	writeFile(t, fsys, join("a", "top.txt"), "new")
+	if got := readFile(t, fsys, join("a", "top.txt")); got != "new" {
+		t.Errorf("Expected overwritten content, got %q", got)
+	}
+
+	// Walk
+	var walked []string
+	err = storage.Walk(fsys, join("a"), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(join("a"), p)
+		walked = append(walked, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil || strings.Join(walked, ",") != ".,b,b/hello.txt,top.txt" {
+		t.Errorf("Unexpected walk: %v %v", walked, err)
+	}
+
+	// Copy and rename
+	if err := storage.Copy(fsys, join("a"), join("copy")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fsys, join("copy", "b", "hello.txt")); got != "hello world" {
+		t.Errorf("Copied file has content %q", got)
+	}
+	if err := fsys.Rename(join("copy", "top.txt"), join("empty", "moved.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat(join("copy", "top.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Renamed file still exists: %v", err)
+	}
+	if err := fsys.Rename(join("copy"), join("renamed")); err != nil {
+		t.Fatal(err)
+	}
+	if got := names(t, fsys, root); got != "a/,empty/,renamed/" {
+		t.Errorf("Unexpected root listing after rename: %s", got)
+	}
+	if got := readFile(t, fsys, join("renamed", "b", "hello.txt")); got != "hello world" {
+		t.Errorf("Renamed directory lost content: %q", got)
+	}
+
+	// Remove only removes files and empty directories
+	if err := fsys.Remove(join("renamed")); err == nil {
+		t.Error("Expected Remove of a non-empty directory to fail")
+	}
+	if err := fsys.Remove(join("empty", "moved.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.Remove(join("empty")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.RemoveAll(join("renamed")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fsys.RemoveAll(join("not-there")); err != nil {
+		t.Errorf("Expected RemoveAll of a missing path to succeed, got %v", err)
+	}
+	if got := names(t, fsys, root); got != "a/" {
+		t.Errorf("Unexpected root listing after removals: %s", got)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"archive/zip"
+	"io"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+
+	"file-browser/scan"
+	"file-browser/storage"
+	"file-browser/storage/storagetest"
+)
+
+// The S3 backend against wile's own gateway, standing in for MinIO
+func TestS3StorageAgainstGateway(t *testing.T) {
+	setupSearchTree(t)
+	enableTestWriteMode(t)
+	client := setupS3Test(t, false)
+
+	fsys := storage.NewS3(storage.S3Config{
+		Endpoint:    client.server.URL,
+		Bucket:      "photos",
+		Prefix:      "suite",
+		AccessKeyID: client.key.AccessKeyID,
+		SecretKey:   client.key.SecretKey,
+	})
+	storagetest.TestFS(t, fsys, fsys.Root())
+}
+
+// useMemoryStorage serves an in-memory tree with the search test layout
+func useMemoryStorage(t *testing.T) *storage.Memory {
+	t.Helper()
+	fsys := storage.NewMemory("/mem")
+	files := map[string]string{
+		"notes.txt":        "hello",
+		"photos/beach.jpg": "0123456789",
+	}
+	for name, content := range files {
+		full := filepath.Join(fsys.Root(), name)
+		if err := fsys.MkdirAll(filepath.Dir(full)); err != nil {
+			t.Fatal(err)
+		}
+		w, _ := fsys.Create(full)
+		io.WriteString(w, content)
+		w.Close()
+	}
+
+	oldFS, oldRoot, oldWithSizes, oldTree := rootFS, rootPath, withSizes, sizeTreeRoot
+	t.Cleanup(func() {
+		rootFS, rootPath, withSizes, sizeTreeRoot = oldFS, oldRoot, oldWithSizes, oldTree
+	})
+	rootFS, rootPath = fsys, fsys.Root()
+
+	children, err := scan.ScanFSConcurrent(fsys, rootPath, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizeTreeRoot = &scan.FileData{ID: "root", Name: "mem", RootPath: rootPath, IsDir: true, Children: children, CachedSize: -1}
+	sizeTreeRoot.RebuildParentPointers(nil)
+	sizeTreeRoot.Size()
+	withSizes = true
+	return fsys
+}
+
+func TestHandlersOnMemoryStorage(t *testing.T) {
+	fsys := useMemoryStorage(t)
+	enableTestWriteMode(t)
+	app := fiber.New()
+	app.Get("/file", handleFileStream)
+	app.Get("/zip", handleZipDownload)
+	app.Post("/rename", handleRename)
+	app.Get("/manage", handleManage)
+
+	do := func(method, target, body string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	items := getDirectoryListing(primaryMount(), "", "name", "asc")
+	if len(items) != 2 || items[0].Path != "photos" || items[0].Size != 10 || items[1].Size != 5 {
+		t.Fatalf("Unexpected listing: %+v", items)
+	}
+
+	if status, body := do("GET", "/file?path=photos/beach.jpg", ""); status != 200 || body != "0123456789" {
+		t.Errorf("Expected file content, got %d %q", status, body)
+	}
+
+	if status, body := do("GET", "/manage?action=new_folder&dest=&name=docs", ""); status != 200 {
+		t.Fatalf("new_folder failed: %d %s", status, body)
+	}
+	if status, body := do("GET", "/manage?action=copy&srcs=notes.txt&dest=docs", ""); status != 200 || !strings.Contains(body, "ok") {
+		t.Fatalf("copy failed: %d %s", status, body)
+	}
+	if status, body := do("POST", "/rename", `{"path":"docs/notes.txt","newName":"copy.txt"}`); status != 200 {
+		t.Fatalf("rename failed: %d %s", status, body)
+	}
+	if _, err := fsys.Stat("/mem/docs/copy.txt"); err != nil {
+		t.Errorf("Renamed file missing from storage: %v", err)
+	}
+	if sizeTreeRoot.Size() != 20 {
+		t.Errorf("Expected size tree total 20 after the copy, got %d", sizeTreeRoot.Size())
+	}
+
+	status, body := do("GET", "/zip?path=docs", "")
+	zr, err := zip.NewReader(strings.NewReader(body), int64(len(body)))
+	if status != 200 || err != nil || len(zr.File) != 1 || zr.File[0].Name != "copy.txt" {
+		t.Fatalf("Unexpected zip: %d %v", status, err)
+	}
+
+	if status, body := do("GET", "/manage?action=delete&srcs=docs", ""); status != 200 || !strings.Contains(body, "ok") {
+		t.Fatalf("delete failed: %d %s", status, body)
+	}
+	if _, err := fsys.Stat("/mem/docs"); err == nil {
+		t.Error("Deleted folder still in storage")
+	}
+	if sizeTreeRoot.Size() != 15 {
+		t.Errorf("Expected size tree total 15 after the delete, got %d", sizeTreeRoot.Size())
+	}
+}
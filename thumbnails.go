@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	_ "image/gif"
+
+	"github.com/gofiber/fiber/v2"
+	_ "golang.org/x/image/bmp"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+	"golang.org/x/sync/singleflight"
+)
+
+// Thumbnail sizes (longest edge); requests are rounded up to one of these
+var thumbnailSizes = []int{128, 512, 2048}
+
+const (
+	defaultThumbnailSize = 128
+	maxThumbnailSource   = 256 << 20 // Bigger files aren't decoded
+	maxThumbnailPixels   = 100e6     // Nor images with more pixels
+	thumbnailQuality     = 82
+)
+
+// Types thumbnails are made of. SVGs scale by themselves and are sent as they are.
+var thumbnailTypes = map[string]bool{
+	"image/jpeg":    true,
+	"image/png":     true,
+	"image/gif":     true,
+	"image/webp":    true,
+	"image/bmp":     true,
+	"image/tiff":    true,
+	"image/svg+xml": true,
+}
+
+var (
+	thumbnailDir      string // --thumbnail-cache
+	thumbnailCacheMB  int64  // --thumbnail-cache-mb
+	thumbnailWorkers  int    // --thumbnail-workers
+	thumbnailSlots    chan struct{}
+	thumbnailFlight   singleflight.Group
+	thumbnailBytes    atomic.Int64 // Size of the cache
+	thumbnailEvicting atomic.Bool
+)
+
+var errImageTooLarge = errors.New("image too large for a thumbnail")
+
+// setupThumbnails creates the cache dir and counts what is in it already
+func setupThumbnails() error {
+	if err := os.MkdirAll(thumbnailDir, 0755); err != nil {
+		return err
+	}
+	thumbnailSlots = make(chan struct{}, max(thumbnailWorkers, 1))
+	var total int64
+	filepath.WalkDir(thumbnailDir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	thumbnailBytes.Store(total)
+	log.Printf("Thumbnail cache %s: %s of %d MB, %d workers", thumbnailDir, formatBytes(total), thumbnailCacheMB, cap(thumbnailSlots))
+	return nil
+}
+
+// canThumbnail reports whether there is a thumbnail for a file, by its name
+func canThumbnail(name string) bool {
+	return thumbnailTypes[mediaType(typeByExtension(name))]
+}
+
+// thumbnailURL is the URL of the thumbnail of an image of the listing
+func thumbnailURL(m *mount, relativePath string) string {
+	params := url.Values{"path": {relativePath}}
+	if m.Path != rootPath {
+		params.Set("root", m.Name)
+	}
+	return "/thumbnail?" + params.Encode()
+}
+
+// thumbnailSize rounds a requested size up to one of thumbnailSizes
+func thumbnailSize(requested int) int {
+	for _, size := range thumbnailSizes {
+		if requested <= size {
+			return size
+		}
+	}
+	return thumbnailSizes[len(thumbnailSizes)-1]
+}
+
+// thumbnailKey names the cached thumbnail of a file version at a size
+func thumbnailKey(fullPath string, info fs.FileInfo, size int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d\x00%d\x00%d", fullPath, size, info.ModTime().UnixNano(), info.Size())))
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedThumbnail finds a cached thumbnail (JPEG, or PNG for images with
+// transparency) and marks it used for eviction
+func cachedThumbnail(key string) (string, bool) {
+	for _, ext := range []string{".jpg", ".png"} {
+		path := filepath.Join(thumbnailDir, key[:2], key+ext)
+		if _, err := os.Stat(path); err == nil {
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			return path, true
+		}
+	}
+	return "", false
+}
+
+// thumbnail returns the cached thumbnail of a file, making it first if
+// needed. Requests for the same thumbnail wait for one generation, which
+// runs in one of --thumbnail-workers slots.
+func thumbnail(fullPath string, info fs.FileInfo, size int) (string, error) {
+	key := thumbnailKey(fullPath, info, size)
+	if path, ok := cachedThumbnail(key); ok {
+		return path, nil
+	}
+	path, err, _ := thumbnailFlight.Do(key, func() (any, error) {
+		if path, ok := cachedThumbnail(key); ok {
+			return path, nil
+		}
+		thumbnailSlots <- struct{}{}
+		defer func() { <-thumbnailSlots }()
+		return generateThumbnail(fullPath, info, size, key)
+	})
+	if err != nil {
+		return "", err
+	}
+	return path.(string), nil
+}
+
+// generateThumbnail decodes an image, scales it to fit size, turns it upright
+// by its EXIF orientation and stores it in the cache
+func generateThumbnail(fullPath string, info fs.FileInfo, size int, key string) (string, error) {
+	if info.Size() > maxThumbnailSource {
+		return "", errImageTooLarge
+	}
+	r, err := openStored(fullPath, info)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	// The header is kept while reading the dimensions (and holds the EXIF
+	// block of JPEGs), then the image is decoded from it and the rest of the
+	// stream, without the whole file in memory
+	var head bytes.Buffer
+	limited := io.LimitReader(r, maxThumbnailSource)
+	config, _, err := image.DecodeConfig(io.TeeReader(limited, &head))
+	if err != nil {
+		return "", err
+	}
+	if float64(config.Width)*float64(config.Height) > maxThumbnailPixels {
+		return "", errImageTooLarge
+	}
+	src, _, err := image.Decode(io.MultiReader(bytes.NewReader(head.Bytes()), limited))
+	if err != nil {
+		return "", err
+	}
+
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w > size || h > size { // Never scaled up
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Src, nil)
+	if x, err := readEXIF(head.Bytes()); err == nil {
+		dst = orient(dst, x.orientation())
+	}
+
+	ext := ".jpg"
+	if !dst.Opaque() {
+		ext = ".png"
+	}
+	dir := filepath.Join(thumbnailDir, key[:2])
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(dir, "tmp-*")
+	if err != nil {
+		return "", err
+	}
+	if ext == ".png" {
+		err = png.Encode(tmp, dst)
+	} else {
+		err = jpeg.Encode(tmp, dst, &jpeg.Options{Quality: thumbnailQuality})
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	path := filepath.Join(dir, key+ext)
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+
+	if stat, err := os.Stat(path); err == nil {
+		if thumbnailBytes.Add(stat.Size()) > thumbnailCacheMB<<20 && thumbnailEvicting.CompareAndSwap(false, true) {
+			go func() {
+				defer thumbnailEvicting.Store(false)
+				evictThumbnails()
+			}()
+		}
+	}
+	return path, nil
+}
+
+// orient turns an image upright by its EXIF orientation (2-8 mirror and/or rotate)
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // Mirrored
+				sx, sy = w-1-x, y
+			case 3: // Upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // Mirrored upside down
+				sx, sy = x, h-1-y
+			case 5: // Transposed
+				sx, sy = y, x
+			case 6: // Turned left, needs turning right
+				sx, sy = y, h-1-x
+			case 7: // Transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // Turned right, needs turning left
+				sx, sy = w-1-y, x
+			}
+			i, j := dst.PixOffset(x, y), src.PixOffset(sx, sy)
+			copy(dst.Pix[i:i+4], src.Pix[j:j+4])
+		}
+	}
+	return dst
+}
+
+// evictThumbnails removes the least recently used thumbnails until the cache
+// is at 90% of --thumbnail-cache-mb
+func evictThumbnails() {
+	total, removed := evictLeastRecentlyUsed(thumbnailDir, thumbnailCacheMB<<20*9/10)
+	thumbnailBytes.Store(total)
+	log.Printf("Thumbnail cache: removed %d least recently used, %s left", removed, formatBytes(total))
+}
+
+// evictLeastRecentlyUsed removes the files of a cache dir that were used
+// longest ago (by modification time, which hits refresh) until at most limit
+// bytes are left. Returns what is left and how many files were removed.
+func evictLeastRecentlyUsed(dir string, limit int64) (int64, int) {
+	type cached struct {
+		path string
+		size int64
+		used time.Time
+	}
+	var files []cached
+	var total int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			files = append(files, cached{path, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].used.Before(files[j].used) })
+
+	removed := 0
+	for _, f := range files {
+		if total <= limit {
+			break
+		}
+		// Half-written files of running generations stay
+		if strings.HasPrefix(filepath.Base(f.path), "tmp-") && time.Since(f.used) < time.Hour {
+			continue
+		}
+		if os.Remove(f.path) == nil {
+			total -= f.size
+			removed++
+		}
+	}
+	return total, removed
+}
+
+// handleThumbnail sends a scaled down image: size is the longest edge (128,
+// 512 or 2048, others are rounded up)
+func handleThumbnail(c *fiber.Ctx) error {
+	relativePath := c.Query("path")
+	if relativePath == "" {
+		return c.Status(400).SendString("Path parameter required")
+	}
+	fullPath, err := resolveRequestPath(c, relativePath)
+	if err != nil {
+		return c.Status(400).SendString(err.Error())
+	}
+	info, err := statPath(fullPath)
+	if err != nil {
+		return c.Status(404).SendString("Image not found")
+	}
+	if info.IsDir() {
+		return c.Status(400).SendString("Path is a directory, not a file")
+	}
+
+	contentType := contentTypeOf(fullPath, info)
+	if !thumbnailTypes[mediaType(contentType)] {
+		return c.Status(415).SendString("No thumbnails for " + mediaType(contentType))
+	}
+	if mediaType(contentType) == "image/svg+xml" {
+		setContentType(c, contentType)
+		return sendStoredFile(c, fullPath, info)
+	}
+
+	path, err := thumbnail(fullPath, info, thumbnailSize(c.QueryInt("size", defaultThumbnailSize)))
+	if errors.Is(err, errImageTooLarge) {
+		return c.Status(413).SendString(err.Error())
+	}
+	if err != nil {
+		log.Printf("Thumbnail of %s failed: %v", fullPath, err)
+		return c.Status(422).SendString("Cannot make a thumbnail: " + err.Error())
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return c.Status(500).SendString("Thumbnail was evicted, try again")
+	}
+
+	if strings.HasSuffix(path, ".png") {
+		setContentType(c, "image/png")
+	} else {
+		setContentType(c, "image/jpeg")
+	}
+	etag := `"` + strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) + `"`
+	return sendWithValidators(c, etag, stat.Size(), info.ModTime(), func() (io.ReadCloser, error) {
+		return os.Open(path)
+	})
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setupTestThumbnails uses a temp thumbnail cache
+func setupTestThumbnails(t *testing.T) {
+	t.Helper()
+	oldDir, oldMB, oldWorkers := thumbnailDir, thumbnailCacheMB, thumbnailWorkers
+	t.Cleanup(func() { thumbnailDir, thumbnailCacheMB, thumbnailWorkers = oldDir, oldMB, oldWorkers })
+	thumbnailDir, thumbnailCacheMB, thumbnailWorkers = t.TempDir(), 1024, 2
+	if err := setupThumbnails(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// withOrientation adds an EXIF block with an orientation to JPEG data
+func withOrientation(data []byte, orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1) // One entry
+	tiff = binary.BigEndian.AppendUint16(tiff, exifTagOrientation)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3) // SHORT
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0) // Padding, no next IFD
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+	return append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+}
+
+func TestThumbnails(t *testing.T) {
+	setupSearchTree(t)
+	setupTestThumbnails(t)
+
+	// 400x200, left half red: turned right by orientation 6 it is 100x200
+	// scaled to 128, with the red half on top
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 400; x++ {
+			c := color.RGBA{0, 0, 255, 255}
+			if x < 200 {
+				c = color.RGBA{255, 0, 0, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	jpeg.Encode(&buf, img, nil)
+	os.WriteFile(filepath.Join(rootPath, "photo.jpg"), withOrientation(buf.Bytes(), 6), 0644)
+	buf.Reset()
+	png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 50, 50))) // Transparent
+	os.WriteFile(filepath.Join(rootPath, "clear.png"), buf.Bytes(), 0644)
+
+	app := fiber.New()
+	app.Get("/thumbnail", handleThumbnail)
+	get := func(target, ifNoneMatch string) (int, string, string, []byte) {
+		t.Helper()
+		req := httptest.NewRequest("GET", target, nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("Content-Type"), resp.Header.Get("ETag"), data
+	}
+
+	status, contentType, etag, data := get("/thumbnail?path=photo.jpg&size=100", "")
+	if status != 200 || contentType != "image/jpeg" {
+		t.Fatalf("Expected a JPEG thumbnail, got %d %s %s", status, contentType, data)
+	}
+	thumb, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := thumb.Bounds(); b.Dx() != 64 || b.Dy() != 128 {
+		t.Errorf("Expected a 64x128 upright thumbnail, got %v", b)
+	}
+	if r, _, b, _ := thumb.At(32, 10).RGBA(); r < b {
+		t.Error("Expected the red half on top after turning")
+	}
+
+	if status, _, _, _ := get("/thumbnail?path=photo.jpg&size=100", etag); status != 304 {
+		t.Errorf("Expected the cached thumbnail to revalidate, got %d", status)
+	}
+	if _, _, otherETag, _ := get("/thumbnail?path=photo.jpg&size=2048", ""); otherETag == etag {
+		t.Error("Expected another size to be another thumbnail")
+	}
+
+	if status, contentType, _, _ := get("/thumbnail?path=clear.png", ""); status != 200 || contentType != "image/png" {
+		t.Errorf("Expected a PNG thumbnail for transparency, got %d %s", status, contentType)
+	}
+	if status, _, _, _ := get("/thumbnail?path=notes.txt", ""); status != 415 {
+		t.Errorf("Expected 415 for text, got %d", status)
+	}
+	if status, _, _, _ := get("/thumbnail?path=missing.jpg", ""); status != 404 {
+		t.Errorf("Expected 404 for a missing image, got %d", status)
+	}
+
+	var listed bool
+	for _, item := range getDirectoryListing(primaryMount(), "", "name", "asc") {
+		if item.Name == "photo.jpg" {
+			listed = item.Thumbnail == "/thumbnail?path=photo.jpg"
+		} else if item.Thumbnail != "" && item.Name != "clear.png" {
+			t.Errorf("Unexpected thumbnail for %s", item.Name)
+		}
+	}
+	if !listed {
+		t.Error("Expected the listing to have the thumbnail URL")
+	}
+
+	// Eviction drops the least recently used
+	thumbnailCacheMB = 0
+	evictThumbnails()
+	if thumbnailBytes.Load() != 0 {
+		t.Errorf("Expected an empty cache, %d bytes left", thumbnailBytes.Load())
+	}
+	if status, _, _, _ := get("/thumbnail?path=photo.jpg", ""); status != 200 {
+		t.Errorf("Expected the thumbnail to be made again, got %d", status)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 2x1: a red and a green pixel
+	src := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	src.Set(1, 0, color.RGBA{0, 255, 0, 255})
+	red := color.RGBA{255, 0, 0, 255}
+	tests := []struct {
+		orientation int
+		w, h        int
+		redAt       image.Point
+	}{
+		{1, 2, 1, image.Pt(0, 0)},
+		{2, 2, 1, image.Pt(1, 0)},
+		{3, 2, 1, image.Pt(1, 0)},
+		{4, 2, 1, image.Pt(0, 0)},
+		{5, 1, 2, image.Pt(0, 0)},
+		{6, 1, 2, image.Pt(0, 0)},
+		{7, 1, 2, image.Pt(0, 1)},
+		{8, 1, 2, image.Pt(0, 1)},
+	}
+	for _, tt := range tests {
+		dst := orient(src, tt.orientation)
+		if dst.Bounds().Dx() != tt.w || dst.Bounds().Dy() != tt.h || dst.RGBAAt(tt.redAt.X, tt.redAt.Y) != red {
+			t.Errorf("Orientation %d: got %v with red at %v", tt.orientation, dst.Bounds(), tt.redAt)
+		}
+	}
+}
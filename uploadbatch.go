@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// Most files one batch can announce
+const maxBatchFiles = 100000
+
+// uploadBatch groups the uploads of a folder drop. Every file carries the
+// batch ID in its tus metadata and is moved into place when it completes; the
+// size tree update and the modifications log entry happen once, when the
+// batch finishes: all files arrived, the client says it is done, or nothing
+// happened for --upload-expiry.
+type uploadBatch struct {
+	mu           sync.Mutex
+	id           string
+	mount        *mount
+	destPath     string // Existing folder the batch goes into
+	uploader     string
+	expected     int
+	done         int              // Files that arrived or failed
+	files        []string         // Stored files, relative to destPath
+	sizes        map[string]int64 // Their full paths and sizes, not in the size tree until the batch finishes
+	errors       []string
+	topLevel     map[string]bool // Names directly below destPath that were written
+	lastActivity time.Time
+	finished     bool
+}
+
+var (
+	uploadBatches   = make(map[string]*uploadBatch)
+	uploadBatchesMu sync.Mutex
+)
+
+// lookupBatch returns a running batch, nil if id is empty or unknown
+func lookupBatch(id string) *uploadBatch {
+	if id == "" {
+		return nil
+	}
+	uploadBatchesMu.Lock()
+	defer uploadBatchesMu.Unlock()
+	return uploadBatches[id]
+}
+
+func (b *uploadBatch) touch() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastActivity = time.Now()
+}
+
+// completed records a file of the batch that was stored at finalPath, or
+// failed with err. It returns false if the batch can't take it (no batch or
+// finished already), then the caller updates the size tree and logs it itself.
+func (b *uploadBatch) completed(finalPath string, err error) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	if b.finished {
+		b.mu.Unlock()
+		return false
+	}
+	rel, _ := filepath.Rel(b.destPath, finalPath)
+	rel = filepath.ToSlash(rel)
+	if err != nil {
+		b.errors = append(b.errors, fmt.Sprintf("%s: %v", rel, err))
+	} else {
+		b.files = append(b.files, rel)
+		b.topLevel[strings.SplitN(rel, "/", 2)[0]] = true
+		if info, err := rootFS.Stat(finalPath); err == nil {
+			b.sizes[finalPath] = info.Size()
+		}
+	}
+	b.done++
+	b.lastActivity = time.Now()
+	all := b.done >= b.expected
+	b.mu.Unlock()
+
+	if all {
+		b.finish()
+	}
+	return true
+}
+
+// failed records a file of the batch that was refused before it was stored
+func (b *uploadBatch) failed(name string, err error) {
+	if b == nil {
+		return
+	}
+	b.completed(filepath.Join(b.destPath, filepath.FromSlash(name)), err)
+}
+
+// finish adds what the batch wrote to the size tree and logs it. Only the
+// first call does anything.
+func (b *uploadBatch) finish() {
+	b.mu.Lock()
+	if b.finished {
+		b.mu.Unlock()
+		return
+	}
+	b.finished = true
+	b.mu.Unlock()
+
+	names := make([]string, 0, len(b.topLevel))
+	for name := range b.topLevel {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sizeTreeAdd(filepath.Join(b.destPath, name))
+	}
+
+	// Only now, so quotas always see the batch's files in one place or the other
+	uploadBatchesMu.Lock()
+	delete(uploadBatches, b.id)
+	uploadBatchesMu.Unlock()
+
+	dest, _ := b.mount.rel(b.destPath)
+	entry := newModificationLogEntry("upload", b.files, dest, b.errors)
+	entry.User = b.uploader
+	writeModificationLog(b.mount.LogFile, entry)
+	log.Printf("Upload batch %s finished: %d of %d files into %s, %d errors", b.id, len(b.files), b.expected, b.destPath, len(b.errors))
+}
+
+// batchBytes adds up what running batches stored in folder, which the size
+// tree doesn't have yet (upload quotas count it)
+func batchBytes(folder string) int64 {
+	uploadBatchesMu.Lock()
+	defer uploadBatchesMu.Unlock()
+	var total int64
+	for _, b := range uploadBatches {
+		b.mu.Lock()
+		for fullPath, size := range b.sizes {
+			if isWithin(fullPath, folder) {
+				total += size
+			}
+		}
+		b.mu.Unlock()
+	}
+	return total
+}
+
+// finishIdleBatches finishes batches nothing happened to for --upload-expiry
+func finishIdleBatches() {
+	if uploadExpiry <= 0 {
+		return
+	}
+	uploadBatchesMu.Lock()
+	var idle []*uploadBatch
+	for _, b := range uploadBatches {
+		b.mu.Lock()
+		if time.Since(b.lastActivity) > uploadExpiry {
+			idle = append(idle, b)
+		}
+		b.mu.Unlock()
+	}
+	uploadBatchesMu.Unlock()
+
+	for _, b := range idle {
+		log.Printf("Upload batch %s idle, finishing it", b.id)
+		b.finish()
+	}
+}
+
+// handleCreateUploadBatch starts a batch: {root, path, files} with path the
+// existing folder the files go into and files how many will be uploaded
+func handleCreateUploadBatch(c *fiber.Ctx) error {
+	var req struct {
+		Root  string `json:"root"`
+		Path  string `json:"path"`
+		Files int    `json:"files"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Request body must be JSON with root, path and files",
+		})
+	}
+	if req.Files < 1 || req.Files > maxBatchFiles {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  fmt.Sprintf("files must be between 1 and %d", maxBatchFiles),
+		})
+	}
+	m, err := mountByName(req.Root)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	if !m.WriteMode {
+		return c.Status(403).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Write mode is not enabled for this root",
+		})
+	}
+	destPath, err := m.resolve(req.Path)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  err.Error(),
+		})
+	}
+	if info, err := rootFS.Stat(destPath); err != nil || !info.IsDir() {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Destination folder does not exist",
+		})
+	}
+
+	b := &uploadBatch{
+		id:           uuid.New().String(),
+		mount:        m,
+		destPath:     destPath,
+		uploader:     c.IP(),
+		expected:     req.Files,
+		topLevel:     make(map[string]bool),
+		sizes:        make(map[string]int64),
+		lastActivity: time.Now(),
+	}
+	uploadBatchesMu.Lock()
+	uploadBatches[b.id] = b
+	uploadBatchesMu.Unlock()
+	log.Printf("Upload batch %s started: %d files into %s", b.id, b.expected, destPath)
+
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"batch":  fiber.Map{"id": b.id},
+	})
+}
+
+// handleFinishUploadBatch finishes a batch before all announced files arrived,
+// e.g. when some were cancelled or refused by the browser
+func handleFinishUploadBatch(c *fiber.Ctx) error {
+	b := lookupBatch(c.Params("id"))
+	if b == nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Upload batch not found or finished already",
+		})
+	}
+	fileOpsInProgress.Add(1)
+	defer fileOpsInProgress.Done()
+	b.finish()
+
+	return c.JSON(fiber.Map{
+		"status": "ok",
+		"files":  len(b.files),
+		"errors": b.errors,
+	})
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tus/tusd/pkg/handler"
+	bolt "go.etcd.io/bbolt"
+)
+
+// UploadPolicy limits what can be uploaded (--upload-policy). Everything is
+// optional; an empty policy allows any upload.
+type UploadPolicy struct {
+	MaxFileSize     int64         `json:"maxFileSize"`     // Bytes per file, sent to clients as tus Max-Size
+	Quotas          []UploadQuota `json:"quotas"`          // Needs sizes (--with-sizes, --sizes or --sizes-db)
+	AllowExtensions []string      `json:"allowExtensions"` // e.g. ".jpg"; if set, only these
+	DenyExtensions  []string      `json:"denyExtensions"`
+	AllowTypes      []string      `json:"allowTypes"` // MIME types, "image/*" for a whole family; if set, only these
+	DenyTypes       []string      `json:"denyTypes"`
+}
+
+// UploadQuota caps the total size of a folder, from the size tree. Uploads
+// anywhere below Path count. With User set it caps only what that uploader
+// stored there (files they uploaded that are still as they left them), which
+// needs --sizes-db to remember who uploaded what.
+type UploadQuota struct {
+	Root     string `json:"root"` // Named root, the primary root if empty
+	Path     string `json:"path"` // Folder relative to the root, "" for the whole root
+	User     string `json:"user"` // Uploader (client address), everyone if empty
+	MaxBytes int64  `json:"maxBytes"`
+}
+
+// uploadRecord is who stored a file through an upload, for per-user quotas.
+// Size and ModTime tell if the file changed since.
+type uploadRecord struct {
+	User    string `json:"user"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"`
+}
+
+var (
+	uploadPolicyFile string
+	uploadPolicy     UploadPolicy
+	uploadersBucket  = []byte("uploaders")
+)
+
+// loadUploadPolicy reads and validates the --upload-policy file
+func loadUploadPolicy(path string) (UploadPolicy, error) {
+	var policy UploadPolicy
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return policy, err
+	}
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return policy, fmt.Errorf("invalid upload policy %s: %w", path, err)
+	}
+	for i, ext := range policy.AllowExtensions {
+		policy.AllowExtensions[i] = normalizeExtension(ext)
+	}
+	for i, ext := range policy.DenyExtensions {
+		policy.DenyExtensions[i] = normalizeExtension(ext)
+	}
+	for _, quota := range policy.Quotas {
+		if quota.MaxBytes <= 0 {
+			return policy, fmt.Errorf("quota for %q needs maxBytes", quota.Path)
+		}
+		if _, err := mountByName(quota.Root); err != nil {
+			return policy, fmt.Errorf("quota for %q: %w", quota.Path, err)
+		}
+		if quota.User != "" && boltDB == nil {
+			return policy, fmt.Errorf("quota for %q of %s: per-user quotas need --sizes-db", quota.Path, quota.User)
+		}
+	}
+	if len(policy.Quotas) > 0 && !withSizes {
+		return policy, fmt.Errorf("upload quotas need --with-sizes, --sizes or --sizes-db")
+	}
+	return policy, nil
+}
+
+func normalizeExtension(ext string) string {
+	ext = strings.ToLower(strings.TrimSpace(ext))
+	if ext != "" && !strings.HasPrefix(ext, ".") {
+		ext = "." + ext
+	}
+	return ext
+}
+
+// matchesType reports whether contentType is one of types ("image/*" matches all images)
+func matchesType(contentType string, types []string) bool {
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if t == contentType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(contentType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkName checks a filename against the extension lists
+func (p *UploadPolicy) checkName(filename string) error {
+	lower := strings.ToLower(filename)
+	ext := filepath.Ext(lower)
+	for _, denied := range p.DenyExtensions {
+		// Suffix match so ".tar.gz" works too
+		if strings.HasSuffix(lower, denied) {
+			return fmt.Errorf("%s files are not allowed", denied)
+		}
+	}
+	if len(p.AllowExtensions) > 0 {
+		allowed := false
+		for _, ext := range p.AllowExtensions {
+			allowed = allowed || strings.HasSuffix(lower, ext)
+		}
+		if !allowed {
+			if ext == "" {
+				return fmt.Errorf("files without an extension are not allowed (allowed: %s)", strings.Join(p.AllowExtensions, ", "))
+			}
+			return fmt.Errorf("%s files are not allowed (allowed: %s)", ext, strings.Join(p.AllowExtensions, ", "))
+		}
+	}
+	return nil
+}
+
+// checkType checks a MIME type against the type lists; parameters like
+// "; charset=utf-8" are ignored
+func (p *UploadPolicy) checkType(contentType string) error {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(contentType)
+	}
+	if matchesType(mediaType, p.DenyTypes) {
+		return fmt.Errorf("files of type %s are not allowed", mediaType)
+	}
+	if len(p.AllowTypes) > 0 && !matchesType(mediaType, p.AllowTypes) {
+		return fmt.Errorf("files of type %s are not allowed (allowed: %s)", mediaType, strings.Join(p.AllowTypes, ", "))
+	}
+	return nil
+}
+
+// checkQuotas checks that size more bytes fit into every quota that covers
+// finalPath for uploader. Folder sizes come from the size tree and the
+// running folder uploads, per-user ones from the upload records, so uploads
+// that are still running don't count until they complete.
+func (p *UploadPolicy) checkQuotas(m *mount, finalPath, uploader string, size int64) error {
+	for _, quota := range p.Quotas {
+		qm, _ := mountByName(quota.Root)
+		if qm.Name != m.Name || (quota.User != "" && quota.User != uploader) {
+			continue
+		}
+		folder, err := qm.resolve(quota.Path)
+		if err != nil || !isWithin(finalPath, folder) {
+			continue
+		}
+		var used int64
+		if quota.User != "" {
+			used = uploadedBy(folder, quota.User)
+		} else {
+			// Files of folder uploads that are still running aren't in the
+			// size tree yet
+			used, _ = treeSize(folder)
+			pending := batchBytes(folder)
+			if used < 0 && pending == 0 {
+				continue // Folder does not exist yet
+			}
+			used = max(used, 0) + pending
+		}
+		if used+size > quota.MaxBytes {
+			owner := ""
+			if quota.User != "" {
+				owner = " of " + quota.User
+			}
+			return fmt.Errorf("quota%s exceeded for /%s: %s used of %s, upload is %s",
+				owner, cleanRelativePath(quota.Path), formatBytes(used), formatBytes(quota.MaxBytes), formatBytes(size))
+		}
+	}
+	return nil
+}
+
+// recordUpload remembers that uploader stored the file at fullPath, for
+// per-user quotas. Needs --sizes-db; without it nothing is kept.
+func recordUpload(fullPath, uploader string) {
+	if boltDB == nil {
+		return
+	}
+	info, err := rootFS.Stat(fullPath)
+	if err != nil {
+		return
+	}
+	data, _ := json.Marshal(uploadRecord{
+		User:    uploader,
+		Size:    info.Size(),
+		ModTime: info.ModTime().UnixNano(),
+	})
+	err = boltDB.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(uploadersBucket)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(fullPath), data)
+	})
+	if err != nil {
+		log.Printf("Failed to record the uploader of %s: %v", fullPath, err)
+	}
+}
+
+// uploadedBy adds up the files below folder that uploader stored and nobody
+// changed since. Records of files that were deleted, moved or overwritten
+// are dropped on the way.
+func uploadedBy(folder, uploader string) int64 {
+	if boltDB == nil {
+		return 0
+	}
+	prefix := folder
+	if !strings.HasSuffix(prefix, string(filepath.Separator)) {
+		prefix += string(filepath.Separator)
+	}
+	var total int64
+	var stale [][]byte
+	boltDB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(uploadersBucket)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			var record uploadRecord
+			if json.Unmarshal(v, &record) != nil {
+				continue
+			}
+			info, err := rootFS.Stat(string(k))
+			if err != nil || info.Size() != record.Size || info.ModTime().UnixNano() != record.ModTime {
+				stale = append(stale, append([]byte(nil), k...))
+				continue
+			}
+			if record.User == uploader {
+				total += record.Size
+			}
+		}
+		return nil
+	})
+	if len(stale) > 0 {
+		boltDB.Update(func(tx *bolt.Tx) error {
+			if bucket := tx.Bucket(uploadersBucket); bucket != nil {
+				for _, k := range stale {
+					bucket.Delete(k)
+				}
+			}
+			return nil
+		})
+	}
+	return total
+}
+
+// checkCreate applies the policy to a new upload, from what its metadata
+// tells: name, declared type and size (unless the length is deferred)
+func (p *UploadPolicy) checkCreate(m *mount, finalPath string, info handler.FileInfo, uploader string) error {
+	if err := p.checkName(filepath.Base(finalPath)); err != nil {
+		return err
+	}
+	if contentType := typeByExtension(finalPath); contentType != "" {
+		if err := p.checkType(contentType); err != nil {
+			return err
+		}
+	}
+	// The browser's guess of the type (tus clients send filetype, Uppy also
+	// type); the content is checked again at the end
+	for _, key := range []string{"filetype", "type"} {
+		if declared := info.MetaData[key]; declared != "" {
+			if err := p.checkType(declared); err != nil {
+				return err
+			}
+		}
+	}
+	if !info.SizeIsDeferred {
+		return p.checkQuotas(m, finalPath, uploader, info.Size)
+	}
+	return nil
+}
+
+// checkComplete applies the policy to the uploaded data at tempFile: the
+// type of its name, the sniffed content type and the final size. Content the
+// sniffer doesn't recognize (application/octet-stream) goes by the name only.
+func (p *UploadPolicy) checkComplete(m *mount, finalPath, tempFile, uploader string) error {
+	if len(p.AllowTypes) > 0 || len(p.DenyTypes) > 0 {
+		byName := typeByExtension(finalPath)
+		if byName != "" {
+			if err := p.checkType(byName); err != nil {
+				return err
+			}
+		}
+		sniffed, err := sniffContentType(tempFile)
+		if err != nil {
+			return err
+		}
+		if byName == "" || mediaType(sniffed) != "application/octet-stream" {
+			if err := p.checkType(sniffed); err != nil {
+				return err
+			}
+		}
+	}
+	if len(p.Quotas) > 0 {
+		info, err := os.Stat(tempFile)
+		if err != nil {
+			return err
+		}
+		return p.checkQuotas(m, finalPath, uploader, info.Size())
+	}
+	return nil
+}
+
+// sniffContentType detects the type of a local file from its first bytes.
+// http.DetectContentType doesn't know executables, those are added here.
+func sniffContentType(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, _ := f.Read(head)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, []byte("MZ")):
+		return "application/x-msdownload", nil
+	case bytes.HasPrefix(head, []byte("\x7fELF")):
+		return "application/x-executable", nil
+	}
+	return http.DetectContentType(head), nil
+}
+
+// formatBytes formats a size for messages, e.g. "1.5 GB"
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/tus/tusd/pkg/handler"
+
+	"file-browser/storage"
+)
+
+// How often unfinished uploads are looked at for expiry
+const uploadSweepInterval = 10 * time.Minute
+
+var (
+	uploadsDir   string        // Unfinished tus uploads and S3 multipart parts (--uploads-dir)
+	uploadExpiry time.Duration // Unfinished uploads without any data for this long are removed
+)
+
+// uploadTarget resolves where an upload goes from its tus metadata: root,
+// relativePath (the folder) and filename. Files of a folder upload have batch
+// instead of root and relativePath, and may have subfolder, the folder inside
+// the upload (e.g. "album/2024"), which is created as needed.
+func uploadTarget(meta handler.MetaData) (*mount, string, error) {
+	var m *mount
+	var dir string
+	if id := meta["batch"]; id != "" {
+		b := lookupBatch(id)
+		if b == nil {
+			return nil, "", fmt.Errorf("upload batch not found or finished already")
+		}
+		m, dir = b.mount, b.destPath
+	} else {
+		var err error
+		if m, err = mountByName(meta["root"]); err != nil {
+			return nil, "", err
+		}
+		if dir, err = m.resolve(meta["relativePath"]); err != nil {
+			return nil, "", err
+		}
+	}
+	if !m.WriteMode {
+		return nil, "", fmt.Errorf("root %s is read-only", m.Name)
+	}
+
+	filename := meta["filename"]
+	if filename == "" || filename != filepath.Base(filename) || filename == ".." {
+		return nil, "", fmt.Errorf("invalid filename: %q", filename)
+	}
+	if subfolder := meta["subfolder"]; subfolder != "" {
+		clean, ok := cleanMemberName(subfolder)
+		if !ok {
+			return nil, "", fmt.Errorf("invalid subfolder: %q", subfolder)
+		}
+		dir = filepath.Join(dir, filepath.FromSlash(clean))
+	}
+	finalPath := filepath.Join(dir, filename)
+	if !isWithin(finalPath, m.Path) {
+		return nil, "", fmt.Errorf("path is outside of the served root: %s", filename)
+	}
+	// Folders created on the way must not end up somewhere else
+	if linked(m.Path, finalPath) {
+		return nil, "", fmt.Errorf("path goes through a symlink")
+	}
+	if info, err := rootFS.Stat(finalPath); err == nil && info.IsDir() {
+		return nil, "", fmt.Errorf("a folder named %s exists", filename)
+	}
+	return m, finalPath, nil
+}
+
+// uploadName is the name of an upload in messages: the file's path inside a
+// folder upload, or its filename
+func uploadName(meta handler.MetaData) string {
+	return path.Join(meta["subfolder"], meta["filename"])
+}
+
+// uploaderOf identifies who sent an upload for the modifications log. The web
+// UI has no logins, so this is the client address.
+func uploaderOf(r handler.HTTPRequest) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// checkUploadCreate rejects an upload before any data is sent if it could not
+// be stored (PreUploadCreateCallback)
+func checkUploadCreate(hook handler.HookEvent) error {
+	batch := lookupBatch(hook.Upload.MetaData["batch"])
+	batch.touch()
+	m, finalPath, err := uploadTarget(hook.Upload.MetaData)
+	if err != nil {
+		batch.failed(uploadName(hook.Upload.MetaData), err)
+		return handler.NewHTTPError(err, http.StatusBadRequest)
+	}
+	if err := uploadPolicy.checkCreate(m, finalPath, hook.Upload, uploaderOf(hook.HTTPRequest)); err != nil {
+		log.Printf("Upload of %s refused: %v", finalPath, err)
+		batch.failed(uploadName(hook.Upload.MetaData), err)
+		return handler.NewHTTPError(err, http.StatusForbidden)
+	}
+	if checksum := hook.Upload.MetaData["checksum"]; checksum != "" {
+		if _, _, err := parseChecksum(checksum); err != nil {
+			batch.failed(uploadName(hook.Upload.MetaData), err)
+			return handler.NewHTTPError(err, http.StatusBadRequest)
+		}
+	}
+	return nil
+}
+
+// discardUpload removes an upload's data and tus info file
+func discardUpload(id string) {
+	tempFile := filepath.Join(uploadsDir, id)
+	os.Remove(tempFile)
+	os.Remove(tempFile + ".info")
+}
+
+// finishUpload moves a complete upload into place, updates the size tree and
+// logs it. It runs before the response to the last PATCH
+// (PreFinishResponseCallback), so failures reach the client.
+func finishUpload(hook handler.HookEvent) error {
+	fileOpsInProgress.Add(1)
+	defer fileOpsInProgress.Done()
+
+	info := hook.Upload
+	uploader := uploaderOf(hook.HTTPRequest)
+	log.Printf("Upload completed - ID: %s, Filename: %s, TargetPath: %s, From: %s", info.ID, info.MetaData["filename"], info.MetaData["relativePath"], uploader)
+
+	// Checked at creation already, but the root may have changed since
+	batch := lookupBatch(info.MetaData["batch"])
+	m, finalPath, err := uploadTarget(info.MetaData)
+	if err != nil {
+		log.Printf("Discarding upload %s: %v", info.ID, err)
+		discardUpload(info.ID)
+		batch.failed(uploadName(info.MetaData), err)
+		return handler.NewHTTPError(err, http.StatusBadRequest)
+	}
+
+	tempFile := filepath.Join(uploadsDir, info.ID)
+	if err := uploadPolicy.checkComplete(m, finalPath, tempFile, uploader); err != nil {
+		log.Printf("Discarding upload %s: %v", info.ID, err)
+		discardUpload(info.ID)
+		batch.completed(finalPath, err)
+		return handler.NewHTTPError(err, http.StatusForbidden)
+	}
+
+	// A whole-file checksum from the client is verified before anything is
+	// moved; data that doesn't match is kept aside for an admin to look at
+	var algorithm string
+	var sum []byte
+	if checksum := info.MetaData["checksum"]; checksum != "" {
+		algorithm, sum, err = verifyUpload(tempFile, checksum)
+		if err != nil && !errors.Is(err, errChecksumMismatch) {
+			log.Printf("Failed to verify upload %s: %v", info.ID, err)
+			discardUpload(info.ID)
+			batch.completed(finalPath, err)
+			return handler.NewHTTPError(fmt.Errorf("failed to verify upload: %w", err), http.StatusInternalServerError)
+		}
+		if err != nil {
+			quarantineUpload(info, m, finalPath, uploader, err)
+			batch.completed(finalPath, err)
+			return handler.NewHTTPError(fmt.Errorf("upload quarantined: %w", err), statusChecksumMismatch)
+		}
+	}
+
+	createdTop, err := createParentDirs(filepath.Dir(finalPath))
+	if err == nil {
+		err = storage.Import(rootFS, tempFile, finalPath)
+	}
+
+	// Folder uploads update the size tree and log once, for the whole batch
+	if !batch.completed(finalPath, err) {
+		// Same as copies: a new parent folder goes into the size tree as a whole
+		if createdTop != "" {
+			sizeTreeAdd(createdTop)
+		} else if err == nil {
+			sizeTreeAdd(finalPath)
+		}
+
+		rel, _ := m.rel(finalPath)
+		entry := newModificationLogEntry("upload", nil, rel, nil)
+		entry.User = uploader
+		if err != nil {
+			entry.Errors = []string{err.Error()}
+		}
+		writeModificationLog(m.LogFile, entry)
+	}
+
+	if err != nil {
+		log.Printf("Failed to store upload %s at %s: %v", info.ID, finalPath, err)
+		discardUpload(info.ID)
+		return handler.NewHTTPError(fmt.Errorf("failed to store upload: %w", err), http.StatusInternalServerError)
+	}
+	os.Remove(tempFile + ".info")
+	if sum != nil {
+		saveDigest(finalPath, algorithm, sum)
+	}
+	recordUpload(finalPath, uploader)
+	log.Printf("Successfully moved uploaded file to %s", finalPath)
+	return nil
+}
+
+// uploadExpires is when an unfinished upload expires: uploadExpiry after data
+// last arrived (or after it was created). --upload-expiry 0 keeps them forever.
+func uploadExpires(id string) (time.Time, bool) {
+	if uploadExpiry <= 0 {
+		return time.Time{}, false // Never
+	}
+	tempFile := filepath.Join(uploadsDir, id)
+	info, err := os.Stat(tempFile)
+	if err != nil {
+		if info, err = os.Stat(tempFile + ".info"); err != nil {
+			return time.Time{}, false
+		}
+	}
+	return info.ModTime().Add(uploadExpiry), true
+}
+
+// tusExpiration adds the tus expiration extension, which tusd v1 doesn't
+// have: Upload-Expires on responses for unfinished uploads, and 410 Gone for
+// expired ones (the sweeper removes them later)
+func tusExpiration(c *fiber.Ctx) error {
+	id := path.Base(c.Path())
+	if c.Method() == "HEAD" || c.Method() == "PATCH" {
+		if expires, ok := uploadExpires(id); ok && time.Now().After(expires) {
+			log.Printf("Upload %s expired", id)
+			discardUpload(id)
+			c.Set("Tus-Resumable", "1.0.0")
+			return c.Status(http.StatusGone).SendString("upload expired")
+		}
+	}
+
+	if err := c.Next(); err != nil {
+		return err
+	}
+
+	if extensions := c.GetRespHeader("Tus-Extension"); extensions != "" {
+		c.Set("Tus-Extension", extensions+",expiration")
+	}
+	if c.Method() == "POST" {
+		id = path.Base(c.GetRespHeader("Location"))
+	}
+	status := c.Response().StatusCode()
+	if c.Method() != "DELETE" && status >= 200 && status < 300 && id != "" {
+		// Gone once complete (the info file is removed when it is moved into place)
+		if _, err := os.Stat(filepath.Join(uploadsDir, id+".info")); err == nil {
+			if expires, ok := uploadExpires(id); ok {
+				c.Set("Upload-Expires", expires.UTC().Format(http.TimeFormat))
+			}
+		}
+	}
+	return nil
+}
+
+// UploadInfo describes an unfinished tus upload to admins
+type UploadInfo struct {
+	ID           string `json:"id"`
+	Root         string `json:"root"`
+	Path         string `json:"path"` // Destination relative to the root
+	Size         int64  `json:"size"` // -1 if the length is deferred
+	Offset       int64  `json:"offset"`
+	Created      int64  `json:"created"`
+	LastActivity int64  `json:"lastActivity"`
+	Expires      int64  `json:"expires"`
+}
+
+// listUploads reads the unfinished uploads from uploadsDir, oldest first
+func listUploads() ([]UploadInfo, error) {
+	entries, err := os.ReadDir(uploadsDir)
+	if err != nil {
+		return nil, err
+	}
+	uploads := []UploadInfo{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".info")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(uploadsDir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		var info handler.FileInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			continue
+		}
+		upload := UploadInfo{
+			ID:   id,
+			Root: info.MetaData["root"],
+			Path: cleanRelativePath(filepath.Join(info.MetaData["relativePath"], uploadName(info.MetaData))),
+			Size: info.Size,
+		}
+		if info.SizeIsDeferred {
+			upload.Size = -1
+		}
+		if stat, err := entry.Info(); err == nil {
+			upload.Created = stat.ModTime().Unix()
+			upload.LastActivity = upload.Created
+		}
+		if stat, err := os.Stat(filepath.Join(uploadsDir, id)); err == nil {
+			upload.Offset = stat.Size()
+			upload.LastActivity = stat.ModTime().Unix()
+		}
+		if expires, ok := uploadExpires(id); ok {
+			upload.Expires = expires.Unix()
+		}
+		uploads = append(uploads, upload)
+	}
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].Created < uploads[j].Created })
+	return uploads, nil
+}
+
+// sweepUploads removes expired unfinished uploads, and data files whose info
+// file is gone, and finishes idle folder uploads. S3 multipart uploads (the
+// s3-multipart folder) expire the same way.
+func sweepUploads() {
+	finishIdleBatches()
+	if uploadExpiry > 0 {
+		cleanupS3Multipart(uploadExpiry)
+	}
+	entries, err := os.ReadDir(uploadsDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		id := strings.TrimSuffix(entry.Name(), ".info")
+		if expires, ok := uploadExpires(id); ok && time.Now().After(expires) {
+			log.Printf("Removing expired upload %s", id)
+			discardUpload(id)
+		}
+	}
+}
+
+// handleListUploads lists the unfinished uploads with their progress
+func handleListUploads(c *fiber.Ctx) error {
+	uploads, err := listUploads()
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{
+			"status": "error",
+			"error":  fmt.Sprintf("Failed to read uploads: %v", err),
+		})
+	}
+	return c.JSON(fiber.Map{
+		"status":      "ok",
+		"uploads":     uploads,
+		"quarantined": listQuarantine(),
+	})
+}
+
+// handleAbortUpload removes an unfinished upload; the client gets 404 on its
+// next request. Quarantined uploads are removed the same way.
+func handleAbortUpload(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if strings.ContainsAny(id, "/\\") || strings.HasPrefix(id, ".") {
+		return c.Status(400).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Invalid upload ID",
+		})
+	}
+	if removeQuarantined(id) {
+		log.Printf("Quarantined upload %s removed by admin", id)
+		return c.JSON(fiber.Map{
+			"status": "ok",
+		})
+	}
+	if _, err := os.Stat(filepath.Join(uploadsDir, id+".info")); err != nil {
+		return c.Status(404).JSON(fiber.Map{
+			"status": "error",
+			"error":  "Upload not found",
+		})
+	}
+	discardUpload(id)
+	log.Printf("Upload %s aborted by admin", id)
+	return c.JSON(fiber.Map{
+		"status": "ok",
+	})
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// setupTestUploads serves tus uploads into the primary root with a temp uploads dir
+func setupTestUploads(t *testing.T) *fiber.App {
+	t.Helper()
+	oldDir, oldExpiry := uploadsDir, uploadExpiry
+	t.Cleanup(func() { uploadsDir, uploadExpiry = oldDir, oldExpiry })
+	uploadsDir, uploadExpiry = t.TempDir(), time.Hour
+
+	app := fiber.New()
+	setupTusUpload(app)
+	return app
+}
+
+// tusCreate starts an upload; returns the status and the upload's URL
+func tusCreate(t *testing.T, app *fiber.App, meta map[string]string, size int) (int, string, string) {
+	t.Helper()
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, key := range keys {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(meta[key])))
+	}
+
+	req := httptest.NewRequest("POST", "/upload/tus/", nil)
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Length", strconv.Itoa(size))
+	req.Header.Set("Upload-Metadata", strings.Join(pairs, ","))
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, resp.Header.Get("Location"), string(body)
+}
+
+// tusUpload sends data in one PATCH; returns the status and error message of
+// the last response
+func tusUpload(t *testing.T, app *fiber.App, meta map[string]string, data string) (int, string) {
+	t.Helper()
+	status, location, body := tusCreate(t, app, meta, len(data))
+	if status != 201 {
+		return status, body
+	}
+	req := httptest.NewRequest("PATCH", location[strings.Index(location, "/upload/tus/"):], strings.NewReader(data))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Offset", "0")
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	respBody, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(respBody)
+}
+
+func TestUploadCompletion(t *testing.T) {
+	setupSearchTree(t)
+	enableTestWriteMode(t)
+	loadTestSizeTree(t)
+	app := setupTestUploads(t)
+
+	// Into a new folder: the folder goes into the size tree with the file
+	status, body := tusUpload(t, app, map[string]string{"relativePath": "new/dir", "filename": "a.txt"}, "hello upload")
+	if status != 204 {
+		t.Fatalf("Expected the upload to succeed, got %d %s", status, body)
+	}
+	if data, _ := os.ReadFile(filepath.Join(rootPath, "new", "dir", "a.txt")); string(data) != "hello upload" {
+		t.Errorf("Unexpected uploaded content %q", data)
+	}
+	if node := sizeTreeRoot.FindByPath(filepath.Join(rootPath, "new")); node == nil || node.Size() != 12 {
+		t.Errorf("Uploaded folder missing from the size tree: %+v", node)
+	}
+	if entries, _ := os.ReadDir(uploadsDir); len(entries) != 0 {
+		t.Errorf("Upload left files behind: %v", entries)
+	}
+
+	// Into an existing folder
+	if status, body := tusUpload(t, app, map[string]string{"relativePath": "photos", "filename": "b.txt"}, "b"); status != 204 {
+		t.Fatalf("Expected the upload to succeed, got %d %s", status, body)
+	}
+	if node := sizeTreeRoot.FindByPath(filepath.Join(rootPath, "photos", "b.txt")); node == nil {
+		t.Error("Uploaded file missing from the size tree")
+	}
+
+	// Bad destinations are refused before any data is sent
+	for _, meta := range []map[string]string{
+		{"relativePath": "../..", "filename": "x.txt"},
+		{"relativePath": "", "filename": "../x.txt"},
+		{"relativePath": "", "filename": "photos"},
+		{"root": "nope", "filename": "x.txt"},
+	} {
+		if status, _, body := tusCreate(t, app, meta, 1); status != 400 {
+			t.Errorf("Expected 400 for %v, got %d %s", meta, status, body)
+		}
+	}
+
+	// Failures when moving into place reach the client: a folder appeared in the meantime
+	status, location, _ := tusCreate(t, app, map[string]string{"relativePath": "", "filename": "late"}, 1)
+	if status != 201 {
+		t.Fatalf("Expected the upload to be created, got %d", status)
+	}
+	os.Mkdir(filepath.Join(rootPath, "late"), 0755)
+	req := httptest.NewRequest("PATCH", location[strings.Index(location, "/upload/tus/"):], strings.NewReader("x"))
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	req.Header.Set("Upload-Offset", "0")
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if respBody, _ := io.ReadAll(resp.Body); resp.StatusCode != 400 || !strings.Contains(string(respBody), "late") {
+		t.Errorf("Expected the failed upload to be reported, got %d %s", resp.StatusCode, respBody)
+	}
+
+	entries := readLog(t, modificationsLogFile)
+	if len(entries) != 2 || entries[0].Action != "upload" || entries[0].Dest != "new/dir/a.txt" || entries[0].User == "" || entries[1].Dest != "photos/b.txt" {
+		t.Errorf("Unexpected log: %+v", entries)
+	}
+}
+
+func TestUploadPolicy(t *testing.T) {
+	setupSearchTree(t)
+	enableTestWriteMode(t)
+	loadTestSizeTree(t)
+	db, err := openBoltDB(filepath.Join(t.TempDir(), "sizes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDB := boltDB
+	boltDB = db
+	t.Cleanup(func() { boltDB = oldDB; db.Close() })
+
+	policyFile := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(policyFile, []byte(`{
+		"maxFileSize": 100,
+		"denyExtensions": ["EXE"],
+		"allowTypes": ["image/*", "text/*"],
+		"denyTypes": ["text/html", "application/x-msdownload"],
+		"quotas": [
+			{"path": "photos", "maxBytes": 30},
+			{"path": "", "user": "10.0.0.1", "maxBytes": 1},
+			{"path": "", "user": "0.0.0.0", "maxBytes": 20}
+		]
+	}`), 0644)
+	policy, err := loadUploadPolicy(policyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.DenyExtensions[0] != ".exe" {
+		t.Errorf("Expected extensions to be normalized, got %v", policy.DenyExtensions)
+	}
+	oldPolicy := uploadPolicy
+	t.Cleanup(func() { uploadPolicy = oldPolicy })
+	uploadPolicy = policy
+	app := setupTestUploads(t)
+
+	// Refused at creation: size, extension, declared type
+	for _, c := range []struct {
+		meta   map[string]string
+		size   int
+		status int
+	}{
+		{map[string]string{"filename": "big.txt"}, 101, 413},
+		{map[string]string{"filename": "setup.exe"}, 1, 403},
+		{map[string]string{"filename": "a.bin", "filetype": "application/zip"}, 1, 403},
+	} {
+		if status, _, body := tusCreate(t, app, c.meta, c.size); status != c.status {
+			t.Errorf("Expected %d for %v, got %d %s", c.status, c.meta, status, body)
+		}
+	}
+
+	// Refused after sniffing the content
+	status, body := tusUpload(t, app, map[string]string{"filename": "fake.jpg"}, "PK\x03\x04 not an image")
+	if status != 403 || !strings.Contains(body, "application/zip") {
+		t.Errorf("Expected the zip content to be refused, got %d %s", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(rootPath, "fake.jpg")); err == nil {
+		t.Error("Refused upload was stored")
+	}
+	// A Windows program under a harmless name, and a denied type by name
+	// with content that sniffs as plain text
+	status, body = tusUpload(t, app, map[string]string{"filename": "tool.txt"}, "MZ\x90\x00\x03 program")
+	if status != 403 || !strings.Contains(body, "application/x-msdownload") {
+		t.Errorf("Expected the executable to be refused, got %d %s", status, body)
+	}
+	status, _, body = tusCreate(t, app, map[string]string{"filename": "page.htm"}, 5)
+	if status != 403 || !strings.Contains(body, "text/html") {
+		t.Errorf("Expected the HTML file to be refused by its name, got %d %s", status, body)
+	}
+
+	// photos holds 23 bytes (hidden files count too) of 30
+	if status, body := tusUpload(t, app, map[string]string{"relativePath": "photos", "filename": "a.txt"}, "12345"); status != 204 {
+		t.Fatalf("Expected the upload within the quota to succeed, got %d %s", status, body)
+	}
+	status, _, body = tusCreate(t, app, map[string]string{"relativePath": "photos/2024", "filename": "b.txt"}, 5)
+	if status != 403 || !strings.Contains(body, "quota exceeded for /photos") {
+		t.Errorf("Expected the quota to be exceeded, got %d %s", status, body)
+	}
+	// Outside photos the per-user quotas apply: the 10.0.0.1 one is for
+	// someone else, and of ours only our own uploads count, not the files
+	// that were already there
+	if status, body := tusUpload(t, app, map[string]string{"filename": "c.txt"}, "12345"); status != 204 {
+		t.Errorf("Expected the upload within the user quota to succeed, got %d %s", status, body)
+	}
+	status, _, body = tusCreate(t, app, map[string]string{"filename": "d.txt"}, 11)
+	if status != 403 || !strings.Contains(body, "quota of 0.0.0.0 exceeded") {
+		t.Errorf("Expected the user quota to be exceeded, got %d %s", status, body)
+	}
+	// Files that changed since don't count any more
+	os.WriteFile(filepath.Join(rootPath, "c.txt"), []byte("replaced by someone else"), 0644)
+	if status, body := tusUpload(t, app, map[string]string{"filename": "d.txt"}, "12345678901"); status != 204 {
+		t.Errorf("Expected the upload to fit after the change, got %d %s", status, body)
+	}
+
+	boltDB = nil
+	if _, err := loadUploadPolicy(policyFile); err == nil || !strings.Contains(err.Error(), "--sizes-db") {
+		t.Errorf("Expected per-user quotas without --sizes-db to be refused, got %v", err)
+	}
+	boltDB = db
+	withSizes = false
+	if _, err := loadUploadPolicy(policyFile); err == nil {
+		t.Error("Expected quotas without sizes to be refused")
+	}
+}
+
+func TestUploadExpiry(t *testing.T) {
+	setupSearchTree(t)
+	enableTestWriteMode(t)
+	app := setupTestUploads(t)
+	// Without requireLocalAdmin, test requests don't come from localhost
+	admin := fiber.New()
+	admin.Get("/admin/uploads", handleListUploads)
+	admin.Delete("/admin/uploads/:id", handleAbortUpload)
+
+	tusRequest := func(method, location, body string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(method, location[strings.Index(location, "/upload/tus/"):], strings.NewReader(body))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		if method == "PATCH" {
+			req.Header.Set("Upload-Offset", "0")
+			req.Header.Set("Content-Type", "application/offset+octet-stream")
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	listUploads := func() []UploadInfo {
+		t.Helper()
+		resp, _ := admin.Test(httptest.NewRequest("GET", "/admin/uploads", nil))
+		var body struct {
+			Uploads []UploadInfo `json:"uploads"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		return body.Uploads
+	}
+
+	if resp := tusRequest("OPTIONS", "/upload/tus/", ""); !strings.Contains(resp.Header.Get("Tus-Extension"), "expiration") {
+		t.Errorf("Expected the expiration extension, got %q", resp.Header.Get("Tus-Extension"))
+	}
+
+	// Half done: listed with its progress, and expires
+	_, location, _ := tusCreate(t, app, map[string]string{"relativePath": "photos", "filename": "half.bin"}, 10)
+	if resp := tusRequest("PATCH", location, "12345"); resp.StatusCode != 204 || resp.Header.Get("Upload-Expires") == "" {
+		t.Fatalf("Expected Upload-Expires on an unfinished upload, got %d %v", resp.StatusCode, resp.Header)
+	}
+	uploads := listUploads()
+	if len(uploads) != 1 || uploads[0].Path != "photos/half.bin" || uploads[0].Offset != 5 || uploads[0].Size != 10 || uploads[0].Expires == 0 {
+		t.Fatalf("Unexpected uploads: %+v", uploads)
+	}
+
+	// Aborted by an admin
+	resp, _ := admin.Test(httptest.NewRequest("DELETE", "/admin/uploads/"+uploads[0].ID, nil))
+	if resp.StatusCode != 200 || len(listUploads()) != 0 {
+		t.Errorf("Expected the upload to be aborted, got %d", resp.StatusCode)
+	}
+	if resp := tusRequest("HEAD", location, ""); resp.StatusCode != 404 {
+		t.Errorf("Expected 404 for an aborted upload, got %d", resp.StatusCode)
+	}
+	if resp, _ := admin.Test(httptest.NewRequest("DELETE", "/admin/uploads/nope", nil)); resp.StatusCode != 404 {
+		t.Errorf("Expected 404 for an unknown upload, got %d", resp.StatusCode)
+	}
+
+	// Nothing arrived for longer than the expiry: gone for the client, then swept
+	_, location, _ = tusCreate(t, app, map[string]string{"filename": "stale.bin"}, 10)
+	_, stale, _ := tusCreate(t, app, map[string]string{"filename": "swept.bin"}, 10)
+	old := time.Now().Add(-2 * time.Hour)
+	for _, l := range []string{location, stale} {
+		id := path.Base(l)
+		os.Chtimes(filepath.Join(uploadsDir, id), old, old)
+		os.Chtimes(filepath.Join(uploadsDir, id+".info"), old, old)
+	}
+	if resp := tusRequest("HEAD", location, ""); resp.StatusCode != 410 {
+		t.Errorf("Expected 410 for an expired upload, got %d", resp.StatusCode)
+	}
+	// S3 multipart uploads expire after the same time without a new part
+	oldMultipart := s3MultipartDir
+	t.Cleanup(func() { s3MultipartDir = oldMultipart })
+	s3MultipartDir = filepath.Join(uploadsDir, s3MultipartDirName)
+	for _, id := range []string{"abandoned", "active"} {
+		os.MkdirAll(filepath.Join(s3MultipartDir, id), 0755)
+		os.WriteFile(filepath.Join(s3MultipartDir, id, "meta.json"), []byte("{}"), 0644)
+		os.WriteFile(filepath.Join(s3MultipartDir, id, "part-00001"), []byte("part"), 0644)
+		os.Chtimes(filepath.Join(s3MultipartDir, id, "meta.json"), old, old)
+		os.Chtimes(filepath.Join(s3MultipartDir, id), old, old)
+	}
+	os.Chtimes(filepath.Join(s3MultipartDir, "abandoned", "part-00001"), old, old)
+	sweepUploads()
+	if entries, _ := os.ReadDir(uploadsDir); len(entries) != 1 || entries[0].Name() != s3MultipartDirName {
+		t.Errorf("Expected only the S3 multipart folder to be left, got %v", entries)
+	}
+	if entries, _ := os.ReadDir(s3MultipartDir); len(entries) != 1 || entries[0].Name() != "active" {
+		t.Errorf("Expected only the active multipart upload to be left, got %v", entries)
+	}
+}
+
+func TestFolderUploadQuota(t *testing.T) {
+	setupSearchTree(t)
+	enableTestWriteMode(t)
+	loadTestSizeTree(t)
+	oldPolicy := uploadPolicy
+	t.Cleanup(func() { uploadPolicy = oldPolicy })
+	uploadPolicy = UploadPolicy{Quotas: []UploadQuota{{Path: "photos", MaxBytes: 40}}}
+	app := setupTestUploads(t)
+
+	req := httptest.NewRequest("POST", "/upload/batches", strings.NewReader(`{"files": 3}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result struct {
+		Batch struct {
+			ID string `json:"id"`
+		} `json:"batch"`
+	}
+	json.NewDecoder(resp.Body).Decode(&result)
+
+	// photos holds 23 bytes; the files of the batch are only added to the
+	// size tree at the end, but count right away
+	for i, want := range []int{204, 204, 403} {
+		meta := map[string]string{"batch": result.Batch.ID, "subfolder": "photos/new", "filename": fmt.Sprintf("%d.txt", i)}
+		if status, body := tusUpload(t, app, meta, "123456"); status != want {
+			t.Errorf("File %d: expected %d, got %d %s", i, want, status, body)
+		}
+	}
+}
+
+func TestFolderUpload(t *testing.T) {
+	setupSearchTree(t)
+	enableTestWriteMode(t)
+	loadTestSizeTree(t)
+	app := setupTestUploads(t)
+
+	startBatch := func(body string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/upload/batches", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var result struct {
+			Batch struct {
+				ID string `json:"id"`
+			} `json:"batch"`
+		}
+		json.NewDecoder(resp.Body).Decode(&result)
+		return resp.StatusCode, result.Batch.ID
+	}
+	finishBatch := func(id string) int {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("POST", "/upload/batches/"+id+"/finish", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	status, batch := startBatch(`{"path": "photos", "files": 4}`)
+	if status != 200 || batch == "" {
+		t.Fatalf("Expected a batch, got %d", status)
+	}
+	for _, f := range []struct{ subfolder, filename, data string }{
+		{"album", "a.txt", "aaa"},
+		{"album/2024", "b.txt", "bb"},
+		{"", "c.txt", "c"},
+	} {
+		if status, body := tusUpload(t, app, map[string]string{"batch": batch, "subfolder": f.subfolder, "filename": f.filename}, f.data); status != 204 {
+			t.Fatalf("Expected %s to be uploaded, got %d %s", f.filename, status, body)
+		}
+	}
+	// Nothing is logged until the batch is done
+	if _, err := os.Stat(modificationsLogFile); err == nil {
+		t.Error("Batch logged before it finished")
+	}
+	// The 4th file escapes the destination: refused, and the batch finishes
+	if status, _, _ := tusCreate(t, app, map[string]string{"batch": batch, "subfolder": "../..", "filename": "x.txt"}, 1); status != 400 {
+		t.Errorf("Expected 400 for a subfolder outside the destination, got %d", status)
+	}
+
+	if data, _ := os.ReadFile(filepath.Join(rootPath, "photos", "album", "2024", "b.txt")); string(data) != "bb" {
+		t.Errorf("Expected the folder structure to be kept, got %q", data)
+	}
+	if node := sizeTreeRoot.FindByPath(filepath.Join(rootPath, "photos", "album")); node == nil || node.Size() != 5 {
+		t.Errorf("Uploaded folder missing from the size tree: %+v", node)
+	}
+	entries := readLog(t, modificationsLogFile)
+	if len(entries) != 1 || entries[0].Dest != "photos" || len(entries[0].Sources) != 3 || len(entries[0].Errors) != 1 {
+		t.Errorf("Expected one log entry for the batch, got %+v", entries)
+	}
+	if finishBatch(batch) != 404 {
+		t.Error("Expected a finished batch to be gone")
+	}
+
+	// Finished early by the client; later files of it are refused
+	_, batch = startBatch(`{"path": "", "files": 5}`)
+	tusUpload(t, app, map[string]string{"batch": batch, "subfolder": "docs", "filename": "d.txt"}, "d")
+	if status := finishBatch(batch); status != 200 {
+		t.Errorf("Expected the batch to finish, got %d", status)
+	}
+	if status, _, _ := tusCreate(t, app, map[string]string{"batch": batch, "filename": "e.txt"}, 1); status != 400 {
+		t.Errorf("Expected 400 for a finished batch, got %d", status)
+	}
+	if node := sizeTreeRoot.FindByPath(filepath.Join(rootPath, "docs", "d.txt")); node == nil {
+		t.Error("Early finished batch missing from the size tree")
+	}
+
+	// Folders through a symlink could end up outside the root
+	os.Symlink(t.TempDir(), filepath.Join(rootPath, "photos", "out"))
+	if status, _, _ := tusCreate(t, app, map[string]string{"relativePath": "photos", "subfolder": "out/deeper", "filename": "x.txt"}, 1); status != 400 {
+		t.Errorf("Expected 400 for a path through a symlink, got %d", status)
+	}
+	for _, body := range []string{`{"path": "missing", "files": 1}`, `{"path": "", "files": 0}`, `not json`} {
+		if status, _ := startBatch(body); status != 400 {
+			t.Errorf("Expected 400 for %s, got %d", body, status)
+		}
+	}
+}
+
+func TestUploadChecksum(t *testing.T) {
+	setupSearchTree(t)
+	enableTestWriteMode(t)
+	app := setupTestUploads(t)
+	db, err := openBoltDB(filepath.Join(t.TempDir(), "sizes.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldDB := boltDB
+	boltDB = db
+	t.Cleanup(func() { boltDB = oldDB; db.Close() })
+	app.Get("/file", handleFileStream)
+	admin := fiber.New()
+	admin.Get("/admin/uploads", handleListUploads)
+	admin.Delete("/admin/uploads/:id", handleAbortUpload)
+
+	resp, _ := app.Test(httptest.NewRequest("OPTIONS", "/upload/tus/", nil))
+	if !strings.Contains(resp.Header.Get("Tus-Extension"), "checksum") || resp.Header.Get("Tus-Checksum-Algorithm") == "" {
+		t.Errorf("Expected the checksum extension to be advertised, got %q", resp.Header.Get("Tus-Extension"))
+	}
+
+	// Chunk checksums: a bad chunk is refused and nothing is written
+	_, location, _ := tusCreate(t, app, map[string]string{"filename": "chunk.txt"}, 5)
+	patch := func(checksum string) int {
+		req := httptest.NewRequest("PATCH", location[strings.Index(location, "/upload/tus/"):], strings.NewReader("hello"))
+		req.Header.Set("Tus-Resumable", "1.0.0")
+		req.Header.Set("Upload-Offset", "0")
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Checksum", checksum)
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := patch("sha1 " + base64.StdEncoding.EncodeToString([]byte("01234567890123456789"))); status != 460 {
+		t.Errorf("Expected 460 for a bad chunk checksum, got %d", status)
+	}
+	if status := patch("crc32 AAAA"); status != 400 {
+		t.Errorf("Expected 400 for an unsupported algorithm, got %d", status)
+	}
+	if status := patch("sha1 qvTGHdzF6KLavt4PO0gs2a6pQ00="); status != 204 {
+		t.Errorf("Expected the chunk with a good checksum to be stored, got %d", status)
+	}
+	if data, _ := os.ReadFile(filepath.Join(rootPath, "chunk.txt")); string(data) != "hello" {
+		t.Errorf("Expected chunk.txt to be stored, got %q", data)
+	}
+
+	// Whole-file checksum: verified, and the digest is served with the file
+	sha := "sha256 2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	if status, body := tusUpload(t, app, map[string]string{"filename": "good.txt", "checksum": sha}, "hello"); status != 204 {
+		t.Fatalf("Expected the verified upload to succeed, got %d %s", status, body)
+	}
+	resp, err = app.Test(httptest.NewRequest("GET", "/file?path=good.txt", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Header.Get("Digest"); got != "sha-256=LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ=" {
+		t.Errorf("Expected the digest to be served, got %q", got)
+	}
+	if !strings.Contains(resp.Header.Get("ETag"), "2cf24dba") {
+		t.Errorf("Expected an ETag from the digest, got %q", resp.Header.Get("ETag"))
+	}
+
+	// Once the file changes the digest no longer applies
+	os.WriteFile(filepath.Join(rootPath, "good.txt"), []byte("changed"), 0644)
+	resp, _ = app.Test(httptest.NewRequest("GET", "/file?path=good.txt", nil))
+	resp.Body.Close()
+	if got := resp.Header.Get("Digest"); got != "" {
+		t.Errorf("Expected no digest for a changed file, got %q", got)
+	}
+
+	// A mismatch is quarantined and reported
+	status, body := tusUpload(t, app, map[string]string{"filename": "bad.txt", "checksum": sha}, "hellO")
+	if status != 460 || !strings.Contains(body, "checksum mismatch") {
+		t.Errorf("Expected 460 for a mismatching upload, got %d %s", status, body)
+	}
+	if _, err := os.Stat(filepath.Join(rootPath, "bad.txt")); err == nil {
+		t.Error("Expected the mismatching upload to stay out of the root")
+	}
+	resp, _ = admin.Test(httptest.NewRequest("GET", "/admin/uploads", nil))
+	var list struct {
+		Quarantined []QuarantinedUpload `json:"quarantined"`
+	}
+	json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if len(list.Quarantined) != 1 || list.Quarantined[0].Path != "bad.txt" {
+		t.Fatalf("Expected the quarantined upload to be listed, got %+v", list.Quarantined)
+	}
+	id := list.Quarantined[0].ID
+	if data, _ := os.ReadFile(filepath.Join(uploadsDir, quarantineDirName, id)); string(data) != "hellO" {
+		t.Errorf("Expected the data to be kept in quarantine, got %q", data)
+	}
+	resp, _ = admin.Test(httptest.NewRequest("DELETE", "/admin/uploads/"+id, nil))
+	resp.Body.Close()
+	if _, err := os.Stat(filepath.Join(uploadsDir, quarantineDirName, id)); err == nil || resp.StatusCode != 200 {
+		t.Errorf("Expected the admin to remove the quarantined upload, got %d", resp.StatusCode)
+	}
+
+	// A checksum that can't be used is refused up front
+	if status, _, _ := tusCreate(t, app, map[string]string{"filename": "x.txt", "checksum": "crc32 1234"}, 5); status != 400 {
+		t.Errorf("Expected 400 for an unsupported checksum, got %d", status)
+	}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/gofiber/websocket/v2"
+
+	"file-browser/storage"
+)
+
+// Changes are collected for this long before being pushed, so that bursts
+// (uploads, large copies, fsnotify + our own hooks for the same file) are coalesced
+const changeDebounce = 250 * time.Millisecond
+
+// A client gets this long to take each message. Change events are queued per
+// client (up to wsEventBuffer) and written by its own goroutine; a client that
+// falls that far behind is disconnected, so one slow browser can't hold up
+// events for everybody else. It reloads the listing when it reconnects.
+const wsWriteTimeout = 10 * time.Second
+
+var wsEventBuffer = 1024
+
+// wsClient wraps a websocket connection. Listing replies and change events are
+// written from different goroutines, so writes go through a mutex. ctx is
+// cancelled when the connection closes, which stops its running searches.
+type wsClient struct {
+	conn      *websocket.Conn
+	writeMu   sync.Mutex
+	events    chan WSEvent
+	done      chan struct{}
+	closeOnce sync.Once
+	ctx       context.Context
+	cancel    context.CancelFunc
+}
+
+// newWSClient wraps conn and starts writing its change events
+func newWSClient(conn *websocket.Conn) *wsClient {
+	c := &wsClient{
+		conn:   conn,
+		events: make(chan WSEvent, wsEventBuffer),
+		done:   make(chan struct{}),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	go c.writeEvents()
+	return c
+}
+
+func (c *wsClient) WriteJSON(v any) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	err := c.conn.WriteJSON(v)
+	if err != nil {
+		c.close()
+	}
+	return err
+}
+
+// send queues a change event without waiting. It returns false if the client
+// is gone or was too far behind and has been disconnected.
+func (c *wsClient) send(event WSEvent) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	select {
+	case c.events <- event:
+		return true
+	default:
+		log.Printf("WebSocket client %s is %d events behind, disconnecting", c.conn.RemoteAddr(), cap(c.events))
+		c.close()
+		return false
+	}
+}
+
+func (c *wsClient) writeEvents() {
+	for {
+		select {
+		case event := <-c.events:
+			if c.WriteJSON(event) != nil {
+				return
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// close ends the connection; the read loop then fails and cleans up
+func (c *wsClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.cancel()
+		c.conn.Close()
+	})
+}
+
+// WSEvent is pushed to clients subscribed to Dir when an item in it changes
+type WSEvent struct {
+	Event string   `json:"event"` // "add", "remove" or "update"
+	Root  string   `json:"root"`  // Named root of Dir
+	Dir   string   `json:"dir"`   // Subscribed directory, relative to the root
+	Item  FileItem `json:"item"`  // Only name and path are set for "remove"
+
+	fullDir string // Subscription key
+}
+
+// changeHub tracks which clients watch which directories and pushes change events to them
+type changeHub struct {
+	mu      sync.Mutex
+	subs    map[string]map[*wsClient]bool // Absolute dir -> subscribed clients
+	watcher *fsnotify.Watcher             // nil if fsnotify is not available
+	pending map[string]bool               // Absolute path -> created (vs. modified)
+	timer   *time.Timer
+}
+
+var liveChanges = &changeHub{
+	subs:    make(map[string]map[*wsClient]bool),
+	pending: make(map[string]bool),
+}
+
+// startLiveChanges hooks the hub into wile's own operations and the filesystem
+func startLiveChanges() {
+	onTreeChange(func(change TreeChange) {
+		if change.OldPath != "" {
+			liveChanges.queue(change.OldPath, false)
+		}
+		liveChanges.queue(change.Path, change.Op != "remove")
+
+		// Folder sizes above the change are different now
+		if m := mountOf(change.Path); m.SizeTree != nil {
+			for dir := filepath.Dir(change.Path); dir != m.Path && isWithin(dir, m.Path); dir = filepath.Dir(dir) {
+				liveChanges.queue(dir, false)
+			}
+		}
+	})
+
+	if !localOnly("Filesystem watching") {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Warning: Filesystem watching disabled, only wile's own changes are pushed: %v", err)
+		return
+	}
+	liveChanges.watcher = watcher
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if event.Op == fsnotify.Chmod {
+					continue
+				}
+				liveChanges.queue(event.Name, event.Has(fsnotify.Create))
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Filesystem watcher error: %v", err)
+			}
+		}
+	}()
+}
+
+func (h *changeHub) subscribe(client *wsClient, dir string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	clients := h.subs[dir]
+	if clients == nil {
+		clients = make(map[*wsClient]bool)
+		h.subs[dir] = clients
+		if localDir, ok := storage.LocalPath(rootFS, dir); ok && h.watcher != nil {
+			if err := h.watcher.Add(localDir); err != nil {
+				log.Printf("Warning: Failed to watch %s: %v", dir, err)
+			}
+		}
+	}
+	clients[client] = true
+}
+
+func (h *changeHub) unsubscribe(client *wsClient, dir string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(client, dir)
+}
+
+// unsubscribeAll drops every subscription of a disconnected client
+func (h *changeHub) unsubscribeAll(client *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for dir, clients := range h.subs {
+		if clients[client] {
+			h.removeLocked(client, dir)
+		}
+	}
+}
+
+func (h *changeHub) removeLocked(client *wsClient, dir string) {
+	clients := h.subs[dir]
+	if !clients[client] {
+		return
+	}
+	delete(clients, client)
+	if len(clients) == 0 {
+		delete(h.subs, dir)
+		if h.watcher != nil {
+			h.watcher.Remove(dir) // Fails harmlessly if the dir is gone or not watched
+		}
+	}
+}
+
+// queue records a changed path; events are sent after changeDebounce
+func (h *changeHub) queue(fullPath string, created bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Nobody is looking at the parent directory
+	if h.subs[filepath.Dir(fullPath)] == nil {
+		return
+	}
+
+	h.pending[fullPath] = h.pending[fullPath] || created
+	if h.timer == nil {
+		h.timer = time.AfterFunc(changeDebounce, h.flush)
+	}
+}
+
+// flush turns the pending paths into events. Whether an item was removed is
+// decided by looking at the disk, so coalesced create/delete sequences end up right.
+func (h *changeHub) flush() {
+	h.mu.Lock()
+	pending := h.pending
+	h.pending = make(map[string]bool)
+	h.timer = nil
+	h.mu.Unlock()
+
+	for fullPath, created := range pending {
+		if strings.HasPrefix(filepath.Base(fullPath), ".") {
+			continue
+		}
+		m := mountOf(fullPath)
+		relPath, ok := m.rel(fullPath)
+		if !ok || relPath == "" {
+			continue
+		}
+
+		event := WSEvent{Root: m.Name, Dir: cleanRelativePath(filepath.Dir(relPath)), fullDir: filepath.Dir(fullPath)}
+		if info, err := rootFS.Stat(fullPath); err != nil {
+			event.Event = "remove"
+			event.Item = FileItem{Name: filepath.Base(fullPath), Path: relPath}
+		} else {
+			event.Event = "update"
+			if created {
+				event.Event = "add"
+			}
+			event.Item = newFileItem(relPath, fullPath, info)
+		}
+		h.publish(event)
+	}
+}
+
+// publish queues event for every client subscribed to its directory. Clients
+// that can't keep up are dropped here; for broken connections the client's
+// read loop notices and cleans up.
+func (h *changeHub) publish(event WSEvent) {
+	h.mu.Lock()
+	clients := make([]*wsClient, 0, len(h.subs[event.fullDir]))
+	for client := range h.subs[event.fullDir] {
+		clients = append(clients, client)
+	}
+	h.mu.Unlock()
+
+	for _, client := range clients {
+		if !client.send(event) {
+			h.unsubscribeAll(client)
+		}
+	}
+}
+
+// newFileItem builds the listing entry for a single item, like getDirectoryListing does
+func newFileItem(relPath, fullPath string, info os.FileInfo) FileItem {
+	size, sizeStale := treeSize(fullPath)
+	return FileItem{
+		Name:      info.Name(),
+		Path:      relPath,
+		IsDir:     info.IsDir(),
+		Size:      size,
+		Modified:  info.ModTime().Unix(),
+		SizeStale: sizeStale,
+		Archive:   !info.IsDir() && isArchiveName(info.Name()),
+		Kind:      itemKind(info.Name(), info.IsDir()),
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	fasthttpws "github.com/fasthttp/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/websocket/v2"
+)
+
+func TestLiveChanges(t *testing.T) {
+	setupSearchTree(t)
+	startLiveChanges()
+
+	app := fiber.New()
+	app.Get("/files", websocket.New(handleWebSocket))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+
+	conn, _, err := fasthttpws.DefaultDialer.Dial("ws://"+ln.Addr().String()+"/files", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(WSRequest{Type: "subscribe", Path: "photos"}); err != nil {
+		t.Fatal(err)
+	}
+	// Subscriptions are handled asynchronously; a listing round trip makes sure it's in place
+	if err := conn.WriteJSON(WSRequest{Path: "photos", RequestID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		var msg WSMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatal(err)
+		}
+		if len(msg.Items) == 0 {
+			break
+		}
+	}
+
+	expectEvent := func(op, path string) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var event WSEvent
+		if err := conn.ReadJSON(&event); err != nil {
+			t.Fatalf("Waiting for %s %s: %v", op, path, err)
+		}
+		if event.Event != op || event.Dir != "photos" || event.Item.Path != path {
+			t.Fatalf("Expected %s of %s, got %+v", op, path, event)
+		}
+	}
+
+	newFile := filepath.Join(rootPath, "photos", "new.jpg")
+	if err := os.WriteFile(newFile, []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent("add", "photos/new.jpg")
+
+	if err := os.Remove(newFile); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent("remove", "photos/new.jpg")
+
+	// Changes in folders nobody watches are not sent
+	os.WriteFile(filepath.Join(rootPath, "elsewhere.txt"), []byte("x"), 0644)
+	sizeTreeAdd(filepath.Join(rootPath, "photos", "beach.jpg"))
+	expectEvent("add", "photos/beach.jpg")
+}
+
+func TestLiveChangesSlowClient(t *testing.T) {
+	setupSearchTree(t)
+	oldBuffer := wsEventBuffer
+	t.Cleanup(func() { wsEventBuffer = oldBuffer })
+	wsEventBuffer = 8
+
+	app := fiber.New()
+	app.Get("/files", websocket.New(handleWebSocket))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go app.Listener(ln)
+	t.Cleanup(func() { app.Shutdown() })
+
+	subscribe := func() *fasthttpws.Conn {
+		t.Helper()
+		conn, _, err := fasthttpws.DefaultDialer.Dial("ws://"+ln.Addr().String()+"/files", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.WriteJSON(WSRequest{Type: "subscribe", Path: "photos"})
+		conn.WriteJSON(WSRequest{Path: "photos", RequestID: 1})
+		for {
+			var msg WSMessage
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if len(msg.Items) == 0 {
+				return conn
+			}
+		}
+	}
+	fast := subscribe()
+	subscribe() // Never reads
+
+	// Big events fill the slow client's socket, then its queue. The other
+	// client keeps getting every event meanwhile.
+	dir := filepath.Join(rootPath, "photos")
+	name := strings.Repeat("x", 64*1024)
+	subscribers := func() int {
+		liveChanges.mu.Lock()
+		defer liveChanges.mu.Unlock()
+		return len(liveChanges.subs[dir])
+	}
+	for i := 0; subscribers() == 2; i++ {
+		if i == 2000 {
+			t.Fatal("Slow client was never disconnected")
+		}
+		liveChanges.publish(WSEvent{Event: "update", Dir: "photos", Item: FileItem{Name: name}, fullDir: dir})
+		fast.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var event WSEvent
+		if err := fast.ReadJSON(&event); err != nil {
+			t.Fatalf("Event %d did not reach the other client: %v", i, err)
+		}
+	}
+	if subscribers() != 1 {
+		t.Errorf("Expected only the reading client to stay subscribed, got %d", subscribers())
+	}
+}
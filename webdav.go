@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/net/webdav"
+)
+
+var webdavPort string // Port for the WebDAV server (empty = disabled)
+
+// Methods that change the tree. LOCK is included because locking an unmapped
+// URL creates an empty file.
+var webdavWriteMethods = map[string]bool{
+	"PUT": true, "DELETE": true, "MKCOL": true, "COPY": true, "MOVE": true,
+	"PROPPATCH": true, "LOCK": true,
+}
+
+type webdavMethodKey struct{}
+
+// Methods that can touch a whole tree of members. The handler updates the size
+// tree and logs them once per request, the file system methods skip members.
+var webdavTreeMethods = map[string]bool{"COPY": true, "MOVE": true}
+
+// webdavFS is a webdav.FileSystem over rootPath that enforces write mode and
+// keeps the size tree, bolt db and modifications log in sync, like handleManage does
+type webdavFS struct {
+	dir webdav.Dir
+}
+
+// webdavMethod returns the WebDAV method of the request a call is made for
+func webdavMethod(ctx context.Context) string {
+	method, _ := ctx.Value(webdavMethodKey{}).(string)
+	return method
+}
+
+// webdavTouch notes that a COPY or MOVE request got to change the tree
+func webdavTouch(ctx context.Context) {
+	if op, ok := ctx.Value(webdavTreeOpKey{}).(*webdavTreeOp); ok {
+		op.touched = true
+	}
+}
+
+func webdavRelPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (fs *webdavFS) fullPath(name string) string {
+	return filepath.Join(rootPath, filepath.FromSlash(webdavRelPath(name)))
+}
+
+func (fs *webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if !writeMode {
+		return os.ErrPermission
+	}
+	fileOpsInProgress.Add(1)
+	defer fileOpsInProgress.Done()
+
+	webdavTouch(ctx)
+	if err := fs.dir.Mkdir(ctx, name, perm); err != nil {
+		return err
+	}
+	if webdavMethod(ctx) == "COPY" {
+		return nil
+	}
+	sizeTreeAdd(fs.fullPath(name))
+	logModification("new_folder", nil, webdavRelPath(name), nil)
+	return nil
+}
+
+func (fs *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	writing := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0
+	if writing && !writeMode {
+		return nil, os.ErrPermission
+	}
+
+	// x/net/webdav also opens files O_RDWR for PROPPATCH, which changes
+	// nothing. Only creating, truncating or writing counts as an upload.
+	_, statErr := os.Stat(fs.fullPath(name))
+	changed := flag&os.O_TRUNC != 0 || (flag&os.O_CREATE != 0 && os.IsNotExist(statErr))
+
+	if writing {
+		webdavTouch(ctx)
+	}
+	f, err := fs.dir.OpenFile(ctx, name, flag, perm)
+	if err != nil || !writing || webdavMethod(ctx) == "COPY" {
+		return f, err
+	}
+
+	// Released in Close, so shutdown waits for the upload to finish
+	fileOpsInProgress.Add(1)
+	return &webdavFile{File: f, fullPath: fs.fullPath(name), relPath: webdavRelPath(name), changed: changed}, nil
+}
+
+func (fs *webdavFS) RemoveAll(ctx context.Context, name string) error {
+	if !writeMode {
+		return os.ErrPermission
+	}
+	fileOpsInProgress.Add(1)
+	defer fileOpsInProgress.Done()
+
+	fullPath := fs.fullPath(name)
+	info, err := os.Stat(fullPath)
+	if err != nil {
+		return err
+	}
+	relPath := webdavRelPath(name)
+	// COPY and MOVE remove an overwritten destination first; the handler logs those
+	quiet := webdavTreeMethods[webdavMethod(ctx)]
+	webdavTouch(ctx)
+	if err := fs.dir.RemoveAll(ctx, name); err != nil {
+		if !quiet {
+			logModification("delete", []string{relPath}, "", []string{err.Error()})
+		}
+		return err
+	}
+	sizeTreeRemove(fullPath, info.IsDir())
+	if !quiet {
+		logModification("delete", []string{relPath}, "", nil)
+	}
+	return nil
+}
+
+func (fs *webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	if !writeMode {
+		return os.ErrPermission
+	}
+	fileOpsInProgress.Add(1)
+	defer fileOpsInProgress.Done()
+
+	oldPath := fs.fullPath(oldName)
+	info, err := os.Stat(oldPath)
+	if err != nil {
+		return err
+	}
+	webdavTouch(ctx)
+	if err := fs.dir.Rename(ctx, oldName, newName); err != nil {
+		return err
+	}
+	// Only MOVE renames; the handler logs it
+	sizeTreeMove(oldPath, fs.fullPath(newName), info.IsDir())
+	return nil
+}
+
+func (fs *webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return fs.dir.Stat(ctx, name)
+}
+
+// webdavFile updates the size tree and log once a written file is closed,
+// if it was actually created or written to
+type webdavFile struct {
+	webdav.File
+	fullPath string
+	relPath  string
+	changed  bool
+	closed   bool
+}
+
+func (f *webdavFile) Write(p []byte) (int, error) {
+	n, err := f.File.Write(p)
+	if n > 0 {
+		f.changed = true
+	}
+	return n, err
+}
+
+// ReadFrom keeps io.Copy on the fast path of the underlying *os.File
+func (f *webdavFile) ReadFrom(r io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := f.File.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{f.File}, r)
+	}
+	if n > 0 {
+		f.changed = true
+	}
+	return n, err
+}
+
+func (f *webdavFile) Truncate(size int64) error {
+	t, ok := f.File.(interface{ Truncate(int64) error })
+	if !ok {
+		return os.ErrInvalid
+	}
+	f.changed = true
+	return t.Truncate(size)
+}
+
+func (f *webdavFile) Close() error {
+	err := f.File.Close()
+	if f.closed {
+		return err
+	}
+	f.closed = true
+	defer fileOpsInProgress.Done()
+	if !f.changed {
+		return err
+	}
+
+	sizeTreeAdd(f.fullPath)
+	var errors []string
+	if err != nil {
+		errors = []string{err.Error()}
+	}
+	logModification("upload", nil, f.relPath, errors)
+	return err
+}
+
+// newWebDAVHandler serves rootPath over WebDAV
+func newWebDAVHandler() http.Handler {
+	dav := &webdav.Handler{
+		FileSystem: &webdavFS{dir: webdav.Dir(rootPath)},
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("WebDAV %s %s: %v", r.Method, r.URL.Path, err)
+			}
+			if op, ok := r.Context().Value(webdavTreeOpKey{}).(*webdavTreeOp); ok {
+				op.err = err
+			}
+		},
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if webdavWriteMethods[r.Method] && !writeMode {
+			http.Error(w, "File operations are disabled. Use --write flag to enable write mode", http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(r.Context(), webdavMethodKey{}, r.Method)
+		if !webdavTreeMethods[r.Method] {
+			dav.ServeHTTP(w, r.WithContext(ctx))
+			return
+		}
+
+		fileOpsInProgress.Add(1)
+		defer fileOpsInProgress.Done()
+		op := &webdavTreeOp{}
+		ctx = context.WithValue(ctx, webdavTreeOpKey{}, op)
+		dav.ServeHTTP(w, r.WithContext(ctx))
+		op.finish(r)
+	})
+}
+
+type webdavTreeOpKey struct{}
+
+// webdavTreeOp records the outcome of a COPY or MOVE request
+type webdavTreeOp struct {
+	touched bool // Got past the checks to changing the tree
+	err     error
+}
+
+// finish adds a copied tree to the size tree and logs the request. Requests
+// refused before anything was changed aren't logged.
+func (op *webdavTreeOp) finish(r *http.Request) {
+	if !op.touched {
+		return
+	}
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil {
+		return
+	}
+	srcRel, destRel := webdavRelPath(r.URL.Path), webdavRelPath(dest.Path)
+	var errors []string
+	if op.err != nil {
+		errors = []string{op.err.Error()}
+	}
+
+	if r.Method == "MOVE" {
+		logModification("rename", []string{srcRel}, destRel, errors)
+		return
+	}
+	destPath := filepath.Join(rootPath, filepath.FromSlash(destRel))
+	if _, err := os.Stat(destPath); err == nil {
+		sizeTreeAdd(destPath)
+	}
+	logModification("copy", []string{srcRel}, destRel, errors)
+}
+
+// startWebDAV runs the WebDAV server on its own listener. It doesn't go through
+// Fiber because Fiber buffers request bodies and doesn't know the WebDAV methods.
+func startWebDAV() {
+	if webdavPort == "" || !localOnly("WebDAV") {
+		return
+	}
+	mode := "read-only"
+	if writeMode {
+		mode = "read-write"
+	}
+	log.Printf("WebDAV server starting on :%s (%s)", webdavPort, mode)
+
+	go func() {
+		if err := http.ListenAndServe(":"+webdavPort, newWebDAVHandler()); err != nil {
+			log.Printf("WebDAV server error: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// enableTestWriteMode turns on write mode with a temporary modifications log
+func enableTestWriteMode(t *testing.T) {
+	t.Helper()
+	oldWriteMode, oldLog := writeMode, modificationsLogFile
+	t.Cleanup(func() { writeMode, modificationsLogFile = oldWriteMode, oldLog })
+	writeMode = true
+	modificationsLogFile = filepath.Join(t.TempDir(), "modifications.jsonl")
+}
+
+func readModificationLog(t *testing.T) []ModificationLogEntry {
+	t.Helper()
+	f, err := os.Open(modificationsLogFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var entries []ModificationLogEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry ModificationLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func davRequest(t *testing.T, server *httptest.Server, method, path, body string, headers map[string]string) int {
+	t.Helper()
+	req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWebDAVReadOnly(t *testing.T) {
+	setupSearchTree(t)
+	server := httptest.NewServer(newWebDAVHandler())
+	defer server.Close()
+
+	if status := davRequest(t, server, "GET", "/notes.txt", "", nil); status != 200 {
+		t.Errorf("Expected GET to work in read-only mode, got %d", status)
+	}
+	if status := davRequest(t, server, "PUT", "/new.txt", "data", nil); status != 403 {
+		t.Errorf("Expected PUT to be forbidden in read-only mode, got %d", status)
+	}
+	if _, err := os.Stat(filepath.Join(rootPath, "new.txt")); err == nil {
+		t.Error("File was created in read-only mode")
+	}
+}
+
+func TestWebDAVWrites(t *testing.T) {
+	setupSearchTree(t)
+	loadTestSizeTree(t)
+	enableTestWriteMode(t)
+	server := httptest.NewServer(newWebDAVHandler())
+	defer server.Close()
+
+	rootSize := sizeTreeRoot.Size()
+
+	if status := davRequest(t, server, "MKCOL", "/docs", "", nil); status != 201 {
+		t.Fatalf("MKCOL failed: %d", status)
+	}
+	if status := davRequest(t, server, "PUT", "/docs/a.txt", "12345", nil); status != 201 {
+		t.Fatalf("PUT failed: %d", status)
+	}
+	if node := sizeTreeRoot.FindByPath(filepath.Join(rootPath, "docs", "a.txt")); node == nil || node.Size() != 5 {
+		t.Fatalf("Uploaded file missing from size tree: %+v", node)
+	}
+	if sizeTreeRoot.Size() != rootSize+5 {
+		t.Errorf("Expected root size %d, got %d", rootSize+5, sizeTreeRoot.Size())
+	}
+
+	// Clients set properties after each PUT; that is not another upload
+	proppatch := `<?xml version="1.0"?><D:propertyupdate xmlns:D="DAV:" xmlns:Z="urn:test"><D:set><D:prop><Z:color>red</Z:color></D:prop></D:set></D:propertyupdate>`
+	if status := davRequest(t, server, "PROPPATCH", "/docs/a.txt", proppatch, nil); status != 207 {
+		t.Fatalf("PROPPATCH failed: %d", status)
+	}
+
+	if status := davRequest(t, server, "MOVE", "/docs/a.txt", "", map[string]string{"Destination": server.URL + "/photos/b.txt"}); status != 201 {
+		t.Fatalf("MOVE failed: %d", status)
+	}
+	if sizeTreeRoot.FindByPath(filepath.Join(rootPath, "photos", "b.txt")) == nil {
+		t.Error("Moved file missing from size tree")
+	}
+
+	if status := davRequest(t, server, "DELETE", "/photos/b.txt", "", nil); status != 204 {
+		t.Fatalf("DELETE failed: %d", status)
+	}
+	if sizeTreeRoot.Size() != rootSize {
+		t.Errorf("Expected root size back at %d, got %d", rootSize, sizeTreeRoot.Size())
+	}
+
+	// Copying a folder is one entry, not one per member
+	photosSize := sizeTreeRoot.FindByPath(filepath.Join(rootPath, "photos")).Size()
+	if status := davRequest(t, server, "COPY", "/photos", "", map[string]string{"Destination": server.URL + "/album"}); status != 201 {
+		t.Fatalf("COPY failed: %d", status)
+	}
+	if node := sizeTreeRoot.FindByPath(filepath.Join(rootPath, "album")); node == nil || node.Size() != photosSize {
+		t.Fatalf("Expected the copy in the size tree with %d bytes, got %+v", photosSize, node)
+	}
+	// Refused without changing anything, not logged
+	if status := davRequest(t, server, "COPY", "/notes.txt", "", map[string]string{"Destination": server.URL + "/album", "Overwrite": "F"}); status != 412 {
+		t.Fatalf("Expected COPY onto an existing folder to be refused, got %d", status)
+	}
+
+	var actions []string
+	entries := readModificationLog(t)
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	if strings.Join(actions, ",") != "new_folder,upload,rename,delete,copy" {
+		t.Errorf("Unexpected modifications log: %v", actions)
+	}
+	if last := entries[len(entries)-1]; strings.Join(last.Sources, ",") != "photos" || last.Dest != "album" {
+		t.Errorf("Expected a copy of photos to album, got %+v", last)
+	}
+}